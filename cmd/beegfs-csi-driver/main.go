@@ -26,20 +26,27 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	"github.com/netapp/beegfs-csi-driver/pkg/beegfs"
 	"k8s.io/klog/v2"
 )
 
 var (
-	connAuthPath           = flag.String("connauth-path", "", "path to connection authentication file")
-	configPath             = flag.String("config-path", "", "path to plugin configuration file")
-	csDataDir              = flag.String("cs-data-dir", "/tmp/beegfs-csi-data-dir", "path to directory the controller service uses to store client configuration files and mount file systems")
-	driverName             = flag.String("driver-name", "beegfs.csi.netapp.com", "name of the driver")
-	endpoint               = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
-	nodeID                 = flag.String("node-id", "", "node id")
-	showVersion            = flag.Bool("version", false, "Show version.")
-	clientConfTemplatePath = flag.String("client-conf-template-path", "/etc/beegfs/beegfs-client.conf", "path to template beegfs-client.conf")
+	connAuthPath              = flag.String("connauth-path", "", "path to connection authentication file")
+	configPath                = flag.String("config-path", "", "path to plugin configuration file")
+	csDataDir                 = flag.String("cs-data-dir", "/tmp/beegfs-csi-data-dir", "path to directory the controller service uses to store client configuration files and mount file systems")
+	driverName                = flag.String("driver-name", "beegfs.csi.netapp.com", "name of the driver")
+	endpoint                  = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
+	nodeID                    = flag.String("node-id", "", "node id")
+	showVersion               = flag.Bool("version", false, "Show version.")
+	clientConfTemplatePath    = flag.String("client-conf-template-path", "/etc/beegfs/beegfs-client.conf", "path to template beegfs-client.conf")
+	controllerBackgroundTasks = flag.Bool("controller-background-tasks", false, "run controller service background tasks (e.g. removing expired volumes from the trash and resuming interrupted deletions); set only for the controller service")
+	beegfsCtlTimeout          = flag.Duration("beegfs-ctl-timeout", 2*time.Minute, "time after which a beegfs-ctl command is killed or, with --beegfs-native-client, a BeeGFS request is abandoned (e.g. because a BeeGFS management service does not respond); 0 disables the timeout")
+	beegfsNativeClient        = flag.Bool("beegfs-native-client", false, "EXPERIMENTAL: send requests directly to the BeeGFS management and metadata services instead of running beegfs-ctl; the protocol implementation has only been tested against a fake server")
+	nodeReconcileMounts       = flag.Bool("node-reconcile-mounts", false, "recover the BeeGFS mounts of volumes staged on the node when the node service starts; set only for the node service")
+	nodeKubeletCSIPluginDir   = flag.String("node-kubelet-csi-plugin-dir", "/var/lib/kubelet/plugins/kubernetes.io/csi", "directory below which kubelet creates the staging target paths of CSI volumes (<kubelet --root-dir>/plugins/kubernetes.io/csi); the node service only reconciles the mounts of volumes staged below it")
+	nodeSharedMountDir        = flag.String("node-shared-mount-dir", "", "directory in which the node service mounts each BeeGFS file system once for all volumes staged on the node; if unset, each staged volume has its own mount")
 
 	// Set by the build process
 	version = ""
@@ -63,7 +70,9 @@ func main() {
 }
 
 func handle() {
-	driver, err := beegfs.NewBeegfsDriver(*connAuthPath, *configPath, *csDataDir, *driverName, *endpoint, *nodeID, *clientConfTemplatePath, version)
+	driver, err := beegfs.NewBeegfsDriver(*connAuthPath, *configPath, *csDataDir, *driverName, *endpoint, *nodeID, *clientConfTemplatePath, version,
+		*controllerBackgroundTasks, *beegfsCtlTimeout, *nodeSharedMountDir, *nodeReconcileMounts,
+		*nodeKubeletCSIPluginDir, *beegfsNativeClient)
 	if err != nil {
 		beegfs.LogFatal(nil, err, "Failed to initialize driver")
 	}
@@ -0,0 +1,86 @@
+#!/usr/bin/env bash
+# Copyright 2021 NetApp, Inc. All Rights Reserved.
+# Licensed under the Apache License, Version 2.0.
+
+# Capture the stderr beegfs-ctl writes when it fails the way the driver classifies failures (see classifyCtlFailure in
+# pkg/beegfs/beegfs_ctl.go). Each capture is written to pkg/beegfs/testdata/ctlfailures/<class>/<version>-<case>.txt,
+# where TestClassifyCtlFailureCaptured checks that it is classified as <class>.
+
+# Run this script as root on a host with beegfs-ctl installed and a BeeGFS file system it can reach, like
+# "sudo CLIENT_CONF=/etc/beegfs/beegfs-client.conf hack/capture-ctl-failures.sh". The script does not modify the file
+# system. The only command that could succeed in modifying it sets the stripe pattern of the root directory to the
+# number of targets it already has.
+
+# To capture a target offline failure instead, stop the metadata service that owns the root directory of the file
+# system before running the script and set CAPTURE_TARGET_OFFLINE=true.
+
+set -uo pipefail
+
+CLIENT_CONF="${CLIENT_CONF:-/etc/beegfs/beegfs-client.conf}"
+CAPTURE_TARGET_OFFLINE="${CAPTURE_TARGET_OFFLINE:-false}"
+# 192.0.2.1 is reserved for documentation (RFC 5737) and never answers.
+UNREACHABLE_MGMTD_HOST="${UNREACHABLE_MGMTD_HOST:-192.0.2.1}"
+
+OUT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")/.." && pwd)/pkg/beegfs/testdata/ctlfailures"
+VERSION="$(beegfs-ctl --version 2>&1 | grep -oE '[0-9]+\.[0-9]+(\.[0-9]+)?' | head -n 1)"
+if [[ -z "${VERSION}" ]]; then
+    echo "Unable to determine the beegfs-ctl version" >&2
+    exit 1
+fi
+WORK_DIR="$(mktemp -d)"
+trap 'rm -rf "${WORK_DIR}"' EXIT
+
+# capture runs beegfs-ctl with the remaining arguments and writes its stderr to OUT_DIR/<class>/VERSION-<case>.txt. It
+# is an error for the command to succeed.
+capture() {
+    local class="$1" case="$2"
+    shift 2
+    mkdir -p "${OUT_DIR}/${class}"
+    local out="${OUT_DIR}/${class}/${VERSION}-${case}.txt"
+    if timeout 120 "$@" >/dev/null 2>"${out}"; then
+        echo "Expected failure, but command succeeded: $*" >&2
+        rm -f "${out}"
+        return 1
+    fi
+    echo "Captured ${out}"
+}
+
+# The metadata target that owns the root directory is offline. The other failures cannot be provoked while it is.
+if [[ "${CAPTURE_TARGET_OFFLINE}" == "true" ]]; then
+    capture target-offline meta-target-offline \
+        beegfs-ctl --cfgFile="${CLIENT_CONF}" --unmounted --getentryinfo /
+    exit
+fi
+
+# The management service does not answer.
+sed -E "s/^(sysMgmtdHost[[:space:]]*=).*/\1 ${UNREACHABLE_MGMTD_HOST}/" "${CLIENT_CONF}" > "${WORK_DIR}/unreachable.conf"
+capture unreachable mgmtd-unreachable \
+    beegfs-ctl --cfgFile="${WORK_DIR}/unreachable.conf" --unmounted --getentryinfo /
+
+# The connAuthFile does not match the one the file system uses.
+head -c 32 /dev/urandom | base64 > "${WORK_DIR}/wrong-connauthfile"
+grep -vE '^[[:space:]]*(connAuthFile|connDisableAuthentication)[[:space:]]*=' "${CLIENT_CONF}" > "${WORK_DIR}/auth.conf"
+printf 'connAuthFile = %s\nconnDisableAuthentication = false\n' "${WORK_DIR}/wrong-connauthfile" >> "${WORK_DIR}/auth.conf"
+capture auth wrong-connauthfile \
+    beegfs-ctl --cfgFile="${WORK_DIR}/auth.conf" --unmounted --getentryinfo /
+
+# A user other than root changes the stripe pattern of the root directory. It is "changed" to the number of targets it
+# already has in case beegfs-ctl does not refuse.
+NUM_TARGETS="$(beegfs-ctl --cfgFile="${CLIENT_CONF}" --unmounted --getentryinfo / |
+    sed -nE 's/^[[:space:]]*Number of storage targets:[^0-9]*([0-9]+).*/\1/p')"
+if [[ -z "${NUM_TARGETS}" ]]; then
+    echo "Unable to determine the number of storage targets of the root directory" >&2
+    exit 1
+fi
+# nobody must be able to read the configuration (and connAuthFile) or beegfs-ctl fails before it contacts BeeGFS.
+chmod 711 "${WORK_DIR}"
+grep -vE '^[[:space:]]*connAuthFile[[:space:]]*=' "${CLIENT_CONF}" > "${WORK_DIR}/permission.conf"
+CONN_AUTH_FILE="$(sed -nE 's/^[[:space:]]*connAuthFile[[:space:]]*=[[:space:]]*([^[:space:]]+).*/\1/p' "${CLIENT_CONF}")"
+if [[ -n "${CONN_AUTH_FILE}" ]]; then
+    install -o nobody -m 400 "${CONN_AUTH_FILE}" "${WORK_DIR}/connauthfile"
+    echo "connAuthFile = ${WORK_DIR}/connauthfile" >> "${WORK_DIR}/permission.conf"
+fi
+chown nobody "${WORK_DIR}/permission.conf"
+capture permission setpattern-non-root \
+    runuser -u nobody -- beegfs-ctl --cfgFile="${WORK_DIR}/permission.conf" --unmounted --setpattern \
+    --numtargets="${NUM_TARGETS}" /
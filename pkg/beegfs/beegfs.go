@@ -24,21 +24,46 @@ package beegfs
 import (
 	"os"
 	"path"
+	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/net/context"
 	"k8s.io/utils/mount"
 )
 
 const (
-	volDirBasePathKey             = "volDirBasePath"
-	sysMgmtdHostKey               = "sysMgmtdHost"
-	stripePatternStoragePoolIDKey = "stripePattern/storagePoolID"
-	stripePatternChunkSizeKey     = "stripePattern/chunkSize"
-	stripePatternNumTargetsKey    = "stripePattern/numTargets"
-	permissionsUIDKey             = "permissions/uid"
-	permissionsGIDKey             = "permissions/gid"
-	permissionsModeKey            = "permissions/mode"
-	defaultPermissionsMode        = 0o0777
+	volDirBasePathKey                     = "volDirBasePath"
+	volDirNameKey                         = "volDirName"
+	pvcNameKey                            = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey                       = "csi.storage.k8s.io/pvc/namespace"
+	maxDirNameLength                      = 255
+	creationTimeKey                       = "creationTime"
+	driverVersionKey                      = "driverVersion"
+	sysMgmtdHostKey                       = "sysMgmtdHost"
+	stripePatternStoragePoolIDKey         = "stripePattern/storagePoolID"
+	stripePatternStoragePoolNameKey       = "stripePattern/storagePoolName"
+	stripePatternStoragePoolCandidatesKey = "stripePattern/storagePoolCandidates"
+	stripePatternChunkSizeKey             = "stripePattern/chunkSize"
+	stripePatternNumTargetsKey            = "stripePattern/numTargets"
+	stripePatternTypeKey                  = "stripePattern/patternType"
+	metadataMirroringKey                  = "stripePattern/metadataMirroring"
+	stripePatternTypeRAID0                = "raid0"
+	stripePatternTypeBuddyMirror          = "buddymirror"
+	permissionsUIDKey                     = "permissions/uid"
+	permissionsGIDKey                     = "permissions/gid"
+	permissionsModeKey                    = "permissions/mode"
+	quotaEnforceCapacityKey               = "quota/enforceCapacity"
+	quotaIDTypeKey                        = "quota/idType"
+	quotaIDRangeKey                       = "quota/idRange"
+	defaultPermissionsMode                = 0o0777
+	defaultQuotaIDType                    = quotaIDTypeGID
+	deletePolicyKey                       = "deletePolicy"
+	defaultSnapshotDirBasePath            = "/.beegfs-csi-snapshots"
+	defaultTrashDirBasePath               = "/.beegfs-csi-trash"
+	pendingDeletionDirBasePath            = "/.beegfs-csi-pending-deletion"
+	defaultTrashRetentionPeriod           = 7 * 24 * time.Hour
+	trashTimeFormat                       = "20060102T150405Z"
+	metadataFileSuffix                    = ".beegfs-csi.json"
 
 	LogLevelDebug   = 3 // This log level is used for most informational logs in RPCs and GRPC calls
 	LogLevelVerbose = 5 // This log level is used for only very repetitive logs such as the Probe GRPC call
@@ -52,6 +77,10 @@ type beegfs struct {
 	pluginConfig           PluginConfig
 	clientConfTemplatePath string
 	csDataDir              string // directory controller service uses to create BeeGFS config files and mount file systems
+	runBackgroundTasks     bool   // whether the controller service runs background tasks (e.g. reaping the trash)
+	reconcileMounts        bool   // whether the node service recovers the mounts of staged volumes when it starts
+	nodeKubeletDir         string // directory below which kubelet stages volumes on the node (see reconcileMounts)
+	nativeClient           bool   // whether the services use beegfsNativeExecutor instead of running beegfs-ctl
 
 	ids *identityServer
 	ns  *nodeServer
@@ -65,23 +94,26 @@ type beegfs struct {
 // Path variables rooted from BeeGFS have the suffix PathBeegfsRoot.
 //
 // From the host's perspective (file or directory names in "") (all variable names represent absolute paths):
-//    /
-//    |-- ...
-//        |-- mountDirPath
-//            |-- "beegfs-client.conf" (clientConfPath)
-//            |-- "connInterfacesFile"
-//            |-- "connNetFilterFile"
-//            |-- "connTcpOnlyFilterFile"
-//            |-- "mount" (mountPath)
-//                |-- ...
-//                    |-- volDirBasePath
-//                        |-- volDirPath (same as volDirPathBeegfsRoot)
+//
+//	/
+//	|-- ...
+//	    |-- mountDirPath
+//	        |-- "beegfs-client.conf" (clientConfPath)
+//	        |-- "connInterfacesFile"
+//	        |-- "connNetFilterFile"
+//	        |-- "connTcpOnlyFilterFile"
+//	        |-- "mount" (mountPath)
+//	            |-- ...
+//	                |-- volDirBasePath
+//	                    |-- volDirPath (same as volDirPathBeegfsRoot)
+//	                    |-- ".<volume>.beegfs-csi.json" (volMetadataPath)
 //
 // From the perspective of the BeeGFS file system (all variable names represent absolute paths):
-//    /
-//    |-- ...
-//        |-- volDirBasePathBeegfsRoot
-//            |-- volDirPathBeegfsRoot (same as volDirPath)
+//
+//	/
+//	|-- ...
+//	    |-- volDirBasePathBeegfsRoot
+//	        |-- volDirPathBeegfsRoot (same as volDirPath)
 type beegfsVolume struct {
 	config                   beegfsConfig
 	clientConfPath           string // absolute path to beegfs-client.conf from host root (e.g. .../mountDirPath/beegfs-client.conf)
@@ -92,13 +124,25 @@ type beegfsVolume struct {
 	volDirBasePath           string // absolute path to BeeGFS parent directory from host root (e.g. ../mountDirPath/mount/parent)
 	volDirPathBeegfsRoot     string // absolute path to BeeGFS directory from BeeGFS root (e.g. /parent/volume)
 	volDirPath               string // absolute path to BeeGFS directory from host root (e.g. .../mountDirPath/mount/parent/volume)
+	volMetadataPath          string // absolute path to volume metadata file from host root (e.g. .../mountDirPath/mount/parent/.volume.beegfs-csi.json)
 	volumeID                 string // like beegfs://sysMgmtdHost/volDirPathBeegfsRoot
 }
 
 type stripePatternConfig struct {
 	storagePoolID           string
+	storagePoolName         string                 // resolved to a storagePoolID by the controller service (see resolveStoragePoolName)
+	storagePoolCandidates   []storagePoolCandidate // one is chosen as the storagePoolID (see selectStoragePool)
 	stripePatternChunkSize  string
 	stripePatternNumTargets string
+	stripePatternType       string // stripePatternTypeRAID0 or stripePatternTypeBuddyMirror
+	metadataMirroring       string // "true", "false", or "" to inherit metadata mirroring from the parent directory
+}
+
+// storagePoolCandidate is a storage pool (referenced by ID or name) that CreateVolume may choose for a new volume. The
+// free space of each candidate is multiplied by its weight before the candidate with the most is chosen.
+type storagePoolCandidate struct {
+	pool   string
+	weight float64
 }
 
 // permissionsConfig contains our internal representation of all CreateVolume parameters (StorageClass parameters in
@@ -110,6 +154,26 @@ type permissionsConfig struct {
 	mode uint16 // A full access mode consists of four base-8 digits (12 bits).
 }
 
+// quotaConfig contains our internal representation of all CreateVolume parameters (StorageClass parameters in K8s)
+// that should be prefaced with quota/. When enforceCapacity is true, each volume is assigned a dedicated uid or gid
+// (depending on idType) from the inclusive range idRangeStart-idRangeEnd and a BeeGFS quota limit is set for that ID.
+type quotaConfig struct {
+	enforceCapacity bool
+	idType          quotaIDType
+	idRangeStart    uint32
+	idRangeEnd      uint32
+}
+
+// deletePolicy is our internal representation of the deletePolicy CreateVolume parameter (StorageClass parameter in
+// K8s). It determines what DeleteVolume does with the volume's directory.
+type deletePolicy string
+
+const (
+	deletePolicyDelete        deletePolicy = "delete"          // Remove the directory (the default).
+	deletePolicyRetainInPlace deletePolicy = "retain-in-place" // Leave the directory where it is.
+	deletePolicyMoveToTrash   deletePolicy = "move-to-trash"   // Move the directory into the trashDirBasePath.
+)
+
 // hasNonDefaultOwnerOrGroup returns true if either uid or gid are not 0 and false otherwise.
 func (cfg permissionsConfig) hasNonDefaultOwnerOrGroup() bool { return cfg.uid > 0 || cfg.gid > 0 }
 
@@ -145,7 +209,9 @@ var (
 	vendorVersion = "dev"
 )
 
-func NewBeegfsDriver(connAuthPath, configPath, csDataDir, driverName, endpoint, nodeID, clientConfTemplatePath, version string) (*beegfs, error) {
+func NewBeegfsDriver(connAuthPath, configPath, csDataDir, driverName, endpoint, nodeID, clientConfTemplatePath, version string,
+	runBackgroundTasks bool, ctlTimeout time.Duration, nodeSharedMountDir string,
+	nodeReconcileMounts bool, nodeKubeletCSIPluginDir string, beegfsNativeClient bool) (*beegfs, error) {
 	if driverName == "" {
 		return nil, errors.New("no driver name provided")
 	}
@@ -157,6 +223,14 @@ func NewBeegfsDriver(connAuthPath, configPath, csDataDir, driverName, endpoint,
 	if endpoint == "" {
 		return nil, errors.New("no driver endpoint provided")
 	}
+	if nodeSharedMountDir != "" && !path.IsAbs(nodeSharedMountDir) {
+		return nil, errors.Errorf("node shared mount directory %s is not an absolute path", nodeSharedMountDir)
+	}
+	if nodeKubeletCSIPluginDir == "" {
+		nodeKubeletCSIPluginDir = defaultKubeletCSIPluginDir
+	} else if !path.IsAbs(nodeKubeletCSIPluginDir) {
+		return nil, errors.Errorf("node kubelet CSI plugin directory %s is not an absolute path", nodeKubeletCSIPluginDir)
+	}
 	if version != "" {
 		vendorVersion = version
 	}
@@ -191,12 +265,25 @@ func NewBeegfsDriver(connAuthPath, configPath, csDataDir, driverName, endpoint,
 		pluginConfig:           pluginConfig,
 		clientConfTemplatePath: clientConfTemplatePath,
 		csDataDir:              csDataDir,
+		runBackgroundTasks:     runBackgroundTasks,
+		reconcileMounts:        nodeReconcileMounts,
+		nodeKubeletDir:         path.Clean(nodeKubeletCSIPluginDir),
+		nativeClient:           beegfsNativeClient,
 	}
 
 	// Create GRPC servers
 	driver.ids = NewIdentityServer(driver.driverName, driver.version)
 	driver.ns = NewNodeServer(driver.nodeID, driver.pluginConfig, driver.clientConfTemplatePath)
+	driver.ns.sharedMountDir = nodeSharedMountDir
 	driver.cs = NewControllerServer(driver.nodeID, driver.pluginConfig, driver.clientConfTemplatePath, driver.csDataDir)
+	driver.cs.runsBackgroundTasks = runBackgroundTasks
+	// Both services run beegfs-ctl (or send requests directly to the BeeGFS services) with the same default timeout.
+	var ctlExec beegfsCtlExecutorInterface = &beegfsCtlExecutor{timeout: ctlTimeout}
+	if beegfsNativeClient {
+		ctlExec = &beegfsNativeExecutor{timeout: ctlTimeout}
+	}
+	driver.ns.ctlExec = ctlExec
+	driver.cs.ctlExec = ctlExec
 
 	return &driver, nil
 }
@@ -208,6 +295,17 @@ func (b *beegfs) Run() {
 	if b.ns.mounter == nil {
 		b.ns.mounter = mount.New("")
 	}
+	Logger(nil).Info("Starting driver", "controllerBackgroundTasks", b.runBackgroundTasks,
+		"nodeReconcileMounts", b.reconcileMounts, "nodeKubeletCSIPluginDir", b.nodeKubeletDir,
+		"beegfsNativeClient", b.nativeClient)
+	if b.runBackgroundTasks {
+		go b.cs.runBackgroundTasks()
+	}
+	if b.reconcileMounts {
+		// Recover the mounts of staged volumes before (or, if that takes too long, while) the node service handles
+		// requests.
+		b.ns.reconcileMountsInBackground(context.Background(), b.nodeKubeletDir, reconcileMountsWaitTimeout)
+	}
 
 	s := NewNonBlockingGRPCServer()
 	s.Start(b.endpoint, b.ids, b.cs, b.ns)
@@ -230,6 +328,7 @@ func newBeegfsVolume(mountDirPath, sysMgmtdHost, volDirPathBeegfsRoot string, pl
 		volDirBasePath:           path.Dir(volDirPath),
 		volDirPathBeegfsRoot:     volDirPathBeegfsRoot,
 		volDirPath:               volDirPath,
+		volMetadataPath:          path.Join(path.Dir(volDirPath), "."+path.Base(volDirPath)+metadataFileSuffix),
 		volumeID:                 NewBeegfsUrl(sysMgmtdHost, volDirPathBeegfsRoot),
 	}
 }
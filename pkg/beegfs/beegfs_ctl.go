@@ -10,27 +10,76 @@ import (
 	"fmt"
 	"os/exec"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
 )
 
 // beegfsCtlExecutorInterface abstracts beegfs-ctl so tests can run without access to a beegfs-ctl binary or a BeeGFS
 // file system.
 type beegfsCtlExecutorInterface interface {
-	createDirectoryForVolume(ctx context.Context, vol beegfsVolume, cfg permissionsConfig) error
-	statDirectoryForVolume(ctx context.Context, vol beegfsVolume) (string, error)
+	createDirectoryForVolume(ctx context.Context, vol beegfsVolume, permCfg permissionsConfig,
+		patternCfg stripePatternConfig) error
+	statDirectoryForVolume(ctx context.Context, vol beegfsVolume) (entryInfo, error)
 	setPatternForVolume(ctx context.Context, vol beegfsVolume, cfg stripePatternConfig) error
+	getQuotasForVolume(ctx context.Context, vol beegfsVolume, storagePoolID string, idType quotaIDType,
+		ids []uint32) ([]quotaInfo, error)
+	setQuotaLimitForVolume(ctx context.Context, vol beegfsVolume, storagePoolID string, idType quotaIDType, id uint32,
+		sizeLimit uint64) error
+	listStorageTargets(ctx context.Context, vol beegfsVolume) ([]storageTarget, error)
+	listStoragePools(ctx context.Context, vol beegfsVolume) ([]storagePool, error)
+	listMirrorGroups(ctx context.Context, vol beegfsVolume, nodeType string) ([]mirrorGroup, error)
+}
+
+// Node types for beegfs-ctl commands that take a --nodetype argument.
+const (
+	nodeTypeMeta    = "meta"
+	nodeTypeStorage = "storage"
+)
+
+// quotaIDType is the type of ID (user or group) a BeeGFS quota applies to.
+type quotaIDType string
+
+const (
+	quotaIDTypeUID quotaIDType = "uid"
+	quotaIDTypeGID quotaIDType = "gid"
+)
+
+// defaultStoragePoolID is the ID of the storage pool every BeeGFS file system has. beegfs-ctl gets and sets quotas in
+// this pool unless a command specifies another one with --storagepoolid.
+const defaultStoragePoolID = "1"
+
+// quotaInfo contains the information output by "beegfs-ctl --getquota" for a single user or group in a single storage
+// pool. BeeGFS tracks usage and limits separately in each storage pool. A limit of 0 indicates that no limit is set.
+type quotaInfo struct {
+	idType        quotaIDType
+	id            uint32
+	storagePoolID string
+	sizeUsed      uint64 // bytes
+	sizeLimit     uint64 // bytes
+	inodesUsed    uint64
+	inodesLimit   uint64
 }
 
 // beegfsCtlExecutor is the standard implementation of beegfsCtlExecutorInterface.
-type beegfsCtlExecutor struct{}
+type beegfsCtlExecutor struct {
+	timeout time.Duration // the default for file systems without a BeegfsCtlTimeout (0 means no timeout)
+}
+
+// beegfsCtlPath is the beegfs-ctl executable beegfsCtlExecutor runs. Tests can replace it.
+var beegfsCtlPath = "beegfs-ctl"
 
 // createDirForVolume uses a "beegfs-ctl --createdir" command to create the directory specified by
 // vol.volDirPathBeegfsRoot on the BeeGFS file system specified by vol.sysMgmtdHost. createDirectory returns an error
 // if it cannot create the directory, but does not return an error if the directory already exists.
-func (ctlExec *beegfsCtlExecutor) createDirectoryForVolume(ctx context.Context, vol beegfsVolume, cfg permissionsConfig) error {
+func (ctlExec *beegfsCtlExecutor) createDirectoryForVolume(ctx context.Context, vol beegfsVolume, permCfg permissionsConfig,
+	patternCfg stripePatternConfig) error {
 	LogDebug(ctx, "Creating BeeGFS directory", "volDirPathBeegfsRoot", vol.volDirPathBeegfsRoot, "volumeID", vol.volumeID)
 	// Check if volume already exists.
 	_, err := ctlExec.statDirectoryForVolume(ctx, vol)
@@ -39,18 +88,11 @@ func (ctlExec *beegfsCtlExecutor) createDirectoryForVolume(ctx context.Context,
 		LogDebug(ctx, "BeeGFS directory does not exist", "volDirPathBeegfsRoot", vol.volDirPathBeegfsRoot, "volumeID", vol.volumeID)
 
 		// Construct the set of arguments that will be used to create any necessary directories.
-		createDirArgs := constructCreateDirForVolumeArgs(cfg)
+		createDirArgs := constructCreateDirForVolumeArgs(permCfg, patternCfg)
 
-		// Multiple parent directories may need to be created.
-		// Create a slice of paths where the first path is the most general and each subsequent path is less general.
-		dirsToMake := []string{vol.volDirPathBeegfsRoot}
-		for dir := path.Dir(vol.volDirPathBeegfsRoot); dir != "/"; { // path.Dir() returns "." if there is no parent.
-			dirsToMake = append([]string{dir}, dirsToMake...) // Prepend so the more general path comes first.
-			dir = path.Dir(dir)
-		}
 		// Starting with the most general path, create all directories required to eventually create vol.volDirPathBeegfsRoot.
-		for _, dir := range dirsToMake {
-			_, err := ctlExec.execute(ctx, vol.clientConfPath, append(createDirArgs, dir))
+		for _, dir := range dirsToMakeForVolume(vol) {
+			_, err := ctlExec.execute(ctx, vol, append(createDirArgs, dir))
 			if err != nil && !errors.As(err, &ctlExistError{}) {
 				// We can't create the volume.
 				return errors.WithMessagef(err, "cannot create BeeGFS directory %s for %s", dir, vol.volumeID)
@@ -64,10 +106,106 @@ func (ctlExec *beegfsCtlExecutor) createDirectoryForVolume(ctx context.Context,
 	return nil
 }
 
-// statDirForVolume returns the information output by "beegfs-ctl --getentryinfo" as a string, or an empty string
-// and an error if the stat fails.
-func (ctlExec *beegfsCtlExecutor) statDirectoryForVolume(ctx context.Context, vol beegfsVolume) (string, error) {
-	return ctlExec.execute(ctx, vol.clientConfPath, []string{"--unmounted", "--getentryinfo", vol.volDirPathBeegfsRoot})
+// dirsToMakeForVolume returns the directories that may need to be created to create vol.volDirPathBeegfsRoot (multiple
+// parent directories may be missing). The first path is the most general and each subsequent path is less general.
+func dirsToMakeForVolume(vol beegfsVolume) []string {
+	dirsToMake := []string{vol.volDirPathBeegfsRoot}
+	for dir := path.Dir(vol.volDirPathBeegfsRoot); dir != "/"; { // path.Dir() returns "." if there is no parent.
+		dirsToMake = append([]string{dir}, dirsToMake...) // Prepend so the more general path comes first.
+		dir = path.Dir(dir)
+	}
+	return dirsToMake
+}
+
+// statDirForVolume returns the information output by "beegfs-ctl --getentryinfo" for the volume's directory, or an
+// empty entryInfo and an error if the stat fails.
+func (ctlExec *beegfsCtlExecutor) statDirectoryForVolume(ctx context.Context, vol beegfsVolume) (entryInfo, error) {
+	stdOut, err := ctlExec.execute(ctx, vol, []string{"--unmounted", "--getentryinfo", vol.volDirPathBeegfsRoot})
+	if err != nil {
+		return entryInfo{}, err
+	}
+	return parseEntryInfo(stdOut)
+}
+
+// entryInfo contains the information output by "beegfs-ctl --getentryinfo" for a single directory. Fields that are
+// not part of the output are empty (or 0).
+type entryInfo struct {
+	entryType          string // e.g. directory
+	entryID            string // e.g. 0-5F8D7E1B-1
+	metadataNode       string // the (current primary) metadata node, e.g. meta01
+	metadataNodeID     string
+	metadataBuddyGroup string // only for an entry with metadata mirroring
+	stripePatternType  string // stripePatternTypeRAID0 or stripePatternTypeBuddyMirror
+	chunkSize          string // e.g. 512K
+	numTargets         uint64 // the desired number of storage targets (or buddy mirror groups)
+	storagePoolID      string
+	storagePoolName    string // the storage pool description, e.g. Default
+}
+
+// isMetadataMirrored returns true if the entry's metadata is mirrored.
+func (info entryInfo) isMetadataMirrored() bool { return info.metadataBuddyGroup != "" }
+
+// nodeRegexp matches the node descriptions output by beegfs-ctl, e.g. "meta01 [ID: 1]".
+var nodeRegexp = regexp.MustCompile(`^(.*) \[ID: (\d+)\]$`)
+
+// parseEntryInfo parses the output of a "beegfs-ctl --getentryinfo" command for a directory, which looks like:
+//    Entry type: directory
+//    EntryID: 0-5F8D7E1B-1
+//    Metadata node: meta01 [ID: 1]
+//    Stripe pattern details:
+//    + Type: RAID0
+//    + Chunksize: 512K
+//    + Number of storage targets: desired: 4
+//    + Storage Pool: 1 (Default)
+// An entry with metadata mirroring has "Metadata buddy group" and "Current primary metadata node" lines instead of a
+// "Metadata node" line. Lines with other labels are ignored.
+func parseEntryInfo(stdOut string) (entryInfo, error) {
+	var info entryInfo
+	for _, line := range strings.Split(stdOut, "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "+ ")
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		label, value := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		switch label {
+		case "Entry type":
+			info.entryType = strings.ToLower(value)
+		case "EntryID":
+			info.entryID = value
+		case "Metadata node", "Current primary metadata node":
+			if matches := nodeRegexp.FindStringSubmatch(value); matches != nil {
+				info.metadataNode, info.metadataNodeID = matches[1], matches[2]
+			} else {
+				info.metadataNode = value
+			}
+		case "Metadata buddy group":
+			info.metadataBuddyGroup = value
+		case "Type":
+			info.stripePatternType = strings.ToLower(strings.ReplaceAll(value, " ", ""))
+		case "Chunksize":
+			info.chunkSize = value
+		case "Number of storage targets":
+			// e.g. "desired: 4"
+			desired := strings.TrimSpace(strings.TrimPrefix(value, "desired:"))
+			numTargets, err := strconv.ParseUint(desired, 10, 32)
+			if err != nil {
+				return entryInfo{}, errors.Wrapf(err, "unexpected number of storage targets %s", value)
+			}
+			info.numTargets = numTargets
+		case "Storage Pool":
+			// e.g. "1 (Default)"
+			poolFields := strings.SplitN(value, " ", 2)
+			info.storagePoolID = poolFields[0]
+			if len(poolFields) == 2 {
+				info.storagePoolName = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(poolFields[1]), "("), ")")
+			}
+		}
+	}
+	if info.entryID == "" {
+		return entryInfo{}, errors.Errorf("unexpected beegfs-ctl --getentryinfo output: %s", stdOut)
+	}
+	return info, nil
 }
 
 // constructSetPatternForVolumeArgs constructs the slice of arguments that will be passed to ctlExec.execute() in a
@@ -75,6 +213,10 @@ func (ctlExec *beegfsCtlExecutor) statDirectoryForVolume(ctx context.Context, vo
 func constructSetPatternForVolumeArgs(cfg stripePatternConfig) ([]string, bool) {
 	var needToExecute bool
 	var args []string
+	if cfg.stripePatternType != "" {
+		args = append([]string{fmt.Sprintf("--pattern=%s", cfg.stripePatternType)}, args...)
+		needToExecute = true
+	}
 	if cfg.stripePatternNumTargets != "" {
 		args = append([]string{fmt.Sprintf("--numtargets=%s", cfg.stripePatternNumTargets)}, args...)
 		needToExecute = true
@@ -96,18 +238,22 @@ func constructSetPatternForVolumeArgs(cfg stripePatternConfig) ([]string, bool)
 }
 
 // constructCreateDirForVolumeArgs constructs the slice of arguments that will be passed to ctlExec.execute() in a
-// createDirForVolume() call. We keep this logic in a separate function for easy testing.
-func constructCreateDirForVolumeArgs(cfg permissionsConfig) []string {
+// createDirForVolume() call. We keep this logic in a separate function for easy testing. A new directory inherits
+// metadata mirroring from its parent unless metadata mirroring is explicitly disabled.
+func constructCreateDirForVolumeArgs(permCfg permissionsConfig, patternCfg stripePatternConfig) []string {
 	args := []string{"--unmounted", "--createdir"}
 	// beegfs-ctl ignores special permissions (the first digit in the four digit octal permissions schema).
 	// Construct the --access argument without this digit for clarity.
-	mode := cfg.mode & 0o777
+	mode := permCfg.mode & 0o777
 	args = append(args, fmt.Sprintf("--access=%03o", mode)) // Print 3 digits padded with 0s to the left.
-	if cfg.uid != 0 {
-		args = append(args, fmt.Sprintf("--uid=%d", cfg.uid))
+	if permCfg.uid != 0 {
+		args = append(args, fmt.Sprintf("--uid=%d", permCfg.uid))
+	}
+	if permCfg.gid != 0 {
+		args = append(args, fmt.Sprintf("--gid=%d", permCfg.gid))
 	}
-	if cfg.gid != 0 {
-		args = append(args, fmt.Sprintf("--gid=%d", cfg.gid))
+	if patternCfg.metadataMirroring == "false" {
+		args = append(args, "--nomirror")
 	}
 	return args
 }
@@ -120,7 +266,7 @@ func (ctlExec *beegfsCtlExecutor) setPatternForVolume(ctx context.Context, vol b
 	args, needToExecute := constructSetPatternForVolumeArgs(cfg)
 	if needToExecute {
 		args = append(args, vol.volDirPathBeegfsRoot)
-		_, err := ctlExec.execute(ctx, vol.clientConfPath, args)
+		_, err := ctlExec.execute(ctx, vol, args)
 		if err != nil {
 			return errors.WithMessagef(err, "cannot set pattern for BeeGFS directory %s for volume %s", vol.volDirPathBeegfsRoot, vol.sysMgmtdHost)
 		}
@@ -129,12 +275,449 @@ func (ctlExec *beegfsCtlExecutor) setPatternForVolume(ctx context.Context, vol b
 	return nil
 }
 
-// execute runs arbitrary beegfs-ctl commands like "beegfs-ctl --arg1 --arg2=value". It logs the stdout and stderr
-// when running at a high verbosity and returns stdout as a string (as well as any potential errors). execute fails if
-// beegfs-ctl is not on the PATH.
-func (*beegfsCtlExecutor) execute(ctx context.Context, clientConfPath string, args []string) (stdOut string, err error) {
-	args = append([]string{fmt.Sprintf("--cfgFile=%s", clientConfPath)}, args...)
-	cmd := exec.Command("beegfs-ctl", args...)
+// getQuotasForVolume uses a "beegfs-ctl --getquota" command to get the quota usage and limits of one or more users or
+// groups in the storage pool identified by storagePoolID (or the default storage pool if storagePoolID is empty) on the
+// BeeGFS file system specified by vol.sysMgmtdHost. Quotas are file system wide, so the results include usage outside
+// of vol.volDirPathBeegfsRoot. getQuotasForVolume returns one quotaInfo for each requested ID.
+func (ctlExec *beegfsCtlExecutor) getQuotasForVolume(ctx context.Context, vol beegfsVolume, storagePoolID string,
+	idType quotaIDType, ids []uint32) ([]quotaInfo, error) {
+	if storagePoolID == "" {
+		storagePoolID = defaultStoragePoolID
+	}
+	var idStrings []string
+	for _, id := range ids {
+		idStrings = append(idStrings, strconv.FormatUint(uint64(id), 10))
+	}
+	args := []string{"--getquota", fmt.Sprintf("--%s", idType), "--list", strings.Join(idStrings, ","),
+		fmt.Sprintf("--storagepoolid=%s", storagePoolID), "--csv"}
+	stdOut, err := ctlExec.execute(ctx, vol, args)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot get quota for %s %v for volume %s", idType, ids, vol.volumeID)
+	}
+	allInfos, err := parseGetQuotaOutput(stdOut)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot get quota for %s %v for volume %s", idType, ids, vol.volumeID)
+	}
+	// Output without a storage pool header (e.g. from a file system without storage pools) is for the requested pool.
+	var infos []quotaInfo
+	for _, info := range allInfos {
+		if info.storagePoolID == "" || info.storagePoolID == storagePoolID {
+			info.idType, info.storagePoolID = idType, storagePoolID
+			infos = append(infos, info)
+		}
+	}
+	if len(infos) != len(ids) {
+		return nil, errors.Errorf("expected quota for %d %ss in storage pool %s but got %d for volume %s", len(ids),
+			idType, storagePoolID, len(infos), vol.volumeID)
+	}
+	return infos, nil
+}
+
+// setQuotaLimitForVolume uses a "beegfs-ctl --setquota" command to set the size limit of a user or group in the storage
+// pool identified by storagePoolID (or the default storage pool if storagePoolID is empty) on the BeeGFS file system
+// specified by vol.sysMgmtdHost. A sizeLimit of 0 removes any existing size limit. The inode limit is always removed.
+func (ctlExec *beegfsCtlExecutor) setQuotaLimitForVolume(ctx context.Context, vol beegfsVolume, storagePoolID string,
+	idType quotaIDType, id uint32, sizeLimit uint64) error {
+	args := constructSetQuotaLimitForVolumeArgs(storagePoolID, idType, id, sizeLimit)
+	if _, err := ctlExec.execute(ctx, vol, args); err != nil {
+		return errors.WithMessagef(err, "cannot set quota limit for %s %d for volume %s", idType, id, vol.volumeID)
+	}
+	return nil
+}
+
+// constructSetQuotaLimitForVolumeArgs constructs the slice of arguments that will be passed to ctlExec.execute() in a
+// setQuotaLimitForVolume() call. We keep this logic in a separate function for easy testing.
+func constructSetQuotaLimitForVolumeArgs(storagePoolID string, idType quotaIDType, id uint32,
+	sizeLimit uint64) []string {
+	if storagePoolID == "" {
+		storagePoolID = defaultStoragePoolID
+	}
+	sizeLimitString := "unlimited"
+	if sizeLimit != 0 {
+		sizeLimitString = strconv.FormatUint(sizeLimit, 10)
+	}
+	return []string{"--setquota", fmt.Sprintf("--%s", idType), strconv.FormatUint(uint64(id), 10),
+		fmt.Sprintf("--sizelimit=%s", sizeLimitString), "--inodelimit=unlimited",
+		fmt.Sprintf("--storagepoolid=%s", storagePoolID)}
+}
+
+// storagePoolHeaderRegexp matches the line "beegfs-ctl --getquota" prints before the quotas of each storage pool.
+var storagePoolHeaderRegexp = regexp.MustCompile(`^Quota information for storage pool .* \(ID: (\d+)\):$`)
+
+// parseGetQuotaOutput parses the output of a "beegfs-ctl --getquota --csv" command. Without --storagepoolid, the
+// output contains a block for every storage pool (with the same IDs in each), so parseGetQuotaOutput records the
+// storage pool of each quotaInfo (if the output has storage pool headers). The output looks like:
+//    Quota information for storage pool Default (ID: 1):
+//    name,id,size,hard,files,hard
+//    user,1000,4096,10737418240,1,unlimited
+//    1001,1001,0,unlimited,0,unlimited
+//
+//    Quota information for storage pool fast (ID: 2):
+//    name,id,size,hard,files,hard
+//    user,1000,0,unlimited,0,unlimited
+//    1001,1001,0,unlimited,0,unlimited
+func parseGetQuotaOutput(stdOut string) ([]quotaInfo, error) {
+	// parseValue converts a quota value to a uint64. BeeGFS reports a limit that is not set as "unlimited".
+	parseValue := func(value string) (uint64, error) {
+		if value == "unlimited" {
+			return 0, nil
+		}
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, errors.Wrapf(err, "unexpected beegfs-ctl --getquota output: %s", stdOut)
+		}
+		return parsed, nil
+	}
+
+	var infos []quotaInfo
+	var storagePoolID string
+	for _, line := range strings.Split(stdOut, "\n") {
+		line = strings.TrimSpace(line)
+		if matches := storagePoolHeaderRegexp.FindStringSubmatch(line); matches != nil {
+			storagePoolID = matches[1]
+			continue
+		}
+		if !strings.Contains(line, ",") || strings.HasPrefix(line, "name,") {
+			continue // Skip the column headers and any empty lines.
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 6 {
+			return nil, errors.Errorf("unexpected beegfs-ctl --getquota output: %s", stdOut)
+		}
+
+		info := quotaInfo{storagePoolID: storagePoolID}
+		id, err := strconv.ParseUint(fields[1], 10, 32) // IDs are <= 32 bits.
+		if err != nil {
+			return nil, errors.Wrapf(err, "unexpected beegfs-ctl --getquota output: %s", stdOut)
+		}
+		info.id = uint32(id)
+		for i, dest := range []*uint64{&info.sizeUsed, &info.sizeLimit, &info.inodesUsed, &info.inodesLimit} {
+			if *dest, err = parseValue(fields[i+2]); err != nil {
+				return nil, err
+			}
+		}
+		infos = append(infos, info)
+	}
+	if len(infos) == 0 {
+		return nil, errors.Errorf("unexpected beegfs-ctl --getquota output: %s", stdOut)
+	}
+	return infos, nil
+}
+
+// storageTarget contains the information output by "beegfs-ctl --listtargets" for a single storage target.
+type storageTarget struct {
+	id           string
+	reachability string // e.g. Online, Probably-offline, or Offline
+	consistency  string // e.g. Good, Needs-resync, or Bad
+	totalBytes   uint64
+	freeBytes    uint64
+	totalInodes  uint64
+	freeInodes   uint64
+}
+
+// isOnline returns true if the storage target is reachable and false otherwise.
+func (target storageTarget) isOnline() bool { return target.reachability == "Online" }
+
+// isGood returns true if the storage target is consistent and false otherwise (e.g. if it needs a resync).
+func (target storageTarget) isGood() bool { return target.consistency == "Good" }
+
+// storagePool contains the information output by "beegfs-ctl --liststoragepools" for a single storage pool.
+type storagePool struct {
+	id          string
+	description string
+	targets     []string // storage target IDs
+	buddyGroups []string // storage buddy mirror group IDs
+}
+
+// mirrorGroup contains the information output by "beegfs-ctl --listmirrorgroups" for a single buddy mirror group.
+// primary and secondary are storage target IDs for a storage buddy mirror group and node IDs for a metadata buddy mirror
+// group.
+type mirrorGroup struct {
+	id        string
+	primary   string
+	secondary string
+}
+
+// listStorageTargets uses a "beegfs-ctl --listtargets" command to list the state and free space of all storage targets
+// on the BeeGFS file system specified by vol.sysMgmtdHost.
+func (ctlExec *beegfsCtlExecutor) listStorageTargets(ctx context.Context, vol beegfsVolume) ([]storageTarget, error) {
+	args := []string{"--listtargets", "--nodetype=storage", "--state", "--spaceinfo"}
+	stdOut, err := ctlExec.execute(ctx, vol, args)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot list storage targets for %s", vol.sysMgmtdHost)
+	}
+	targets, err := parseListTargetsOutput(stdOut)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot list storage targets for %s", vol.sysMgmtdHost)
+	}
+	return targets, nil
+}
+
+// listStoragePools uses a "beegfs-ctl --liststoragepools" command to list all storage pools on the BeeGFS file system
+// specified by vol.sysMgmtdHost.
+func (ctlExec *beegfsCtlExecutor) listStoragePools(ctx context.Context, vol beegfsVolume) ([]storagePool, error) {
+	stdOut, err := ctlExec.execute(ctx, vol, []string{"--liststoragepools"})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot list storage pools for %s", vol.sysMgmtdHost)
+	}
+	pools, err := parseListStoragePoolsOutput(stdOut)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot list storage pools for %s", vol.sysMgmtdHost)
+	}
+	return pools, nil
+}
+
+// listMirrorGroups uses a "beegfs-ctl --listmirrorgroups" command to list all buddy mirror groups of nodeType
+// (nodeTypeMeta or nodeTypeStorage) on the BeeGFS file system specified by vol.sysMgmtdHost.
+func (ctlExec *beegfsCtlExecutor) listMirrorGroups(ctx context.Context, vol beegfsVolume,
+	nodeType string) ([]mirrorGroup, error) {
+	args := []string{"--listmirrorgroups", "--nodetype=" + nodeType}
+	stdOut, err := ctlExec.execute(ctx, vol, args)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot list %s mirror groups for %s", nodeType, vol.sysMgmtdHost)
+	}
+	groups, err := parseListMirrorGroupsOutput(stdOut)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot list %s mirror groups for %s", nodeType, vol.sysMgmtdHost)
+	}
+	return groups, nil
+}
+
+// parseListTargetsOutput parses the output of a "beegfs-ctl --listtargets --nodetype=storage --state --spaceinfo"
+// command. The output looks like:
+//    TargetID     Reachability  Consistency        Total         Free    %      ITotal       IFree    %
+//    ========     ============  ===========        =====         ====    =      ======       =====    =
+//           1           Online         Good     916.7GiB     900.1GiB  98%       58.3M       58.3M 100%
+func parseListTargetsOutput(stdOut string) ([]storageTarget, error) {
+	header, rows, err := parseCtlTable(stdOut)
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		if _, ok := columns[name]; !ok { // The "%" header appears twice. We don't use it.
+			columns[name] = i
+		}
+	}
+	for _, name := range []string{"TargetID", "Reachability", "Consistency", "Total", "Free", "ITotal", "IFree"} {
+		if _, ok := columns[name]; !ok {
+			return nil, errors.Errorf("beegfs-ctl --listtargets output missing column %s: %s", name, stdOut)
+		}
+	}
+
+	var targets []storageTarget
+	for _, row := range rows {
+		target := storageTarget{
+			id:           row[columns["TargetID"]],
+			reachability: row[columns["Reachability"]],
+			consistency:  row[columns["Consistency"]],
+		}
+		for name, dest := range map[string]*uint64{"Total": &target.totalBytes, "Free": &target.freeBytes,
+			"ITotal": &target.totalInodes, "IFree": &target.freeInodes} {
+			if *dest, err = parseCtlSize(row[columns[name]]); err != nil {
+				return nil, errors.WithMessagef(err, "unexpected beegfs-ctl --listtargets output: %s", stdOut)
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// parseListStoragePoolsOutput parses the output of a "beegfs-ctl --liststoragepools" command. The output looks like:
+//    Pool ID   Pool Description                      Targets                 Buddy Groups
+//    ======= ================== ============================ ============================
+//          1            Default                      1,2,3,4
+//          2               nvme                          5,6                          1,2
+func parseListStoragePoolsOutput(stdOut string) ([]storagePool, error) {
+	header, rows, err := parseCtlTable(stdOut)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) != 4 {
+		return nil, errors.Errorf("unexpected beegfs-ctl --liststoragepools output: %s", stdOut)
+	}
+
+	// splitList converts a comma separated list of IDs into a slice.
+	splitList := func(list string) []string {
+		if list == "" {
+			return nil
+		}
+		return strings.Split(list, ",")
+	}
+
+	var pools []storagePool
+	for _, row := range rows {
+		pools = append(pools, storagePool{
+			id:          row[0],
+			description: row[1],
+			targets:     splitList(row[2]),
+			buddyGroups: splitList(row[3]),
+		})
+	}
+	return pools, nil
+}
+
+// parseListMirrorGroupsOutput parses the output of a "beegfs-ctl --listmirrorgroups" command. The output looks like
+// (with NodeID instead of TargetID for metadata buddy mirror groups):
+//         BuddyGroupID   PrimaryTargetID SecondaryTargetID
+//         ============   =============== =================
+//                    1               101               201
+func parseListMirrorGroupsOutput(stdOut string) ([]mirrorGroup, error) {
+	header, rows, err := parseCtlTable(stdOut)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) != 3 {
+		return nil, errors.Errorf("unexpected beegfs-ctl --listmirrorgroups output: %s", stdOut)
+	}
+
+	var groups []mirrorGroup
+	for _, row := range rows {
+		groups = append(groups, mirrorGroup{id: row[0], primary: row[1], secondary: row[2]})
+	}
+	return groups, nil
+}
+
+// parseCtlTable parses the tables beegfs-ctl outputs in modes like --listtargets and --liststoragepools. These tables
+// consist of a header line, a separator line made up of runs of "=", and one line per row. Values may contain spaces
+// (e.g. a storage pool description), so parseCtlTable uses the end of each run of "=" in the separator line to
+// determine where each right aligned column ends. Rows are padded with empty values if necessary.
+func parseCtlTable(stdOut string) (header []string, rows [][]string, err error) {
+	lines := strings.Split(stdOut, "\n")
+	separatorIndex := -1
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "=") {
+			separatorIndex = i
+			break
+		}
+	}
+	if separatorIndex < 1 {
+		return nil, nil, errors.Errorf("unexpected beegfs-ctl output: %s", stdOut)
+	}
+
+	// Find the index one past the end of each run of "=" in the separator line.
+	var columnEnds []int
+	separator := lines[separatorIndex]
+	for i := range separator {
+		if separator[i] == '=' && (i+1 == len(separator) || separator[i+1] != '=') {
+			columnEnds = append(columnEnds, i+1)
+		}
+	}
+
+	// splitLine splits a single line into columns. The final column extends to the end of the line.
+	splitLine := func(line string) []string {
+		var values []string
+		start := 0
+		for i, end := range columnEnds {
+			if i == len(columnEnds)-1 || end > len(line) {
+				end = len(line)
+			}
+			if start > end {
+				start = end
+			}
+			values = append(values, strings.TrimSpace(line[start:end]))
+			start = end
+		}
+		return values
+	}
+
+	header = splitLine(lines[separatorIndex-1])
+	for _, line := range lines[separatorIndex+1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rows = append(rows, splitLine(line))
+	}
+	return header, rows, nil
+}
+
+// parseCtlSize converts a human readable size output by beegfs-ctl (e.g. 916.7GiB or 58.3M) to a uint64. Sizes with a
+// binary suffix (e.g. GiB) are interpreted in powers of 1024. Sizes with a bare suffix (e.g. M) are interpreted in
+// powers of 1000. The result is necessarily approximate.
+func parseCtlSize(size string) (uint64, error) {
+	multipliers := []struct {
+		suffix     string
+		multiplier float64
+	}{
+		// Longer suffixes must come first so that (e.g.) "GiB" is not mistaken for "B".
+		{"EiB", 1 << 60}, {"PiB", 1 << 50}, {"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+		{"E", 1e18}, {"P", 1e15}, {"T", 1e12}, {"G", 1e9}, {"M", 1e6}, {"k", 1e3}, {"K", 1e3}, {"B", 1},
+	}
+	multiplier := float64(1)
+	number := size
+	for _, m := range multipliers {
+		if strings.HasSuffix(size, m.suffix) {
+			multiplier = m.multiplier
+			number = strings.TrimSuffix(size, m.suffix)
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, errors.Errorf("could not parse size %s", size)
+	}
+	return uint64(value * multiplier), nil
+}
+
+// Retries of beegfs-ctl commands (and native BeeGFS requests) that fail for transient reasons (see
+// ctlFailureClass.isTransient) wait ctlRetryInitialBackoff before the first retry and twice as long before each
+// subsequent retry (up to ctlRetryMaxBackoff). Tests can replace these.
+var (
+	ctlMaxRetries          = 3
+	ctlRetryInitialBackoff = time.Second
+	ctlRetryMaxBackoff     = 8 * time.Second
+)
+
+// execute runs beegfs-ctl with vol's beegfs-client.conf and the given arguments. It retries a command that fails for a
+// transient reason (e.g. the BeeGFS management service is unreachable) as described in retryTransientCtlFailures.
+func (ctlExec *beegfsCtlExecutor) execute(ctx context.Context, vol beegfsVolume, args []string) (stdOut string, err error) {
+	err = retryTransientCtlFailures(ctx, func() error {
+		stdOut, err = ctlExec.executeOnce(ctx, vol, args)
+		return err
+	})
+	return stdOut, err
+}
+
+// retryTransientCtlFailures calls op and retries it if it fails with a ctlFailureError for a transient reason up to
+// ctlMaxRetries times with exponential backoff, but never after ctx ends. It returns the error of the last call.
+func retryTransientCtlFailures(ctx context.Context, op func() error) error {
+	backoff := ctlRetryInitialBackoff
+	for retry := 0; ; retry++ {
+		err := op()
+		var failureErr ctlFailureError
+		if err == nil || retry >= ctlMaxRetries || !errors.As(err, &failureErr) || !failureErr.class.isTransient() {
+			return err
+		}
+		LogDebug(ctx, "Retrying BeeGFS operation", "reason", failureErr.class, "backoff", backoff, "retry", retry+1)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > ctlRetryMaxBackoff {
+			backoff = ctlRetryMaxBackoff
+		}
+	}
+}
+
+// executeOnce runs beegfs-ctl once with vol's beegfs-client.conf and the given arguments. It kills beegfs-ctl (and
+// any processes it started) if it does not finish within the BeegfsCtlTimeout configured for vol's file system (or the
+// executor's default timeout) or before ctx ends, and returns a ctlTimeoutError in that case.
+func (ctlExec *beegfsCtlExecutor) executeOnce(ctx context.Context, vol beegfsVolume, args []string) (stdOut string, err error) {
+	args = append([]string{fmt.Sprintf("--cfgFile=%s", vol.clientConfPath)}, args...)
+	timeout := ctlExec.timeout
+	if vol.config.BeegfsCtlTimeout != 0 {
+		timeout = vol.config.BeegfsCtlTimeout
+	}
+	cmdCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(cmdCtx, beegfsCtlPath, args...)
+	// Start beegfs-ctl in its own process group so that any processes it starts can be killed along with it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	LogDebug(ctx, "Executing command", "command", cmd.Args)
 
 	var stdoutBuffer bytes.Buffer
@@ -142,14 +725,32 @@ func (*beegfsCtlExecutor) execute(ctx context.Context, clientConfPath string, ar
 	cmd.Stdout = &stdoutBuffer
 	cmd.Stderr = &stderrBuffer
 
-	err = cmd.Run()
+	if err = cmd.Start(); err != nil {
+		return "", errors.Wrap(err, "failed to start beegfs-ctl")
+	}
+	waitDone := make(chan struct{})
+	go func() {
+		select {
+		case <-cmdCtx.Done():
+			// exec.CommandContext only kills beegfs-ctl itself, and Wait does not return while another process in
+			// the group holds on to its output.
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-waitDone:
+		}
+	}()
+	err = cmd.Wait()
+	close(waitDone)
 	stdOutString := stdoutBuffer.String()
 	stdErrString := stderrBuffer.String()
 	if err != nil {
-		if strings.Contains(stdErrString, "does not exist") {
+		if cmdCtx.Err() != nil {
+			err = errors.WithStack(ctlTimeoutError{args: cmd.Args, timeout: timeout, ctxErr: ctx.Err()})
+		} else if strings.Contains(stdErrString, "does not exist") {
 			err = errors.WithStack(newCtlNotExistError(stdOutString, stdErrString))
 		} else if strings.Contains(stdErrString, "exists already") {
 			err = errors.WithStack(newCtlExistError(stdOutString, stdErrString))
+		} else if class, ok := classifyCtlFailure(stdErrString); ok {
+			err = errors.WithStack(ctlFailureError{class: class, stdOutString: stdOutString, stdErrString: stdErrString})
 		} else {
 			err = errors.Wrapf(err, "beegfs-ctl failed with stdOut: %s and stdErr: %s", stdOutString, stdErrString)
 		}
@@ -164,6 +765,30 @@ func (*beegfsCtlExecutor) execute(ctx context.Context, clientConfPath string, ar
 	return stdOutString, err
 }
 
+// ctlTimeoutError indicates that beegfs-ctl was killed because it did not finish within its timeout (e.g. because the
+// BeeGFS management service does not respond) or before the context of the request it was run for ended.
+type ctlTimeoutError struct {
+	args    []string
+	timeout time.Duration
+	ctxErr  error // the error of the request's context if it ended first
+}
+
+func (err ctlTimeoutError) Error() string {
+	if err.ctxErr != nil {
+		return fmt.Sprintf("beegfs-ctl killed because the request ended (%v): %v", err.ctxErr, err.args)
+	}
+	return fmt.Sprintf("beegfs-ctl did not finish within %s: %v", err.timeout, err.args)
+}
+
+// grpcCode returns the gRPC code an RPC that failed because of the ctlTimeoutError should return. The CO retries an
+// RPC that returns DeadlineExceeded (its own deadline expired) or Unavailable (the file system did not respond).
+func (err ctlTimeoutError) grpcCode() codes.Code {
+	if err.ctxErr != nil {
+		return codes.DeadlineExceeded
+	}
+	return codes.Unavailable
+}
+
 // ctlNotExistError indicates that beegfs-ctl failed to stat or modify an entry that does not exist.
 type ctlNotExistError struct {
 	stdOutString string
@@ -190,17 +815,85 @@ func (err ctlExistError) Error() string {
 	return fmt.Sprintf("beegfs-ctl failed with stdOut: %v and stdErr: %v", err.stdOutString, err.stdErrString)
 }
 
-// fakeBeeGFSCtlExecutor is a mock implementation of beegfsCtlExecutorInterface useful for testing.
-type fakeBeegfsCtlExecutor struct{}
+// ctlFailureClass is the reason a beegfs-ctl command failed as recognized from its stderr.
+type ctlFailureClass int
 
-func (*fakeBeegfsCtlExecutor) createDirectoryForVolume(ctx context.Context, vol beegfsVolume, cfg permissionsConfig) error {
-	return nil
+const (
+	ctlFailureUnreachable   ctlFailureClass = iota // a BeeGFS service (usually the management service) did not respond
+	ctlFailureAuth                                 // the connAuthFile does not match the one the file system uses
+	ctlFailurePermission                           // the BeeGFS services refused the operation
+	ctlFailureTargetOffline                        // a storage or metadata target needed for the operation is offline
+)
+
+// ctlFailurePatterns maps each ctlFailureClass to the beegfs-ctl error messages that indicate it. classifyCtlFailure
+// checks them in order, so more specific patterns come first (e.g. "target ... is unreachable" is not a communication
+// failure with the management service). TestClassifyCtlFailureCaptured checks them against the beegfs-ctl output in
+// testdata/ctlfailures, which hack/capture-ctl-failures.sh captures from a real file system. Until that output exists
+// for a class, its patterns only match narrow phrases. A message that does not match any of them is not retried and
+// fails the request with Internal, the same as before beegfs-ctl failures were classified.
+var ctlFailurePatterns = []struct {
+	class   ctlFailureClass
+	pattern *regexp.Regexp
+}{
+	{ctlFailureAuth, regexp.MustCompile(`(?i)\bauthentication failed\b`)},
+	{ctlFailurePermission, regexp.MustCompile(`(?i)\bpermission denied\b|\boperation not permitted\b`)},
+	{ctlFailureTargetOffline, regexp.MustCompile(`(?i)\btargets?\b[^\n]*\b(is|are) (offline|unreachable)\b`)},
+	{ctlFailureUnreachable, regexp.MustCompile(`(?i)\bcommunication error\b|\bunable to connect\b|` +
+		`\bconnection refused\b|\bno route to host\b|\bmanagement node is unreachable\b`)},
 }
 
-func (*fakeBeegfsCtlExecutor) statDirectoryForVolume(ctx context.Context, vol beegfsVolume) (string, error) {
-	return "", nil
+// classifyCtlFailure returns the ctlFailureClass indicated by the stderr of a failed beegfs-ctl command and true, or
+// false if stdErr does not match any known class.
+func classifyCtlFailure(stdErr string) (ctlFailureClass, bool) {
+	for _, p := range ctlFailurePatterns {
+		if p.pattern.MatchString(stdErr) {
+			return p.class, true
+		}
+	}
+	return 0, false
 }
 
-func (*fakeBeegfsCtlExecutor) setPatternForVolume(ctx context.Context, vol beegfsVolume, cfg stripePatternConfig) error {
-	return nil
+func (class ctlFailureClass) String() string {
+	switch class {
+	case ctlFailureUnreachable:
+		return "unreachable"
+	case ctlFailureAuth:
+		return "authentication failure"
+	case ctlFailurePermission:
+		return "permission denied"
+	case ctlFailureTargetOffline:
+		return "target offline"
+	}
+	return fmt.Sprintf("ctlFailureClass(%d)", int(class))
+}
+
+// isTransient returns true if a beegfs-ctl command that failed for this reason may succeed when retried without any
+// intervention.
+func (class ctlFailureClass) isTransient() bool {
+	return class == ctlFailureUnreachable || class == ctlFailureTargetOffline
+}
+
+// ctlFailureError indicates that beegfs-ctl failed for a reason classifyCtlFailure recognized.
+type ctlFailureError struct {
+	class        ctlFailureClass
+	stdOutString string
+	stdErrString string
+}
+
+func (err ctlFailureError) Error() string {
+	return fmt.Sprintf("beegfs-ctl failed (%s) with stdOut: %v and stdErr: %v", err.class, err.stdOutString,
+		err.stdErrString)
+}
+
+// grpcCode returns the gRPC code an RPC that failed because of the ctlFailureError should return.
+func (err ctlFailureError) grpcCode() codes.Code {
+	switch err.class {
+	case ctlFailureUnreachable:
+		return codes.Unavailable
+	case ctlFailureAuth, ctlFailurePermission:
+		return codes.PermissionDenied
+	case ctlFailureTargetOffline:
+		return codes.FailedPrecondition
+	}
+	return codes.Internal
 }
@@ -0,0 +1,482 @@
+/*
+Copyright 2021 NetApp, Inc. All Rights Reserved.
+Licensed under the Apache License, Version 2.0.
+*/
+
+package beegfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+)
+
+// simOp identifies a simBeegfsCtlExecutor operation by the beegfs-ctl mode it stands in for.
+type simOp string
+
+const (
+	simOpCreateDir        simOp = "createdir"
+	simOpGetEntryInfo     simOp = "getentryinfo"
+	simOpSetPattern       simOp = "setpattern"
+	simOpGetQuota         simOp = "getquota"
+	simOpSetQuota         simOp = "setquota"
+	simOpListTargets      simOp = "listtargets"
+	simOpListStoragePools simOp = "liststoragepools"
+	simOpListMirrorGroups simOp = "listmirrorgroups"
+)
+
+// Errors a simBeegfsCtlExecutor can be told to fail an operation with. They match the errors beegfsCtlExecutor returns
+// when beegfs-ctl fails for the same reason.
+var (
+	simErrNotExist    = newCtlNotExistError("", "Path does not exist")
+	simErrExist       = newCtlExistError("", "Entry exists already")
+	simErrTimeout     = ctlTimeoutError{args: []string{"beegfs-ctl"}, timeout: 2 * time.Minute} // the default timeout
+	simErrUnreachable = ctlFailureError{class: ctlFailureUnreachable,
+		stdErrString: "Communication error: Unable to connect to management node"}
+)
+
+// simBeegfsCtlExecutor is a beegfsCtlExecutorInterface that simulates a BeeGFS file system for each sysMgmtdHost. It
+// creates directories in a local directory that stands in for the root of the file system (see simRootPath and
+// sanityMounter), so the controller service sees them (and can remove or rename them) through the mount point.
+// Everything else beegfs-ctl reports is kept in memory: the entry ID, ownership, mode, stripe pattern, and storage pool
+// of each directory and the quota of each user and group in each storage pool. All simulated file systems share the
+// same storage targets, pools, and mirror groups.
+//
+// A new directory inherits its stripe pattern and metadata mirroring from its parent like it does in BeeGFS. A
+// directory the driver creates without beegfs-ctl (or renames) is treated as if it was created with its local
+// ownership and permissions in its (new) parent directory. Use ownershipFs to make the driver see the simulated
+// ownership of directories created with beegfs-ctl.
+type simBeegfsCtlExecutor struct {
+	mutex          sync.Mutex
+	beegfsRootPath string
+	fileSystems    map[string]*simFileSystem // by sysMgmtdHost
+	targets        []storageTarget
+	pools          []storagePool
+	storageGroups  []mirrorGroup
+	metaGroups     []mirrorGroup
+	failures       map[simOp][]error
+}
+
+// simFileSystem is the state of the BeeGFS file system of a single sysMgmtdHost.
+type simFileSystem struct {
+	rootPath    string               // the local directory that stands in for the root of the file system
+	entries     map[string]*simEntry // by path from the root of the file system
+	lastEntryID int
+	quotas      map[simQuotaKey]quotaInfo
+}
+
+// simQuotaKey identifies the quota of a user or group in a storage pool.
+type simQuotaKey struct {
+	storagePoolID string
+	idType        quotaIDType
+	id            uint32
+}
+
+// simEntry is the state of a directory on a simulated BeeGFS file system.
+type simEntry struct {
+	info entryInfo
+	uid  uint32
+	gid  uint32
+	mode os.FileMode
+}
+
+// newSimBeegfsCtlExecutor returns a simBeegfsCtlExecutor that simulates file systems with four online storage targets
+// in the Default storage pool, no buddy mirror groups, and no quota usage or limits, whose root directories stripe
+// files across all four targets in 512K chunks. The file system of each sysMgmtdHost is rooted in
+// simRootPath(beegfsRootPath, sysMgmtdHost).
+func newSimBeegfsCtlExecutor(beegfsRootPath string) *simBeegfsCtlExecutor {
+	e := &simBeegfsCtlExecutor{
+		beegfsRootPath: beegfsRootPath,
+		fileSystems:    make(map[string]*simFileSystem),
+		pools:          []storagePool{{id: "1", description: "Default"}},
+		failures:       make(map[simOp][]error),
+	}
+	for _, id := range []string{"101", "102", "201", "202"} {
+		e.targets = append(e.targets, storageTarget{id: id, reachability: "Online", consistency: "Good",
+			totalBytes: 1 << 40, freeBytes: 1 << 40, totalInodes: 1 << 30, freeInodes: 1 << 30})
+		e.pools[0].targets = append(e.pools[0].targets, id)
+	}
+	return e
+}
+
+// simRootPath returns the local directory that stands in for the root of the BeeGFS file system of sysMgmtdHost. Most
+// tests use a single file system on localhost, so its root is beegfsRootPath itself. The root of every other file
+// system is a sibling of beegfsRootPath named after its sysMgmtdHost.
+func simRootPath(beegfsRootPath, sysMgmtdHost string) string {
+	if sysMgmtdHost == "localhost" {
+		return beegfsRootPath
+	}
+	return beegfsRootPath + "-" + sysMgmtdHost
+}
+
+// fileSystem returns the state of the file system of sysMgmtdHost, starting it with an empty root directory if
+// necessary. The caller must hold e.mutex.
+func (e *simBeegfsCtlExecutor) fileSystem(sysMgmtdHost string) *simFileSystem {
+	if f, ok := e.fileSystems[sysMgmtdHost]; ok {
+		return f
+	}
+	f := &simFileSystem{
+		rootPath: simRootPath(e.beegfsRootPath, sysMgmtdHost),
+		entries:  make(map[string]*simEntry),
+		quotas:   make(map[simQuotaKey]quotaInfo),
+	}
+	f.entries["/"] = &simEntry{
+		info: entryInfo{
+			entryType:         "directory",
+			entryID:           "root",
+			metadataNode:      "meta01",
+			metadataNodeID:    "1",
+			stripePatternType: stripePatternTypeRAID0,
+			chunkSize:         "512K",
+			numTargets:        4,
+			storagePoolID:     "1",
+			storagePoolName:   "Default",
+		},
+		mode: 0755,
+	}
+	e.fileSystems[sysMgmtdHost] = f
+	return f
+}
+
+// injectFailure makes the next call of op fail with err. Failures injected for the same op are returned in order, one
+// per call.
+func (e *simBeegfsCtlExecutor) injectFailure(op simOp, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.failures[op] = append(e.failures[op], err)
+}
+
+// nextFailure returns (and forgets) the next failure injected for op or nil. The caller must hold e.mutex.
+func (e *simBeegfsCtlExecutor) nextFailure(op simOp) error {
+	if len(e.failures[op]) == 0 {
+		return nil
+	}
+	err := e.failures[op][0]
+	e.failures[op] = e.failures[op][1:]
+	return errors.WithStack(err)
+}
+
+// entry returns the state of the directory at dirPath (relative to the root of the file system) or nil if it does not
+// exist. The caller must hold the mutex of the simBeegfsCtlExecutor.
+func (f *simFileSystem) entry(dirPath string) *simEntry {
+	dirPath = path.Clean("/" + dirPath)
+	if dirPath == "/" {
+		return f.entries[dirPath]
+	}
+	fileInfo, err := os.Stat(path.Join(f.rootPath, dirPath))
+	if err != nil || !fileInfo.IsDir() {
+		delete(f.entries, dirPath) // The driver may have removed or renamed it.
+		return nil
+	}
+	if entry, ok := f.entries[dirPath]; ok {
+		return entry
+	}
+	parent := f.entry(path.Dir(dirPath))
+	if parent == nil {
+		return nil
+	}
+	permCfg := permissionsConfig{mode: uint16(fileInfo.Mode().Perm())}
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		permCfg.uid, permCfg.gid = stat.Uid, stat.Gid
+	}
+	return f.addEntry(dirPath, parent, permCfg, stripePatternConfig{})
+}
+
+// addEntry records a new directory at dirPath in parent. The caller must hold the mutex of the simBeegfsCtlExecutor.
+func (f *simFileSystem) addEntry(dirPath string, parent *simEntry, permCfg permissionsConfig,
+	patternCfg stripePatternConfig) *simEntry {
+	f.lastEntryID++
+	entry := &simEntry{info: parent.info, uid: permCfg.uid, gid: permCfg.gid, mode: os.FileMode(permCfg.mode & 0o777)}
+	entry.info.entryID = fmt.Sprintf("%d-5F8D7E1B-1", f.lastEntryID)
+	if patternCfg.metadataMirroring == "false" {
+		entry.info.metadataBuddyGroup = ""
+	}
+	f.entries[dirPath] = entry
+	return entry
+}
+
+func (e *simBeegfsCtlExecutor) createDirectoryForVolume(ctx context.Context, vol beegfsVolume,
+	permCfg permissionsConfig, patternCfg stripePatternConfig) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.nextFailure(simOpCreateDir); err != nil {
+		return err
+	}
+	// Like beegfsCtlExecutor, create any missing parent directories with the same permissions.
+	f := e.fileSystem(vol.sysMgmtdHost)
+	if err := os.MkdirAll(f.rootPath, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	var dirsToMake []string
+	for dir := path.Clean("/" + vol.volDirPathBeegfsRoot); f.entry(dir) == nil; dir = path.Dir(dir) {
+		dirsToMake = append([]string{dir}, dirsToMake...)
+	}
+	for _, dir := range dirsToMake {
+		localPath := path.Join(f.rootPath, dir)
+		if err := os.Mkdir(localPath, 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		// beegfs-ctl ignores special permissions.
+		if err := os.Chmod(localPath, os.FileMode(permCfg.mode&0o777)); err != nil {
+			return errors.WithStack(err)
+		}
+		f.addEntry(dir, f.entry(path.Dir(dir)), permCfg, patternCfg)
+	}
+	return nil
+}
+
+// entryState returns the simulated state of the directory at dirPath (relative to the root of the BeeGFS file system of
+// sysMgmtdHost) and true, or false if it does not exist.
+func (e *simBeegfsCtlExecutor) entryState(sysMgmtdHost, dirPath string) (simEntry, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if entry := e.fileSystem(sysMgmtdHost).entry(dirPath); entry != nil {
+		return *entry, true
+	}
+	return simEntry{}, false
+}
+
+func (e *simBeegfsCtlExecutor) statDirectoryForVolume(ctx context.Context, vol beegfsVolume) (entryInfo, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.nextFailure(simOpGetEntryInfo); err != nil {
+		return entryInfo{}, err
+	}
+	entry := e.fileSystem(vol.sysMgmtdHost).entry(vol.volDirPathBeegfsRoot)
+	if entry == nil {
+		return entryInfo{}, errors.WithStack(simErrNotExist)
+	}
+	return entry.info, nil
+}
+
+func (e *simBeegfsCtlExecutor) setPatternForVolume(ctx context.Context, vol beegfsVolume,
+	cfg stripePatternConfig) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.nextFailure(simOpSetPattern); err != nil {
+		return err
+	}
+	if _, needToExecute := constructSetPatternForVolumeArgs(cfg); !needToExecute {
+		return nil
+	}
+	entry := e.fileSystem(vol.sysMgmtdHost).entry(vol.volDirPathBeegfsRoot)
+	if entry == nil {
+		return errors.WithStack(simErrNotExist)
+	}
+	info := entry.info
+	if cfg.stripePatternType != "" {
+		info.stripePatternType = cfg.stripePatternType
+	}
+	if cfg.stripePatternNumTargets != "" {
+		numTargets, err := strconv.ParseUint(cfg.stripePatternNumTargets, 10, 64)
+		if err != nil || numTargets == 0 {
+			return errors.Errorf("invalid number of storage targets %s", cfg.stripePatternNumTargets)
+		}
+		info.numTargets = numTargets
+	}
+	if cfg.stripePatternChunkSize != "" {
+		chunkSize, err := parseChunkSize(cfg.stripePatternChunkSize)
+		if err != nil || chunkSize < 64<<10 || chunkSize&(chunkSize-1) != 0 {
+			return errors.Errorf("invalid chunk size %s", cfg.stripePatternChunkSize)
+		}
+		// beegfs-ctl --getentryinfo reports chunk sizes in K or M.
+		if chunkSize%(1<<20) == 0 {
+			info.chunkSize = fmt.Sprintf("%dM", chunkSize>>20)
+		} else {
+			info.chunkSize = fmt.Sprintf("%dK", chunkSize>>10)
+		}
+	}
+	if cfg.storagePoolID != "" {
+		var pool *storagePool
+		for i := range e.pools {
+			if e.pools[i].id == cfg.storagePoolID {
+				pool = &e.pools[i]
+			}
+		}
+		if pool == nil {
+			return errors.Errorf("storage pool %s does not exist", cfg.storagePoolID)
+		}
+		info.storagePoolID, info.storagePoolName = pool.id, pool.description
+	}
+	entry.info = info
+	return nil
+}
+
+func (e *simBeegfsCtlExecutor) getQuotasForVolume(ctx context.Context, vol beegfsVolume, storagePoolID string,
+	idType quotaIDType, ids []uint32) ([]quotaInfo, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.nextFailure(simOpGetQuota); err != nil {
+		return nil, err
+	}
+	if storagePoolID == "" {
+		storagePoolID = defaultStoragePoolID
+	}
+	if !e.hasStoragePool(storagePoolID) {
+		return nil, errors.Errorf("storage pool %s does not exist", storagePoolID)
+	}
+	var infos []quotaInfo
+	for _, id := range ids {
+		infos = append(infos, e.fileSystem(vol.sysMgmtdHost).quota(storagePoolID, idType, id))
+	}
+	return infos, nil
+}
+
+func (e *simBeegfsCtlExecutor) setQuotaLimitForVolume(ctx context.Context, vol beegfsVolume, storagePoolID string,
+	idType quotaIDType, id uint32, sizeLimit uint64) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.nextFailure(simOpSetQuota); err != nil {
+		return err
+	}
+	if storagePoolID == "" {
+		storagePoolID = defaultStoragePoolID
+	}
+	if !e.hasStoragePool(storagePoolID) {
+		return errors.Errorf("storage pool %s does not exist", storagePoolID)
+	}
+	f := e.fileSystem(vol.sysMgmtdHost)
+	info := f.quota(storagePoolID, idType, id)
+	info.sizeLimit, info.inodesLimit = sizeLimit, 0
+	f.quotas[simQuotaKey{storagePoolID, idType, id}] = info
+	return nil
+}
+
+// setQuota records the usage and limits of a user or group in a storage pool of the file system of sysMgmtdHost.
+func (e *simBeegfsCtlExecutor) setQuota(sysMgmtdHost string, info quotaInfo) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.fileSystem(sysMgmtdHost).quotas[simQuotaKey{info.storagePoolID, info.idType, info.id}] = info
+}
+
+// setQuotaUsage records usage by a user or group in a storage pool of the file system of sysMgmtdHost (e.g. by files
+// the driver does not know about).
+func (e *simBeegfsCtlExecutor) setQuotaUsage(sysMgmtdHost, storagePoolID string, idType quotaIDType, id uint32,
+	sizeUsed, inodesUsed uint64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	f := e.fileSystem(sysMgmtdHost)
+	info := f.quota(storagePoolID, idType, id)
+	info.sizeUsed, info.inodesUsed = sizeUsed, inodesUsed
+	f.quotas[simQuotaKey{storagePoolID, idType, id}] = info
+}
+
+// quota returns the quota of a user or group in a storage pool of the file system of sysMgmtdHost.
+func (e *simBeegfsCtlExecutor) quota(sysMgmtdHost, storagePoolID string, idType quotaIDType, id uint32) quotaInfo {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.fileSystem(sysMgmtdHost).quota(storagePoolID, idType, id)
+}
+
+// quota returns the quota of a user or group in a storage pool. The caller must hold the mutex of the
+// simBeegfsCtlExecutor.
+func (f *simFileSystem) quota(storagePoolID string, idType quotaIDType, id uint32) quotaInfo {
+	info, ok := f.quotas[simQuotaKey{storagePoolID, idType, id}]
+	if !ok {
+		info = quotaInfo{idType: idType, id: id, storagePoolID: storagePoolID}
+	}
+	return info
+}
+
+// hasStoragePool returns true if the storage pool with the given ID exists. The caller must hold e.mutex.
+func (e *simBeegfsCtlExecutor) hasStoragePool(storagePoolID string) bool {
+	for _, pool := range e.pools {
+		if pool.id == storagePoolID {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *simBeegfsCtlExecutor) listStorageTargets(ctx context.Context, vol beegfsVolume) ([]storageTarget, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.nextFailure(simOpListTargets); err != nil {
+		return nil, err
+	}
+	return append([]storageTarget(nil), e.targets...), nil
+}
+
+func (e *simBeegfsCtlExecutor) listStoragePools(ctx context.Context, vol beegfsVolume) ([]storagePool, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.nextFailure(simOpListStoragePools); err != nil {
+		return nil, err
+	}
+	return append([]storagePool(nil), e.pools...), nil
+}
+
+func (e *simBeegfsCtlExecutor) listMirrorGroups(ctx context.Context, vol beegfsVolume,
+	nodeType string) ([]mirrorGroup, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err := e.nextFailure(simOpListMirrorGroups); err != nil {
+		return nil, err
+	}
+	if nodeType == nodeTypeMeta {
+		return append([]mirrorGroup(nil), e.metaGroups...), nil
+	}
+	return append([]mirrorGroup(nil), e.storageGroups...), nil
+}
+
+// ownershipFs returns an afero.Fs that reports the simulated owner (uid) and group (gid) of directories on the
+// simulated file systems in the syscall.Stat_t of their FileInfo, like a real BeeGFS mount would. Every other call is
+// passed to base.
+func (e *simBeegfsCtlExecutor) ownershipFs(base afero.Fs) afero.Fs {
+	return &simOwnershipFs{Fs: base, sim: e}
+}
+
+// simOwnershipFs is the afero.Fs returned by ownershipFs.
+type simOwnershipFs struct {
+	afero.Fs
+	sim *simBeegfsCtlExecutor
+}
+
+func (sfs *simOwnershipFs) Stat(name string) (os.FileInfo, error) {
+	fileInfo, err := sfs.Fs.Stat(name)
+	if err != nil || !fileInfo.IsDir() {
+		return fileInfo, err
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileInfo, nil
+	}
+	localPath, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return fileInfo, nil
+	}
+	sfs.sim.mutex.Lock()
+	defer sfs.sim.mutex.Unlock()
+	for _, f := range sfs.sim.fileSystems {
+		dirPath, err := filepath.Rel(f.rootPath, localPath)
+		if err != nil || dirPath == ".." || strings.HasPrefix(dirPath, "../") {
+			continue
+		}
+		if entry := f.entry(dirPath); entry != nil {
+			simStat := *stat
+			simStat.Uid, simStat.Gid = entry.uid, entry.gid
+			return simFileInfo{FileInfo: fileInfo, stat: &simStat}, nil
+		}
+	}
+	return fileInfo, nil
+}
+
+// simFileInfo is an os.FileInfo whose Sys returns a simulated syscall.Stat_t.
+type simFileInfo struct {
+	os.FileInfo
+	stat *syscall.Stat_t
+}
+
+func (fi simFileInfo) Sys() interface{} {
+	return fi.stat
+}
@@ -6,8 +6,19 @@ Licensed under the Apache License, Version 2.0.
 package beegfs
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
 )
 
 func TestConstructSetPatternForVolumeArgs(t *testing.T) {
@@ -25,6 +36,21 @@ func TestConstructSetPatternForVolumeArgs(t *testing.T) {
 			wantArgs:      []string{"--unmounted", "--setpattern", "--storagepoolid=2", "--chunksize=2m", "--numtargets=4"},
 			wantToExecute: true,
 		},
+		"buddy mirror example": {
+			config: stripePatternConfig{
+				stripePatternNumTargets: "2",
+				stripePatternType:       stripePatternTypeBuddyMirror,
+			},
+			wantArgs:      []string{"--unmounted", "--setpattern", "--numtargets=2", "--pattern=buddymirror"},
+			wantToExecute: true,
+		},
+		"metadata mirroring only example": {
+			config: stripePatternConfig{
+				metadataMirroring: "false",
+			},
+			wantArgs:      []string{},
+			wantToExecute: false,
+		},
 		"nothing example": {
 			config: stripePatternConfig{
 				storagePoolID:           "",
@@ -51,8 +77,9 @@ func TestConstructSetPatternForVolumeArgs(t *testing.T) {
 
 func TestConstructCreateDirForVolumeArgs(t *testing.T) {
 	tests := map[string]struct {
-		config   permissionsConfig
-		wantArgs []string
+		config        permissionsConfig
+		patternConfig stripePatternConfig
+		wantArgs      []string
 	}{
 		"default": {
 			config: permissionsConfig{
@@ -96,14 +123,599 @@ func TestConstructCreateDirForVolumeArgs(t *testing.T) {
 			// We explicitly do not use the leading digit in octal notation because beegfs-ctl ignores it anyway.
 			wantArgs: []string{"--unmounted", "--createdir", "--access=755", "--uid=1000", "--gid=1000"},
 		},
+		"metadata mirroring enabled": {
+			config:        permissionsConfig{mode: defaultPermissionsMode},
+			patternConfig: stripePatternConfig{metadataMirroring: "true"},
+			// Metadata mirroring is inherited from the parent directory.
+			wantArgs: []string{"--unmounted", "--createdir", "--access=777"},
+		},
+		"metadata mirroring disabled": {
+			config:        permissionsConfig{mode: defaultPermissionsMode},
+			patternConfig: stripePatternConfig{metadataMirroring: "false"},
+			wantArgs:      []string{"--unmounted", "--createdir", "--access=777", "--nomirror"},
+		},
 	}
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			got := constructCreateDirForVolumeArgs(tc.config)
+			got := constructCreateDirForVolumeArgs(tc.config, tc.patternConfig)
 			if !reflect.DeepEqual(tc.wantArgs, got) {
 				t.Fatalf("expected: %s, got: %s", tc.wantArgs, got)
 			}
 		})
 	}
 }
+
+func TestParseGetQuotaOutput(t *testing.T) {
+	tests := map[string]struct {
+		stdOut  string
+		want    []quotaInfo
+		wantErr bool
+	}{
+		"limits set": {
+			stdOut: "name,id,size,hard,files,hard\nuser,1000,4096,10737418240,1,1000\n",
+			want:   []quotaInfo{{id: 1000, sizeUsed: 4096, sizeLimit: 10737418240, inodesUsed: 1, inodesLimit: 1000}},
+		},
+		"limits unlimited": {
+			stdOut: "name,id,size,hard,files,hard\nuser,1000,4096,unlimited,1,unlimited\n",
+			want:   []quotaInfo{{id: 1000, sizeUsed: 4096, inodesUsed: 1}},
+		},
+		"storage pool header": {
+			stdOut: "Quota information for storage pool Default (ID: 1):\n\nname,id,size,hard,files,hard\nuser,1000,4096,unlimited,1,unlimited\n",
+			want:   []quotaInfo{{id: 1000, storagePoolID: "1", sizeUsed: 4096, inodesUsed: 1}},
+		},
+		"multiple storage pools": {
+			stdOut: "Quota information for storage pool Default (ID: 1):\n\n" +
+				"name,id,size,hard,files,hard\nuser,1000,4096,10737418240,1,unlimited\n1001,1001,0,unlimited,0,unlimited\n\n" +
+				"Quota information for storage pool fast pool (ID: 2):\n\n" +
+				"name,id,size,hard,files,hard\nuser,1000,8192,unlimited,2,unlimited\n1001,1001,0,1073741824,0,unlimited\n",
+			want: []quotaInfo{
+				{id: 1000, storagePoolID: "1", sizeUsed: 4096, sizeLimit: 10737418240, inodesUsed: 1},
+				{id: 1001, storagePoolID: "1"},
+				{id: 1000, storagePoolID: "2", sizeUsed: 8192, inodesUsed: 2},
+				{id: 1001, storagePoolID: "2", sizeLimit: 1073741824},
+			},
+		},
+		"no header": {
+			stdOut: "user,1000,4096,unlimited,1,unlimited",
+			want:   []quotaInfo{{id: 1000, sizeUsed: 4096, inodesUsed: 1}},
+		},
+		"multiple ids": {
+			stdOut: "name,id,size,hard,files,hard\n1000,1000,0,unlimited,0,unlimited\n1001,1001,0,1073741824,0,unlimited\n",
+			want: []quotaInfo{
+				{id: 1000},
+				{id: 1001, sizeLimit: 1073741824},
+			},
+		},
+		"empty output": {
+			stdOut:  "",
+			wantErr: true,
+		},
+		"unparseable value": {
+			stdOut:  "name,id,size,hard,files,hard\nuser,1000,4096,strange_value,1,unlimited\n",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseGetQuotaOutput(tc.stdOut)
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error occured: %s", err)
+			}
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected error did not occur")
+			}
+			if !tc.wantErr && !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("expected: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGetQuotasForVolume(t *testing.T) {
+	// The fake beegfs-ctl fails without --storagepoolid. Otherwise, it prints the quotas of uid 1000 in two storage
+	// pools, like beegfs-ctl does on a file system with multiple storage pools if a command does not restrict the output
+	// to one pool.
+	script := "case \"$*\" in *--storagepoolid=*) ;; *) echo 'missing --storagepoolid' >&2; exit 1;; esac\n" +
+		"printf 'Quota information for storage pool Default (ID: 1):\\n\\nname,id,size,hard,files,hard\\n" +
+		"user,1000,4096,10737418240,1,unlimited\\n\\n" +
+		"Quota information for storage pool fast (ID: 2):\\n\\nname,id,size,hard,files,hard\\n" +
+		"user,1000,8192,unlimited,2,unlimited\\n'\n"
+	defer useFakeBeegfsCtl(t, script)()
+
+	tests := map[string]struct {
+		storagePoolID string
+		want          quotaInfo
+		wantErr       bool
+	}{
+		"default storage pool": {
+			want: quotaInfo{idType: quotaIDTypeUID, id: 1000, storagePoolID: "1", sizeUsed: 4096,
+				sizeLimit: 10737418240, inodesUsed: 1},
+		},
+		"other storage pool": {
+			storagePoolID: "2",
+			want:          quotaInfo{idType: quotaIDTypeUID, id: 1000, storagePoolID: "2", sizeUsed: 8192, inodesUsed: 2},
+		},
+		"missing storage pool": {
+			storagePoolID: "3",
+			wantErr:       true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := (&beegfsCtlExecutor{}).getQuotasForVolume(context.Background(), beegfsVolume{},
+				tc.storagePoolID, quotaIDTypeUID, []uint32{1000})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error did not occur")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error occured: %s", err)
+			}
+			if !reflect.DeepEqual([]quotaInfo{tc.want}, got) {
+				t.Fatalf("expected: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestConstructSetQuotaLimitForVolumeArgs(t *testing.T) {
+	tests := map[string]struct {
+		storagePoolID string
+		idType        quotaIDType
+		id            uint32
+		sizeLimit     uint64
+		wantArgs      []string
+	}{
+		"set gid limit": {
+			storagePoolID: "2",
+			idType:        quotaIDTypeGID,
+			id:            2000,
+			sizeLimit:     1073741824,
+			wantArgs: []string{"--setquota", "--gid", "2000", "--sizelimit=1073741824", "--inodelimit=unlimited",
+				"--storagepoolid=2"},
+		},
+		"clear uid limit in default storage pool": {
+			idType: quotaIDTypeUID,
+			id:     1000,
+			wantArgs: []string{"--setquota", "--uid", "1000", "--sizelimit=unlimited", "--inodelimit=unlimited",
+				"--storagepoolid=1"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := constructSetQuotaLimitForVolumeArgs(tc.storagePoolID, tc.idType, tc.id, tc.sizeLimit)
+			if !reflect.DeepEqual(tc.wantArgs, got) {
+				t.Fatalf("expected: %s, got: %s", tc.wantArgs, got)
+			}
+		})
+	}
+}
+
+func TestParseListTargetsOutput(t *testing.T) {
+	stdOut := `TargetID     Reachability  Consistency        Total         Free    %      ITotal       IFree    %
+========     ============  ===========        =====         ====    =      ======       =====    =
+       1           Online         Good     916.5GiB     900.0GiB  98%       58.3M       58.3M 100%
+       2 Probably-offline Needs-resync       1.0TiB     512.0MiB   0%        1.0k         500  50%
+`
+	want := []storageTarget{
+		{id: "1", reachability: "Online", consistency: "Good", totalBytes: 916.5 * (1 << 30),
+			freeBytes: 900 * (1 << 30), totalInodes: 58300000, freeInodes: 58300000},
+		{id: "2", reachability: "Probably-offline", consistency: "Needs-resync", totalBytes: 1 << 40,
+			freeBytes: 512 * (1 << 20), totalInodes: 1000, freeInodes: 500},
+	}
+	got, err := parseListTargetsOutput(stdOut)
+	if err != nil {
+		t.Fatalf("unexpected error occured: %s", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected: %v, got: %v", want, got)
+	}
+
+	if _, err := parseListTargetsOutput("strange output"); err == nil {
+		t.Fatalf("expected error did not occur")
+	}
+}
+
+func TestParseListStoragePoolsOutput(t *testing.T) {
+	stdOut := `Pool ID   Pool Description                      Targets                 Buddy Groups
+======= ================== ============================ ============================
+      1            Default                      1,2,3,4
+      2        fast drives                          5,6                          1,2
+`
+	want := []storagePool{
+		{id: "1", description: "Default", targets: []string{"1", "2", "3", "4"}},
+		{id: "2", description: "fast drives", targets: []string{"5", "6"}, buddyGroups: []string{"1", "2"}},
+	}
+	got, err := parseListStoragePoolsOutput(stdOut)
+	if err != nil {
+		t.Fatalf("unexpected error occured: %s", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected: %v, got: %v", want, got)
+	}
+}
+
+func TestParseListMirrorGroupsOutput(t *testing.T) {
+	stdOut := `     BuddyGroupID   PrimaryTargetID SecondaryTargetID
+     ============   =============== =================
+                1               101               201
+                2               102               202
+`
+	want := []mirrorGroup{
+		{id: "1", primary: "101", secondary: "201"},
+		{id: "2", primary: "102", secondary: "202"},
+	}
+	got, err := parseListMirrorGroupsOutput(stdOut)
+	if err != nil {
+		t.Fatalf("unexpected error occured: %s", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected: %v, got: %v", want, got)
+	}
+
+	noGroups := "     BuddyGroupID   PrimaryNodeID SecondaryNodeID\n     ============   ============= ===============\n"
+	if got, err = parseListMirrorGroupsOutput(noGroups); err != nil || len(got) != 0 {
+		t.Fatalf("expected no groups, got %v (%v)", got, err)
+	}
+}
+
+// TestParseEntryInfo parses the files in testdata/getentryinfo. These files are synthetic. They were written by hand to
+// resemble "beegfs-ctl --getentryinfo" output (with and without metadata mirroring) and were not captured from a real
+// BeeGFS file system.
+func TestParseEntryInfo(t *testing.T) {
+	tests := map[string]entryInfo{ // by file in testdata/getentryinfo
+		"raid0.txt": {
+			entryType:         "directory",
+			entryID:           "0-5F8D7E1B-1",
+			metadataNode:      "meta01",
+			metadataNodeID:    "1",
+			stripePatternType: stripePatternTypeRAID0,
+			chunkSize:         "512K",
+			numTargets:        4,
+			storagePoolID:     "1",
+			storagePoolName:   "Default",
+		},
+		"buddymirror.txt": {
+			entryType:          "directory",
+			entryID:            "1-5F8D7E1B-1",
+			metadataNode:       "meta01",
+			metadataNodeID:     "1",
+			metadataBuddyGroup: "1",
+			stripePatternType:  stripePatternTypeBuddyMirror,
+			chunkSize:          "1M",
+			numTargets:         2,
+			storagePoolID:      "2",
+			storagePoolName:    "nvme",
+		},
+		"root.txt": {
+			entryType:         "directory",
+			entryID:           "root",
+			metadataNode:      "meta01",
+			metadataNodeID:    "1",
+			stripePatternType: stripePatternTypeRAID0,
+			chunkSize:         "512K",
+			numTargets:        4,
+			storagePoolID:     "1",
+			storagePoolName:   "Default",
+		},
+	}
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			stdOut, err := ioutil.ReadFile(path.Join("testdata", "getentryinfo", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseEntryInfo(string(stdOut))
+			if err != nil {
+				t.Fatalf("unexpected error occured: %s", err)
+			}
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("expected: %+v, got: %+v", want, got)
+			}
+		})
+	}
+
+	for _, stdOut := range []string{
+		"",
+		"Path: /vols/vol1\n",
+		"EntryID: 0-5F8D7E1B-1\n+ Number of storage targets: many\n",
+	} {
+		if got, err := parseEntryInfo(stdOut); err == nil {
+			t.Fatalf("expected error for %q, got %+v", stdOut, got)
+		}
+	}
+}
+
+func TestParseCtlSize(t *testing.T) {
+	tests := map[string]struct {
+		size    string
+		want    uint64
+		wantErr bool
+	}{
+		"bytes":             {size: "512B", want: 512},
+		"no suffix":         {size: "500", want: 500},
+		"binary suffix":     {size: "1.5GiB", want: 1.5 * (1 << 30)},
+		"decimal suffix":    {size: "58.3M", want: 58300000},
+		"unparseable value": {size: "strange_value", wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseCtlSize(tc.size)
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error occured: %s", err)
+			}
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected error did not occur")
+			}
+			if !tc.wantErr && tc.want != got {
+				t.Fatalf("expected: %d, got: %d", tc.want, got)
+			}
+		})
+	}
+}
+
+// useFakeBeegfsCtl makes beegfsCtlExecutor run a shell script with the given body instead of beegfs-ctl. The returned
+// function restores beegfsCtlPath and removes the script.
+func useFakeBeegfsCtl(t *testing.T, script string) (restore func()) {
+	testDir, err := ioutil.TempDir("", "beegfs-ctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scriptPath := path.Join(testDir, "beegfs-ctl")
+	if err := ioutil.WriteFile(scriptPath, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defaultBeegfsCtlPath := beegfsCtlPath
+	beegfsCtlPath = scriptPath
+	return func() {
+		beegfsCtlPath = defaultBeegfsCtlPath
+		_ = os.RemoveAll(testDir)
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	// The fake beegfs-ctl starts a child that holds on to its output. execute only returns if the whole process group
+	// is killed.
+	defer useFakeBeegfsCtl(t, "sleep 60 &\nwait\n")()
+
+	tests := map[string]struct {
+		executorTimeout time.Duration
+		configTimeout   time.Duration
+		ctxTimeout      time.Duration
+		wantCode        codes.Code
+	}{
+		"executor timeout": {
+			executorTimeout: 100 * time.Millisecond,
+			wantCode:        codes.Unavailable,
+		},
+		"config timeout overrides executor timeout": {
+			executorTimeout: time.Hour,
+			configTimeout:   100 * time.Millisecond,
+			wantCode:        codes.Unavailable,
+		},
+		"request deadline": {
+			executorTimeout: time.Hour,
+			ctxTimeout:      100 * time.Millisecond,
+			wantCode:        codes.DeadlineExceeded,
+		},
+		"request deadline without executor timeout": {
+			ctxTimeout: 100 * time.Millisecond,
+			wantCode:   codes.DeadlineExceeded,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.ctxTimeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.ctxTimeout)
+				defer cancel()
+			}
+			ctlExec := &beegfsCtlExecutor{timeout: tc.executorTimeout}
+			vol := beegfsVolume{config: beegfsConfig{BeegfsCtlTimeout: tc.configTimeout}}
+
+			start := time.Now()
+			_, err := ctlExec.execute(ctx, vol, []string{"--listtargets"})
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Fatalf("expected execute to return after its timeout, returned after %s", elapsed)
+			}
+			if !errors.As(err, &ctlTimeoutError{}) {
+				t.Fatalf("expected ctlTimeoutError, got %v", err)
+			}
+			if code := grpcCode(newGrpcErrorFromCause(codes.Internal, err)); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v", tc.wantCode, code)
+			}
+		})
+	}
+}
+
+// TestClassifyCtlFailure uses illustrative stderr strings. They are not captured from beegfs-ctl.
+// TestClassifyCtlFailureCaptured checks captured output.
+func TestClassifyCtlFailure(t *testing.T) {
+	tests := map[string]struct {
+		stdErr    string
+		wantClass ctlFailureClass
+		wantOK    bool
+	}{
+		"communication error": {
+			stdErr:    "Communication error: Unable to connect to management node mgmtd [ID: 1]\n",
+			wantClass: ctlFailureUnreachable,
+			wantOK:    true,
+		},
+		"connection refused": {
+			stdErr:    "Connect failed: Connection refused\n",
+			wantClass: ctlFailureUnreachable,
+			wantOK:    true,
+		},
+		"management node unreachable": {
+			stdErr:    "Management node is unreachable: 10.10.10.1\n",
+			wantClass: ctlFailureUnreachable,
+			wantOK:    true,
+		},
+		"auth failure": {
+			stdErr:    "Peer authentication failed. Check the connAuthFile.\n",
+			wantClass: ctlFailureAuth,
+			wantOK:    true,
+		},
+		"permission denied": {
+			stdErr:    "Operation failed: Permission denied\n",
+			wantClass: ctlFailurePermission,
+			wantOK:    true,
+		},
+		"target offline": {
+			stdErr:    "Unable to create directory: Storage target 101 is offline\n",
+			wantClass: ctlFailureTargetOffline,
+			wantOK:    true,
+		},
+		"target unreachable": {
+			stdErr:    "Unable to create directory: targets 101,102 are unreachable\n",
+			wantClass: ctlFailureTargetOffline,
+			wantOK:    true,
+		},
+		"unknown": {
+			stdErr: "Invalid chunksize\n",
+		},
+		"unknown mentioning authentication": {
+			stdErr: "Invalid authentication file path\n",
+		},
+		"unknown mentioning connAuthFile": {
+			stdErr: "Unable to read connAuthFile: No such file or directory\n",
+		},
+		"unknown mentioning communication": {
+			stdErr: "Communication with node succeeded, but chunksize is invalid\n",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			class, ok := classifyCtlFailure(tc.stdErr)
+			if ok != tc.wantOK {
+				t.Fatalf("expected ok %t, got %t", tc.wantOK, ok)
+			}
+			if ok && class != tc.wantClass {
+				t.Fatalf("expected class %v, got %v", tc.wantClass, class)
+			}
+		})
+	}
+}
+
+// TestClassifyCtlFailureCaptured classifies the files in testdata/ctlfailures. Each file is the stderr of a failed
+// beegfs-ctl command captured by hack/capture-ctl-failures.sh and must be classified as the class its directory is
+// named after.
+func TestClassifyCtlFailureCaptured(t *testing.T) {
+	classes := map[string]ctlFailureClass{ // by directory in testdata/ctlfailures
+		"unreachable":    ctlFailureUnreachable,
+		"auth":           ctlFailureAuth,
+		"permission":     ctlFailurePermission,
+		"target-offline": ctlFailureTargetOffline,
+	}
+	captures, err := filepath.Glob(path.Join("testdata", "ctlfailures", "*", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) == 0 {
+		t.Skip("no beegfs-ctl output captured in testdata/ctlfailures; run hack/capture-ctl-failures.sh")
+	}
+	for _, capture := range captures {
+		dirName := path.Base(path.Dir(capture))
+		t.Run(path.Join(dirName, path.Base(capture)), func(t *testing.T) {
+			wantClass, ok := classes[dirName]
+			if !ok {
+				t.Fatalf("unknown class directory %s", dirName)
+			}
+			stdErr, err := ioutil.ReadFile(capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			class, ok := classifyCtlFailure(string(stdErr))
+			if !ok {
+				t.Fatalf("expected class %v, got no class for stdErr: %s", wantClass, stdErr)
+			}
+			if class != wantClass {
+				t.Fatalf("expected class %v, got %v for stdErr: %s", wantClass, class, stdErr)
+			}
+		})
+	}
+}
+
+func TestExecuteRetry(t *testing.T) {
+	defaultMaxRetries, defaultInitialBackoff := ctlMaxRetries, ctlRetryInitialBackoff
+	ctlMaxRetries, ctlRetryInitialBackoff = 2, time.Millisecond
+	defer func() { ctlMaxRetries, ctlRetryInitialBackoff = defaultMaxRetries, defaultInitialBackoff }()
+	countDir, err := ioutil.TempDir("", "beegfs-ctl-count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(countDir) }()
+
+	// Each fake beegfs-ctl records every run in a count file and fails with stdErr for its first failures runs.
+	tests := map[string]struct {
+		stdErr   string
+		failures int
+		wantRuns int
+		wantCode codes.Code // 0 (OK) if execute should succeed
+	}{
+		"transient failure recovers": {
+			stdErr:   "Communication error: Unable to connect to management node\n",
+			failures: 2,
+			wantRuns: 3,
+		},
+		"transient failure persists": {
+			stdErr:   "Communication error: Unable to connect to management node\n",
+			failures: 5,
+			wantRuns: 3,
+			wantCode: codes.Unavailable,
+		},
+		"target offline persists": {
+			stdErr:   "Storage target 101 is offline\n",
+			failures: 5,
+			wantRuns: 3,
+			wantCode: codes.FailedPrecondition,
+		},
+		"auth failure is not retried": {
+			stdErr:   "Peer authentication failed\n",
+			failures: 5,
+			wantRuns: 1,
+			wantCode: codes.PermissionDenied,
+		},
+		"permission denied is not retried": {
+			stdErr:   "Permission denied\n",
+			failures: 5,
+			wantRuns: 1,
+			wantCode: codes.PermissionDenied,
+		},
+		"unknown failure is not retried": {
+			stdErr:   "Invalid chunksize\n",
+			failures: 5,
+			wantRuns: 1,
+			wantCode: codes.Internal,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			countPath := path.Join(countDir, name)
+			script := fmt.Sprintf("echo run >> '%s'\nif [ $(wc -l < '%s') -le %d ]; then printf '%s' >&2; exit 1; fi\n",
+				countPath, countPath, tc.failures, tc.stdErr)
+			defer useFakeBeegfsCtl(t, script)()
+
+			_, err := (&beegfsCtlExecutor{}).execute(context.Background(), beegfsVolume{}, []string{"--listtargets"})
+			if code := grpcCode(newGrpcErrorFromCause(codes.Internal, err)); err != nil && code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v: %v", tc.wantCode, code, err)
+			} else if err == nil && tc.wantCode != codes.OK {
+				t.Fatalf("expected code %v, got success", tc.wantCode)
+			}
+			runs, err := ioutil.ReadFile(countPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotRuns := strings.Count(string(runs), "run"); gotRuns != tc.wantRuns {
+				t.Fatalf("expected %d runs, got %d", tc.wantRuns, gotRuns)
+			}
+		})
+	}
+}
@@ -0,0 +1,530 @@
+/*
+Copyright 2021 NetApp, Inc. All Rights Reserved.
+Licensed under the Apache License, Version 2.0.
+*/
+
+package beegfs
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/netapp/beegfs-csi-driver/pkg/beegfsproto"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"gopkg.in/ini.v1"
+)
+
+// defaultConnMgmtdPortTCP is the TCP port of the BeeGFS management service if beegfs-client.conf does not set one.
+const defaultConnMgmtdPortTCP = 8008
+
+// beegfsNativeExecutor is an experimental implementation of beegfsCtlExecutorInterface that sends requests directly to
+// the BeeGFS management and metadata services (see package beegfsproto) instead of running beegfs-ctl. The protocol
+// implementation has only been tested against beegfsproto.FakeServer. It is selected with --beegfs-native-client.
+//
+// beegfsNativeExecutor returns the same errors beegfsCtlExecutor does when an operation fails for the same reason (see
+// nativeError) and retries and times out operations the same way.
+type beegfsNativeExecutor struct {
+	timeout time.Duration // the default for file systems without a BeegfsCtlTimeout (0 means no timeout)
+}
+
+// nativeError is the error of a failed beegfsNativeExecutor operation. errors.As finds its equivalent, the error
+// beegfsCtlExecutor returns when beegfs-ctl fails for the same reason (e.g. a ctlNotExistError), so callers handle the
+// errors of both executors the same way.
+type nativeError struct {
+	op         string // e.g. "stat /k8s/pvc-1"
+	err        error
+	equivalent error // nil if there is no equivalent
+}
+
+func (err nativeError) Error() string {
+	return fmt.Sprintf("BeeGFS request to %s failed: %v", err.op, err.err)
+}
+
+func (err nativeError) Unwrap() error { return err.err }
+
+func (err nativeError) As(target interface{}) bool {
+	return err.equivalent != nil && errors.As(err.equivalent, target)
+}
+
+// newNativeError returns a nativeError for err, the error of op. opCtx is the context op ran with. It is derived from
+// ctx, but also ends after the operation's timeout.
+func newNativeError(ctx, opCtx context.Context, op string, err error, timeout time.Duration) error {
+	var equivalent error
+	var commErr *beegfsproto.CommError
+	var opsErr beegfsproto.OpsErr
+	if opCtx.Err() != nil {
+		equivalent = ctlTimeoutError{args: []string{op}, timeout: timeout, ctxErr: ctx.Err()}
+	} else if errors.As(err, &commErr) {
+		equivalent = ctlFailureError{class: ctlFailureUnreachable, stdErrString: err.Error()}
+	} else if errors.As(err, &opsErr) {
+		switch opsErr {
+		case beegfsproto.OpsErrPathNotExists:
+			equivalent = newCtlNotExistError("", err.Error())
+		case beegfsproto.OpsErrExists:
+			equivalent = newCtlExistError("", err.Error())
+		case beegfsproto.OpsErrCommunication:
+			equivalent = ctlFailureError{class: ctlFailureUnreachable, stdErrString: err.Error()}
+		case beegfsproto.OpsErrPerm:
+			equivalent = ctlFailureError{class: ctlFailurePermission, stdErrString: err.Error()}
+		case beegfsproto.OpsErrUnknownTarget:
+			equivalent = ctlFailureError{class: ctlFailureTargetOffline, stdErrString: err.Error()}
+		}
+	}
+	return errors.WithStack(nativeError{op: op, err: err, equivalent: equivalent})
+}
+
+// newNativeClient returns a beegfsproto.Client for vol's file system that uses the management service port and the
+// connAuthFile configured in vol's beegfs-client.conf.
+func newNativeClient(vol beegfsVolume) (*beegfsproto.Client, error) {
+	clientConfBytes, err := fsutil.ReadFile(vol.clientConfPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error loading beegfs-client.conf file at %s", vol.clientConfPath)
+	}
+	clientConfINI, err := ini.Load(clientConfBytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing beegfs-client.conf file at %s", vol.clientConfPath)
+	}
+	section := clientConfINI.Section("")
+
+	port := uint16(defaultConnMgmtdPortTCP)
+	if value := section.Key("connMgmtdPortTCP").String(); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid connMgmtdPortTCP in %s", vol.clientConfPath)
+		}
+		port = uint16(parsed)
+	}
+	var connAuth []byte
+	connAuthFilePath := section.Key("connAuthFile").String()
+	if connAuthFilePath != "" && !section.Key("connDisableAuthentication").MustBool(false) {
+		if connAuth, err = fsutil.ReadFile(connAuthFilePath); err != nil {
+			return nil, errors.Wrapf(err, "error loading connAuthFile at %s", connAuthFilePath)
+		}
+	}
+	return beegfsproto.NewClient(vol.sysMgmtdHost, port, connAuth), nil
+}
+
+// run calls do with a beegfsproto.Client for vol's file system. do's context ends after the BeegfsCtlTimeout configured
+// for vol's file system (or the executor's default timeout). run retries do like beegfsCtlExecutor.execute retries
+// beegfs-ctl and returns a nativeError if do fails. op describes the operation in logs and errors.
+func (nativeExec *beegfsNativeExecutor) run(ctx context.Context, vol beegfsVolume, op string,
+	do func(ctx context.Context, client *beegfsproto.Client) error) error {
+	client, err := newNativeClient(vol)
+	if err != nil {
+		return err
+	}
+	timeout := nativeExec.timeout
+	if vol.config.BeegfsCtlTimeout != 0 {
+		timeout = vol.config.BeegfsCtlTimeout
+	}
+	return retryTransientCtlFailures(ctx, func() error {
+		LogDebug(ctx, "Sending BeeGFS requests", "operation", op, "sysMgmtdHost", vol.sysMgmtdHost)
+		opCtx := ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			opCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if err := do(opCtx, client); err != nil {
+			return newNativeError(ctx, opCtx, op, err, timeout)
+		}
+		return nil
+	})
+}
+
+// createDirectoryForVolume creates the directory specified by vol.volDirPathBeegfsRoot (and any missing parent
+// directories) like beegfsCtlExecutor.createDirectoryForVolume does. It does not return an error if the directory
+// already exists.
+func (nativeExec *beegfsNativeExecutor) createDirectoryForVolume(ctx context.Context, vol beegfsVolume,
+	permCfg permissionsConfig, patternCfg stripePatternConfig) error {
+	LogDebug(ctx, "Creating BeeGFS directory", "volDirPathBeegfsRoot", vol.volDirPathBeegfsRoot, "volumeID", vol.volumeID)
+	_, err := nativeExec.statDirectoryForVolume(ctx, vol)
+	if errors.As(err, &ctlNotExistError{}) {
+		LogDebug(ctx, "BeeGFS directory does not exist", "volDirPathBeegfsRoot", vol.volDirPathBeegfsRoot, "volumeID", vol.volumeID)
+		for _, dir := range dirsToMakeForVolume(vol) {
+			err := nativeExec.run(ctx, vol, "create "+dir, func(ctx context.Context, client *beegfsproto.Client) error {
+				parent, err := client.FindOwner(ctx, path.Dir(dir))
+				if err != nil {
+					return err
+				}
+				_, err = client.MkDir(ctx, &beegfsproto.MkDirMsg{
+					Parent:   parent,
+					Name:     path.Base(dir),
+					UserID:   permCfg.uid,
+					GroupID:  permCfg.gid,
+					Mode:     uint32(permCfg.mode & 0o777), // Special permissions are ignored like beegfs-ctl does.
+					NoMirror: patternCfg.metadataMirroring == "false",
+				})
+				return err
+			})
+			if err != nil && !errors.As(err, &ctlExistError{}) {
+				return errors.WithMessagef(err, "cannot create BeeGFS directory %s for %s", dir, vol.volumeID)
+			}
+		}
+	} else if err != nil {
+		return err
+	} else {
+		LogDebug(ctx, "BeeGFS directory already exists", "volDirPathBeegfsRoot", vol.volDirPathBeegfsRoot, "volumeID", vol.volumeID)
+	}
+	return nil
+}
+
+// statDirectoryForVolume returns the same information "beegfs-ctl --getentryinfo" outputs for the volume's directory,
+// or an empty entryInfo and an error if the stat fails.
+func (nativeExec *beegfsNativeExecutor) statDirectoryForVolume(ctx context.Context, vol beegfsVolume) (entryInfo,
+	error) {
+	var info entryInfo
+	err := nativeExec.run(ctx, vol, "stat "+vol.volDirPathBeegfsRoot,
+		func(ctx context.Context, client *beegfsproto.Client) error {
+			entry, err := client.FindOwner(ctx, vol.volDirPathBeegfsRoot)
+			if err != nil {
+				return err
+			}
+			pattern, err := client.GetEntryInfo(ctx, entry)
+			if err != nil {
+				return err
+			}
+			node, err := client.MetaNode(ctx, entry)
+			if err != nil {
+				return err
+			}
+			pools, err := client.GetStoragePools(ctx)
+			if err != nil {
+				return err
+			}
+			info = newEntryInfo(entry, pattern, node, pools)
+			return nil
+		})
+	return info, err
+}
+
+// newEntryInfo converts the information the BeeGFS services report about an entry to an entryInfo.
+func newEntryInfo(entry beegfsproto.EntryInfo, pattern beegfsproto.StripePattern, node beegfsproto.Node,
+	pools []beegfsproto.StoragePool) entryInfo {
+	info := entryInfo{
+		entryID:        entry.EntryID,
+		metadataNode:   node.ID,
+		metadataNodeID: strconv.FormatUint(uint64(node.NumID), 10),
+		chunkSize:      formatChunkSize(pattern.ChunkSize),
+		numTargets:     uint64(pattern.DefaultNumTargets),
+		storagePoolID:  strconv.FormatUint(uint64(pattern.StoragePoolID), 10),
+	}
+	switch entry.Type {
+	case beegfsproto.EntryTypeDirectory:
+		info.entryType = "directory"
+	case beegfsproto.EntryTypeRegularFile:
+		info.entryType = "file"
+	default:
+		info.entryType = "unknown"
+	}
+	if entry.BuddyMirrored {
+		info.metadataBuddyGroup = strconv.FormatUint(uint64(entry.OwnerID), 10)
+	}
+	switch pattern.Type {
+	case beegfsproto.PatternTypeRAID0:
+		info.stripePatternType = stripePatternTypeRAID0
+	case beegfsproto.PatternTypeBuddyMirror:
+		info.stripePatternType = stripePatternTypeBuddyMirror
+	default:
+		info.stripePatternType = "unknown"
+	}
+	for _, pool := range pools {
+		if pool.ID == pattern.StoragePoolID {
+			info.storagePoolName = pool.Description
+		}
+	}
+	return info
+}
+
+// formatChunkSize formats a chunk size in bytes like beegfs-ctl does (e.g. 512K or 1M).
+func formatChunkSize(bytes uint32) string {
+	if bytes != 0 && bytes%(1<<20) == 0 {
+		return fmt.Sprintf("%dM", bytes>>20)
+	} else if bytes != 0 && bytes%(1<<10) == 0 {
+		return fmt.Sprintf("%dK", bytes>>10)
+	}
+	return strconv.FormatUint(uint64(bytes), 10)
+}
+
+// setPatternForVolume sets the pattern for the directory specified by vol.volDirPathBeegfsRoot like
+// beegfsCtlExecutor.setPatternForVolume does. Settings cfg does not specify keep their current values.
+// setPatternForVolume has no effect and does not return an error if cfg is empty.
+func (nativeExec *beegfsNativeExecutor) setPatternForVolume(ctx context.Context, vol beegfsVolume,
+	cfg stripePatternConfig) error {
+	if cfg.stripePatternType == "" && cfg.stripePatternNumTargets == "" && cfg.stripePatternChunkSize == "" &&
+		cfg.storagePoolID == "" {
+		return nil
+	}
+	err := nativeExec.run(ctx, vol, "set pattern of "+vol.volDirPathBeegfsRoot,
+		func(ctx context.Context, client *beegfsproto.Client) error {
+			entry, err := client.FindOwner(ctx, vol.volDirPathBeegfsRoot)
+			if err != nil {
+				return err
+			}
+			pattern, err := client.GetEntryInfo(ctx, entry)
+			if err != nil {
+				return err
+			}
+			if err = applyStripePatternConfig(&pattern, cfg); err != nil {
+				return err
+			}
+			return client.SetDirPattern(ctx, entry, pattern)
+		})
+	if err != nil {
+		return errors.WithMessagef(err, "cannot set pattern for BeeGFS directory %s for volume %s", vol.volDirPathBeegfsRoot, vol.sysMgmtdHost)
+	}
+	return nil
+}
+
+// applyStripePatternConfig overrides the settings of pattern cfg specifies.
+func applyStripePatternConfig(pattern *beegfsproto.StripePattern, cfg stripePatternConfig) error {
+	switch cfg.stripePatternType {
+	case "":
+	case stripePatternTypeRAID0:
+		pattern.Type = beegfsproto.PatternTypeRAID0
+	case stripePatternTypeBuddyMirror:
+		pattern.Type = beegfsproto.PatternTypeBuddyMirror
+	default:
+		return errors.Errorf("unsupported stripe pattern type %s", cfg.stripePatternType)
+	}
+	if cfg.stripePatternNumTargets != "" {
+		numTargets, err := strconv.ParseUint(cfg.stripePatternNumTargets, 10, 32)
+		if err != nil {
+			return errors.Wrapf(err, "could not parse number of targets %s", cfg.stripePatternNumTargets)
+		}
+		pattern.DefaultNumTargets = uint32(numTargets)
+	}
+	if cfg.stripePatternChunkSize != "" {
+		chunkSize, err := parseChunkSize(cfg.stripePatternChunkSize)
+		if err != nil {
+			return err
+		}
+		if chunkSize > 1<<32-1 {
+			return errors.Errorf("chunk size %s too large", cfg.stripePatternChunkSize)
+		}
+		pattern.ChunkSize = uint32(chunkSize)
+	}
+	if cfg.storagePoolID != "" {
+		storagePoolID, err := strconv.ParseUint(cfg.storagePoolID, 10, 16)
+		if err != nil {
+			return errors.Wrapf(err, "could not parse storage pool ID %s", cfg.storagePoolID)
+		}
+		pattern.StoragePoolID = uint16(storagePoolID)
+	}
+	pattern.TargetIDs = nil // A directory has no targets of its own.
+	return nil
+}
+
+// nativeQuotaIDType converts a quotaIDType to a beegfsproto.QuotaIDType.
+func nativeQuotaIDType(idType quotaIDType) (beegfsproto.QuotaIDType, error) {
+	switch idType {
+	case quotaIDTypeUID:
+		return beegfsproto.QuotaIDTypeUser, nil
+	case quotaIDTypeGID:
+		return beegfsproto.QuotaIDTypeGroup, nil
+	}
+	return 0, errors.Errorf("unsupported quota ID type %s", idType)
+}
+
+// parseStoragePoolID parses a storage pool ID or returns the ID of the default storage pool if storagePoolID is empty.
+func parseStoragePoolID(storagePoolID string) (uint16, error) {
+	if storagePoolID == "" {
+		storagePoolID = defaultStoragePoolID
+	}
+	id, err := strconv.ParseUint(storagePoolID, 10, 16)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not parse storage pool ID %s", storagePoolID)
+	}
+	return uint16(id), nil
+}
+
+// getQuotasForVolume gets the quota usage and limits of one or more users or groups in the storage pool identified by
+// storagePoolID (or the default storage pool if storagePoolID is empty) like beegfsCtlExecutor.getQuotasForVolume
+// does. It returns one quotaInfo for each requested ID.
+func (nativeExec *beegfsNativeExecutor) getQuotasForVolume(ctx context.Context, vol beegfsVolume,
+	storagePoolID string, idType quotaIDType, ids []uint32) ([]quotaInfo, error) {
+	poolID, err := parseStoragePoolID(storagePoolID)
+	if err != nil {
+		return nil, err
+	}
+	nativeIDType, err := nativeQuotaIDType(idType)
+	if err != nil {
+		return nil, err
+	}
+	var quotas []beegfsproto.QuotaInfo
+	err = nativeExec.run(ctx, vol, fmt.Sprintf("get quota for %s %v", idType, ids),
+		func(ctx context.Context, client *beegfsproto.Client) error {
+			quotas, err = client.GetQuotaInfo(ctx, nativeIDType, ids, poolID)
+			return err
+		})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot get quota for %s %v for volume %s", idType, ids, vol.volumeID)
+	}
+	if len(quotas) != len(ids) {
+		return nil, errors.Errorf("expected quota for %d %ss in storage pool %d but got %d for volume %s", len(ids),
+			idType, poolID, len(quotas), vol.volumeID)
+	}
+	var infos []quotaInfo
+	for _, quota := range quotas {
+		infos = append(infos, quotaInfo{
+			idType:        idType,
+			id:            quota.ID,
+			storagePoolID: strconv.FormatUint(uint64(poolID), 10),
+			sizeUsed:      quota.SizeUsed,
+			sizeLimit:     quota.SizeLimit,
+			inodesUsed:    quota.InodesUsed,
+			inodesLimit:   quota.InodesLimit,
+		})
+	}
+	return infos, nil
+}
+
+// setQuotaLimitForVolume sets the size limit of a user or group in the storage pool identified by storagePoolID (or
+// the default storage pool if storagePoolID is empty) like beegfsCtlExecutor.setQuotaLimitForVolume does. A sizeLimit
+// of 0 removes any existing size limit. The inode limit is always removed.
+func (nativeExec *beegfsNativeExecutor) setQuotaLimitForVolume(ctx context.Context, vol beegfsVolume,
+	storagePoolID string, idType quotaIDType, id uint32, sizeLimit uint64) error {
+	poolID, err := parseStoragePoolID(storagePoolID)
+	if err != nil {
+		return err
+	}
+	nativeIDType, err := nativeQuotaIDType(idType)
+	if err != nil {
+		return err
+	}
+	err = nativeExec.run(ctx, vol, fmt.Sprintf("set quota limit for %s %d", idType, id),
+		func(ctx context.Context, client *beegfsproto.Client) error {
+			return client.SetQuota(ctx, &beegfsproto.SetQuotaMsg{IDType: nativeIDType, ID: id, StoragePoolID: poolID,
+				SizeLimit: sizeLimit})
+		})
+	if err != nil {
+		return errors.WithMessagef(err, "cannot set quota limit for %s %d for volume %s", idType, id, vol.volumeID)
+	}
+	return nil
+}
+
+// nativeReachability and nativeConsistency map target states to the strings beegfs-ctl outputs for them.
+var (
+	nativeReachability = map[beegfsproto.Reachability]string{
+		beegfsproto.ReachabilityOnline:          "Online",
+		beegfsproto.ReachabilityProbablyOffline: "Probably-offline",
+		beegfsproto.ReachabilityOffline:         "Offline",
+	}
+	nativeConsistency = map[beegfsproto.Consistency]string{
+		beegfsproto.ConsistencyGood:        "Good",
+		beegfsproto.ConsistencyNeedsResync: "Needs-resync",
+		beegfsproto.ConsistencyBad:         "Bad",
+	}
+)
+
+// listStorageTargets lists the state and free space of all storage targets on the BeeGFS file system specified by
+// vol.sysMgmtdHost.
+func (nativeExec *beegfsNativeExecutor) listStorageTargets(ctx context.Context, vol beegfsVolume) ([]storageTarget,
+	error) {
+	var infos []beegfsproto.TargetInfo
+	err := nativeExec.run(ctx, vol, "list storage targets", func(ctx context.Context, client *beegfsproto.Client) error {
+		var err error
+		infos, err = client.GetStorageTargetInfo(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot list storage targets for %s", vol.sysMgmtdHost)
+	}
+	// nonNegative converts a size BeeGFS reports as a signed value (negative if unknown) to a uint64.
+	nonNegative := func(size int64) uint64 {
+		if size < 0 {
+			return 0
+		}
+		return uint64(size)
+	}
+	var targets []storageTarget
+	for _, info := range infos {
+		target := storageTarget{
+			id:           strconv.FormatUint(uint64(info.TargetID), 10),
+			reachability: nativeReachability[info.Reachability],
+			consistency:  nativeConsistency[info.Consistency],
+			totalBytes:   nonNegative(info.TotalBytes),
+			freeBytes:    nonNegative(info.FreeBytes),
+			totalInodes:  nonNegative(info.TotalInodes),
+			freeInodes:   nonNegative(info.FreeInodes),
+		}
+		if target.reachability == "" {
+			target.reachability = "Unknown"
+		}
+		if target.consistency == "" {
+			target.consistency = "Unknown"
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// formatIDs converts IDs to strings.
+func formatIDs(ids []uint16) []string {
+	var formatted []string
+	for _, id := range ids {
+		formatted = append(formatted, strconv.FormatUint(uint64(id), 10))
+	}
+	return formatted
+}
+
+// listStoragePools lists all storage pools on the BeeGFS file system specified by vol.sysMgmtdHost.
+func (nativeExec *beegfsNativeExecutor) listStoragePools(ctx context.Context, vol beegfsVolume) ([]storagePool,
+	error) {
+	var nativePools []beegfsproto.StoragePool
+	err := nativeExec.run(ctx, vol, "list storage pools", func(ctx context.Context, client *beegfsproto.Client) error {
+		var err error
+		nativePools, err = client.GetStoragePools(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot list storage pools for %s", vol.sysMgmtdHost)
+	}
+	var pools []storagePool
+	for _, pool := range nativePools {
+		pools = append(pools, storagePool{
+			id:          strconv.FormatUint(uint64(pool.ID), 10),
+			description: pool.Description,
+			targets:     formatIDs(pool.TargetIDs),
+			buddyGroups: formatIDs(pool.BuddyGroups),
+		})
+	}
+	return pools, nil
+}
+
+// listMirrorGroups lists all buddy mirror groups of nodeType (nodeTypeMeta or nodeTypeStorage) on the BeeGFS file
+// system specified by vol.sysMgmtdHost.
+func (nativeExec *beegfsNativeExecutor) listMirrorGroups(ctx context.Context, vol beegfsVolume,
+	nodeType string) ([]mirrorGroup, error) {
+	var nativeNodeType beegfsproto.NodeType
+	switch nodeType {
+	case nodeTypeMeta:
+		nativeNodeType = beegfsproto.NodeTypeMeta
+	case nodeTypeStorage:
+		nativeNodeType = beegfsproto.NodeTypeStorage
+	default:
+		return nil, errors.Errorf("unsupported node type %s", nodeType)
+	}
+	var nativeGroups []beegfsproto.BuddyGroup
+	err := nativeExec.run(ctx, vol, "list "+nodeType+" mirror groups",
+		func(ctx context.Context, client *beegfsproto.Client) error {
+			var err error
+			nativeGroups, err = client.GetMirrorBuddyGroups(ctx, nativeNodeType)
+			return err
+		})
+	if err != nil {
+		return nil, errors.WithMessagef(err, "cannot list %s mirror groups for %s", nodeType, vol.sysMgmtdHost)
+	}
+	var groups []mirrorGroup
+	for _, group := range nativeGroups {
+		groups = append(groups, mirrorGroup{
+			id:        strconv.FormatUint(uint64(group.ID), 10),
+			primary:   strconv.FormatUint(uint64(group.PrimaryID), 10),
+			secondary: strconv.FormatUint(uint64(group.SecondaryID), 10),
+		})
+	}
+	return groups, nil
+}
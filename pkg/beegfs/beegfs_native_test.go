@@ -0,0 +1,336 @@
+/*
+Copyright 2021 NetApp, Inc. All Rights Reserved.
+Licensed under the Apache License, Version 2.0.
+*/
+
+package beegfs
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/netapp/beegfs-csi-driver/pkg/beegfsproto"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+)
+
+// newNativeTestVolume sets up a memory-mapped file system with a beegfs-client.conf for a file system whose management
+// service listens on port of 127.0.0.1 and returns a beegfsVolume for /k8s/pvc-1 on it. connAuth is written to a
+// connAuthFile if it is not nil.
+func newNativeTestVolume(t *testing.T, port uint16, connAuth []byte) beegfsVolume {
+	fs = afero.NewMemMapFs() // test sets up its own, new, memory-mapped file system
+	fsutil = afero.Afero{Fs: fs}
+	vol := newBeegfsVolume("/mountDir", "127.0.0.1", "/k8s/pvc-1", PluginConfig{})
+	clientConf := fmt.Sprintf("connMgmtdPortTCP = %d\n", port)
+	if connAuth != nil {
+		clientConf += "connAuthFile = /mountDir/connAuthFile\n"
+		if err := fsutil.WriteFile("/mountDir/connAuthFile", connAuth, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsutil.WriteFile(vol.clientConfPath, []byte(clientConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return vol
+}
+
+// newNativeTestServer starts a beegfsproto.FakeServer for a test and returns it with a beegfsVolume on it.
+func newNativeTestServer(t *testing.T) (*beegfsproto.FakeServer, beegfsVolume) {
+	server, err := beegfsproto.NewFakeServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	return server, newNativeTestVolume(t, server.Port(), nil)
+}
+
+func TestNativeDirectoryForVolume(t *testing.T) {
+	server, vol := newNativeTestServer(t)
+	nativeExec := &beegfsNativeExecutor{}
+	ctx := context.Background()
+
+	_, err := nativeExec.statDirectoryForVolume(ctx, vol)
+	if !errors.As(err, &ctlNotExistError{}) {
+		t.Fatalf("expected ctlNotExistError, got %v", err)
+	}
+	permCfg := permissionsConfig{uid: 1000, gid: 2000, mode: 0o2750}
+	if err = nativeExec.createDirectoryForVolume(ctx, vol, permCfg, stripePatternConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"/k8s", "/k8s/pvc-1"} {
+		entry, ok := server.Entry(dir)
+		if !ok {
+			t.Fatalf("expected %s to exist", dir)
+		}
+		if entry.UserID != 1000 || entry.GroupID != 2000 || entry.Mode != 0o750 {
+			t.Fatalf("expected owner 1000:2000 and mode 750 for %s, got %d:%d and %o", dir, entry.UserID,
+				entry.GroupID, entry.Mode)
+		}
+	}
+	// Creating the directory again has no effect.
+	if err = nativeExec.createDirectoryForVolume(ctx, vol, permCfg, stripePatternConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if count := server.RequestCount(beegfsproto.MsgTypeMkDir); count != 2 {
+		t.Fatalf("expected 2 MkDir requests, got %d", count)
+	}
+
+	patternCfg := stripePatternConfig{stripePatternChunkSize: "1m", stripePatternNumTargets: "2"}
+	if err = nativeExec.setPatternForVolume(ctx, vol, patternCfg); err != nil {
+		t.Fatal(err)
+	}
+	info, err := nativeExec.statDirectoryForVolume(ctx, vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := server.Entry("/k8s/pvc-1")
+	want := entryInfo{
+		entryType:         "directory",
+		entryID:           entry.Info.EntryID,
+		metadataNode:      "meta01",
+		metadataNodeID:    "1",
+		stripePatternType: stripePatternTypeRAID0,
+		chunkSize:         "1M",
+		numTargets:        2,
+		storagePoolID:     "1",
+		storagePoolName:   "Default",
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Fatalf("expected %+v, got %+v", want, info)
+	}
+
+	if err = nativeExec.setPatternForVolume(ctx, vol, stripePatternConfig{storagePoolID: "2"}); err == nil {
+		t.Fatal("expected error for unknown storage pool")
+	}
+}
+
+func TestNativeMetadataMirroring(t *testing.T) {
+	server, vol := newNativeTestServer(t)
+	nativeExec := &beegfsNativeExecutor{}
+	ctx := context.Background()
+	server.SetMirrorBuddyGroups(beegfsproto.NodeTypeMeta, []beegfsproto.BuddyGroup{{ID: 7, PrimaryID: 1,
+		SecondaryID: 1}})
+	server.SetRootMetadataMirrored(7)
+
+	if err := nativeExec.createDirectoryForVolume(ctx, vol, permissionsConfig{mode: 0o777},
+		stripePatternConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := nativeExec.statDirectoryForVolume(ctx, vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.isMetadataMirrored() || info.metadataBuddyGroup != "7" || info.metadataNode != "meta01" {
+		t.Fatalf("expected metadata buddy group 7 with primary meta01, got %+v", info)
+	}
+
+	vol = newBeegfsVolume("/mountDir", "127.0.0.1", "/unmirrored", PluginConfig{})
+	if err = nativeExec.createDirectoryForVolume(ctx, vol, permissionsConfig{mode: 0o777},
+		stripePatternConfig{metadataMirroring: "false"}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = nativeExec.statDirectoryForVolume(ctx, vol); err != nil || info.isMetadataMirrored() {
+		t.Fatalf("expected directory without metadata mirroring, got %+v (error %v)", info, err)
+	}
+}
+
+func TestNativeManagement(t *testing.T) {
+	server, vol := newNativeTestServer(t)
+	nativeExec := &beegfsNativeExecutor{}
+	ctx := context.Background()
+	server.SetStorageTargets([]beegfsproto.TargetInfo{
+		{TargetID: 101, NodeID: 1, TotalBytes: 1 << 40, FreeBytes: 1 << 39, TotalInodes: 100, FreeInodes: -1},
+		{TargetID: 102, NodeID: 2, Reachability: beegfsproto.ReachabilityProbablyOffline,
+			Consistency: beegfsproto.ConsistencyNeedsResync},
+	})
+	server.SetStoragePools([]beegfsproto.StoragePool{
+		{ID: 1, Description: "Default", TargetIDs: []uint16{101}},
+		{ID: 2, Description: "mirrored", TargetIDs: []uint16{102}, BuddyGroups: []uint16{1}},
+	})
+	server.SetMirrorBuddyGroups(beegfsproto.NodeTypeStorage, []beegfsproto.BuddyGroup{{ID: 1, PrimaryID: 101,
+		SecondaryID: 102}})
+
+	targets, err := nativeExec.listStorageTargets(ctx, vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTargets := []storageTarget{
+		{id: "101", reachability: "Online", consistency: "Good", totalBytes: 1 << 40, freeBytes: 1 << 39,
+			totalInodes: 100},
+		{id: "102", reachability: "Probably-offline", consistency: "Needs-resync"},
+	}
+	if !reflect.DeepEqual(targets, wantTargets) {
+		t.Fatalf("expected targets %+v, got %+v", wantTargets, targets)
+	}
+	pools, err := nativeExec.listStoragePools(ctx, vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPools := []storagePool{
+		{id: "1", description: "Default", targets: []string{"101"}},
+		{id: "2", description: "mirrored", targets: []string{"102"}, buddyGroups: []string{"1"}},
+	}
+	if !reflect.DeepEqual(pools, wantPools) {
+		t.Fatalf("expected pools %+v, got %+v", wantPools, pools)
+	}
+	groups, err := nativeExec.listMirrorGroups(ctx, vol, nodeTypeStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []mirrorGroup{{id: "1", primary: "101", secondary: "102"}}; !reflect.DeepEqual(groups, want) {
+		t.Fatalf("expected mirror groups %+v, got %+v", want, groups)
+	}
+	if groups, err = nativeExec.listMirrorGroups(ctx, vol, nodeTypeMeta); err != nil || len(groups) != 0 {
+		t.Fatalf("expected no metadata mirror groups, got %+v (error %v)", groups, err)
+	}
+}
+
+func TestNativeQuotas(t *testing.T) {
+	server, vol := newNativeTestServer(t)
+	nativeExec := &beegfsNativeExecutor{}
+	ctx := context.Background()
+	server.SetQuota(beegfsproto.QuotaIDTypeGroup, 1, beegfsproto.QuotaInfo{ID: 1000, SizeUsed: 4096, InodesUsed: 1})
+
+	if err := nativeExec.setQuotaLimitForVolume(ctx, vol, "", quotaIDTypeGID, 1000, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	quotas, err := nativeExec.getQuotasForVolume(ctx, vol, "", quotaIDTypeGID, []uint32{1000, 1001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []quotaInfo{
+		{idType: quotaIDTypeGID, id: 1000, storagePoolID: "1", sizeUsed: 4096, sizeLimit: 1 << 30, inodesUsed: 1},
+		{idType: quotaIDTypeGID, id: 1001, storagePoolID: "1"},
+	}
+	if !reflect.DeepEqual(quotas, want) {
+		t.Fatalf("expected quotas %+v, got %+v", want, quotas)
+	}
+	if quota := server.Quota(beegfsproto.QuotaIDTypeUser, 1, 1000); quota.SizeLimit != 0 {
+		t.Fatalf("expected no limit for user 1000, got %d", quota.SizeLimit)
+	}
+}
+
+func TestNativeErrors(t *testing.T) {
+	defaultMaxRetries, defaultInitialBackoff := ctlMaxRetries, ctlRetryInitialBackoff
+	ctlMaxRetries, ctlRetryInitialBackoff = 2, time.Millisecond
+	defer func() { ctlMaxRetries, ctlRetryInitialBackoff = defaultMaxRetries, defaultInitialBackoff }()
+
+	// The fake server fails every GetQuotaInfo request with result.
+	tests := map[string]struct {
+		result       beegfsproto.OpsErr
+		wantRequests int
+		wantCode     codes.Code
+	}{
+		"communication error is retried": {
+			result:       beegfsproto.OpsErrCommunication,
+			wantRequests: 3,
+			wantCode:     codes.Unavailable,
+		},
+		"unknown target is retried": {
+			result:       beegfsproto.OpsErrUnknownTarget,
+			wantRequests: 3,
+			wantCode:     codes.FailedPrecondition,
+		},
+		"permission denied is not retried": {
+			result:       beegfsproto.OpsErrPerm,
+			wantRequests: 1,
+			wantCode:     codes.PermissionDenied,
+		},
+		"internal error is not retried": {
+			result:       beegfsproto.OpsErrInternal,
+			wantRequests: 1,
+			wantCode:     codes.Internal,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, vol := newNativeTestServer(t)
+			server.FailRequests(beegfsproto.MsgTypeGetQuotaInfo, tc.result)
+			_, err := (&beegfsNativeExecutor{}).getQuotasForVolume(context.Background(), vol, "", quotaIDTypeUID,
+				[]uint32{1000})
+			if code := grpcCode(newGrpcErrorFromCause(codes.Internal, err)); code != tc.wantCode {
+				t.Fatalf("expected code %v, got %v: %v", tc.wantCode, code, err)
+			}
+			if count := server.RequestCount(beegfsproto.MsgTypeGetQuotaInfo); count != tc.wantRequests {
+				t.Fatalf("expected %d requests, got %d", tc.wantRequests, count)
+			}
+		})
+	}
+}
+
+func TestNativeUnreachable(t *testing.T) {
+	defaultMaxRetries, defaultInitialBackoff := ctlMaxRetries, ctlRetryInitialBackoff
+	ctlMaxRetries, ctlRetryInitialBackoff = 2, time.Millisecond
+	defer func() { ctlMaxRetries, ctlRetryInitialBackoff = defaultMaxRetries, defaultInitialBackoff }()
+	server, vol := newNativeTestServer(t)
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := (&beegfsNativeExecutor{}).listStorageTargets(context.Background(), vol)
+	var failureErr ctlFailureError
+	if !errors.As(err, &failureErr) || failureErr.class != ctlFailureUnreachable {
+		t.Fatalf("expected unreachable ctlFailureError, got %v", err)
+	}
+}
+
+func TestNativeTimeout(t *testing.T) {
+	// This listener accepts connections but never responds.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	vol := newNativeTestVolume(t, uint16(listener.Addr().(*net.TCPAddr).Port), nil)
+
+	_, err = (&beegfsNativeExecutor{timeout: 50 * time.Millisecond}).listStoragePools(context.Background(), vol)
+	if !errors.As(err, &ctlTimeoutError{}) {
+		t.Fatalf("expected ctlTimeoutError, got %v", err)
+	}
+}
+
+func TestNativeAuthentication(t *testing.T) {
+	server, err := beegfsproto.NewFakeServer([]byte("secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	vol := newNativeTestVolume(t, server.Port(), []byte("secret\n"))
+	if _, err = (&beegfsNativeExecutor{}).listStoragePools(context.Background(), vol); err != nil {
+		t.Fatal(err)
+	}
+	if server.UnauthorizedCount() != 0 {
+		t.Fatalf("expected no unauthorized connections, got %d", server.UnauthorizedCount())
+	}
+
+	// beegfs-client.conf disables authentication, so the connAuthFile is ignored and the server rejects the connection.
+	if err = fsutil.WriteFile(vol.clientConfPath, []byte(fmt.Sprintf(
+		"connMgmtdPortTCP = %d\nconnAuthFile = /mountDir/connAuthFile\nconnDisableAuthentication = true\n",
+		server.Port())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaultMaxRetries := ctlMaxRetries
+	ctlMaxRetries = 0
+	defer func() { ctlMaxRetries = defaultMaxRetries }()
+	if _, err = (&beegfsNativeExecutor{}).listStoragePools(context.Background(), vol); err == nil {
+		t.Fatal("expected error for unauthenticated connection")
+	}
+	if server.UnauthorizedCount() != 1 {
+		t.Fatalf("expected 1 unauthorized connection, got %d", server.UnauthorizedCount())
+	}
+}
@@ -7,7 +7,9 @@ package beegfs
 
 import (
 	"crypto/sha1"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/url"
@@ -16,11 +18,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 	"gopkg.in/ini.v1"
 	"k8s.io/utils/mount"
 )
@@ -156,6 +161,37 @@ func writeClientFiles(ctx context.Context, vol beegfsVolume, confTemplatePath st
 	return nil
 }
 
+// readClientConf validates a beegfs-client.conf file written by writeClientFiles and returns its sysMgmtdHost. The file
+// is valid if it sets sysMgmtdHost and connClientPortUDP and every connection file writeClientFiles wrote next to it
+// (e.g. a connAuthFile) still exists.
+func readClientConf(clientConfPath string) (sysMgmtdHost string, err error) {
+	var clientConfBytes []byte
+	var clientConfINI *ini.File
+	if clientConfBytes, err = fsutil.ReadFile(clientConfPath); err != nil {
+		return "", errors.Wrapf(err, "error loading beegfs-client.conf file at %s", clientConfPath)
+	}
+	if clientConfINI, err = ini.Load(clientConfBytes); err != nil {
+		return "", errors.Wrapf(err, "error parsing beegfs-client.conf file at %s", clientConfPath)
+	}
+	section := clientConfINI.Section("")
+	for _, key := range []string{"sysMgmtdHost", "connClientPortUDP"} {
+		if section.Key(key).String() == "" {
+			return "", errors.Errorf("%s not set in beegfs-client.conf file at %s", key, clientConfPath)
+		}
+	}
+	for _, key := range []string{"connAuthFile", "connInterfacesFile", "connNetFilterFile", "connTcpOnlyFilterFile"} {
+		filePath := section.Key(key).String()
+		if filePath == "" || path.Dir(filePath) != path.Dir(clientConfPath) {
+			continue // writeClientFiles did not write this file
+		}
+		if _, err = fs.Stat(filePath); err != nil {
+			return "", errors.Wrapf(err, "error checking %s referenced by beegfs-client.conf file at %s", key,
+				clientConfPath)
+		}
+	}
+	return section.Key("sysMgmtdHost").String(), nil
+}
+
 // squashConfigForSysMgmtdHost takes a sysMgmtdHost and PluginConfig, which MAY have FileSystemSpecificConfigs. If
 // the PluginConfig contains overrides for the provided sysMgmtdHost, squashConfigForSysMgmtdHost combines them with
 // the DefaultConfig (giving preference to the appropriate FileSystemSpecificConfig). Otherwise, it returns the
@@ -213,9 +249,31 @@ func unmountAndCleanUpIfNecessary(ctx context.Context, vol beegfsVolume, rmDir b
 	// cannot use beegfsMounter.GetRefs() because we are bind mounting subdirectories (e.g. .../volume1/mount is the
 	// initial mount point but .../volume1/mount/volume1 is the directory we bind mount). beegfsMounter.GetRefs() is
 	// incapable of discovering this.
+	bindMountPath, err := getBindMountPath(vol, mounter)
+	if err != nil {
+		return err
+	}
+	if bindMountPath != "" {
+		return errors.Errorf("refused to unmount staged file system at %s while bind mounted at %s",
+			vol.mountPath, bindMountPath)
+	}
+
+	LogDebug(ctx, "Unmounting volume from path", "volumeID", vol.volumeID, "path", vol.mountPath)
+	if err = mount.CleanupMountPoint(vol.mountPath, mounter, false); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = cleanUpIfNecessary(ctx, vol, rmDir); err != nil {
+		return errors.WithMessagef(err, "failed to clean up %s for %s", vol.mountDirPath, vol.volumeID)
+	}
+	return nil
+}
+
+// getBindMountPath returns a path at which the BeeGFS filesystem mounted at vol.mountPath is bind mounted or "" if it
+// is not bind mounted anywhere.
+func getBindMountPath(vol beegfsVolume, mounter mount.Interface) (string, error) {
 	allMounts, err := mounter.List()
 	if err != nil {
-		return errors.Wrap(err, "error listing mounted filesystems")
+		return "", errors.Wrap(err, "error listing mounted filesystems")
 	}
 	for _, entry := range allMounts {
 		// Our container mounts the host's root filesystem at /host (like /:/host), so a file system might appear to be
@@ -225,21 +283,12 @@ func unmountAndCleanUpIfNecessary(ctx context.Context, vol beegfsVolume, rmDir b
 			for _, opt := range entry.Opts {
 				if strings.Contains(opt, vol.clientConfPath) {
 					// This is a bind mount of the BeeGFS filesystem mounted at mountPath
-					return errors.Errorf("refused to unmount staged file system at %s while bind mounted at %s",
-						vol.mountPath, entry.Path)
+					return entry.Path, nil
 				}
 			}
 		}
 	}
-
-	LogDebug(ctx, "Unmounting volume from path", "volumeID", vol.volumeID, "path", vol.mountPath)
-	if err = mount.CleanupMountPoint(vol.mountPath, mounter, false); err != nil {
-		return errors.WithStack(err)
-	}
-	if err = cleanUpIfNecessary(ctx, vol, rmDir); err != nil {
-		return errors.WithMessagef(err, "failed to clean up %s for %s", vol.mountDirPath, vol.volumeID)
-	}
-	return nil
+	return "", nil
 }
 
 // cleanUpIfNecessary deletes all files associated with a beegfsVolume (in vol.mountDirPath) that is not mounted. It
@@ -264,6 +313,54 @@ func cleanUpIfNecessary(ctx context.Context, vol beegfsVolume, rmDir bool) (err
 	return nil
 }
 
+// clientFileNames are the names of the files writeClientFiles may write to the mountDirPath of a beegfsVolume.
+var clientFileNames = []string{"beegfs-client.conf", "connAuthFile", "connInterfacesFile", "connNetFilterFile",
+	"connTcpOnlyFilterFile"}
+
+// removeClientFiles deletes the files writeClientFiles wrote to vol.mountDirPath and the mount point (vol.mountPath) if
+// it is empty. It refuses to do anything while a file system is mounted at vol.mountPath. Unlike cleanUpIfNecessary,
+// it never deletes a directory recursively, so it cannot delete volume data that appears at vol.mountPath (e.g.
+// because a mount was not listed). It also deletes the shared mount references (see sharedMountRefsDirName) and
+// vol.mountDirPath if rmDir is set to true.
+func removeClientFiles(ctx context.Context, vol beegfsVolume, rmDir bool, mounter mount.Interface) error {
+	notMnt, err := mounter.IsLikelyNotMountPoint(vol.mountPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	if !notMnt {
+		return errors.Errorf("refused to remove client files from %s while a file system is mounted at %s",
+			vol.mountDirPath, vol.mountPath)
+	}
+
+	LogDebug(ctx, "Removing client files", "path", vol.mountDirPath, "volumeID", vol.volumeID)
+	filePaths := make([]string, 0, len(clientFileNames)+1)
+	for _, name := range clientFileNames {
+		filePaths = append(filePaths, path.Join(vol.mountDirPath, name))
+	}
+	if rmDir {
+		refsDirPath := path.Join(vol.mountDirPath, sharedMountRefsDirName)
+		refs, err := fsutil.ReadDir(refsDirPath)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		for _, ref := range refs {
+			filePaths = append(filePaths, path.Join(refsDirPath, ref.Name()))
+		}
+		filePaths = append(filePaths, refsDirPath)
+	}
+	// fs.Remove fails instead of deleting a directory that is not empty.
+	filePaths = append(filePaths, vol.mountPath)
+	if rmDir {
+		filePaths = append(filePaths, vol.mountDirPath)
+	}
+	for _, filePath := range filePaths {
+		if err := fs.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
 // getEphemeralPortUDP either returns an error or the system-assigned ephemeral port of a temporary UDP/IPv4 socket bound to INADDR_ANY.
 // Note: This only exists because BeeGFS does not support setting connClientPortUDP to zero.
 // Warning: Other processes on the host may bind the port returned before BeeGFS binds it.  Calling this method in a retry loop may mitigate that issue.  Ideally, BeeGFS itself should be patched to support binding to port zero.
@@ -324,6 +421,433 @@ func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) (valid bool, rea
 	return true, ""
 }
 
+// newVolumeUsageFromStatfs converts the result of a statfs call on a mounted BeeGFS file system into the byte and inode
+// VolumeUsage reported by NodeGetVolumeStats.
+func newVolumeUsageFromStatfs(statfs unix.Statfs_t) []*csi.VolumeUsage {
+	blockSize := uint64(statfs.Bsize)
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks * blockSize),
+			Available: int64(statfs.Bavail * blockSize),
+			Used:      int64((statfs.Blocks - statfs.Bfree) * blockSize),
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+		},
+	}
+}
+
+// newVolumeUsageFromQuota converts BeeGFS quota information into the byte and inode VolumeUsage reported by
+// NodeGetVolumeStats. Usage always comes from the quota. Total and available come from the quota limit if one is set
+// and from the underlying file system (as reported by statfs) otherwise.
+func newVolumeUsageFromQuota(quota quotaInfo, statfs unix.Statfs_t) []*csi.VolumeUsage {
+	usage := newVolumeUsageFromStatfs(statfs)
+	for _, u := range usage {
+		used, limit := quota.sizeUsed, quota.sizeLimit
+		if u.Unit == csi.VolumeUsage_INODES {
+			used, limit = quota.inodesUsed, quota.inodesLimit
+		}
+		u.Used = int64(used)
+		if limit != 0 {
+			u.Total = int64(limit)
+			u.Available = 0
+			if limit > used {
+				u.Available = int64(limit - used)
+			}
+		}
+	}
+	return usage
+}
+
+// volumeMetadataVersion is the version of the volumeMetadata format the controller service writes. Fields may be added
+// without incrementing it, but a change to the meaning of an existing field requires a new version.
+const volumeMetadataVersion = 1
+
+// volumeMetadata is the information the controller service stores in a hidden file next to a volume's directory
+// (vol.volMetadataPath) so that it is available to RPCs (e.g. DeleteVolume) that do not receive CreateVolume
+// parameters. It also records how and for whom the volume was created (see recordVolumeCreation).
+type volumeMetadata struct {
+	Version         int               `json:"version,omitempty"` // 0 if written by a driver that did not record a version
+	CapacityBytes   int64             `json:"capacityBytes,omitempty"`
+	QuotaIDType     quotaIDType       `json:"quotaIDType,omitempty"`
+	QuotaID         uint32            `json:"quotaID,omitempty"`
+	QuotaPoolID     string            `json:"quotaPoolID,omitempty"`     // empty for the default storage pool
+	ContentSourceID string            `json:"contentSourceID,omitempty"` // volume or snapshot ID the volume is populated from
+	ContentCopied   bool              `json:"contentCopied,omitempty"`   // the content source has been completely copied
+	DeletePolicy    deletePolicy      `json:"deletePolicy,omitempty"`
+	TrashedVolumeID string            `json:"trashedVolumeID,omitempty"` // volume ID of a volume moved to the trash
+	TrashTime       *time.Time        `json:"trashTime,omitempty"`       // time a volume was moved to the trash
+	VolumeName      string            `json:"volumeName,omitempty"`      // CreateVolume (PV) name of the volume
+	PVCName         string            `json:"pvcName,omitempty"`         // only with --extra-create-metadata
+	PVCNamespace    string            `json:"pvcNamespace,omitempty"`    // only with --extra-create-metadata
+	Parameters      map[string]string `json:"parameters,omitempty"`      // CreateVolume (StorageClass) parameters
+	CreationTime    *time.Time        `json:"creationTime,omitempty"`    // time the volume was first created
+	DriverVersion   string            `json:"driverVersion,omitempty"`   // version of the driver that created the volume
+}
+
+// hasQuota returns true if a dedicated quota ID was assigned to the volume.
+func (md volumeMetadata) hasQuota() bool { return md.QuotaIDType != "" }
+
+// getDeletePolicy returns the deletePolicy of the volume or deletePolicyDelete if none was recorded.
+func (md volumeMetadata) getDeletePolicy() deletePolicy {
+	if md.DeletePolicy == "" {
+		return deletePolicyDelete
+	}
+	return md.DeletePolicy
+}
+
+// snapshotMetadata is the information the controller service stores in a hidden file next to a snapshot's directory.
+// A snapshot directory with ReadyToUse set to false is either still being copied or was left behind by an interrupted
+// copy.
+type snapshotMetadata struct {
+	SourceVolumeID string    `json:"sourceVolumeID"`
+	CreationTime   time.Time `json:"creationTime"`
+	SizeBytes      int64     `json:"sizeBytes,omitempty"`
+	ReadyToUse     bool      `json:"readyToUse"`
+}
+
+// readVolumeMetadata reads the metadata file of a beegfsVolume from a mounted BeeGFS file system. It returns false
+// (and no error) if the file does not exist.
+func readVolumeMetadata(vol beegfsVolume) (md volumeMetadata, exists bool, err error) {
+	if exists, err = readMetadataFile(vol.volMetadataPath, &md); err != nil {
+		return md, exists, err
+	}
+	if md.Version > volumeMetadataVersion {
+		return md, exists, errors.Errorf("metadata file %s has version %d, but only version %d is supported",
+			vol.volMetadataPath, md.Version, volumeMetadataVersion)
+	}
+	return md, exists, nil
+}
+
+// writeVolumeMetadata writes the metadata file of a beegfsVolume to a mounted BeeGFS file system, replacing any
+// existing file.
+func writeVolumeMetadata(vol beegfsVolume, md volumeMetadata) error {
+	return writeMetadataFile(vol.volMetadataPath, md)
+}
+
+// readSnapshotMetadata reads the metadata file of a snapshot (represented by a beegfsVolume) from a mounted BeeGFS file
+// system. It returns false (and no error) if the file does not exist.
+func readSnapshotMetadata(snap beegfsVolume) (md snapshotMetadata, exists bool, err error) {
+	exists, err = readMetadataFile(snap.volMetadataPath, &md)
+	return md, exists, err
+}
+
+// writeSnapshotMetadata writes the metadata file of a snapshot (represented by a beegfsVolume) to a mounted BeeGFS file
+// system, replacing any existing file.
+func writeSnapshotMetadata(snap beegfsVolume, md snapshotMetadata) error {
+	return writeMetadataFile(snap.volMetadataPath, md)
+}
+
+// readMetadataFile unmarshals the JSON metadata file at mdPath into md. It returns false (and no error) if the file does
+// not exist.
+func readMetadataFile(mdPath string, md interface{}) (bool, error) {
+	mdBytes, err := fsutil.ReadFile(mdPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.WithStack(err)
+	}
+	if err = json.Unmarshal(mdBytes, md); err != nil {
+		return false, errors.Wrapf(err, "failed to parse metadata file %s", mdPath)
+	}
+	return true, nil
+}
+
+// writeMetadataFile marshals md into a JSON metadata file at mdPath, replacing any existing file.
+func writeMetadataFile(mdPath string, md interface{}) error {
+	mdBytes, err := json.Marshal(md)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = fsutil.WriteFile(mdPath, mdBytes, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// copyDirectory recursively copies the directory at srcPath to dstPath (which must not exist) and returns the total
+// size of the regular files it copied. It preserves the mode, ownership (when running as root), and modification time
+// of every directory, file, and symbolic link. Special files (e.g. sockets and device files) are skipped. copyDirectory
+// checks ctx between (and while copying) files and returns ctx.Err() as soon as ctx is cancelled.
+//
+// Directories are created with a restrictive mode and only receive their final mode, ownership, and modification time
+// once everything below them has been copied. Otherwise, read-only directories could not be filled and copying
+// children would change modification times.
+func copyDirectory(ctx context.Context, srcPath, dstPath string) (int64, error) {
+	return copyTree(ctx, srcPath, dstPath, true)
+}
+
+// copyDirectoryContents is like copyDirectory, but it copies the contents of srcPath into the existing directory at
+// dstPath and leaves the mode, ownership, and modification time of dstPath itself alone.
+func copyDirectoryContents(ctx context.Context, srcPath, dstPath string) (int64, error) {
+	return copyTree(ctx, srcPath, dstPath, false)
+}
+
+// copyTree implements copyDirectory and copyDirectoryContents.
+func copyTree(ctx context.Context, srcPath, dstPath string, copyRoot bool) (int64, error) {
+	var sizeBytes int64
+	var dirs []string // in the order created, so parents come before children
+	var dirInfos []os.FileInfo
+
+	err := afero.Walk(fs, srcPath, func(srcFilePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if srcFilePath == srcPath && !copyRoot {
+			return nil
+		}
+		dstFilePath := path.Join(dstPath, strings.TrimPrefix(srcFilePath, srcPath))
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := fs.Mkdir(dstFilePath, 0700); err != nil {
+				return errors.WithStack(err)
+			}
+			dirs = append(dirs, dstFilePath)
+			dirInfos = append(dirInfos, info)
+			return nil
+		case mode&os.ModeSymlink != 0:
+			return copySymlink(srcFilePath, dstFilePath, info)
+		case mode.IsRegular():
+			written, err := copyFile(ctx, srcFilePath, dstFilePath, info)
+			sizeBytes += written
+			return err
+		default:
+			return nil // Special files cannot be meaningfully copied to another location.
+		}
+	})
+	if err != nil {
+		return sizeBytes, err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := copyAttributes(dirs[i], dirInfos[i]); err != nil {
+			return sizeBytes, err
+		}
+	}
+	return sizeBytes, nil
+}
+
+// errSourceModified indicates that something in the source of a copy changed while it was being copied.
+var errSourceModified = errors.New("source changed while it was being copied")
+
+// treeEntryState is the state of a directory, file, or symbolic link recorded by statTree.
+type treeEntryState struct {
+	mode  os.FileMode
+	size  int64
+	mtime time.Time
+	ctime time.Time // zero if the file system does not report it
+}
+
+// statTree returns the state of the directory at dirPath and of everything below it by path relative to dirPath. Any
+// change to an entry (including a change of its mode or ownership) updates its change time, and creating, removing, or
+// renaming an entry updates the modification time of its directory. Comparing the results of two statTree calls
+// therefore reveals whether anything changed in between (as long as the file system records times with sufficient
+// resolution).
+func statTree(ctx context.Context, dirPath string) (map[string]treeEntryState, error) {
+	states := make(map[string]treeEntryState)
+	err := afero.Walk(fs, dirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		state := treeEntryState{mode: info.Mode(), size: info.Size(), mtime: info.ModTime()}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			state.ctime = time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+		}
+		states[strings.TrimPrefix(filePath, dirPath)] = state
+		return nil
+	})
+	return states, err
+}
+
+// removeDirectoryContents removes everything inside the directory at dirPath, but not the directory itself.
+func removeDirectoryContents(dirPath string) error {
+	dirEntries, err := fsutil.ReadDir(dirPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, dirEntry := range dirEntries {
+		if err = fs.RemoveAll(path.Join(dirPath, dirEntry.Name())); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// removeTreeBatchSize is the maximum number of directory entries removeTree reads at once.
+var removeTreeBatchSize = 1000
+
+// removeTree removes the directory at dirPath and everything in it like fs.RemoveAll. Unlike fs.RemoveAll, it reads
+// each directory in batches of removeTreeBatchSize entries (so its memory use does not grow with the size of a
+// directory), stops when ctx is cancelled, and calls progressFn with the number of entries removed so far after each
+// batch. It returns the number of entries removed.
+func removeTree(ctx context.Context, dirPath string, progressFn func(removed int64)) (int64, error) {
+	var removed int64
+	var removeDir func(dirPath string) error
+	removeDir = func(dirPath string) error {
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// Reopen the directory for each batch. Entries removed by the previous batch are no longer listed.
+			dir, err := fs.Open(dirPath)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			infos, err := dir.Readdir(removeTreeBatchSize)
+			_ = dir.Close()
+			if err != nil && err != io.EOF {
+				return errors.WithStack(err)
+			}
+			if len(infos) == 0 {
+				break
+			}
+			for _, info := range infos {
+				entryPath := path.Join(dirPath, info.Name())
+				if info.IsDir() {
+					if err := removeDir(entryPath); err != nil {
+						return err
+					}
+				} else if err := fs.Remove(entryPath); err != nil && !os.IsNotExist(err) {
+					return errors.WithStack(err)
+				}
+				removed++
+			}
+			progressFn(removed)
+		}
+		if err := fs.Remove(dirPath); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	if _, err := fs.Stat(dirPath); os.IsNotExist(err) {
+		return 0, nil
+	}
+	err := removeDir(dirPath)
+	return removed, err
+}
+
+// applyQuotaIDToDirectoryContents changes the owner (for a uid quota) or group (for a gid quota) of everything inside
+// the directory at dirPath to id so that the BeeGFS quota of a volume with enforced capacity accounts for it. For a gid
+// quota, it also sets the set gid bit on every directory so that new files and directories inherit the group.
+func applyQuotaIDToDirectoryContents(dirPath string, idType quotaIDType, id uint32) error {
+	uid, gid := -1, int(id)
+	if idType == quotaIDTypeUID {
+		uid, gid = int(id), -1
+	}
+	return afero.Walk(fs, dirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if filePath == dirPath {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.WithStack(os.Lchown(filePath, uid, gid))
+		}
+		if err := fs.Chown(filePath, uid, gid); err != nil {
+			return errors.WithStack(err)
+		}
+		// chown clears the set uid and set gid bits, so the mode must be restored afterwards.
+		mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if info.IsDir() && idType == quotaIDTypeGID {
+			mode |= os.ModeSetgid
+		}
+		return errors.WithStack(fs.Chmod(filePath, mode))
+	})
+}
+
+// copyFile copies the contents and attributes of a single regular file and returns the number of bytes written.
+func copyFile(ctx context.Context, srcFilePath, dstFilePath string, info os.FileInfo) (int64, error) {
+	srcFile, err := fs.Open(srcFilePath)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer srcFile.Close()
+	dstFile, err := fs.OpenFile(dstFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	var written int64
+	buf := make([]byte, 1024*1024)
+	for {
+		if err := ctx.Err(); err != nil {
+			_ = dstFile.Close()
+			return written, err
+		}
+		n, readErr := srcFile.Read(buf)
+		if n > 0 {
+			if _, err := dstFile.Write(buf[:n]); err != nil {
+				_ = dstFile.Close()
+				return written, errors.WithStack(err)
+			}
+			written += int64(n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			_ = dstFile.Close()
+			return written, errors.WithStack(readErr)
+		}
+	}
+	if err := dstFile.Close(); err != nil {
+		return written, errors.WithStack(err)
+	}
+	return written, copyAttributes(dstFilePath, info)
+}
+
+// copySymlink recreates a symbolic link (with the same target) and its ownership. Symbolic links are skipped if the
+// underlying afero.Fs does not support them.
+func copySymlink(srcFilePath, dstFilePath string, info os.FileInfo) error {
+	linker, ok := fs.(afero.Symlinker)
+	if !ok {
+		return nil
+	}
+	target, err := linker.ReadlinkIfPossible(srcFilePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = linker.SymlinkIfPossible(target, dstFilePath); err != nil {
+		return errors.WithStack(err)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+		if err = os.Lchown(dstFilePath, int(stat.Uid), int(stat.Gid)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// copyAttributes applies the ownership (when running as root), mode, and modification time described by info to the
+// file or directory at dstFilePath. Ownership is applied first because chown clears the set uid and set gid bits.
+func copyAttributes(dstFilePath string, info os.FileInfo) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+		if err := fs.Chown(dstFilePath, int(stat.Uid), int(stat.Gid)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := fs.Chmod(dstFilePath, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := fs.Chtimes(dstFilePath, info.ModTime(), info.ModTime()); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
 // threadSafeStringLock maintains a threadsafe set of strings and provides easily consumable methods for obtaining and
 // releasing a lock on a string. Use a threadSafeStringLock to ensure only one Goroutine makes use of or references a
 // particular string at a any given time.
@@ -7,7 +7,9 @@ package beegfs
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"path"
 	"reflect"
 	"regexp"
@@ -17,6 +19,7 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/spf13/afero"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 )
 
 // This is included here as a constant for formatting reasons (literal looks better with no indentation involved).
@@ -237,6 +240,57 @@ func TestWriteClientFiles(t *testing.T) {
 	}
 }
 
+func TestReadClientConf(t *testing.T) {
+	clientConfPath := "/testvol/beegfs-client.conf"
+	tests := map[string]struct {
+		clientConf string
+		files      []string // connection files that exist next to clientConfPath
+		wantHost   string
+		wantErr    bool
+	}{
+		"valid": {
+			clientConf: TestWriteClientFilesBeegfsClientConf,
+			files:      []string{"connAuthFile", "connInterfacesFile", "connNetFilterFile", "connTcpOnlyFilterFile"},
+			wantHost:   "127.0.0.1",
+		},
+		"template values": {
+			clientConf: TestWriteClientFilesTemplate,
+			wantErr:    true,
+		},
+		"missing connection file": {
+			clientConf: TestWriteClientFilesBeegfsClientConf,
+			files:      []string{"connAuthFile", "connInterfacesFile", "connNetFilterFile"},
+			wantErr:    true,
+		},
+		"missing beegfs-client.conf": {
+			wantErr: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			fs = afero.NewMemMapFs()
+			fsutil = afero.Afero{Fs: fs}
+			if tc.clientConf != "" {
+				if err := fsutil.WriteFile(clientConfPath, []byte(tc.clientConf), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, file := range tc.files {
+				if err := fsutil.WriteFile(path.Join("/testvol", file), []byte{}, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			gotHost, err := readClientConf(clientConfPath)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("expected error: %t, got: %v", tc.wantErr, err)
+			}
+			if tc.wantHost != gotHost {
+				t.Fatalf("expected host: %s, got host: %s", tc.wantHost, gotHost)
+			}
+		})
+	}
+}
+
 func TestSquashConfigForSysMgmtdHost(t *testing.T) {
 	defaultConfig := *newBeegfsConfig()
 	defaultConfig.ConnInterfaces = []string{"ib0"}
@@ -431,3 +485,182 @@ func TestThreadSafeStringLock(t *testing.T) {
 		}
 	}
 }
+
+func TestNewVolumeUsageFromQuota(t *testing.T) {
+	// A file system with 100 4KiB blocks (60 free and 50 available) and 100 inodes (60 free).
+	statfs := unix.Statfs_t{Bsize: 4096, Blocks: 100, Bfree: 60, Bavail: 50, Files: 100, Ffree: 60}
+	tests := map[string]struct {
+		quota quotaInfo
+		want  []*csi.VolumeUsage
+	}{
+		"limits set": {
+			quota: quotaInfo{sizeUsed: 4096, sizeLimit: 8192, inodesUsed: 1, inodesLimit: 10},
+			want: []*csi.VolumeUsage{
+				{Unit: csi.VolumeUsage_BYTES, Total: 8192, Available: 4096, Used: 4096},
+				{Unit: csi.VolumeUsage_INODES, Total: 10, Available: 9, Used: 1},
+			},
+		},
+		"limits exceeded": {
+			quota: quotaInfo{sizeUsed: 16384, sizeLimit: 8192, inodesUsed: 20, inodesLimit: 10},
+			want: []*csi.VolumeUsage{
+				{Unit: csi.VolumeUsage_BYTES, Total: 8192, Available: 0, Used: 16384},
+				{Unit: csi.VolumeUsage_INODES, Total: 10, Available: 0, Used: 20},
+			},
+		},
+		"limits unlimited": {
+			quota: quotaInfo{sizeUsed: 4096, inodesUsed: 1},
+			want: []*csi.VolumeUsage{
+				{Unit: csi.VolumeUsage_BYTES, Total: 409600, Available: 204800, Used: 4096},
+				{Unit: csi.VolumeUsage_INODES, Total: 100, Available: 60, Used: 1},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := newVolumeUsageFromQuota(tc.quota, statfs)
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("expected: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestReadWriteVolumeMetadata(t *testing.T) {
+	fs = afero.NewMemMapFs() // test sets up its own, new, memory-mapped file system
+	fsutil = afero.Afero{Fs: fs}
+	vol := newBeegfsVolume("/testvol", "127.0.0.1", "/parent/volume", PluginConfig{})
+	if err := fs.MkdirAll(vol.volDirBasePath, 0755); err != nil {
+		t.Fatalf("failed to set up volDirBasePath: %v", err)
+	}
+
+	if _, exists, err := readVolumeMetadata(vol); err != nil || exists {
+		t.Fatalf("expected no metadata, got exists: %t, err: %v", exists, err)
+	}
+
+	want := volumeMetadata{CapacityBytes: 1 << 30, QuotaIDType: quotaIDTypeGID, QuotaID: 5000}
+	if err := writeVolumeMetadata(vol, want); err != nil {
+		t.Fatalf("failed to write metadata: %v", err)
+	}
+	got, exists, err := readVolumeMetadata(vol)
+	if err != nil || !exists {
+		t.Fatalf("expected metadata, got exists: %t, err: %v", exists, err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected: %v, got: %v", want, got)
+	}
+	if vol.volMetadataPath != "/testvol/mount/parent/.volume.beegfs-csi.json" {
+		t.Fatalf("unexpected volMetadataPath: %s", vol.volMetadataPath)
+	}
+
+	if err := writeVolumeMetadata(vol, volumeMetadata{Version: volumeMetadataVersion + 1}); err != nil {
+		t.Fatalf("failed to write metadata: %v", err)
+	}
+	if _, _, err := readVolumeMetadata(vol); err == nil {
+		t.Fatalf("expected error for unsupported metadata version")
+	}
+}
+
+func TestCopyDirectory(t *testing.T) {
+	fs = afero.NewOsFs() // copyDirectory must preserve symbolic links, which a memory-mapped file system does not support
+	fsutil = afero.Afero{Fs: fs}
+	testDir, err := ioutil.TempDir("", "copy-directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+	srcPath := path.Join(testDir, "src")
+	modTime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, dirPath := range []string{srcPath, path.Join(srcPath, "readonly")} {
+		if err := os.Mkdir(dirPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fsutil.WriteFile(path.Join(srcPath, "file"), []byte("0123456789"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsutil.WriteFile(path.Join(srcPath, "readonly", "file"), []byte("01234"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("readonly/file", path.Join(srcPath, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(srcPath, "readonly"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path.Join(srcPath, "readonly"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := copyDirectory(cancelledCtx, srcPath, path.Join(testDir, "cancelled")); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	dstPath := path.Join(testDir, "dst")
+	sizeBytes, err := copyDirectory(context.Background(), srcPath, dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(path.Join(dstPath, "readonly"), 0755) // allow os.RemoveAll
+	if sizeBytes != 15 {
+		t.Fatalf("expected 15 bytes, got %d", sizeBytes)
+	}
+	if data, err := fsutil.ReadFile(path.Join(dstPath, "link")); err != nil || string(data) != "01234" {
+		t.Fatalf("expected link to copied file, got %q (%v)", data, err)
+	}
+	for relPath, wantMode := range map[string]os.FileMode{"file": 0640, "readonly": os.ModeDir | 0555,
+		"readonly/file": 0444} {
+		info, err := os.Stat(path.Join(dstPath, relPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != wantMode {
+			t.Fatalf("expected mode %v for %s, got %v", wantMode, relPath, info.Mode())
+		}
+	}
+	if info, err := os.Stat(path.Join(dstPath, "readonly")); err != nil || !info.ModTime().Equal(modTime) {
+		t.Fatalf("expected modification time %v, got %v (%v)", modTime, info.ModTime(), err)
+	}
+}
+
+func TestRemoveTree(t *testing.T) {
+	fs = afero.NewMemMapFs() // test sets up its own, new, memory-mapped file system
+	fsutil = afero.Afero{Fs: fs}
+	defaultRemoveTreeBatchSize := removeTreeBatchSize
+	removeTreeBatchSize = 2
+	defer func() { removeTreeBatchSize = defaultRemoveTreeBatchSize }()
+	for _, filePath := range []string{"/tree/a", "/tree/b", "/tree/c", "/tree/dir/d", "/tree/dir/sub/e", "/other/f"} {
+		if err := fsutil.WriteFile(filePath, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := removeTree(cancelledCtx, "/tree", func(int64) {}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	var progress []int64
+	removed, err := removeTree(context.Background(), "/tree", func(removed int64) { progress = append(progress, removed) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 7 { // 5 files and 2 directories
+		t.Fatalf("expected 7 entries removed, got %d", removed)
+	}
+	if len(progress) < 4 || progress[len(progress)-1] != removed {
+		t.Fatalf("expected progress reported after each batch, got %v", progress)
+	}
+	if exists, _ := fsutil.Exists("/tree"); exists {
+		t.Fatalf("expected /tree to be removed")
+	}
+	if exists, _ := fsutil.Exists("/other/f"); !exists {
+		t.Fatalf("expected /other/f to remain")
+	}
+	if removed, err := removeTree(context.Background(), "/tree", func(int64) {}); err != nil || removed != 0 {
+		t.Fatalf("expected nothing to remove, got %d (%v)", removed, err)
+	}
+}
@@ -8,7 +8,9 @@ package beegfs
 import (
 	"encoding/json"
 	"net"
+	"path"
 	"regexp"
+	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
@@ -29,14 +31,28 @@ var unsupportedBeegfsConfOptions = []string{
 	"connAuthFile",
 }
 
+// These values are accepted for the volumeStatsSource configuration option. They determine how NodeGetVolumeStats
+// calculates the usage of a volume.
+const (
+	volumeStatsSourceStatfs   = "statfs"   // Report the usage of the entire BeeGFS file system (the default).
+	volumeStatsSourceUIDQuota = "uidQuota" // Report the BeeGFS quota usage of the user that owns the volume.
+	volumeStatsSourceGIDQuota = "gidQuota" // Report the BeeGFS quota usage of the group that owns the volume.
+)
+
 // beegfsConfig contains all of the custom configuration (above and beyond whatever is in the beegfs-client.conf file)
 // associated with a single BeeGFS file system EXCEPT for sysMgmtdHost, which is stored separately.
 type beegfsConfig struct {
-	ConnInterfaces    []string          `yaml:"connInterfaces"`
-	ConnNetFilter     []string          `yaml:"connNetFilter"`
-	ConnTcpOnlyFilter []string          `yaml:"connTcpOnlyFilter"`
-	BeegfsClientConf  map[string]string `yaml:"beegfsClientConf"`
-	connAuth          string            // unexported with no yaml tag so it cannot be set from a configuration file
+	ConnInterfaces       []string          `yaml:"connInterfaces"`
+	ConnNetFilter        []string          `yaml:"connNetFilter"`
+	ConnTcpOnlyFilter    []string          `yaml:"connTcpOnlyFilter"`
+	BeegfsClientConf     map[string]string `yaml:"beegfsClientConf"`
+	VolumeStatsSource    string            `yaml:"volumeStatsSource"`
+	SnapshotDirBasePath  string            `yaml:"snapshotDirBasePath"`
+	VolDirBasePaths      []string          `yaml:"volDirBasePaths"`
+	TrashDirBasePath     string            `yaml:"trashDirBasePath"`
+	TrashRetentionPeriod time.Duration     `yaml:"trashRetentionPeriod"`
+	BeegfsCtlTimeout     time.Duration     `yaml:"beegfsCtlTimeout"`
+	connAuth             string            // unexported with no yaml tag so it cannot be set from a configuration file
 }
 
 func newBeegfsConfig() *beegfsConfig {
@@ -45,6 +61,44 @@ func newBeegfsConfig() *beegfsConfig {
 	}
 }
 
+// snapshotDirBasePathBeegfsRoot returns the absolute path (from the BeeGFS root) to the directory that contains all
+// snapshots on a BeeGFS file system. It returns defaultSnapshotDirBasePath if SnapshotDirBasePath is not set.
+func (c beegfsConfig) snapshotDirBasePathBeegfsRoot() string {
+	if c.SnapshotDirBasePath == "" {
+		return defaultSnapshotDirBasePath
+	}
+	return path.Clean(path.Join("/", c.SnapshotDirBasePath))
+}
+
+// trashDirBasePathBeegfsRoot returns the absolute path (from the BeeGFS root) to the directory that contains all
+// volumes with a deletePolicy of move-to-trash that were deleted on a BeeGFS file system. It returns
+// defaultTrashDirBasePath if TrashDirBasePath is not set.
+func (c beegfsConfig) trashDirBasePathBeegfsRoot() string {
+	if c.TrashDirBasePath == "" {
+		return defaultTrashDirBasePath
+	}
+	return path.Clean(path.Join("/", c.TrashDirBasePath))
+}
+
+// trashRetentionPeriod returns the amount of time a deleted volume stays in the trash directory before the controller
+// service removes it. It returns defaultTrashRetentionPeriod if TrashRetentionPeriod is not set.
+func (c beegfsConfig) trashRetentionPeriod() time.Duration {
+	if c.TrashRetentionPeriod == 0 {
+		return defaultTrashRetentionPeriod
+	}
+	return c.TrashRetentionPeriod
+}
+
+// volDirBasePathsBeegfsRoot returns the absolute paths (from the BeeGFS root) to the directories ListVolumes searches
+// for volumes on a BeeGFS file system in addition to any volDirBasePath referenced by CreateVolume.
+func (c beegfsConfig) volDirBasePathsBeegfsRoot() []string {
+	volDirBasePaths := make([]string, 0, len(c.VolDirBasePaths))
+	for _, volDirBasePath := range c.VolDirBasePaths {
+		volDirBasePaths = append(volDirBasePaths, path.Clean(path.Join("/", volDirBasePath)))
+	}
+	return volDirBasePaths
+}
+
 // MarshalJSON overrides the default JSON encoding for the beegfsConfig struct. klogr uses JSON encoding to log
 // struct values and thus implicitly calls this method. beegfsConfig does not export the connAuth field, so MarshalJSON
 // encodes a new anonymous struct that includes an exported ConnAuth field and replaces it's value with "******" if
@@ -234,6 +288,28 @@ func (plConfig *PluginConfig) validateConfig() error {
 				return errors.Errorf("invalid ConnTCPOnlyFilter %s", filter)
 			}
 		}
+		switch config.VolumeStatsSource {
+		case "", volumeStatsSourceStatfs, volumeStatsSourceUIDQuota, volumeStatsSourceGIDQuota:
+		default:
+			return errors.Errorf("invalid VolumeStatsSource %s", config.VolumeStatsSource)
+		}
+		if config.SnapshotDirBasePath != "" && config.snapshotDirBasePathBeegfsRoot() == "/" {
+			return errors.Errorf("invalid SnapshotDirBasePath %s", config.SnapshotDirBasePath)
+		}
+		if config.TrashDirBasePath != "" && config.trashDirBasePathBeegfsRoot() == "/" {
+			return errors.Errorf("invalid TrashDirBasePath %s", config.TrashDirBasePath)
+		}
+		if config.TrashRetentionPeriod < 0 {
+			return errors.Errorf("invalid TrashRetentionPeriod %s", config.TrashRetentionPeriod)
+		}
+		if config.BeegfsCtlTimeout < 0 {
+			return errors.Errorf("invalid BeegfsCtlTimeout %s", config.BeegfsCtlTimeout)
+		}
+		for _, volDirBasePath := range config.VolDirBasePaths {
+			if volDirBasePath == "" {
+				return errors.New("invalid empty VolDirBasePath")
+			}
+		}
 	}
 
 	return nil
@@ -298,6 +374,25 @@ func (c *beegfsConfig) overwriteFrom(writeFrom beegfsConfig) {
 		c.ConnTcpOnlyFilter = make([]string, len(writeFrom.ConnTcpOnlyFilter))
 		copy(c.ConnTcpOnlyFilter, writeFrom.ConnTcpOnlyFilter)
 	}
+	if writeFrom.VolumeStatsSource != "" {
+		c.VolumeStatsSource = writeFrom.VolumeStatsSource
+	}
+	if writeFrom.SnapshotDirBasePath != "" {
+		c.SnapshotDirBasePath = writeFrom.SnapshotDirBasePath
+	}
+	if writeFrom.TrashDirBasePath != "" {
+		c.TrashDirBasePath = writeFrom.TrashDirBasePath
+	}
+	if writeFrom.TrashRetentionPeriod != 0 {
+		c.TrashRetentionPeriod = writeFrom.TrashRetentionPeriod
+	}
+	if writeFrom.BeegfsCtlTimeout != 0 {
+		c.BeegfsCtlTimeout = writeFrom.BeegfsCtlTimeout
+	}
+	if len(writeFrom.VolDirBasePaths) != 0 {
+		c.VolDirBasePaths = make([]string, len(writeFrom.VolDirBasePaths))
+		copy(c.VolDirBasePaths, writeFrom.VolDirBasePaths)
+	}
 	if writeFrom.connAuth != "" {
 		c.connAuth = writeFrom.connAuth
 	}
@@ -8,6 +8,7 @@ package beegfs
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
@@ -289,6 +290,120 @@ func TestValidateConfig(t *testing.T) {
 				},
 			},
 		},
+		"valid VolumeStatsSource": {
+			nil,
+			PluginConfig{
+				DefaultConfig: beegfsConfig{
+					VolumeStatsSource: volumeStatsSourceGIDQuota,
+				},
+			},
+		},
+		"invalid VolumeStatsSource": {
+			errors.New("invalid VolumeStatsSource testinvalid"),
+			PluginConfig{
+				FileSystemSpecificConfigs: []FileSystemSpecificConfig{
+					{
+						SysMgmtdHost: "127.0.0.0",
+						Config: beegfsConfig{
+							VolumeStatsSource: "testinvalid",
+						},
+					},
+				},
+			},
+		},
+		"valid SnapshotDirBasePath": {
+			nil,
+			PluginConfig{
+				DefaultConfig: beegfsConfig{
+					SnapshotDirBasePath: "k8s/snapshots",
+				},
+			},
+		},
+		"invalid SnapshotDirBasePath": {
+			errors.New("invalid SnapshotDirBasePath /"),
+			PluginConfig{
+				FileSystemSpecificConfigs: []FileSystemSpecificConfig{
+					{
+						SysMgmtdHost: "127.0.0.0",
+						Config: beegfsConfig{
+							SnapshotDirBasePath: "/",
+						},
+					},
+				},
+			},
+		},
+		"valid VolDirBasePaths": {
+			nil,
+			PluginConfig{
+				DefaultConfig: beegfsConfig{
+					VolDirBasePaths: []string{"k8s/dyn", "/"},
+				},
+			},
+		},
+		"invalid VolDirBasePaths": {
+			errors.New("invalid empty VolDirBasePath"),
+			PluginConfig{
+				FileSystemSpecificConfigs: []FileSystemSpecificConfig{
+					{
+						SysMgmtdHost: "127.0.0.0",
+						Config: beegfsConfig{
+							VolDirBasePaths: []string{"k8s/dyn", ""},
+						},
+					},
+				},
+			},
+		},
+		"valid trash config": {
+			nil,
+			PluginConfig{
+				DefaultConfig: beegfsConfig{
+					TrashDirBasePath:     "k8s/trash",
+					TrashRetentionPeriod: 72 * time.Hour,
+				},
+			},
+		},
+		"invalid TrashDirBasePath": {
+			errors.New("invalid TrashDirBasePath /"),
+			PluginConfig{
+				FileSystemSpecificConfigs: []FileSystemSpecificConfig{
+					{
+						SysMgmtdHost: "127.0.0.0",
+						Config: beegfsConfig{
+							TrashDirBasePath: "/",
+						},
+					},
+				},
+			},
+		},
+		"invalid TrashRetentionPeriod": {
+			errors.New("invalid TrashRetentionPeriod -1h0m0s"),
+			PluginConfig{
+				DefaultConfig: beegfsConfig{
+					TrashRetentionPeriod: -time.Hour,
+				},
+			},
+		},
+		"valid BeegfsCtlTimeout": {
+			nil,
+			PluginConfig{
+				FileSystemSpecificConfigs: []FileSystemSpecificConfig{
+					{
+						SysMgmtdHost: "127.0.0.0",
+						Config: beegfsConfig{
+							BeegfsCtlTimeout: 30 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		"invalid BeegfsCtlTimeout": {
+			errors.New("invalid BeegfsCtlTimeout -1s"),
+			PluginConfig{
+				DefaultConfig: beegfsConfig{
+					BeegfsCtlTimeout: -time.Second,
+				},
+			},
+		},
 		"invalid ConnTCPOnlyFilter": {
 			errors.New("invalid ConnTCPOnlyFilter testinvalid"),
 			PluginConfig{
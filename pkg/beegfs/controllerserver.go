@@ -22,13 +22,21 @@ Licensed under the Apache License, Version 2.0.
 package beegfs
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"os"
 	"path"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
@@ -40,9 +48,64 @@ var (
 	// controllerCaps represents the capability of controller service
 	controllerCaps = []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 	}
+
+	// errNoFreeQuotaID indicates that every ID in a quota/idRange is already assigned to a volume.
+	errNoFreeQuotaID = errors.New("no unused quota ID in range")
+
+	// errBackgroundTasksDisabled indicates that the controller service does not run runBackgroundTasks, so nothing
+	// reaps the trash or resumes deletions that were interrupted (e.g. by a restart) or did not fit in the queue.
+	errBackgroundTasksDisabled = errors.New("controller service background tasks are disabled " +
+		"(see --controller-background-tasks)")
 )
 
+// quotaIDBatchSize is the maximum number of IDs whose quota information is requested with a single beegfs-ctl command
+// while searching a quota/idRange for an unused ID.
+const quotaIDBatchSize = 100
+
+// copyWaitTime is the maximum amount of time CreateSnapshot or CreateVolume waits for a background copy to complete
+// before it responds. The CO is expected to call the RPC again until the copy is complete.
+const copyWaitTime = 5 * time.Second
+
+// backgroundTaskInterval is how often the controller service checks the trash of each file system for expired volumes
+// and the pendingDeletionDirBasePath of each file system for directories no deletion worker is removing.
+const backgroundTaskInterval = time.Hour
+
+// deletionWorkers is the maximum number of directories the controller service removes from pendingDeletionDirBasePaths
+// concurrently.
+const deletionWorkers = 4
+
+// deletionQueueSize is the maximum number of directories waiting for a deletion worker. Directories that do not fit
+// are found and queued by the next background task pass (see queuePendingDeletions).
+const deletionQueueSize = 1024
+
+// deletionProgressInterval is how often a deletion worker logs the progress of a long-running removal.
+var deletionProgressInterval = time.Minute
+
+// knownFileSystemsFileName is the name of the file in csDataDir in which the controller service records the
+// sysMgmtdHosts and volDirBasePaths referenced by requests (see addKnownFileSystem). csDataDir outlives the controller
+// service's container, so RPCs that are not scoped to a particular file system (e.g. ListVolumes) and the background
+// tasks still find them after a restart.
+const knownFileSystemsFileName = ".known-file-systems.json"
+
+// storagePoolCacheTTL is how long the controller service caches the storage pools of a file system to resolve
+// stripePattern/storagePoolName parameters.
+const storagePoolCacheTTL = 5 * time.Minute
+
+// reservedQuotaCacheTTL is how long the controller service caches the capacity reserved by the volumes in a
+// quota/idRange (see getReservedQuota). Without the cache, every GetCapacity call would query the quota of every ID in
+// the range. The controller service invalidates the cache whenever it changes a quota limit, so only usage by the
+// volumes themselves can make a cached value stale.
+const reservedQuotaCacheTTL = time.Minute
+
 type controllerServer struct {
 	ctlExec                beegfsCtlExecutorInterface
 	caps                   []*csi.ControllerServiceCapability
@@ -52,6 +115,54 @@ type controllerServer struct {
 	mounter                mount.Interface
 	csDataDir              string
 	volumeIDsInFlight      *threadSafeStringLock
+	quotaIDMutex           sync.Mutex                 // serializes the search for and claiming of unused quota IDs
+	copiesInFlight         map[string]*backgroundCopy // in progress background copies by target volume or snapshot ID
+	copiesInFlightMutex    sync.Mutex
+	knownVolDirBasePaths   map[string]map[string]struct{} // volDirBasePaths by known sysMgmtdHost (loaded lazily)
+	knownFileSystemsMutex  sync.Mutex
+	deletionQueue          chan pendingDeletion // started lazily along with the deletion workers (see queueDeletion)
+	deletionsQueued        map[string]struct{}  // IDs of pending deletions that are queued or being removed
+	deletionsQueuedMutex   sync.Mutex
+	storagePoolCache       map[string]cachedStoragePools // storage pools by sysMgmtdHost
+	storagePoolCacheMutex  sync.Mutex
+	reservedQuotaCache     map[reservedQuotaCacheKey]cachedReservedQuota
+	reservedQuotaCacheGen  uint64 // incremented by invalidateReservedQuotaCache
+	reservedQuotaMutex     sync.Mutex
+	runsBackgroundTasks    bool // whether runBackgroundTasks runs (see --controller-background-tasks)
+}
+
+// cachedStoragePools is the list of storage pools on a file system and the time after which it must be refreshed.
+type cachedStoragePools struct {
+	pools   []storagePool
+	expires time.Time
+}
+
+// reservedQuotaCacheKey identifies the quota/idRange (and storage pool) of a file system getReservedQuota reports on.
+type reservedQuotaCacheKey struct {
+	sysMgmtdHost  string
+	storagePoolID string
+	cfg           quotaConfig
+}
+
+// cachedReservedQuota is the capacity reserved in a quota/idRange and the time after which it must be refreshed.
+type cachedReservedQuota struct {
+	reserved uint64
+	expires  time.Time
+}
+
+// pendingDeletion is a directory in a pendingDeletionDirBasePath (represented by a beegfsVolume) waiting for a
+// deletion worker. A deletion worker logs with the request ID in ctx.
+type pendingDeletion struct {
+	ctx context.Context
+	dir beegfsVolume
+}
+
+// backgroundCopy tracks a copy (for a snapshot or a volume content source) running in the background. done is closed
+// when the copy ends and err is only valid after that.
+type backgroundCopy struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
 }
 
 func NewControllerServer(nodeID string, pluginConfig PluginConfig, clientConfTemplatePath, csDataDir string) *controllerServer {
@@ -60,6 +171,14 @@ func NewControllerServer(nodeID string, pluginConfig PluginConfig, clientConfTem
 		caps: getControllerServiceCapabilities(
 			[]csi.ControllerServiceCapability_RPC_Type{
 				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+				csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+				csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+				csi.ControllerServiceCapability_RPC_GET_VOLUME,
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+				csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+				csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+				csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+				csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 			}),
 		nodeID:                 nodeID,
 		pluginConfig:           pluginConfig,
@@ -67,12 +186,17 @@ func NewControllerServer(nodeID string, pluginConfig PluginConfig, clientConfTem
 		csDataDir:              csDataDir,
 		mounter:                nil,
 		volumeIDsInFlight:      newThreadSafeStringLock(),
+		copiesInFlight:         make(map[string]*backgroundCopy),
+		deletionsQueued:        make(map[string]struct{}),
+		storagePoolCache:       make(map[string]cachedStoragePools),
+		reservedQuotaCache:     make(map[reservedQuotaCacheKey]cachedReservedQuota),
 	}
 }
 
 // CreateVolume generates a new volumeID and uses beegfs-ctl to create an associated directory at the proper location
 // on the referenced BeeGFS file system. CreateVolume uses beegfs-ctl instead of mounting the file system and using
-// mkdir because it needs to be able to use beegfs-ctl to set stripe patterns, etc. anyway.
+// mkdir because it needs to be able to use beegfs-ctl to set stripe patterns, etc. anyway. If a volume content source
+// is provided, CreateVolume copies it into the new directory (see populateVolume).
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	// Check arguments.
 	volName := req.GetName()
@@ -94,11 +218,13 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if !ok {
 		return nil, status.Errorf(codes.InvalidArgument, "%s not provided", sysMgmtdHostKey)
 	}
-	volDirBasePathBeegfsRoot, ok := reqParams[volDirBasePathKey]
-	if !ok {
+	if _, ok := reqParams[volDirBasePathKey]; !ok {
 		return nil, status.Errorf(codes.InvalidArgument, "%s not provided", volDirBasePathKey)
 	}
-	volDirBasePathBeegfsRoot = path.Clean(path.Join("/", volDirBasePathBeegfsRoot))
+	volDirBasePathBeegfsRoot, volDirName, volDirTemplated, err := getVolDirFromParams(reqParams, volName)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.InvalidArgument, err)
+	}
 	permissionsConfig, err := getPermissionsConfigFromParams(reqParams)
 	if err != nil {
 		return nil, newGrpcErrorFromCause(codes.InvalidArgument, err)
@@ -107,13 +233,54 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if err != nil {
 		return nil, newGrpcErrorFromCause(codes.InvalidArgument, err)
 	}
+	quotaConfig, err := getQuotaConfigFromParams(reqParams, permissionsConfig)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.InvalidArgument, err)
+	}
+	deletePolicy, err := getDeletePolicyFromParams(reqParams)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.InvalidArgument, err)
+	}
+	var capacityBytes int64
+	if quotaConfig.enforceCapacity {
+		if capacityBytes = req.GetCapacityRange().GetRequiredBytes(); capacityBytes == 0 {
+			capacityBytes = req.GetCapacityRange().GetLimitBytes()
+		}
+		if capacityBytes == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Capacity range not provided but %s is set",
+				quotaEnforceCapacityKey)
+		}
+		if quotaConfig.idType == quotaIDTypeGID {
+			// New files and directories must inherit the volume's group for the group quota to account for them.
+			permissionsConfig.mode |= 0o2000
+		}
+	}
+	var contentSource beegfsVolume
+	var contentSourceID string
+	var contentSourceIsSnapshot bool
+	if volContentSource := req.GetVolumeContentSource(); volContentSource != nil {
+		if snapshot := volContentSource.GetSnapshot(); snapshot != nil {
+			contentSourceID = snapshot.GetSnapshotId()
+			contentSourceIsSnapshot = true
+			contentSource, err = cs.newBeegfsSnapshotFromID(contentSourceID)
+		} else if volume := volContentSource.GetVolume(); volume != nil {
+			contentSourceID = volume.GetVolumeId()
+			contentSource, err = cs.newBeegfsVolumeFromID(contentSourceID)
+		} else {
+			return nil, status.Error(codes.InvalidArgument, "Volume content source type not supported")
+		}
+		if err != nil {
+			return nil, newGrpcErrorFromCause(codes.NotFound, err)
+		}
+	}
 
 	// Construct an internal representation of the volume and ensure no other request is currently referencing it.
-	vol := cs.newBeegfsVolume(sysMgmtdHost, volDirBasePathBeegfsRoot, volName)
+	vol := cs.newBeegfsVolume(sysMgmtdHost, volDirBasePathBeegfsRoot, volDirName)
 	if !cs.volumeIDsInFlight.obtainLockOnString(vol.volumeID) {
 		return nil, status.Errorf(codes.Aborted, "volumeID %s is in use by another request", vol.volumeID)
 	}
-	defer cs.volumeIDsInFlight.releaseLockOnString(vol.volumeID)
+	defer func() { cs.volumeIDsInFlight.releaseLockOnString(vol.volumeID) }() // claimVolDir may replace vol
+	cs.addVolDirBasePath(ctx, sysMgmtdHost, volDirBasePathBeegfsRoot)
 
 	// Write configuration files but do not mount BeeGFS.
 	defer func() {
@@ -129,38 +296,95 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if err := writeClientFiles(ctx, vol, cs.clientConfTemplatePath); err != nil {
 		return nil, newGrpcErrorFromCause(codes.Internal, err)
 	}
+	if volDirTemplated {
+		if vol, err = cs.claimVolDir(ctx, vol, volName); err != nil {
+			return nil, err
+		}
+	}
 
 	// Use beegfs-ctl to create the directory and stripe it appropriately.
-	if err := cs.ctlExec.createDirectoryForVolume(ctx, vol, permissionsConfig); err != nil {
+	if stripePatternConfig, err = cs.resolveStoragePoolName(ctx, vol, stripePatternConfig); err != nil {
+		return nil, err
+	}
+	if stripePatternConfig, err = cs.selectStoragePool(ctx, vol, stripePatternConfig); err != nil {
+		return nil, err
+	}
+	if err := validateMirroringForVolume(ctx, cs.ctlExec, vol, stripePatternConfig); err != nil {
+		return nil, err
+	}
+	if stripePatternConfig.metadataMirroring == "true" {
+		if err := cs.validateMetadataMirroringOfAncestor(ctx, vol); err != nil {
+			return nil, err
+		}
+	}
+	if err := cs.ctlExec.createDirectoryForVolume(ctx, vol, permissionsConfig, stripePatternConfig); err != nil {
 		return nil, newGrpcErrorFromCause(codes.Internal, err)
 	}
 	if err := cs.ctlExec.setPatternForVolume(ctx, vol, stripePatternConfig); err != nil {
 		return nil, newGrpcErrorFromCause(codes.Internal, err)
 	}
-
-	// Mount BeeGFS and use OS tools to change the access mode only if beegfs-ctl could not handle the access mode
-	// on its own. beegfs-ctl cannot handle access modes with special permissions (e.g. the set gid bit). These are
-	// governed by the first three bits of a 12 bit access mode (i.e. the first digit in four digit octal notation).
-	if permissionsConfig.hasSpecialPermissions() {
-		if err := mountIfNecessary(ctx, vol, cs.mounter); err != nil {
+	if stripePatternConfig.metadataMirroring == "true" {
+		// An existing directory may not have inherited metadata mirroring from its current parent, so check it too.
+		info, err := cs.ctlExec.statDirectoryForVolume(ctx, vol)
+		if err != nil {
 			return nil, newGrpcErrorFromCause(codes.Internal, err)
 		}
+		if !info.isMetadataMirrored() {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is true, but metadata mirroring is not enabled "+
+				"for %s on %s", metadataMirroringKey, vol.volDirBasePathBeegfsRoot, vol.sysMgmtdHost)
+		}
+	}
+
+	// Mount BeeGFS to record how and for whom the volume was created (including its deletePolicy) in its metadata
+	// file. Use OS tools to change the access mode only if beegfs-ctl could not handle the access mode on its own.
+	// beegfs-ctl cannot handle access modes with special permissions (e.g. the set gid bit). These are governed by the
+	// first three bits of a 12 bit access mode (i.e. the first digit in four digit octal notation).
+	if err := mountIfNecessary(ctx, vol, cs.mounter); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := recordVolumeCreation(vol, volName, reqParams, deletePolicy); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if quotaConfig.enforceCapacity {
+		if capacityBytes, err = cs.enforceCapacityForVolume(ctx, vol, quotaConfig, capacityBytes); err != nil {
+			return nil, err
+		}
+	}
+	if permissionsConfig.hasSpecialPermissions() {
 		LogDebug(ctx, "Applying permissions", "permissions", fmt.Sprintf("%4o", permissionsConfig.mode),
 			"volDirPath", vol.volDirPath, "volumeID", vol.volumeID)
 		if err := os.Chmod(vol.volDirPath, permissionsConfig.goFileMode()); err != nil {
 			return nil, newGrpcErrorFromCause(codes.Internal, err)
 		}
 	}
+	if contentSourceID != "" {
+		if err := cs.populateVolume(ctx, vol, contentSource, contentSourceID, contentSourceIsSnapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	// Record the storage pool CreateVolume chose so that it is visible on the PV.
+	var volContext map[string]string
+	if len(stripePatternConfig.storagePoolCandidates) != 0 {
+		volContext = map[string]string{stripePatternStoragePoolIDKey: stripePatternConfig.storagePoolID}
+	}
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId: vol.volumeID,
+			VolumeId:      vol.volumeID,
+			CapacityBytes: capacityBytes,
+			ContentSource: req.GetVolumeContentSource(),
+			VolumeContext: volContext,
 		},
 	}, nil
 }
 
 // DeleteVolume deletes the directory referenced in the volumeID from the BeeGFS file system referenced in the
-// volumeID.
+// volumeID. DeleteVolume atomically moves the directory into the pendingDeletionDirBasePath of the file system and
+// returns before the directory is actually removed (see scheduleDeletion). If the volume was created with a deletePolicy
+// of retain-in-place, DeleteVolume leaves the directory where it is. If it was created with a deletePolicy of
+// move-to-trash, DeleteVolume moves the directory into the trashDirBasePath, where the controller service removes it
+// once the trashRetentionPeriod elapses (see reapTrash).
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	// Check arguments.
 	volumeID := req.GetVolumeId()
@@ -177,6 +401,7 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return nil, status.Errorf(codes.Aborted, "volumeID %s is in use by another request", vol.volumeID)
 	}
 	defer cs.volumeIDsInFlight.releaseLockOnString(vol.volumeID)
+	cs.cancelCopy(ctx, vol.volumeID)
 
 	// Write configuration files and mount BeeGFS.
 	defer func() {
@@ -196,13 +421,56 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return nil, newGrpcErrorFromCause(codes.Internal, err)
 	}
 
-	// Delete volume from mounted BeeGFS.
-	LogDebug(ctx, "Deleting BeeGFS directory", "volDirBasePathBeegfsRoot", vol.volDirBasePathBeegfsRoot, "volumeID", vol.volumeID)
-	if err = fs.RemoveAll(vol.volDirPath); err != nil {
-		err = errors.WithStack(err)
+	// Read any metadata before deleting the volume so we know its deletePolicy and whether it was assigned a quota ID.
+	metadata, _, err := readVolumeMetadata(vol)
+	if err != nil {
 		return nil, newGrpcErrorFromCause(codes.Internal, err)
 	}
 
+	switch metadata.getDeletePolicy() {
+	case deletePolicyRetainInPlace:
+		LogDebug(ctx, "Retaining BeeGFS directory", "volDirPathBeegfsRoot", vol.volDirPathBeegfsRoot,
+			"volumeID", vol.volumeID)
+	case deletePolicyMoveToTrash:
+		if err = moveVolumeToTrash(ctx, vol, metadata); err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		if !cs.runsBackgroundTasks {
+			LogError(ctx, errBackgroundTasksDisabled, "Volume moved to trash will not be removed",
+				"volumeID", vol.volumeID)
+		}
+	default:
+		// Delete volume from mounted BeeGFS. Removing a large directory can take hours, so a deletion worker does it in
+		// the background.
+		LogDebug(ctx, "Deleting BeeGFS directory", "volDirBasePathBeegfsRoot", vol.volDirBasePathBeegfsRoot, "volumeID", vol.volumeID)
+		if err = cs.scheduleDeletion(ctx, vol, vol.volDirPath); err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		if !cs.runsBackgroundTasks {
+			LogError(ctx, errBackgroundTasksDisabled, "Deletion will not be resumed if it is interrupted",
+				"volumeID", vol.volumeID, "pendingDeletionDirBasePath", pendingDeletionDirBasePath)
+		}
+	}
+
+	// Release the volume's quota ID by clearing its limit. The ID is unused (and can be assigned to a new volume) once
+	// it has no limit and no usage, so it is not reused while a retained or trashed directory still contains files.
+	if metadata.hasQuota() {
+		LogDebug(ctx, "Clearing quota limit", "idType", metadata.QuotaIDType, "id", metadata.QuotaID,
+			"volumeID", vol.volumeID)
+		err = cs.ctlExec.setQuotaLimitForVolume(ctx, vol, metadata.QuotaPoolID, metadata.QuotaIDType,
+			metadata.QuotaID, 0)
+		cs.invalidateReservedQuotaCache(vol.sysMgmtdHost)
+		if err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+	}
+	if metadata.getDeletePolicy() != deletePolicyRetainInPlace {
+		if err = fs.Remove(vol.volMetadataPath); err != nil && !os.IsNotExist(err) {
+			err = errors.WithStack(err)
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+	}
+
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -242,10 +510,10 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}
 	defer cs.volumeIDsInFlight.releaseLockOnString(vol.volumeID)
 
-	// Write configuration files but do not mount BeeGFS.
+	// Write configuration files but only mount BeeGFS if parameters must be validated.
 	defer func() {
 		// Failure to clean up is an internal problem. The CO only cares whether or not the volume exists.
-		if err := cleanUpIfNecessary(ctx, vol, true); err != nil {
+		if err := unmountAndCleanUpIfNecessary(ctx, vol, true, cs.mounter); err != nil {
 			LogError(ctx, err, "Failed to clean up path for volume", "path", vol.mountDirPath, "volumeID", vol.volumeID)
 		}
 	}()
@@ -257,7 +525,8 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, newGrpcErrorFromCause(codes.Internal, err)
 	}
 
-	if _, err := cs.ctlExec.statDirectoryForVolume(ctx, vol); err != nil {
+	info, err := cs.ctlExec.statDirectoryForVolume(ctx, vol)
+	if err != nil {
 		if errors.As(err, &ctlNotExistError{}) {
 			return nil, newGrpcErrorFromCause(codes.NotFound, err)
 		}
@@ -265,20 +534,58 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}
 
 	confirmed, reason := isValidVolumeCapabilities(volCaps)
-	if confirmed {
-		return &csi.ValidateVolumeCapabilitiesResponse{
-			Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-				// VolumeContext: req.GetVolumeContext(),  // Our volumes do not include a context.
-				VolumeCapabilities: volCaps,
-				// TODO(webere, A142) Validate CreateVolumeRequest.parameters if provided.
-				// Parameters: req.GetParameters(),
-			},
-		}, nil
-	} else {
+	if !confirmed {
 		return &csi.ValidateVolumeCapabilitiesResponse{
 			Message: reason,
 		}, nil
 	}
+
+	// Compare parameters with the actual state of the directory first. Parameters that do not affect that state (e.g.
+	// deletePolicy) can only be confirmed if they were recorded when the volume was created (see
+	// recordVolumeCreation). Parameters are only echoed if all of them are confirmed.
+	var confirmedParams map[string]string
+	if reqParams := req.GetParameters(); len(reqParams) != 0 {
+		if err := mountIfNecessary(ctx, vol, cs.mounter); err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		volContext, err := getVolumeContextForEntryInfo(vol, info)
+		if err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		reason, unverifiedParams := getParametersMismatchForVolume(vol, volContext, reqParams)
+		if reason != "" {
+			return &csi.ValidateVolumeCapabilitiesResponse{
+				Message: reason,
+			}, nil
+		}
+		if len(unverifiedParams) != 0 {
+			metadata, _, err := readVolumeMetadata(vol)
+			if err != nil {
+				return nil, newGrpcErrorFromCause(codes.Internal, err)
+			}
+			if metadata.Parameters != nil {
+				if reason := getParametersMismatch(metadata, unverifiedParams); reason != "" {
+					return &csi.ValidateVolumeCapabilitiesResponse{
+						Message: reason,
+					}, nil
+				}
+				unverifiedParams = nil
+			}
+		}
+		if len(unverifiedParams) == 0 {
+			confirmedParams = reqParams
+		} else {
+			LogDebug(ctx, "Not confirming parameters that cannot be verified", "parameters", unverifiedParams,
+				"volumeID", vol.volumeID)
+		}
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: volCaps,
+			Parameters:         confirmedParams,
+		},
+	}, nil
 }
 
 func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
@@ -289,83 +596,1181 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
+// GetCapacity reports the free space available to new volumes on the BeeGFS file system referenced by the sysMgmtdHost
+// parameter. If the stripePattern/storagePoolID parameter is specified, only free space on the storage targets in that
+// storage pool is considered. If the permissions/uid or permissions/gid parameters are specified and a BeeGFS quota
+// limit is set for the referenced user or group, the reported capacity is further limited by the remaining quota. If
+// the quota/enforceCapacity parameter is true, capacity promised to (but not yet consumed by) existing volumes is not
+// reported as available.
 func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
+	// Check arguments.
+	reqParams := req.GetParameters()
+	sysMgmtdHost, ok := reqParams[sysMgmtdHostKey]
+	if !ok {
+		// There is no way to determine which BeeGFS file system the CO is interested in.
+		LogDebug(ctx, "No sysMgmtdHost provided; reporting no capacity")
+		return &csi.GetCapacityResponse{}, nil
+	}
+	permissionsConfig, err := getPermissionsConfigFromParams(reqParams)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.InvalidArgument, err)
+	}
+	stripePatternConfig, err := getStripePatternConfigFromParams(reqParams)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.InvalidArgument, err)
+	}
+	quotaConfig, err := getQuotaConfigFromParams(reqParams, permissionsConfig)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.InvalidArgument, err)
+	}
 
-func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
+	// Construct an internal representation of the file system. GetCapacity only reads, and the CO calls it
+	// concurrently (e.g. for every StorageClass), so it does not lock the file system. Instead, it writes its
+	// configuration files to a directory of its own, which no other request can clean up.
+	vol := cs.newBeegfsVolumeForFileSystem(sysMgmtdHost)
+	if err := fs.MkdirAll(cs.csDataDir, 0750); err != nil {
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	mountDirPath, err := fsutil.TempDir(cs.csDataDir, path.Base(vol.mountDirPath)+"_capacity_")
+	if err != nil {
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	vol = newBeegfsVolume(mountDirPath, sysMgmtdHost, vol.volDirPathBeegfsRoot, cs.pluginConfig)
 
-func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
+	// Write configuration files but do not mount BeeGFS.
+	defer func() {
+		// Failure to clean up is an internal problem. The CO only cares about the capacity.
+		if err := cleanUpIfNecessary(ctx, vol, true); err != nil {
+			LogError(ctx, err, "Failed to clean up path for file system", "path", vol.mountDirPath, "volumeID", vol.volumeID)
+		}
+	}()
+	if err := writeClientFiles(ctx, vol, cs.clientConfTemplatePath); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
 
-func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
+	if stripePatternConfig, err = cs.resolveStoragePoolName(ctx, vol, stripePatternConfig); err != nil {
+		return nil, err
+	}
+	capacity, err := getFreeSpaceForStoragePool(ctx, cs.ctlExec, vol, stripePatternConfig.storagePoolID)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
 
-func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
+	// TODO: Report the remaining quota as maximum_volume_size instead once the driver moves to CSI spec v1.4.0.
+	remaining, limited, err := getRemainingQuota(ctx, cs.ctlExec, vol, stripePatternConfig.storagePoolID,
+		permissionsConfig)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if limited && remaining < capacity {
+		capacity = remaining
+	}
 
-func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if quotaConfig.enforceCapacity {
+		reserved, err := cs.getCachedReservedQuota(ctx, vol, stripePatternConfig.storagePoolID, quotaConfig)
+		if err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		if reserved < capacity {
+			capacity -= reserved
+		} else {
+			capacity = 0
+		}
+	}
+
+	return &csi.GetCapacityResponse{AvailableCapacity: int64(capacity)}, nil
 }
 
-func (cs *controllerServer) ControllerGetVolume(ctx context.Context, in *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// ListVolumes lists the directories with a metadata file in every volDirBasePath of every BeeGFS file system the
+// controller service knows about (see getSysMgmtdHosts and getVolDirBasePaths). Hidden directories (e.g. the default
+// snapshotDirBasePath), the configured snapshotDirBasePath and trashDirBasePath, and directories that are themselves
+// volDirBasePaths (e.g. k8s/<namespace> below k8s when volDirBasePath is templated) are not volumes. The volume
+// condition of each volume reflects the state of all storage targets on its file system (see
+// getStorageTargetCondition). A volDirBasePath that cannot be listed (e.g. because its file system is unreachable) is
+// logged and skipped so that the volumes on other file systems are still listed. Volumes are listed in order of their
+// volume IDs, and the starting token is the volume ID of the last entry in the previous page (see paginate).
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, sysMgmtdHost := range cs.getSysMgmtdHosts(ctx) {
+		volDirBasePaths := cs.getVolDirBasePaths(ctx, sysMgmtdHost)
+		volDirBasePathSet := make(map[string]struct{}, len(volDirBasePaths))
+		for _, volDirBasePathBeegfsRoot := range volDirBasePaths {
+			volDirBasePathSet[volDirBasePathBeegfsRoot] = struct{}{}
+		}
+		for _, volDirBasePathBeegfsRoot := range volDirBasePaths {
+			baseDir := cs.newBeegfsVolume(sysMgmtdHost, path.Dir(volDirBasePathBeegfsRoot),
+				path.Base(volDirBasePathBeegfsRoot))
+			baseDirEntries, err := cs.listVolumesForVolDirBasePath(ctx, baseDir, volDirBasePathSet)
+			if err != nil {
+				LogError(ctx, err, "Failed to list volumes; skipping volDirBasePath", "volDirBasePath",
+					baseDir.volumeID)
+				continue
+			}
+			entries = append(entries, baseDirEntries...)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Volume.VolumeId < entries[j].Volume.VolumeId })
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, entry.Volume.VolumeId)
+	}
+	startIndex, endIndex, nextToken, err := paginate(req.GetStartingToken(), req.GetMaxEntries(), ids)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ListVolumesResponse{Entries: entries[startIndex:endIndex], NextToken: nextToken}, nil
 }
 
-func getControllerServiceCapabilities(cl []csi.ControllerServiceCapability_RPC_Type) []*csi.ControllerServiceCapability {
-	var csc []*csi.ControllerServiceCapability
+// CreateSnapshot copies the directory referenced in the source volumeID into a new directory under the
+// snapshotDirBasePath of the same BeeGFS file system. BeeGFS has no native snapshots, so a copy of a volume that is
+// being written is not even crash consistent (it may contain some files from before and some from after a change).
+// CreateSnapshot therefore requires that nothing changes in the source volume while it is copied (e.g. because the
+// workload using it was stopped or quiesced). It fails the snapshot with FAILED_PRECONDITION (and discards the copy) if
+// anything did (see copySnapshot). The copy runs in the background and CreateSnapshot waits up to copyWaitTime for it
+// to finish. If it does not, CreateSnapshot responds with ready_to_use set to false and reports the final state when
+// it is called again.
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	// Check arguments.
+	snapName := req.GetName()
+	if len(snapName) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot name not provided")
+	}
+	sourceVolumeID := req.GetSourceVolumeId()
+	if len(sourceVolumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Source volume ID not provided")
+	}
+	sourceVol, err := cs.newBeegfsVolumeFromID(sourceVolumeID)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.InvalidArgument, err)
+	}
 
-	for _, cap := range cl {
-		LogDebug(nil, "Enabling controller service capability", "capability", cap.String())
-		csc = append(csc, &csi.ControllerServiceCapability{
-			Type: &csi.ControllerServiceCapability_Rpc{
-				Rpc: &csi.ControllerServiceCapability_RPC{
-					Type: cap,
-				},
-			},
-		})
+	// Construct an internal representation of the snapshot and ensure no other request is currently referencing it.
+	snap := cs.newBeegfsSnapshot(sourceVol.sysMgmtdHost, snapName)
+	if !cs.volumeIDsInFlight.obtainLockOnString(snap.volumeID) {
+		return nil, status.Errorf(codes.Aborted, "snapshotID %s is in use by another request", snap.volumeID)
 	}
+	defer cs.volumeIDsInFlight.releaseLockOnString(snap.volumeID)
+	cs.addSysMgmtdHost(ctx, snap.sysMgmtdHost)
 
-	return csc
-}
+	// Write configuration files and mount BeeGFS.
+	defer func() {
+		// Failure to clean up is an internal problem. The CO only cares whether or not we created the snapshot.
+		if err := unmountAndCleanUpIfNecessary(ctx, snap, true, cs.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up path for snapshot", "path", snap.mountDirPath, "snapshotID", snap.volumeID)
+		}
+	}()
+	if err := fs.MkdirAll(snap.mountDirPath, 0750); err != nil {
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := writeClientFiles(ctx, snap, cs.clientConfTemplatePath); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := mountIfNecessary(ctx, snap, cs.mounter); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
 
-func getStripePatternConfigFromParams(reqParams map[string]string) (stripePatternConfig, error) {
-	cfg := stripePatternConfig{}
-	for param := range reqParams {
-		if strings.Contains(param, "stripePattern/") {
-			switch param {
-			case stripePatternStoragePoolIDKey:
-				cfg.storagePoolID = reqParams[stripePatternStoragePoolIDKey]
-			case stripePatternChunkSizeKey:
-				cfg.stripePatternChunkSize = reqParams[stripePatternChunkSizeKey]
-			case stripePatternNumTargetsKey:
-				cfg.stripePatternNumTargets = reqParams[stripePatternNumTargetsKey]
-			default:
-				return cfg, errors.Errorf("CreateVolume parameter invalid: %s", param)
+	metadata, exists, err := readSnapshotMetadata(snap)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if exists {
+		if metadata.SourceVolumeID != sourceVolumeID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for source volume %s",
+				snap.volumeID, metadata.SourceVolumeID)
+		}
+	} else {
+		if _, err := fs.Stat(path.Join(snap.mountPath, sourceVol.volDirPathBeegfsRoot)); err != nil {
+			if os.IsNotExist(err) {
+				return nil, status.Errorf(codes.NotFound, "source volume %s does not exist", sourceVolumeID)
 			}
+			err = errors.WithStack(err)
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		if err := fs.MkdirAll(snap.volDirBasePath, 0750); err != nil {
+			err = errors.WithStack(err)
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		metadata = snapshotMetadata{SourceVolumeID: sourceVolumeID, CreationTime: time.Now().UTC()}
+		if err := writeSnapshotMetadata(snap, metadata); err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
 		}
 	}
-	return cfg, nil
+
+	if !metadata.ReadyToUse {
+		// Either this is a new snapshot, a copy is already running, or a previous copy was interrupted (e.g. by a
+		// controller restart) and must start over.
+		c := cs.startCopy(ctx, snap.volumeID, func(copyCtx context.Context) error {
+			return cs.copySnapshot(copyCtx, snap, sourceVol, metadata)
+		})
+		select {
+		case <-c.done:
+			if errors.Is(c.err, errSourceModified) {
+				return nil, newGrpcErrorFromCause(codes.FailedPrecondition, c.err)
+			} else if c.err != nil {
+				return nil, newGrpcErrorFromCause(codes.Internal, c.err)
+			}
+		case <-time.After(copyWaitTime):
+		}
+		if metadata, _, err = readSnapshotMetadata(snap); err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+	}
+
+	csiSnap, err := newCsiSnapshot(snap.volumeID, metadata)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	return &csi.CreateSnapshotResponse{Snapshot: csiSnap}, nil
 }
 
-func getPermissionsConfigFromParams(reqParams map[string]string) (permissionsConfig, error) {
-	cfg := permissionsConfig{mode: defaultPermissionsMode}
-	for param := range reqParams {
-		if strings.HasPrefix(param, "permissions/") {
-			switch param {
-			case permissionsUIDKey:
-				val := reqParams[permissionsUIDKey]
-				uid, err := strconv.ParseUint(val, 10, 32) // UIDs are <= 32 bits.
-				if err != nil {
-					return cfg, errors.Wrap(err, "could not parse provided UID")
-				}
-				cfg.uid = uint32(uid)
-			case permissionsGIDKey:
+// DeleteSnapshot cancels any copy still running for the snapshot referenced in the snapshotID and deletes the
+// snapshot's directory and metadata file. A snapshotID that does not reference a directory under the configured
+// snapshotDirBasePath cannot belong to a snapshot this driver created, so DeleteSnapshot does nothing for it.
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	// Check arguments.
+	snapshotID := req.GetSnapshotId()
+	if len(snapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID not provided")
+	}
+
+	// Construct an internal representation of the snapshot and ensure no other request is currently referencing it.
+	snap, err := cs.newBeegfsSnapshotFromID(snapshotID)
+	if err != nil {
+		LogDebug(ctx, "Ignoring request to delete unknown snapshot", "snapshotID", snapshotID, "reason", err.Error())
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	if !cs.volumeIDsInFlight.obtainLockOnString(snap.volumeID) {
+		return nil, status.Errorf(codes.Aborted, "snapshotID %s is in use by another request", snap.volumeID)
+	}
+	defer cs.volumeIDsInFlight.releaseLockOnString(snap.volumeID)
+	cs.cancelCopy(ctx, snap.volumeID)
+
+	// Write configuration files and mount BeeGFS.
+	defer func() {
+		// Failure to clean up is an internal problem. The CO only cares whether or not we deleted the snapshot.
+		if err := unmountAndCleanUpIfNecessary(ctx, snap, true, cs.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up path for snapshot", "path", snap.mountDirPath, "snapshotID", snap.volumeID)
+		}
+	}()
+	if err := fs.MkdirAll(snap.mountDirPath, 0750); err != nil {
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := writeClientFiles(ctx, snap, cs.clientConfTemplatePath); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := mountIfNecessary(ctx, snap, cs.mounter); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+
+	// Delete the directory before the metadata file so that a partially deleted snapshot is still listed.
+	LogDebug(ctx, "Deleting BeeGFS directory", "snapshotDirBasePathBeegfsRoot", snap.volDirBasePathBeegfsRoot,
+		"snapshotID", snap.volumeID)
+	if err = fs.RemoveAll(snap.volDirPath); err != nil {
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err = fs.Remove(snap.volMetadataPath); err != nil && !os.IsNotExist(err) {
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots reads snapshot metadata files from the snapshotDirBasePath of every BeeGFS file system the controller
+// service knows about (see getSysMgmtdHosts). Filtering by snapshot ID or source volume ID limits the search to the
+// referenced file system. Snapshots are listed in order of their snapshot IDs, and the starting token is the snapshot
+// ID of the last entry in the previous page (see paginate).
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	var snapshots []*csi.Snapshot
+	if snapshotID := req.GetSnapshotId(); snapshotID != "" {
+		snap, err := cs.newBeegfsSnapshotFromID(snapshotID)
+		if err != nil {
+			// The snapshot cannot exist.
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		if snapshots, err = cs.listSnapshotsForSnapshotDir(ctx, snap.sysMgmtdHost, snap); err != nil {
+			return nil, err
+		}
+	} else {
+		var sysMgmtdHosts []string
+		if sourceVolumeID := req.GetSourceVolumeId(); sourceVolumeID != "" {
+			sourceVol, err := cs.newBeegfsVolumeFromID(sourceVolumeID)
+			if err != nil {
+				// There can be no snapshots of the volume.
+				return &csi.ListSnapshotsResponse{}, nil
+			}
+			sysMgmtdHosts = []string{sourceVol.sysMgmtdHost}
+		} else {
+			sysMgmtdHosts = cs.getSysMgmtdHosts(ctx)
+		}
+		for _, sysMgmtdHost := range sysMgmtdHosts {
+			snapDirBasePathBeegfsRoot := squashConfigForSysMgmtdHost(sysMgmtdHost, cs.pluginConfig).
+				snapshotDirBasePathBeegfsRoot()
+			snapDir := cs.newBeegfsVolume(sysMgmtdHost, path.Dir(snapDirBasePathBeegfsRoot),
+				path.Base(snapDirBasePathBeegfsRoot))
+			fsSnapshots, err := cs.listSnapshotsForSnapshotDir(ctx, sysMgmtdHost, snapDir)
+			if err != nil {
+				return nil, err
+			}
+			snapshots = append(snapshots, fsSnapshots...)
+		}
+	}
+	if sourceVolumeID := req.GetSourceVolumeId(); sourceVolumeID != "" {
+		filtered := make([]*csi.Snapshot, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			if snapshot.SourceVolumeId == sourceVolumeID {
+				filtered = append(filtered, snapshot)
+			}
+		}
+		snapshots = filtered
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].SnapshotId < snapshots[j].SnapshotId })
+
+	ids := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.SnapshotId)
+	}
+	startIndex, endIndex, nextToken, err := paginate(req.GetStartingToken(), req.GetMaxEntries(), ids)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, endIndex-startIndex)
+	for _, snapshot := range snapshots[startIndex:endIndex] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+	return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
+}
+
+// ControllerExpandVolume raises the BeeGFS quota limit of a volume created with quota/enforceCapacity to the requested
+// capacity and records the new capacity in the volume's metadata file. The capacity of other volumes is not enforced,
+// so ControllerExpandVolume simply reports success for them. No node expansion is ever required.
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	// Check arguments.
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+	if capacityBytes == 0 {
+		capacityBytes = req.GetCapacityRange().GetLimitBytes()
+	}
+	if capacityBytes == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range not provided")
+	}
+	if volCap := req.GetVolumeCapability(); volCap != nil {
+		if valid, reason := isValidVolumeCapability(volCap); !valid {
+			return nil, status.Errorf(codes.InvalidArgument, "Volume capability not supported: %s", reason)
+		}
+	}
+
+	// Construct an internal representation of the volume and ensure no other request is currently referencing it.
+	vol, err := cs.newBeegfsVolumeFromID(volumeID)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if !cs.volumeIDsInFlight.obtainLockOnString(vol.volumeID) {
+		return nil, status.Errorf(codes.Aborted, "volumeID %s is in use by another request", vol.volumeID)
+	}
+	defer cs.volumeIDsInFlight.releaseLockOnString(vol.volumeID)
+
+	// Write configuration files and mount BeeGFS.
+	defer func() {
+		// Failure to clean up is an internal problem. The CO only cares whether or not we expanded the volume.
+		if err := unmountAndCleanUpIfNecessary(ctx, vol, true, cs.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up path for volume", "path", vol.mountDirPath, "volumeID", vol.volumeID)
+		}
+	}()
+	if err := fs.MkdirAll(vol.mountDirPath, 0750); err != nil {
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := writeClientFiles(ctx, vol, cs.clientConfTemplatePath); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if _, err := cs.ctlExec.statDirectoryForVolume(ctx, vol); err != nil {
+		if errors.As(err, &ctlNotExistError{}) {
+			return nil, newGrpcErrorFromCause(codes.NotFound, err)
+		}
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := mountIfNecessary(ctx, vol, cs.mounter); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+
+	metadata, _, err := readVolumeMetadata(vol)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if !metadata.hasQuota() {
+		LogDebug(ctx, "Volume capacity is not enforced; nothing to expand", "volumeID", vol.volumeID)
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
+	}
+	if capacityBytes <= metadata.CapacityBytes {
+		// The volume is already large enough (e.g. because this is a repeated request).
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: metadata.CapacityBytes}, nil
+	}
+
+	LogDebug(ctx, "Raising quota limit", "idType", metadata.QuotaIDType, "id", metadata.QuotaID,
+		"capacityBytes", capacityBytes, "volumeID", vol.volumeID)
+	err = cs.ctlExec.setQuotaLimitForVolume(ctx, vol, metadata.QuotaPoolID, metadata.QuotaIDType, metadata.QuotaID,
+		uint64(capacityBytes))
+	cs.invalidateReservedQuotaCache(vol.sysMgmtdHost)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	metadata.CapacityBytes = capacityBytes
+	if err := writeVolumeMetadata(vol, metadata); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes, NodeExpansionRequired: false}, nil
+}
+
+// ControllerGetVolume reports the capacity recorded in the metadata file of the volume referenced in the volumeID (0
+// for volumes whose capacity is not enforced) and the stripe pattern and permissions of the volume directory (in the
+// volume context, using the same keys as the CreateVolume parameters). ControllerGetVolume returns NOT_FOUND if the
+// volume directory does not exist. It reports an abnormal volume condition (instead of an error) for a volume that
+// exists but is unhealthy: if beegfs-ctl cannot get entry info for the volume directory or any storage target in the
+// directory's storage pool is not online or needs a resync.
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	// Check arguments.
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	// Construct an internal representation of the volume and ensure no other request is currently referencing it.
+	vol, err := cs.newBeegfsVolumeFromID(volumeID)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if !cs.volumeIDsInFlight.obtainLockOnString(vol.volumeID) {
+		return nil, status.Errorf(codes.Aborted, "volumeID %s is in use by another request", vol.volumeID)
+	}
+	defer cs.volumeIDsInFlight.releaseLockOnString(vol.volumeID)
+
+	// Write configuration files and mount BeeGFS.
+	defer func() {
+		// Failure to clean up is an internal problem. The CO only cares about the volume.
+		if err := unmountAndCleanUpIfNecessary(ctx, vol, true, cs.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up path for volume", "path", vol.mountDirPath, "volumeID", vol.volumeID)
+		}
+	}()
+	if err := fs.MkdirAll(vol.mountDirPath, 0750); err != nil {
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := writeClientFiles(ctx, vol, cs.clientConfTemplatePath); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	info, err := cs.ctlExec.statDirectoryForVolume(ctx, vol)
+	if errors.As(err, &ctlNotExistError{}) {
+		return nil, status.Errorf(codes.NotFound, "volume directory %s does not exist on %s",
+			vol.volDirPathBeegfsRoot, vol.sysMgmtdHost)
+	} else if err != nil {
+		condition := &csi.VolumeCondition{
+			Abnormal: true,
+			Message: fmt.Sprintf("cannot get entry info for volume directory %s: %v", vol.volDirPathBeegfsRoot,
+				err),
+		}
+		LogDebug(ctx, "Volume condition is abnormal", "message", condition.Message, "volumeID", vol.volumeID)
+		return &csi.ControllerGetVolumeResponse{
+			Volume: &csi.Volume{VolumeId: vol.volumeID},
+			Status: &csi.ControllerGetVolumeResponse_VolumeStatus{VolumeCondition: condition},
+		}, nil
+	}
+	if err := mountIfNecessary(ctx, vol, cs.mounter); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+
+	metadata, _, err := readVolumeMetadata(vol)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	volContext, err := getVolumeContextForEntryInfo(vol, info)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	for key, value := range getVolumeContextForMetadata(metadata) {
+		volContext[key] = value
+	}
+	condition := getStorageTargetCondition(ctx, cs.ctlExec, vol, volContext[stripePatternStoragePoolIDKey])
+	if condition.Abnormal {
+		LogDebug(ctx, "Volume condition is abnormal", "message", condition.Message, "volumeID", vol.volumeID)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      vol.volumeID,
+			CapacityBytes: metadata.CapacityBytes,
+			VolumeContext: volContext,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{VolumeCondition: condition},
+	}, nil
+}
+
+func getControllerServiceCapabilities(cl []csi.ControllerServiceCapability_RPC_Type) []*csi.ControllerServiceCapability {
+	var csc []*csi.ControllerServiceCapability
+
+	for _, cap := range cl {
+		LogDebug(nil, "Enabling controller service capability", "capability", cap.String())
+		csc = append(csc, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: cap,
+				},
+			},
+		})
+	}
+
+	return csc
+}
+
+// getFreeSpaceForStoragePool returns the combined free space of all reachable storage targets in the storage pool
+// identified by storagePoolID. It returns the combined free space of all reachable storage targets in the file system if
+// storagePoolID is empty.
+func getFreeSpaceForStoragePool(ctx context.Context, ctlExec beegfsCtlExecutorInterface, vol beegfsVolume,
+	storagePoolID string) (uint64, error) {
+	targets, err := ctlExec.listStorageTargets(ctx, vol)
+	if err != nil {
+		return 0, err
+	}
+
+	var poolTargets map[string]bool
+	if storagePoolID != "" {
+		pools, err := ctlExec.listStoragePools(ctx, vol)
+		if err != nil {
+			return 0, err
+		}
+		for _, pool := range pools {
+			if pool.id == storagePoolID {
+				poolTargets = make(map[string]bool)
+				for _, target := range pool.targets {
+					poolTargets[target] = true
+				}
+			}
+		}
+		if poolTargets == nil {
+			return 0, errors.Errorf("storage pool %s does not exist on %s", storagePoolID, vol.sysMgmtdHost)
+		}
+	}
+
+	var freeSpace uint64
+	for _, target := range targets {
+		if poolTargets != nil && !poolTargets[target.id] {
+			continue
+		}
+		if !target.isOnline() {
+			LogDebug(ctx, "Ignoring free space on unreachable storage target", "targetID", target.id,
+				"reachability", target.reachability, "sysMgmtdHost", vol.sysMgmtdHost)
+			continue
+		}
+		freeSpace += target.freeBytes
+	}
+	return freeSpace, nil
+}
+
+// getStorageTargetCondition returns a VolumeCondition that is abnormal if any storage target in the storage pool with
+// the given ID (or any storage target on the file system if storagePoolID is empty or unknown) is not online or is not
+// in good condition (e.g. because it needs a resync). The condition is also abnormal if the storage targets cannot be
+// listed.
+func getStorageTargetCondition(ctx context.Context, ctlExec beegfsCtlExecutorInterface, vol beegfsVolume,
+	storagePoolID string) *csi.VolumeCondition {
+	targets, err := ctlExec.listStorageTargets(ctx, vol)
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("cannot list storage targets: %v", err)}
+	}
+
+	var poolTargets map[string]bool
+	if storagePoolID != "" {
+		pools, err := ctlExec.listStoragePools(ctx, vol)
+		if err != nil {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("cannot list storage pools: %v", err)}
+		}
+		for _, pool := range pools {
+			if pool.id == storagePoolID {
+				poolTargets = make(map[string]bool)
+				for _, target := range pool.targets {
+					poolTargets[target] = true
+				}
+			}
+		}
+	}
+
+	var unhealthyTargets []string
+	for _, target := range targets {
+		if poolTargets != nil && !poolTargets[target.id] {
+			continue
+		}
+		if !target.isOnline() || !target.isGood() {
+			unhealthyTargets = append(unhealthyTargets, fmt.Sprintf("%s (%s, %s)", target.id, target.reachability,
+				target.consistency))
+		}
+	}
+	if len(unhealthyTargets) != 0 {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("storage targets are offline or need a "+
+			"resync: %s", strings.Join(unhealthyTargets, ", "))}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume directory and storage targets are healthy"}
+}
+
+// getVolumeContextForEntryInfo returns a volume context that describes the stripe pattern in the output of a
+// "beegfs-ctl --getentryinfo" command and the owner and access mode of the volume directory. It uses the same keys as
+// the CreateVolume parameters. vol must be mounted.
+func getVolumeContextForEntryInfo(vol beegfsVolume, info entryInfo) (map[string]string, error) {
+	volContext := make(map[string]string)
+	if info.chunkSize != "" {
+		volContext[stripePatternChunkSizeKey] = info.chunkSize
+	}
+	if info.numTargets != 0 {
+		volContext[stripePatternNumTargetsKey] = strconv.FormatUint(info.numTargets, 10)
+	}
+	if info.storagePoolID != "" {
+		volContext[stripePatternStoragePoolIDKey] = info.storagePoolID
+		if info.storagePoolName != "" {
+			volContext[stripePatternStoragePoolNameKey] = info.storagePoolName
+		}
+	}
+	if info.stripePatternType != "" {
+		volContext[stripePatternTypeKey] = info.stripePatternType
+	}
+	volContext[metadataMirroringKey] = strconv.FormatBool(info.isMetadataMirrored())
+
+	fileInfo, err := fs.Stat(vol.volDirPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		volContext[permissionsUIDKey] = strconv.FormatUint(uint64(stat.Uid), 10)
+		volContext[permissionsGIDKey] = strconv.FormatUint(uint64(stat.Gid), 10)
+		volContext[permissionsModeKey] = fmt.Sprintf("%04o", stat.Mode&0o7777)
+	}
+	return volContext, nil
+}
+
+// getRemainingQuota returns the smallest remaining BeeGFS quota of the user and group referenced by a permissionsConfig
+// in the storage pool identified by storagePoolID (or the default storage pool if storagePoolID is empty) and true if a
+// quota limit is set for either. It returns false if neither is set. It returns an error if quota information is not
+// available (e.g. because quotas are not enabled on the file system) instead of reporting capacity the user or group
+// may not be able to consume.
+func getRemainingQuota(ctx context.Context, ctlExec beegfsCtlExecutorInterface, vol beegfsVolume, storagePoolID string,
+	cfg permissionsConfig) (remaining uint64, limited bool, err error) {
+	var ids []quotaInfo
+	if cfg.uid != 0 {
+		ids = append(ids, quotaInfo{idType: quotaIDTypeUID, id: cfg.uid})
+	}
+	if cfg.gid != 0 {
+		ids = append(ids, quotaInfo{idType: quotaIDTypeGID, id: cfg.gid})
+	}
+	for _, id := range ids {
+		quotas, err := ctlExec.getQuotasForVolume(ctx, vol, storagePoolID, id.idType, []uint32{id.id})
+		if err != nil {
+			return 0, false, errors.WithMessagef(err, "failed to get quota information for %s %d", id.idType, id.id)
+		}
+		quota := quotas[0]
+		if quota.sizeLimit == 0 {
+			continue
+		}
+		var quotaRemaining uint64
+		if quota.sizeLimit > quota.sizeUsed {
+			quotaRemaining = quota.sizeLimit - quota.sizeUsed
+		}
+		if !limited || quotaRemaining < remaining {
+			remaining = quotaRemaining
+			limited = true
+		}
+	}
+	return remaining, limited, nil
+}
+
+// enforceCapacityForVolume assigns a dedicated quota ID to a volume, limits the quota of that ID to capacityBytes in
+// the storage pool of the volume's directory, and makes the ID the owner (uid) or group (gid) of the volume's
+// directory. It records the assignment in the volume's metadata file so it can be reused by a repeated CreateVolume
+// and released by DeleteVolume. enforceCapacityForVolume assumes BeeGFS is mounted and returns the enforced capacity
+// (which may be larger than capacityBytes if the volume already existed and was expanded) or a gRPC error.
+func (cs *controllerServer) enforceCapacityForVolume(ctx context.Context, vol beegfsVolume, cfg quotaConfig,
+	capacityBytes int64) (int64, error) {
+	metadata, exists, err := readVolumeMetadata(vol)
+	if err != nil {
+		return 0, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if exists && metadata.hasQuota() {
+		// This is a repeated request for a volume that was already assigned an ID.
+		if metadata.CapacityBytes < capacityBytes || metadata.QuotaIDType != cfg.idType {
+			return 0, status.Errorf(codes.AlreadyExists, "volume %s already exists with smaller capacity or different %s",
+				vol.volumeID, quotaIDTypeKey)
+		}
+	} else {
+		// BeeGFS limits the usage of an ID separately in each storage pool. Files are stored in the storage pool of
+		// their directory.
+		info, err := cs.ctlExec.statDirectoryForVolume(ctx, vol)
+		if err != nil {
+			return 0, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		id, err := cs.claimQuotaID(ctx, vol, info.storagePoolID, cfg, uint64(capacityBytes))
+		if errors.Is(err, errNoFreeQuotaID) {
+			return 0, newGrpcErrorFromCause(codes.ResourceExhausted, err)
+		} else if err != nil {
+			return 0, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		metadata = volumeMetadata{CapacityBytes: capacityBytes, QuotaIDType: cfg.idType, QuotaID: id,
+			QuotaPoolID: info.storagePoolID}
+		if err := writeVolumeMetadata(vol, metadata); err != nil {
+			// Release the ID so it does not leak.
+			releaseErr := cs.ctlExec.setQuotaLimitForVolume(ctx, vol, info.storagePoolID, cfg.idType, id, 0)
+			cs.invalidateReservedQuotaCache(vol.sysMgmtdHost)
+			if releaseErr != nil {
+				LogError(ctx, releaseErr, "Failed to release quota ID", "idType", cfg.idType, "id", id,
+					"volumeID", vol.volumeID)
+			}
+			return 0, newGrpcErrorFromCause(codes.Internal, err)
+		}
+	}
+
+	uid, gid := -1, -1 // -1 leaves the owner or group unchanged.
+	if metadata.QuotaIDType == quotaIDTypeUID {
+		uid = int(metadata.QuotaID)
+	} else {
+		gid = int(metadata.QuotaID)
+	}
+	LogDebug(ctx, "Applying quota ID", "idType", metadata.QuotaIDType, "id", metadata.QuotaID,
+		"volDirPath", vol.volDirPath, "volumeID", vol.volumeID)
+	if err := fs.Chown(vol.volDirPath, uid, gid); err != nil {
+		err = errors.WithStack(err)
+		return 0, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	return metadata.CapacityBytes, nil
+}
+
+// claimQuotaID searches the quota/idRange of a quotaConfig for an ID that has no quota limit and no usage in any
+// storage pool of the BeeGFS file system referenced by vol and claims it by setting its quota limit in the storage pool
+// identified by storagePoolID to sizeLimit. claimQuotaID returns errNoFreeQuotaID if there is no such ID.
+func (cs *controllerServer) claimQuotaID(ctx context.Context, vol beegfsVolume, storagePoolID string, cfg quotaConfig,
+	sizeLimit uint64) (uint32, error) {
+	// Only one goroutine may search for and claim an ID at a time. Otherwise, two volumes could claim the same ID.
+	cs.quotaIDMutex.Lock()
+	defer cs.quotaIDMutex.Unlock()
+
+	// An ID that is in use in another storage pool belongs to another volume (or to something else entirely).
+	pools, err := cs.getStoragePools(ctx, vol, true)
+	if err != nil {
+		return 0, err
+	}
+	var storagePoolIDs []string
+	for _, pool := range pools {
+		storagePoolIDs = append(storagePoolIDs, pool.id)
+	}
+
+	var unusedID *uint32
+	err = walkQuotaIDRange(ctx, cs.ctlExec, vol, storagePoolIDs, cfg, func(id uint32, quotas []quotaInfo) bool {
+		for _, quota := range quotas {
+			if quota.sizeLimit != 0 || quota.sizeUsed != 0 || quota.inodesUsed != 0 {
+				return true // This ID is already in use.
+			}
+		}
+		unusedID = &id
+		return false
+	})
+	if err != nil {
+		return 0, err
+	}
+	if unusedID == nil {
+		return 0, errors.Wrapf(errNoFreeQuotaID, "%s range %d-%d", cfg.idType, cfg.idRangeStart, cfg.idRangeEnd)
+	}
+
+	LogDebug(ctx, "Claiming quota ID", "idType", cfg.idType, "id", *unusedID, "storagePoolID", storagePoolID,
+		"sizeLimit", sizeLimit, "volumeID", vol.volumeID)
+	err = cs.ctlExec.setQuotaLimitForVolume(ctx, vol, storagePoolID, cfg.idType, *unusedID, sizeLimit)
+	cs.invalidateReservedQuotaCache(vol.sysMgmtdHost)
+	if err != nil {
+		return 0, err
+	}
+	return *unusedID, nil
+}
+
+// walkQuotaIDRange calls fn with the quota information of each ID in the quota/idRange of a quotaConfig (in ascending
+// order) until fn returns false. fn receives one quotaInfo for each storage pool in storagePoolIDs (an empty string
+// identifies the default storage pool). walkQuotaIDRange requests the quota information of up to quotaIDBatchSize IDs
+// at a time.
+func walkQuotaIDRange(ctx context.Context, ctlExec beegfsCtlExecutorInterface, vol beegfsVolume,
+	storagePoolIDs []string, cfg quotaConfig, fn func(id uint32, quotas []quotaInfo) bool) error {
+	for start := uint64(cfg.idRangeStart); start <= uint64(cfg.idRangeEnd); start += quotaIDBatchSize {
+		var ids []uint32
+		for id := start; id < start+quotaIDBatchSize && id <= uint64(cfg.idRangeEnd); id++ {
+			ids = append(ids, uint32(id))
+		}
+		quotasByPool := make([][]quotaInfo, len(storagePoolIDs))
+		for i, storagePoolID := range storagePoolIDs {
+			quotas, err := ctlExec.getQuotasForVolume(ctx, vol, storagePoolID, cfg.idType, ids)
+			if err != nil {
+				return err
+			}
+			quotasByPool[i] = quotas
+		}
+		for i, id := range ids {
+			var quotas []quotaInfo
+			for _, poolQuotas := range quotasByPool {
+				quotas = append(quotas, poolQuotas[i])
+			}
+			if !fn(id, quotas) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// getReservedQuota returns the capacity promised to existing volumes in the quota/idRange of a quotaConfig but not yet
+// consumed by them (i.e. the sum of the remaining quota of every ID in the range that has a limit) in the storage pool
+// identified by storagePoolID (or the default storage pool if storagePoolID is empty).
+func getReservedQuota(ctx context.Context, ctlExec beegfsCtlExecutorInterface, vol beegfsVolume, storagePoolID string,
+	cfg quotaConfig) (reserved uint64, err error) {
+	err = walkQuotaIDRange(ctx, ctlExec, vol, []string{storagePoolID}, cfg, func(id uint32, quotas []quotaInfo) bool {
+		if quotas[0].sizeLimit > quotas[0].sizeUsed {
+			reserved += quotas[0].sizeLimit - quotas[0].sizeUsed
+		}
+		return true
+	})
+	return reserved, err
+}
+
+// getCachedReservedQuota returns the result of getReservedQuota from the reserved quota cache, refreshing the cache if
+// necessary.
+func (cs *controllerServer) getCachedReservedQuota(ctx context.Context, vol beegfsVolume, storagePoolID string,
+	cfg quotaConfig) (uint64, error) {
+	key := reservedQuotaCacheKey{sysMgmtdHost: vol.sysMgmtdHost, storagePoolID: storagePoolID, cfg: cfg}
+	cs.reservedQuotaMutex.Lock()
+	cached, ok := cs.reservedQuotaCache[key]
+	gen := cs.reservedQuotaCacheGen
+	cs.reservedQuotaMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.reserved, nil
+	}
+
+	reserved, err := getReservedQuota(ctx, cs.ctlExec, vol, storagePoolID, cfg)
+	if err != nil {
+		return 0, err
+	}
+	cs.reservedQuotaMutex.Lock()
+	defer cs.reservedQuotaMutex.Unlock()
+	if cs.reservedQuotaCache == nil {
+		cs.reservedQuotaCache = make(map[reservedQuotaCacheKey]cachedReservedQuota)
+	}
+	// A quota limit that changed while getReservedQuota was running may not be reflected in reserved.
+	if gen == cs.reservedQuotaCacheGen {
+		cs.reservedQuotaCache[key] = cachedReservedQuota{reserved: reserved,
+			expires: time.Now().Add(reservedQuotaCacheTTL)}
+	}
+	return reserved, nil
+}
+
+// invalidateReservedQuotaCache removes the cached reserved quotas of a file system. It must be called whenever the
+// controller service changes a quota limit on the file system.
+func (cs *controllerServer) invalidateReservedQuotaCache(sysMgmtdHost string) {
+	cs.reservedQuotaMutex.Lock()
+	defer cs.reservedQuotaMutex.Unlock()
+	cs.reservedQuotaCacheGen++
+	for key := range cs.reservedQuotaCache {
+		if key.sysMgmtdHost == sysMgmtdHost {
+			delete(cs.reservedQuotaCache, key)
+		}
+	}
+}
+
+func getStripePatternConfigFromParams(reqParams map[string]string) (stripePatternConfig, error) {
+	cfg := stripePatternConfig{}
+	for param := range reqParams {
+		if strings.Contains(param, "stripePattern/") {
+			switch param {
+			case stripePatternStoragePoolIDKey:
+				cfg.storagePoolID = reqParams[stripePatternStoragePoolIDKey]
+			case stripePatternStoragePoolNameKey:
+				cfg.storagePoolName = reqParams[stripePatternStoragePoolNameKey]
+			case stripePatternStoragePoolCandidatesKey:
+				candidates, err := parseStoragePoolCandidates(reqParams[stripePatternStoragePoolCandidatesKey])
+				if err != nil {
+					return cfg, errors.WithMessagef(err, "invalid %s", param)
+				}
+				cfg.storagePoolCandidates = candidates
+			case stripePatternChunkSizeKey:
+				cfg.stripePatternChunkSize = reqParams[stripePatternChunkSizeKey]
+			case stripePatternNumTargetsKey:
+				cfg.stripePatternNumTargets = reqParams[stripePatternNumTargetsKey]
+			case stripePatternTypeKey:
+				patternType := strings.ToLower(reqParams[stripePatternTypeKey])
+				if patternType != stripePatternTypeRAID0 && patternType != stripePatternTypeBuddyMirror {
+					return cfg, errors.Errorf("invalid %s %s", param, reqParams[param])
+				}
+				cfg.stripePatternType = patternType
+			case metadataMirroringKey:
+				metadataMirroring, err := strconv.ParseBool(reqParams[metadataMirroringKey])
+				if err != nil {
+					return cfg, errors.Wrapf(err, "could not parse %s", param)
+				}
+				cfg.metadataMirroring = strconv.FormatBool(metadataMirroring)
+			default:
+				return cfg, errors.Errorf("CreateVolume parameter invalid: %s", param)
+			}
+		}
+	}
+	numPoolParams := 0
+	for _, specified := range []bool{cfg.storagePoolID != "", cfg.storagePoolName != "",
+		len(cfg.storagePoolCandidates) != 0} {
+		if specified {
+			numPoolParams++
+		}
+	}
+	if numPoolParams > 1 {
+		return stripePatternConfig{}, errors.Errorf("only one of %s, %s, and %s may be specified",
+			stripePatternStoragePoolIDKey, stripePatternStoragePoolNameKey, stripePatternStoragePoolCandidatesKey)
+	}
+	return cfg, nil
+}
+
+// resolveStoragePoolName sets the storagePoolID of a stripePatternConfig to the ID of the storage pool whose
+// description matches its storagePoolName on the BeeGFS file system referenced by vol. The storage pools of each file
+// system are cached for storagePoolCacheTTL, but the cache is refreshed before a name is reported as unknown (e.g.
+// because the storage pool was just created). resolveStoragePoolName returns gRPC errors.
+func (cs *controllerServer) resolveStoragePoolName(ctx context.Context, vol beegfsVolume,
+	cfg stripePatternConfig) (stripePatternConfig, error) {
+	if cfg.storagePoolName == "" {
+		return cfg, nil
+	}
+	var pools []storagePool
+	for _, refresh := range []bool{false, true} {
+		var err error
+		if pools, err = cs.getStoragePools(ctx, vol, refresh); err != nil {
+			return cfg, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		for _, pool := range pools {
+			if pool.description == cfg.storagePoolName {
+				LogDebug(ctx, "Resolved storage pool name", "storagePoolName", cfg.storagePoolName,
+					"storagePoolID", pool.id, "sysMgmtdHost", vol.sysMgmtdHost)
+				cfg.storagePoolID = pool.id
+				return cfg, nil
+			}
+		}
+	}
+	var names []string
+	for _, pool := range pools {
+		names = append(names, pool.description)
+	}
+	return cfg, status.Errorf(codes.InvalidArgument, "%s %s does not exist on %s (storage pools: %s)",
+		stripePatternStoragePoolNameKey, cfg.storagePoolName, vol.sysMgmtdHost, strings.Join(names, ", "))
+}
+
+// selectStoragePool sets the storagePoolID of a stripePatternConfig to the ID of the candidate storage pool with the
+// most weighted free space on the online storage targets it contains. If vol's directory already exists (e.g. because
+// CreateVolume is being retried), selectStoragePool keeps its current storage pool instead. Like
+// resolveStoragePoolName, selectStoragePool refreshes the storage pool cache before reporting a candidate as unknown.
+// selectStoragePool returns gRPC errors.
+func (cs *controllerServer) selectStoragePool(ctx context.Context, vol beegfsVolume,
+	cfg stripePatternConfig) (stripePatternConfig, error) {
+	if len(cfg.storagePoolCandidates) == 0 {
+		return cfg, nil
+	}
+	info, err := cs.ctlExec.statDirectoryForVolume(ctx, vol)
+	if err == nil {
+		if info.storagePoolID != "" {
+			LogDebug(ctx, "Keeping storage pool of existing BeeGFS directory", "storagePoolID",
+				info.storagePoolID, "volumeID", vol.volumeID)
+			cfg.storagePoolID = info.storagePoolID
+			return cfg, nil
+		}
+	} else if !errors.As(err, &ctlNotExistError{}) {
+		return cfg, newGrpcErrorFromCause(codes.Internal, err)
+	}
+
+	var candidatePools []storagePool
+	for _, refresh := range []bool{false, true} {
+		pools, err := cs.getStoragePools(ctx, vol, refresh)
+		if err != nil {
+			return cfg, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		candidatePools = nil
+		for _, candidate := range cfg.storagePoolCandidates {
+			for _, pool := range pools {
+				if pool.id == candidate.pool || pool.description == candidate.pool {
+					candidatePools = append(candidatePools, pool)
+					break
+				}
+			}
+		}
+		if len(candidatePools) == len(cfg.storagePoolCandidates) {
+			break
+		}
+	}
+	if len(candidatePools) != len(cfg.storagePoolCandidates) {
+		return cfg, status.Errorf(codes.InvalidArgument, "not every storage pool in %s exists on %s",
+			stripePatternStoragePoolCandidatesKey, vol.sysMgmtdHost)
+	}
+
+	targets, err := cs.ctlExec.listStorageTargets(ctx, vol)
+	if err != nil {
+		return cfg, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	freeBytes := make(map[string]uint64)
+	for _, target := range targets {
+		if target.isOnline() {
+			freeBytes[target.id] = target.freeBytes
+		}
+	}
+	var bestScore float64
+	for i, pool := range candidatePools {
+		var poolFreeBytes uint64
+		for _, targetID := range pool.targets {
+			poolFreeBytes += freeBytes[targetID]
+		}
+		score := float64(poolFreeBytes) * cfg.storagePoolCandidates[i].weight
+		LogDebug(ctx, "Considering storage pool", "storagePoolID", pool.id, "freeBytes", poolFreeBytes,
+			"weight", cfg.storagePoolCandidates[i].weight, "volumeID", vol.volumeID)
+		if score > bestScore {
+			bestScore = score
+			cfg.storagePoolID = pool.id
+		}
+	}
+	if cfg.storagePoolID == "" {
+		return cfg, status.Errorf(codes.ResourceExhausted, "no storage pool in %s has free space on %s",
+			stripePatternStoragePoolCandidatesKey, vol.sysMgmtdHost)
+	}
+	LogDebug(ctx, "Selected storage pool", "storagePoolID", cfg.storagePoolID, "volumeID", vol.volumeID)
+	return cfg, nil
+}
+
+// getStoragePools returns the storage pools on the BeeGFS file system referenced by vol from the storage pool cache,
+// refreshing the cache with beegfs-ctl if necessary or if refresh is true.
+func (cs *controllerServer) getStoragePools(ctx context.Context, vol beegfsVolume, refresh bool) ([]storagePool,
+	error) {
+	cs.storagePoolCacheMutex.Lock()
+	cached, ok := cs.storagePoolCache[vol.sysMgmtdHost]
+	cs.storagePoolCacheMutex.Unlock()
+	if ok && !refresh && time.Now().Before(cached.expires) {
+		return cached.pools, nil
+	}
+
+	pools, err := cs.ctlExec.listStoragePools(ctx, vol)
+	if err != nil {
+		return nil, err
+	}
+	cs.storagePoolCacheMutex.Lock()
+	defer cs.storagePoolCacheMutex.Unlock()
+	if cs.storagePoolCache == nil {
+		cs.storagePoolCache = make(map[string]cachedStoragePools)
+	}
+	cs.storagePoolCache[vol.sysMgmtdHost] = cachedStoragePools{pools: pools, expires: time.Now().Add(storagePoolCacheTTL)}
+	return pools, nil
+}
+
+// validateMetadataMirroringOfAncestor checks that the nearest existing ancestor of vol's directory has metadata
+// mirroring enabled. A new directory inherits metadata mirroring from its parent, so checking before creating the
+// directory keeps a CreateVolume that cannot provide metadata mirroring from leaving a directory behind.
+// validateMetadataMirroringOfAncestor returns gRPC errors.
+func (cs *controllerServer) validateMetadataMirroringOfAncestor(ctx context.Context, vol beegfsVolume) error {
+	ancestor := vol
+	ancestor.volDirPathBeegfsRoot = path.Clean("/" + vol.volDirBasePathBeegfsRoot)
+	for {
+		info, err := cs.ctlExec.statDirectoryForVolume(ctx, ancestor)
+		if errors.As(err, &ctlNotExistError{}) && ancestor.volDirPathBeegfsRoot != "/" {
+			ancestor.volDirPathBeegfsRoot = path.Dir(ancestor.volDirPathBeegfsRoot)
+			continue
+		} else if err != nil {
+			return newGrpcErrorFromCause(codes.Internal, err)
+		}
+		if !info.isMetadataMirrored() {
+			return status.Errorf(codes.InvalidArgument, "%s is true, but metadata mirroring is not enabled for %s "+
+				"on %s", metadataMirroringKey, ancestor.volDirPathBeegfsRoot, vol.sysMgmtdHost)
+		}
+		return nil
+	}
+}
+
+// validateMirroringForVolume checks the buddy mirroring requested by a stripePatternConfig against the buddy mirror
+// groups on the BeeGFS file system referenced by vol. A buddymirror stripe pattern requires storage buddy mirror groups
+// (in the requested storage pool, if there is one) and at least as many of them as the requested number of targets.
+// Metadata mirroring requires metadata buddy mirror groups. validateMirroringForVolume returns gRPC errors.
+func validateMirroringForVolume(ctx context.Context, ctlExec beegfsCtlExecutorInterface, vol beegfsVolume,
+	cfg stripePatternConfig) error {
+	if cfg.stripePatternType == stripePatternTypeBuddyMirror {
+		groups, err := ctlExec.listMirrorGroups(ctx, vol, nodeTypeStorage)
+		if err != nil {
+			return newGrpcErrorFromCause(codes.Internal, err)
+		}
+		numGroups := len(groups)
+		where := vol.sysMgmtdHost
+		if cfg.storagePoolID != "" {
+			pools, err := ctlExec.listStoragePools(ctx, vol)
+			if err != nil {
+				return newGrpcErrorFromCause(codes.Internal, err)
+			}
+			for _, pool := range pools {
+				if pool.id == cfg.storagePoolID {
+					numGroups = len(pool.buddyGroups)
+					where = fmt.Sprintf("storage pool %s on %s", pool.id, vol.sysMgmtdHost)
+				}
+			}
+		}
+		if numGroups == 0 {
+			return status.Errorf(codes.InvalidArgument, "%s %s requires storage buddy mirror groups, but %s has none",
+				stripePatternTypeKey, cfg.stripePatternType, where)
+		}
+		if numTargets, err := strconv.Atoi(cfg.stripePatternNumTargets); err == nil && numTargets > numGroups {
+			return status.Errorf(codes.InvalidArgument, "%s %d exceeds the %d storage buddy mirror groups in %s",
+				stripePatternNumTargetsKey, numTargets, numGroups, where)
+		}
+	}
+	if cfg.metadataMirroring == "true" {
+		groups, err := ctlExec.listMirrorGroups(ctx, vol, nodeTypeMeta)
+		if err != nil {
+			return newGrpcErrorFromCause(codes.Internal, err)
+		}
+		if len(groups) == 0 {
+			return status.Errorf(codes.InvalidArgument, "%s is true, but %s has no metadata buddy mirror groups",
+				metadataMirroringKey, vol.sysMgmtdHost)
+		}
+	}
+	return nil
+}
+
+// parseStoragePoolCandidates parses a comma separated list of storage pool IDs or names, each optionally followed by a
+// colon and a positive weight (e.g. "nvme:2,hdd"). The default weight is 1.
+func parseStoragePoolCandidates(list string) ([]storagePoolCandidate, error) {
+	var candidates []storagePoolCandidate
+	for _, item := range strings.Split(list, ",") {
+		candidate := storagePoolCandidate{pool: strings.TrimSpace(item), weight: 1}
+		if i := strings.LastIndex(candidate.pool, ":"); i != -1 {
+			weight, err := strconv.ParseFloat(strings.TrimSpace(candidate.pool[i+1:]), 64)
+			if err != nil || weight <= 0 {
+				return nil, errors.Errorf("weight of %s is not a positive number", candidate.pool)
+			}
+			candidate.pool, candidate.weight = strings.TrimSpace(candidate.pool[:i]), weight
+		}
+		if candidate.pool == "" {
+			return nil, errors.Errorf("empty storage pool in %s", list)
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+func getPermissionsConfigFromParams(reqParams map[string]string) (permissionsConfig, error) {
+	cfg := permissionsConfig{mode: defaultPermissionsMode}
+	for param := range reqParams {
+		if strings.HasPrefix(param, "permissions/") {
+			switch param {
+			case permissionsUIDKey:
+				val := reqParams[permissionsUIDKey]
+				uid, err := strconv.ParseUint(val, 10, 32) // UIDs are <= 32 bits.
+				if err != nil {
+					return cfg, errors.Wrap(err, "could not parse provided UID")
+				}
+				cfg.uid = uint32(uid)
+			case permissionsGIDKey:
 				val := reqParams[permissionsGIDKey]
 				gid, err := strconv.ParseUint(val, 10, 32) // GIDs are <= 32 bits.
 				if err != nil {
@@ -384,7 +1789,1222 @@ func getPermissionsConfigFromParams(reqParams map[string]string) (permissionsCon
 			}
 		}
 	}
-	return cfg, nil
+	return cfg, nil
+}
+
+// getQuotaConfigFromParams parses all CreateVolume parameters prefaced with quota/. A quota/idRange is required if
+// quota/enforceCapacity is true. Because the assigned ID becomes the owner or group of the volume's directory, a
+// permissions/uid (or permissions/gid) cannot be combined with a quota/idType of uid (or gid).
+func getQuotaConfigFromParams(reqParams map[string]string, permissionsConfig permissionsConfig) (quotaConfig, error) {
+	cfg := quotaConfig{idType: defaultQuotaIDType}
+	for param := range reqParams {
+		if strings.HasPrefix(param, "quota/") {
+			switch param {
+			case quotaEnforceCapacityKey:
+				enforceCapacity, err := strconv.ParseBool(reqParams[quotaEnforceCapacityKey])
+				if err != nil {
+					return cfg, errors.Wrap(err, "could not parse provided enforceCapacity")
+				}
+				cfg.enforceCapacity = enforceCapacity
+			case quotaIDTypeKey:
+				switch idType := quotaIDType(reqParams[quotaIDTypeKey]); idType {
+				case quotaIDTypeUID, quotaIDTypeGID:
+					cfg.idType = idType
+				default:
+					return cfg, errors.Errorf("invalid quota ID type %s", idType)
+				}
+			case quotaIDRangeKey:
+				val := reqParams[quotaIDRangeKey]
+				bounds := strings.Split(val, "-")
+				if len(bounds) != 2 {
+					return cfg, errors.Errorf("could not parse provided ID range %s", val)
+				}
+				start, err := strconv.ParseUint(bounds[0], 10, 32) // IDs are <= 32 bits.
+				if err != nil {
+					return cfg, errors.Wrap(err, "could not parse provided ID range")
+				}
+				end, err := strconv.ParseUint(bounds[1], 10, 32) // IDs are <= 32 bits.
+				if err != nil {
+					return cfg, errors.Wrap(err, "could not parse provided ID range")
+				}
+				if start == 0 || start > end {
+					return cfg, errors.Errorf("invalid ID range %s", val)
+				}
+				cfg.idRangeStart, cfg.idRangeEnd = uint32(start), uint32(end)
+			default:
+				return cfg, errors.Errorf("CreateVolume parameter invalid: %s", param)
+			}
+		}
+	}
+
+	if cfg.enforceCapacity {
+		if cfg.idRangeEnd == 0 {
+			return cfg, errors.Errorf("%s is required when %s is true", quotaIDRangeKey, quotaEnforceCapacityKey)
+		}
+		if cfg.idType == quotaIDTypeUID && permissionsConfig.uid != 0 {
+			return cfg, errors.Errorf("%s cannot be combined with a %s of uid", permissionsUIDKey, quotaIDTypeKey)
+		}
+		if cfg.idType == quotaIDTypeGID && permissionsConfig.gid != 0 {
+			return cfg, errors.Errorf("%s cannot be combined with a %s of gid", permissionsGIDKey, quotaIDTypeKey)
+		}
+	}
+	return cfg, nil
+}
+
+// getVolDirFromParams returns the volDirBasePath (relative to the BeeGFS root) and the name of the directory of the
+// volume named volName. Both the volDirBasePath and volDirName parameters may contain ${pvc.metadata.name},
+// ${pvc.metadata.namespace}, and ${pv.metadata.name} (the volume's name), which are replaced by sanitized values (see
+// sanitizeDirName). The PVC variables require the parameters the external-provisioner only passes with
+// --extra-create-metadata. The directory name defaults to volName. getVolDirFromParams also returns whether the
+// directory name can differ from volName (i.e. whether a template was used), in which case it is not necessarily
+// unique (see claimVolDir).
+func getVolDirFromParams(reqParams map[string]string, volName string) (volDirBasePathBeegfsRoot, volDirName string,
+	templated bool, err error) {
+	volDirBasePathBeegfsRoot, err = expandVolDirTemplate(reqParams[volDirBasePathKey], reqParams, volName)
+	if err != nil {
+		return "", "", false, errors.WithMessagef(err, "invalid %s", volDirBasePathKey)
+	}
+	volDirBasePathBeegfsRoot = path.Clean(path.Join("/", volDirBasePathBeegfsRoot))
+	templated = volDirBasePathBeegfsRoot != path.Clean(path.Join("/", reqParams[volDirBasePathKey]))
+
+	volDirName = volName
+	if template, ok := reqParams[volDirNameKey]; ok {
+		if volDirName, err = expandVolDirTemplate(template, reqParams, volName); err != nil {
+			return "", "", false, errors.WithMessagef(err, "invalid %s", volDirNameKey)
+		}
+		if volDirName == "" || volDirName == "." || volDirName == ".." || strings.Contains(volDirName, "/") {
+			return "", "", false, errors.Errorf("invalid %s %s: not a single directory name", volDirNameKey,
+				template)
+		}
+		if len(volDirName) > maxDirNameLength {
+			volDirName = volDirName[:maxDirNameLength]
+		}
+		templated = templated || volDirName != volName
+	}
+	return volDirBasePathBeegfsRoot, volDirName, templated, nil
+}
+
+// volDirTemplateVariableRegexp matches a variable (e.g. ${pvc.metadata.name}) in a volDirBasePath or volDirName.
+var volDirTemplateVariableRegexp = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// expandVolDirTemplate replaces every variable in a volDirBasePath or volDirName template with its sanitized value.
+func expandVolDirTemplate(template string, reqParams map[string]string, volName string) (string, error) {
+	var err error
+	expanded := volDirTemplateVariableRegexp.ReplaceAllStringFunc(template, func(variable string) string {
+		var value string
+		switch variable {
+		case "${pv.metadata.name}":
+			value = volName
+		case "${pvc.metadata.name}":
+			value = reqParams[pvcNameKey]
+		case "${pvc.metadata.namespace}":
+			value = reqParams[pvcNamespaceKey]
+		default:
+			if err == nil {
+				err = errors.Errorf("unknown variable %s", variable)
+			}
+			return ""
+		}
+		if value == "" && err == nil {
+			err = errors.Errorf("no value for %s (is the external-provisioner running with --extra-create-metadata?)",
+				variable)
+		}
+		return sanitizeDirName(value)
+	})
+	return expanded, err
+}
+
+// unsafeDirNameCharRegexp matches the characters sanitizeDirName replaces.
+var unsafeDirNameCharRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// sanitizeDirName makes a value safe to use as (part of) a single directory name. It replaces all characters except
+// letters, digits, ".", "_", and "-" with "_" and refuses to return "." or "..".
+func sanitizeDirName(value string) string {
+	value = unsafeDirNameCharRegexp.ReplaceAllString(value, "_")
+	if value == "." || value == ".." {
+		return strings.Repeat("_", len(value))
+	}
+	return value
+}
+
+// claimVolDir ensures that the directory of a templated volume (see getVolDirFromParams) does not belong to another
+// volume. A templated directory name is not unique (e.g. a PVC may be recreated with the same name while the volume
+// it was previously bound to is retained), so CreateVolume records the name of the volume that owns it in its
+// metadata (see recordVolumeName). If another volume owns the directory, claimVolDir releases vol and returns a locked
+// volume whose directory name ends with a hash of volName instead. The caller must clean up (and release) the returned
+// volume, even if claimVolDir returns an error. claimVolDir returns gRPC errors.
+func (cs *controllerServer) claimVolDir(ctx context.Context, vol beegfsVolume, volName string) (beegfsVolume, error) {
+	owner, err := cs.getVolDirOwner(ctx, vol)
+	if err != nil {
+		return vol, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if owner == "" || owner == volName {
+		return vol, nil
+	}
+
+	hash := fmt.Sprintf("-%x", sha256.Sum256([]byte(volName)))[:9]
+	dirName := path.Base(vol.volDirPathBeegfsRoot)
+	if len(dirName) > maxDirNameLength-len(hash) {
+		dirName = dirName[:maxDirNameLength-len(hash)]
+	}
+	altVol := cs.newBeegfsVolume(vol.sysMgmtdHost, vol.volDirBasePathBeegfsRoot, dirName+hash)
+	LogDebug(ctx, "BeeGFS directory belongs to another volume", "owner", owner, "volumeID", vol.volumeID,
+		"alternateVolumeID", altVol.volumeID)
+	if !cs.volumeIDsInFlight.obtainLockOnString(altVol.volumeID) {
+		return vol, status.Errorf(codes.Aborted, "volumeID %s is in use by another request", altVol.volumeID)
+	}
+	if err := unmountAndCleanUpIfNecessary(ctx, vol, true, cs.mounter); err != nil {
+		LogError(ctx, err, "Failed to clean up path for volume", "path", vol.mountDirPath, "volumeID", vol.volumeID)
+	}
+	cs.volumeIDsInFlight.releaseLockOnString(vol.volumeID)
+
+	if err := fs.MkdirAll(altVol.mountDirPath, 0750); err != nil {
+		err = errors.WithStack(err)
+		return altVol, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := writeClientFiles(ctx, altVol, cs.clientConfTemplatePath); err != nil {
+		return altVol, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if owner, err = cs.getVolDirOwner(ctx, altVol); err != nil {
+		return altVol, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if owner != "" && owner != volName {
+		return altVol, status.Errorf(codes.AlreadyExists, "BeeGFS directories %s and %s belong to other volumes",
+			vol.volumeID, altVol.volumeID)
+	}
+	return altVol, nil
+}
+
+// getVolDirOwner mounts vol and returns the name of the volume recorded as the owner of its directory (see
+// recordVolumeName) or an empty string if there is none.
+func (cs *controllerServer) getVolDirOwner(ctx context.Context, vol beegfsVolume) (string, error) {
+	if err := mountIfNecessary(ctx, vol, cs.mounter); err != nil {
+		return "", err
+	}
+	metadata, _, err := readVolumeMetadata(vol)
+	if err != nil {
+		return "", err
+	}
+	return metadata.VolumeName, nil
+}
+
+// getDeletePolicyFromParams parses the deletePolicy CreateVolume parameter. The default is deletePolicyDelete.
+func getDeletePolicyFromParams(reqParams map[string]string) (deletePolicy, error) {
+	val, ok := reqParams[deletePolicyKey]
+	if !ok {
+		return deletePolicyDelete, nil
+	}
+	switch policy := deletePolicy(val); policy {
+	case deletePolicyDelete, deletePolicyRetainInPlace, deletePolicyMoveToTrash:
+		return policy, nil
+	default:
+		return deletePolicyDelete, errors.Errorf("invalid %s %s", deletePolicyKey, val)
+	}
+}
+
+// recordVolumeCreation records how and for whom a mounted volume was created in its metadata file: the CreateVolume
+// name (which identifies the owner of a templated directory, see claimVolDir), the CreateVolume parameters (including
+// the PVC identity the external-provisioner passes with --extra-create-metadata), and the deletePolicy DeleteVolume
+// honors. The creation time and driver version are only recorded once so that a retried CreateVolume does not change
+// them.
+func recordVolumeCreation(vol beegfsVolume, volName string, reqParams map[string]string, policy deletePolicy) error {
+	metadata, _, err := readVolumeMetadata(vol)
+	if err != nil {
+		return err
+	}
+	metadata.Version = volumeMetadataVersion
+	metadata.VolumeName = volName
+	metadata.PVCName = reqParams[pvcNameKey]
+	metadata.PVCNamespace = reqParams[pvcNamespaceKey]
+	metadata.Parameters = reqParams
+	metadata.DeletePolicy = policy
+	if metadata.CreationTime == nil {
+		creationTime := time.Now().UTC()
+		metadata.CreationTime = &creationTime
+		metadata.DriverVersion = vendorVersion
+	}
+	return writeVolumeMetadata(vol, metadata)
+}
+
+// getVolumeContextForMetadata returns VolumeContext entries for the PVC identity, creation time, and driver version
+// recorded in a volume's metadata file.
+func getVolumeContextForMetadata(metadata volumeMetadata) map[string]string {
+	volContext := make(map[string]string)
+	if metadata.PVCName != "" {
+		volContext[pvcNameKey] = metadata.PVCName
+	}
+	if metadata.PVCNamespace != "" {
+		volContext[pvcNamespaceKey] = metadata.PVCNamespace
+	}
+	if metadata.CreationTime != nil {
+		volContext[creationTimeKey] = metadata.CreationTime.Format(time.RFC3339)
+	}
+	if metadata.DriverVersion != "" {
+		volContext[driverVersionKey] = metadata.DriverVersion
+	}
+	return volContext
+}
+
+// getParametersMismatchForVolume compares the CreateVolume parameters in reqParams with the actual state of a volume's
+// directory as reported by getVolumeContextForEntryInfo. It returns a description of the first mismatch (or an empty
+// string) and the parameters that cannot be verified this way (e.g. deletePolicy or an owner that CreateVolume
+// replaced with a quota ID). Parameters the external-provisioner adds to describe a particular PVC are ignored.
+func getParametersMismatchForVolume(vol beegfsVolume, volContext map[string]string,
+	reqParams map[string]string) (string, map[string]string) {
+	stripePatternConfig, err := getStripePatternConfigFromParams(reqParams)
+	if err != nil {
+		return err.Error(), nil
+	}
+	permissionsConfig, err := getPermissionsConfigFromParams(reqParams)
+	if err != nil {
+		return err.Error(), nil
+	}
+	quotaConfig, err := getQuotaConfigFromParams(reqParams, permissionsConfig)
+	if err != nil {
+		return err.Error(), nil
+	}
+	mode := permissionsConfig.mode
+	if quotaConfig.enforceCapacity && quotaConfig.idType == quotaIDTypeGID {
+		mode |= 0o2000 // CreateVolume sets the set gid bit so that group quotas account for new files.
+	}
+
+	keys := make([]string, 0, len(reqParams))
+	for key := range reqParams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	unverifiedParams := make(map[string]string)
+	for _, key := range keys {
+		want, got := reqParams[key], volContext[key]
+		matches := true
+		switch key {
+		case sysMgmtdHostKey:
+			got = vol.sysMgmtdHost
+			matches = want == got
+		case volDirBasePathKey:
+			if volDirTemplateVariableRegexp.MatchString(want) {
+				unverifiedParams[key] = want
+				continue
+			}
+			got = vol.volDirBasePathBeegfsRoot
+			matches = path.Clean(path.Join("/", want)) == got
+		case stripePatternStoragePoolIDKey, stripePatternStoragePoolNameKey:
+			matches = want == got
+		case stripePatternStoragePoolCandidatesKey:
+			got = volContext[stripePatternStoragePoolIDKey]
+			matches = false
+			for _, candidate := range stripePatternConfig.storagePoolCandidates {
+				if candidate.pool == got || candidate.pool == volContext[stripePatternStoragePoolNameKey] {
+					matches = true
+				}
+			}
+		case stripePatternChunkSizeKey:
+			wantBytes, wantErr := parseChunkSize(want)
+			gotBytes, gotErr := parseChunkSize(got)
+			matches = wantErr == nil && gotErr == nil && wantBytes == gotBytes
+		case stripePatternNumTargetsKey:
+			wantTargets, wantErr := strconv.ParseUint(want, 10, 32)
+			gotTargets, gotErr := strconv.ParseUint(got, 10, 32)
+			matches = wantErr == nil && gotErr == nil && wantTargets == gotTargets
+		case stripePatternTypeKey:
+			matches = stripePatternConfig.stripePatternType == got
+		case metadataMirroringKey:
+			matches = stripePatternConfig.metadataMirroring == got
+		case permissionsUIDKey:
+			if quotaConfig.enforceCapacity && quotaConfig.idType == quotaIDTypeUID {
+				unverifiedParams[key] = want
+				continue
+			}
+			matches = strconv.FormatUint(uint64(permissionsConfig.uid), 10) == got
+		case permissionsGIDKey:
+			if quotaConfig.enforceCapacity && quotaConfig.idType == quotaIDTypeGID {
+				unverifiedParams[key] = want
+				continue
+			}
+			matches = strconv.FormatUint(uint64(permissionsConfig.gid), 10) == got
+		case permissionsModeKey:
+			matches = fmt.Sprintf("%04o", mode) == got
+		default:
+			if !strings.HasPrefix(key, "csi.storage.k8s.io/") {
+				unverifiedParams[key] = want
+			}
+		}
+		if !matches {
+			return fmt.Sprintf("parameter %s is %q, but the volume has %q", key, want, got), nil
+		}
+	}
+	return "", unverifiedParams
+}
+
+// parseChunkSize returns the number of bytes in a chunk size like "512k" (as in the stripePattern/chunkSize parameter)
+// or "512K" (as in the output of "beegfs-ctl --getentryinfo").
+func parseChunkSize(chunkSize string) (uint64, error) {
+	number, multiplier := chunkSize, uint64(1)
+	if len(number) != 0 {
+		switch number[len(number)-1] {
+		case 'k', 'K':
+			number, multiplier = number[:len(number)-1], 1<<10
+		case 'm', 'M':
+			number, multiplier = number[:len(number)-1], 1<<20
+		}
+	}
+	bytes, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not parse chunk size %s", chunkSize)
+	}
+	return bytes * multiplier, nil
+}
+
+// getParametersMismatch returns an empty string if every CreateVolume parameter in reqParams matches the parameter
+// recorded in a volume's metadata file, or a description of the first mismatch otherwise. Parameters the
+// external-provisioner adds to describe a particular PVC (e.g. csi.storage.k8s.io/pvc/name) are ignored.
+func getParametersMismatch(metadata volumeMetadata, reqParams map[string]string) string {
+	keys := make([]string, 0, len(reqParams))
+	for key := range reqParams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if strings.HasPrefix(key, "csi.storage.k8s.io/") {
+			continue
+		}
+		if recorded, ok := metadata.Parameters[key]; !ok || recorded != reqParams[key] {
+			return fmt.Sprintf("parameter %s is %q, but the volume was created with %q", key, reqParams[key], recorded)
+		}
+	}
+	return ""
+}
+
+// moveVolumeToTrash moves the directory of a mounted volume into the trashDirBasePath of its BeeGFS file system. The
+// new directory name starts with the time of the move and ends with the volume's path (with "/" replaced by "_") so
+// that volumes with the same name in different volDirBasePaths do not collide. moveVolumeToTrash writes the volume's
+// metadata (including the time of the move) next to the new directory before it moves the directory. A trashed
+// metadata file without a directory (e.g. because DeleteVolume failed and was retried) is harmless and is removed
+// along with everything else in the trash.
+func moveVolumeToTrash(ctx context.Context, vol beegfsVolume, metadata volumeMetadata) error {
+	if _, err := fs.Stat(vol.volDirPath); os.IsNotExist(err) {
+		LogDebug(ctx, "BeeGFS directory already moved to trash", "volumeID", vol.volumeID)
+		return nil
+	}
+	trashTime := time.Now().UTC()
+	trashDirPath := path.Join(vol.mountPath, vol.config.trashDirBasePathBeegfsRoot())
+	trashName := trashTime.Format(trashTimeFormat) + "_" +
+		strings.ReplaceAll(strings.TrimPrefix(vol.volDirPathBeegfsRoot, "/"), "/", "_")
+	if err := fs.MkdirAll(trashDirPath, 0750); err != nil {
+		return errors.WithStack(err)
+	}
+	metadata.TrashedVolumeID = vol.volumeID
+	metadata.TrashTime = &trashTime
+	if err := writeMetadataFile(path.Join(trashDirPath, "."+trashName+metadataFileSuffix), metadata); err != nil {
+		return err
+	}
+	LogDebug(ctx, "Moving BeeGFS directory to trash", "trashDirPath", trashDirPath, "trashName", trashName,
+		"volumeID", vol.volumeID)
+	return errors.WithStack(fs.Rename(vol.volDirPath, path.Join(trashDirPath, trashName)))
+}
+
+// listSnapshotsForSnapshotDir mounts the BeeGFS file system referenced by sysMgmtdHost and returns the snapshots
+// described by metadata files in snapDir. snapDir is either a single snapshot (so only its own metadata file is read) or
+// the snapshotDirBasePath itself (so every metadata file in it is read). listSnapshotsForSnapshotDir returns gRPC
+// errors.
+func (cs *controllerServer) listSnapshotsForSnapshotDir(ctx context.Context, sysMgmtdHost string,
+	snapDir beegfsVolume) ([]*csi.Snapshot, error) {
+	if !cs.volumeIDsInFlight.obtainLockOnString(snapDir.volumeID) {
+		return nil, status.Errorf(codes.Aborted, "snapshotID %s is in use by another request", snapDir.volumeID)
+	}
+	defer cs.volumeIDsInFlight.releaseLockOnString(snapDir.volumeID)
+
+	// Write configuration files and mount BeeGFS.
+	defer func() {
+		// Failure to clean up is an internal problem. The CO only cares about the snapshots.
+		if err := unmountAndCleanUpIfNecessary(ctx, snapDir, true, cs.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up path for snapshot", "path", snapDir.mountDirPath, "snapshotID", snapDir.volumeID)
+		}
+	}()
+	if err := fs.MkdirAll(snapDir.mountDirPath, 0750); err != nil {
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := writeClientFiles(ctx, snapDir, cs.clientConfTemplatePath); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := mountIfNecessary(ctx, snapDir, cs.mounter); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+
+	// Map snapshot IDs to metadata file paths.
+	mdPaths := make(map[string]string)
+	snapDirBasePathBeegfsRoot := squashConfigForSysMgmtdHost(sysMgmtdHost, cs.pluginConfig).
+		snapshotDirBasePathBeegfsRoot()
+	if snapDir.volDirBasePathBeegfsRoot == snapDirBasePathBeegfsRoot {
+		mdPaths[snapDir.volumeID] = snapDir.volMetadataPath
+	} else {
+		dirEntries, err := fsutil.ReadDir(snapDir.volDirPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil // No snapshot was ever created on this file system.
+			}
+			err = errors.WithStack(err)
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			if dirEntry.IsDir() || !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, metadataFileSuffix) {
+				continue
+			}
+			snapName := strings.TrimSuffix(strings.TrimPrefix(name, "."), metadataFileSuffix)
+			snapshotID := NewBeegfsUrl(sysMgmtdHost, path.Join(snapDirBasePathBeegfsRoot, snapName))
+			mdPaths[snapshotID] = path.Join(snapDir.volDirPath, name)
+		}
+	}
+
+	snapshots := make([]*csi.Snapshot, 0, len(mdPaths))
+	for snapshotID, mdPath := range mdPaths {
+		var metadata snapshotMetadata
+		exists, err := readMetadataFile(mdPath, &metadata)
+		if err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		if !exists {
+			continue
+		}
+		csiSnap, err := newCsiSnapshot(snapshotID, metadata)
+		if err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		snapshots = append(snapshots, csiSnap)
+	}
+	return snapshots, nil
+}
+
+// listVolumesForVolDirBasePath mounts the BeeGFS file system referenced by baseDir and returns a volume for each
+// directory in it that has a metadata file and is not one of volDirBasePaths (the volDirBasePathBeegfsRoots of the
+// file system). Volumes report the capacity and content source recorded in their metadata files and the condition of
+// the storage targets on the file system. listVolumesForVolDirBasePath returns gRPC errors.
+func (cs *controllerServer) listVolumesForVolDirBasePath(ctx context.Context, baseDir beegfsVolume,
+	volDirBasePaths map[string]struct{}) ([]*csi.ListVolumesResponse_Entry, error) {
+	if !cs.volumeIDsInFlight.obtainLockOnString(baseDir.volumeID) {
+		return nil, status.Errorf(codes.Aborted, "volumeID %s is in use by another request", baseDir.volumeID)
+	}
+	defer cs.volumeIDsInFlight.releaseLockOnString(baseDir.volumeID)
+
+	// Write configuration files and mount BeeGFS.
+	defer func() {
+		// Failure to clean up is an internal problem. The CO only cares about the volumes.
+		if err := unmountAndCleanUpIfNecessary(ctx, baseDir, true, cs.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up path for volDirBasePath", "path", baseDir.mountDirPath,
+				"volDirBasePath", baseDir.volumeID)
+		}
+	}()
+	if err := fs.MkdirAll(baseDir.mountDirPath, 0750); err != nil {
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := writeClientFiles(ctx, baseDir, cs.clientConfTemplatePath); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := mountIfNecessary(ctx, baseDir, cs.mounter); err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+
+	dirEntries, err := fsutil.ReadDir(baseDir.volDirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // No volume was ever created in this volDirBasePath.
+		}
+		err = errors.WithStack(err)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	snapDirBasePathBeegfsRoot := baseDir.config.snapshotDirBasePathBeegfsRoot()
+	trashDirBasePathBeegfsRoot := baseDir.config.trashDirBasePathBeegfsRoot()
+	var condition *csi.VolumeCondition
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		volDirPathBeegfsRoot := path.Join(baseDir.volDirPathBeegfsRoot, name)
+		if !dirEntry.IsDir() || strings.HasPrefix(name, ".") || volDirPathBeegfsRoot == snapDirBasePathBeegfsRoot ||
+			volDirPathBeegfsRoot == trashDirBasePathBeegfsRoot {
+			continue
+		}
+		if _, ok := volDirBasePaths[volDirPathBeegfsRoot]; ok {
+			continue
+		}
+		var metadata volumeMetadata
+		exists, err := readMetadataFile(path.Join(baseDir.volDirPath, "."+name+metadataFileSuffix), &metadata)
+		if err != nil {
+			return nil, newGrpcErrorFromCause(codes.Internal, err)
+		}
+		if !exists {
+			continue // not created by the driver (e.g. an intermediate directory of a templated volDirBasePath)
+		}
+		if condition == nil {
+			condition = getStorageTargetCondition(ctx, cs.ctlExec, baseDir, "")
+		}
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      NewBeegfsUrl(baseDir.sysMgmtdHost, volDirPathBeegfsRoot),
+				CapacityBytes: metadata.CapacityBytes,
+				ContentSource: cs.newVolumeContentSource(metadata.ContentSourceID),
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{VolumeCondition: condition},
+		})
+	}
+	return entries, nil
+}
+
+// newVolumeContentSource returns the VolumeContentSource a volume was populated from given the content source ID
+// recorded in its metadata file. It returns nil if contentSourceID is empty.
+func (cs *controllerServer) newVolumeContentSource(contentSourceID string) *csi.VolumeContentSource {
+	if contentSourceID == "" {
+		return nil
+	}
+	if _, err := cs.newBeegfsSnapshotFromID(contentSourceID); err == nil {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: contentSourceID},
+			},
+		}
+	}
+	return &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: contentSourceID},
+		},
+	}
+}
+
+// paginate returns the bounds of a page of entries for ListVolumes or ListSnapshots given the sorted IDs of all
+// entries. The startingToken is the ID of the last entry in the previous page (or empty for the first page) and the
+// returned nextToken is the ID of the last entry in the page (or empty if there is no next page). Unlike an index, an
+// ID still marks the right position in the list if entries are created or deleted between requests. paginate returns
+// gRPC errors.
+func paginate(startingToken string, maxEntries int32, ids []string) (startIndex, endIndex int, nextToken string,
+	err error) {
+	if maxEntries < 0 {
+		return 0, 0, "", status.Errorf(codes.InvalidArgument, "Invalid max entries %d", maxEntries)
+	}
+	if startingToken != "" {
+		if _, _, err := parseBeegfsUrl(startingToken); err != nil {
+			return 0, 0, "", status.Errorf(codes.Aborted, "Invalid starting token %s", startingToken)
+		}
+		startIndex = sort.SearchStrings(ids, startingToken)
+		if startIndex < len(ids) && ids[startIndex] == startingToken {
+			startIndex++
+		}
+	}
+	endIndex = len(ids)
+	if maxEntries > 0 && startIndex+int(maxEntries) < len(ids) {
+		endIndex = startIndex + int(maxEntries)
+		nextToken = ids[endIndex-1]
+	}
+	return startIndex, endIndex, nextToken, nil
+}
+
+// startCopy runs copyFn in the background unless a copy for targetID is already running and returns the
+// backgroundCopy tracking it. The copy outlives the request that starts it, but logs with the same request ID.
+func (cs *controllerServer) startCopy(ctx context.Context, targetID string,
+	copyFn func(ctx context.Context) error) *backgroundCopy {
+	cs.copiesInFlightMutex.Lock()
+	defer cs.copiesInFlightMutex.Unlock()
+	if cs.copiesInFlight == nil {
+		cs.copiesInFlight = make(map[string]*backgroundCopy)
+	}
+	if c, ok := cs.copiesInFlight[targetID]; ok {
+		return c
+	}
+
+	copyCtx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxRequestID, ctx.Value(ctxRequestID)))
+	c := &backgroundCopy{cancel: cancel, done: make(chan struct{})}
+	cs.copiesInFlight[targetID] = c
+	go func() {
+		defer func() {
+			cs.copiesInFlightMutex.Lock()
+			delete(cs.copiesInFlight, targetID)
+			cs.copiesInFlightMutex.Unlock()
+			cancel()
+			close(c.done)
+		}()
+		if c.err = copyFn(copyCtx); c.err != nil {
+			LogError(copyCtx, c.err, "Failed to copy", "targetID", targetID)
+		}
+	}()
+	return c
+}
+
+// cancelCopy cancels the background copy for targetID (if one is running) and waits for it to end.
+func (cs *controllerServer) cancelCopy(ctx context.Context, targetID string) {
+	cs.copiesInFlightMutex.Lock()
+	c, ok := cs.copiesInFlight[targetID]
+	cs.copiesInFlightMutex.Unlock()
+	if !ok {
+		return
+	}
+	LogDebug(ctx, "Cancelling copy", "targetID", targetID)
+	c.cancel()
+	<-c.done
+}
+
+// mountForCopy writes configuration files for and mounts the BeeGFS file system referenced by vol under a dedicated
+// mountDirPath (derived from targetID and purpose) so that a background copy is unaffected by requests cleaning up
+// their own mountDirPaths. It returns vol with paths relative to the new mount and a function that unmounts and cleans
+// it up.
+func (cs *controllerServer) mountForCopy(ctx context.Context, vol beegfsVolume, targetID,
+	purpose string) (beegfsVolume, func(), error) {
+	mountDirPath := path.Join(cs.csDataDir, sanitizeVolumeID(targetID+"/"+purpose))
+	copyVol := newBeegfsVolume(mountDirPath, vol.sysMgmtdHost, vol.volDirPathBeegfsRoot, cs.pluginConfig)
+	cleanUp := func() {
+		if err := unmountAndCleanUpIfNecessary(ctx, copyVol, true, cs.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up path for volume", "path", copyVol.mountDirPath, "volumeID", copyVol.volumeID)
+		}
+	}
+	if err := fs.MkdirAll(copyVol.mountDirPath, 0750); err != nil {
+		cleanUp()
+		return copyVol, nil, errors.WithStack(err)
+	}
+	if err := writeClientFiles(ctx, copyVol, cs.clientConfTemplatePath); err != nil {
+		cleanUp()
+		return copyVol, nil, err
+	}
+	if err := mountIfNecessary(ctx, copyVol, cs.mounter); err != nil {
+		cleanUp()
+		return copyVol, nil, err
+	}
+	return copyVol, cleanUp, nil
+}
+
+// populateVolume copies the contents of a volume content source (a volume or a snapshot, possibly on a different
+// BeeGFS file system) into vol in the background and records its progress in vol's metadata file. The copied files
+// inherit vol's stripe pattern and are assigned vol's quota ID (if it has one). populateVolume waits up to copyWaitTime
+// for the copy to complete and returns an Aborted error if it does not, so that the CO calls CreateVolume again until
+// the volume is populated. populateVolume returns gRPC errors.
+func (cs *controllerServer) populateVolume(ctx context.Context, vol, source beegfsVolume, sourceID string,
+	sourceIsSnapshot bool) error {
+	metadata, _, err := readVolumeMetadata(vol)
+	if err != nil {
+		return newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if metadata.ContentSourceID != "" && metadata.ContentSourceID != sourceID {
+		return status.Errorf(codes.AlreadyExists, "volume %s is already populated from %s", vol.volumeID,
+			metadata.ContentSourceID)
+	}
+	if metadata.ContentCopied {
+		return nil
+	}
+	if metadata.ContentSourceID == "" {
+		if err := cs.checkContentSource(ctx, vol, source, sourceID, sourceIsSnapshot); err != nil {
+			return err
+		}
+		metadata.ContentSourceID = sourceID
+		if err := writeVolumeMetadata(vol, metadata); err != nil {
+			return newGrpcErrorFromCause(codes.Internal, err)
+		}
+	}
+
+	// Either this is a new volume, a copy is already running, or a previous copy was interrupted (e.g. by a controller
+	// restart) and must start over.
+	c := cs.startCopy(ctx, vol.volumeID, func(copyCtx context.Context) error {
+		return cs.copyContentSource(copyCtx, vol, source, metadata)
+	})
+	select {
+	case <-c.done:
+		if c.err != nil {
+			return newGrpcErrorFromCause(codes.Internal, c.err)
+		}
+		return nil
+	case <-time.After(copyWaitTime):
+		return status.Errorf(codes.Aborted, "volume %s is still being populated from %s", vol.volumeID, sourceID)
+	}
+}
+
+// checkContentSource returns a NotFound error if a volume content source does not exist and an Unavailable error if a
+// snapshot content source is not ready to use. checkContentSource returns gRPC errors.
+func (cs *controllerServer) checkContentSource(ctx context.Context, vol, source beegfsVolume, sourceID string,
+	sourceIsSnapshot bool) error {
+	sourceMount, cleanUp, err := cs.mountForCopy(ctx, source, vol.volumeID, "check-source")
+	if err != nil {
+		return newGrpcErrorFromCause(codes.Internal, err)
+	}
+	defer cleanUp()
+
+	if _, err := fs.Stat(sourceMount.volDirPath); err != nil {
+		if os.IsNotExist(err) {
+			return status.Errorf(codes.NotFound, "volume content source %s does not exist", sourceID)
+		}
+		err = errors.WithStack(err)
+		return newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if sourceIsSnapshot {
+		snapMetadata, exists, err := readSnapshotMetadata(sourceMount)
+		if err != nil {
+			return newGrpcErrorFromCause(codes.Internal, err)
+		}
+		if !exists {
+			return status.Errorf(codes.NotFound, "volume content source %s does not exist", sourceID)
+		}
+		if !snapMetadata.ReadyToUse {
+			return status.Errorf(codes.Unavailable, "snapshot %s is not ready to use", sourceID)
+		}
+	}
+	return nil
+}
+
+// copyContentSource copies the contents of source into vol and marks the content of vol as copied in its metadata
+// file. Anything left behind in vol by an interrupted copy is discarded first. source and vol are mounted separately,
+// so they may be on different BeeGFS file systems.
+func (cs *controllerServer) copyContentSource(ctx context.Context, vol, source beegfsVolume,
+	metadata volumeMetadata) error {
+	sourceMount, cleanUpSource, err := cs.mountForCopy(ctx, source, vol.volumeID, "source")
+	if err != nil {
+		return err
+	}
+	defer cleanUpSource()
+	volMount, cleanUpVol, err := cs.mountForCopy(ctx, vol, vol.volumeID, "copy")
+	if err != nil {
+		return err
+	}
+	defer cleanUpVol()
+
+	if err := removeDirectoryContents(volMount.volDirPath); err != nil {
+		return err
+	}
+	LogDebug(ctx, "Copying volume content source", "contentSourceID", metadata.ContentSourceID,
+		"volumeID", vol.volumeID)
+	sizeBytes, err := copyDirectoryContents(ctx, sourceMount.volDirPath, volMount.volDirPath)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to copy %s to %s", sourceMount.volDirPath, volMount.volDirPath)
+	}
+	if metadata.hasQuota() {
+		if err := applyQuotaIDToDirectoryContents(volMount.volDirPath, metadata.QuotaIDType, metadata.QuotaID); err != nil {
+			return err
+		}
+	}
+	LogDebug(ctx, "Finished copying volume content source", "sizeBytes", sizeBytes, "volumeID", vol.volumeID)
+
+	metadata.ContentCopied = true
+	return writeVolumeMetadata(volMount, metadata)
+}
+
+// copySnapshot copies sourceVol into snap and marks snap ready to use in its metadata file. Anything left behind in
+// snap by an interrupted copy is discarded first. copySnapshot compares the state of every entry in sourceVol before
+// and after the copy (see statTree) and discards the copy and returns errSourceModified if anything changed.
+func (cs *controllerServer) copySnapshot(ctx context.Context, snap, sourceVol beegfsVolume,
+	metadata snapshotMetadata) error {
+	copyVol, cleanUp, err := cs.mountForCopy(ctx, snap, snap.volumeID, "copy")
+	if err != nil {
+		return err
+	}
+	defer cleanUp()
+
+	if err := fs.RemoveAll(copyVol.volDirPath); err != nil {
+		return errors.WithStack(err)
+	}
+	sourcePath := path.Join(copyVol.mountPath, sourceVol.volDirPathBeegfsRoot)
+	sourceBefore, err := statTree(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	LogDebug(ctx, "Copying source volume to snapshot", "sourceVolumeID", metadata.SourceVolumeID,
+		"snapshotID", copyVol.volumeID)
+	sizeBytes, err := copyDirectory(ctx, sourcePath, copyVol.volDirPath)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to copy %s to %s", sourcePath, copyVol.volDirPath)
+	}
+	sourceAfter, err := statTree(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(sourceBefore, sourceAfter) {
+		if err := fs.RemoveAll(copyVol.volDirPath); err != nil {
+			LogError(ctx, errors.WithStack(err), "Failed to discard inconsistent snapshot", "snapshotID",
+				copyVol.volumeID)
+		}
+		return errors.Wrapf(errSourceModified, "failed to copy %s to %s", sourcePath, copyVol.volDirPath)
+	}
+	LogDebug(ctx, "Finished copying source volume to snapshot", "sizeBytes", sizeBytes, "snapshotID", copyVol.volumeID)
+
+	metadata.SizeBytes = sizeBytes
+	metadata.ReadyToUse = true
+	return writeSnapshotMetadata(copyVol, metadata)
+}
+
+// newCsiSnapshot converts snapshot metadata into the representation used in CSI responses.
+func newCsiSnapshot(snapshotID string, metadata snapshotMetadata) (*csi.Snapshot, error) {
+	creationTime, err := ptypes.TimestampProto(metadata.CreationTime)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &csi.Snapshot{
+		SizeBytes:      metadata.SizeBytes,
+		SnapshotId:     snapshotID,
+		SourceVolumeId: metadata.SourceVolumeID,
+		CreationTime:   creationTime,
+		ReadyToUse:     metadata.ReadyToUse,
+	}, nil
+}
+
+// addSysMgmtdHost records a sysMgmtdHost referenced by a request so that RPCs that are not scoped to a particular
+// BeeGFS file system (e.g. ListSnapshots) can find it later (see getSysMgmtdHosts).
+func (cs *controllerServer) addSysMgmtdHost(ctx context.Context, sysMgmtdHost string) {
+	cs.addKnownFileSystem(ctx, sysMgmtdHost, "")
+}
+
+// addVolDirBasePath records a sysMgmtdHost and volDirBasePath referenced by CreateVolume so that ListVolumes can find
+// the volumes in it later (see getVolDirBasePaths).
+func (cs *controllerServer) addVolDirBasePath(ctx context.Context, sysMgmtdHost, volDirBasePathBeegfsRoot string) {
+	cs.addKnownFileSystem(ctx, sysMgmtdHost, volDirBasePathBeegfsRoot)
+}
+
+// addKnownFileSystem implements addSysMgmtdHost and addVolDirBasePath (if volDirBasePathBeegfsRoot is not empty). It
+// records anything new in the known file systems file in csDataDir so that it is not forgotten when the controller
+// service restarts. Failure to update the file is logged, but the sysMgmtdHost and volDirBasePath are still known
+// until the controller service restarts.
+func (cs *controllerServer) addKnownFileSystem(ctx context.Context, sysMgmtdHost, volDirBasePathBeegfsRoot string) {
+	cs.knownFileSystemsMutex.Lock()
+	defer cs.knownFileSystemsMutex.Unlock()
+	cs.loadKnownFileSystems(ctx)
+	volDirBasePaths, ok := cs.knownVolDirBasePaths[sysMgmtdHost]
+	if !ok {
+		volDirBasePaths = make(map[string]struct{})
+		cs.knownVolDirBasePaths[sysMgmtdHost] = volDirBasePaths
+	} else if _, ok = volDirBasePaths[volDirBasePathBeegfsRoot]; ok || volDirBasePathBeegfsRoot == "" {
+		return // Nothing new.
+	}
+	if volDirBasePathBeegfsRoot != "" {
+		volDirBasePaths[volDirBasePathBeegfsRoot] = struct{}{}
+	}
+
+	known := make(map[string][]string, len(cs.knownVolDirBasePaths))
+	for host, paths := range cs.knownVolDirBasePaths {
+		known[host] = []string{}
+		for volDirBasePath := range paths {
+			known[host] = append(known[host], volDirBasePath)
+		}
+		sort.Strings(known[host])
+	}
+	knownPath := path.Join(cs.csDataDir, knownFileSystemsFileName)
+	if err := fs.MkdirAll(cs.csDataDir, 0750); err != nil {
+		LogError(ctx, errors.WithStack(err), "Failed to record known file system", "path", knownPath)
+		return
+	}
+	// Replace the file atomically so that a crash cannot leave a partially written file behind.
+	if err := writeMetadataFile(knownPath+".tmp", known); err != nil {
+		LogError(ctx, err, "Failed to record known file system", "path", knownPath)
+		return
+	}
+	if err := fs.Rename(knownPath+".tmp", knownPath); err != nil {
+		LogError(ctx, errors.WithStack(err), "Failed to record known file system", "path", knownPath)
+	}
+}
+
+// loadKnownFileSystems reads the sysMgmtdHosts and volDirBasePaths recorded in the known file systems file in
+// csDataDir the first time it is called. The caller must hold cs.knownFileSystemsMutex.
+func (cs *controllerServer) loadKnownFileSystems(ctx context.Context) {
+	if cs.knownVolDirBasePaths != nil {
+		return
+	}
+	cs.knownVolDirBasePaths = make(map[string]map[string]struct{})
+	knownPath := path.Join(cs.csDataDir, knownFileSystemsFileName)
+	var known map[string][]string
+	if _, err := readMetadataFile(knownPath, &known); err != nil {
+		// Only the file systems referenced by future requests (and configured file systems) will be known.
+		LogError(ctx, err, "Failed to read known file systems", "path", knownPath)
+		return
+	}
+	for sysMgmtdHost, volDirBasePaths := range known {
+		cs.knownVolDirBasePaths[sysMgmtdHost] = make(map[string]struct{})
+		for _, volDirBasePath := range volDirBasePaths {
+			cs.knownVolDirBasePaths[sysMgmtdHost][volDirBasePath] = struct{}{}
+		}
+	}
+}
+
+// runBackgroundTasks calls reapTrash and queuePendingDeletions every backgroundTaskInterval. The first pass queues any
+// directories that were still pending deletion when the controller service last stopped. runBackgroundTasks never
+// returns.
+func (cs *controllerServer) runBackgroundTasks() {
+	for {
+		ctx := context.Background()
+		cs.reapTrash(ctx)
+		cs.queuePendingDeletions(ctx)
+		time.Sleep(backgroundTaskInterval)
+	}
+}
+
+// reapTrash removes every volume whose trashRetentionPeriod has elapsed from the trashDirBasePath of every BeeGFS file
+// system the controller service knows about (see getSysMgmtdHosts). Failures are logged and retried on the next pass.
+func (cs *controllerServer) reapTrash(ctx context.Context) {
+	for _, sysMgmtdHost := range cs.getSysMgmtdHosts(ctx) {
+		trashDirBasePathBeegfsRoot := squashConfigForSysMgmtdHost(sysMgmtdHost, cs.pluginConfig).
+			trashDirBasePathBeegfsRoot()
+		trashDir := cs.newBeegfsVolume(sysMgmtdHost, path.Dir(trashDirBasePathBeegfsRoot),
+			path.Base(trashDirBasePathBeegfsRoot))
+		if err := cs.reapTrashDir(ctx, trashDir); err != nil {
+			LogError(ctx, err, "Failed to remove expired volumes from trash", "trashDirBasePath", trashDir.volumeID)
+		}
+	}
+}
+
+// reapTrashDir mounts the BeeGFS file system referenced by trashDir and removes every volume whose metadata file
+// indicates that it was moved to trashDir more than trashRetentionPeriod ago.
+func (cs *controllerServer) reapTrashDir(ctx context.Context, trashDir beegfsVolume) error {
+	if !cs.volumeIDsInFlight.obtainLockOnString(trashDir.volumeID) {
+		return errors.Errorf("volumeID %s is in use by another request", trashDir.volumeID)
+	}
+	defer cs.volumeIDsInFlight.releaseLockOnString(trashDir.volumeID)
+
+	// Write configuration files and mount BeeGFS.
+	defer func() {
+		if err := unmountAndCleanUpIfNecessary(ctx, trashDir, true, cs.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up path for trashDirBasePath", "path", trashDir.mountDirPath,
+				"trashDirBasePath", trashDir.volumeID)
+		}
+	}()
+	if err := fs.MkdirAll(trashDir.mountDirPath, 0750); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := writeClientFiles(ctx, trashDir, cs.clientConfTemplatePath); err != nil {
+		return err
+	}
+	if err := mountIfNecessary(ctx, trashDir, cs.mounter); err != nil {
+		return err
+	}
+
+	dirEntries, err := fsutil.ReadDir(trashDir.volDirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // No volume was ever moved to the trash.
+		}
+		return errors.WithStack(err)
+	}
+	retentionPeriod := trashDir.config.trashRetentionPeriod()
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, metadataFileSuffix) {
+			continue
+		}
+		var metadata volumeMetadata
+		mdPath := path.Join(trashDir.volDirPath, name)
+		if _, err := readMetadataFile(mdPath, &metadata); err != nil {
+			return err
+		}
+		if metadata.TrashTime == nil || time.Since(*metadata.TrashTime) < retentionPeriod {
+			continue
+		}
+		trashedDirPath := path.Join(trashDir.volDirPath, strings.TrimSuffix(strings.TrimPrefix(name, "."),
+			metadataFileSuffix))
+		LogDebug(ctx, "Removing expired volume from trash", "path", trashedDirPath,
+			"volumeID", metadata.TrashedVolumeID, "trashTime", metadata.TrashTime)
+		if err := cs.scheduleDeletion(ctx, trashDir, trashedDirPath); err != nil {
+			return err
+		}
+		if err := fs.Remove(mdPath); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// scheduleDeletion atomically renames dirPath (a directory on the BeeGFS file system mounted for mounted) into the
+// pendingDeletionDirBasePath of the file system and queues it for a deletion worker. The new name starts with the
+// time of the rename so that directories with the same name never collide. scheduleDeletion does nothing if dirPath
+// does not exist.
+func (cs *controllerServer) scheduleDeletion(ctx context.Context, mounted beegfsVolume, dirPath string) error {
+	pendingDirPath := path.Join(mounted.mountPath, pendingDeletionDirBasePath)
+	if err := fs.MkdirAll(pendingDirPath, 0750); err != nil {
+		return errors.WithStack(err)
+	}
+	pendingName := strconv.FormatInt(time.Now().UnixNano(), 10) + "_" + path.Base(dirPath)
+	if err := fs.Rename(dirPath, path.Join(pendingDirPath, pendingName)); err != nil {
+		if os.IsNotExist(err) {
+			return nil // The directory was already deleted.
+		}
+		return errors.WithStack(err)
+	}
+	cs.queueDeletion(ctx, cs.newBeegfsVolume(mounted.sysMgmtdHost, pendingDeletionDirBasePath, pendingName))
+	return nil
+}
+
+// queueDeletion queues dir (a directory in a pendingDeletionDirBasePath) for a deletion worker unless it is already
+// queued or being removed. It starts the deletion workers the first time it is called. queueDeletion never blocks. If
+// the queue is full, dir waits for the next background task pass (see queuePendingDeletions).
+func (cs *controllerServer) queueDeletion(ctx context.Context, dir beegfsVolume) {
+	cs.deletionsQueuedMutex.Lock()
+	defer cs.deletionsQueuedMutex.Unlock()
+	if cs.deletionsQueued == nil {
+		cs.deletionsQueued = make(map[string]struct{})
+	}
+	if cs.deletionQueue == nil {
+		cs.deletionQueue = make(chan pendingDeletion, deletionQueueSize)
+		for i := 0; i < deletionWorkers; i++ {
+			go cs.runDeletionWorker()
+		}
+	}
+	if _, ok := cs.deletionsQueued[dir.volumeID]; ok {
+		return
+	}
+
+	deletionCtx := context.WithValue(context.Background(), ctxRequestID, ctx.Value(ctxRequestID))
+	select {
+	case cs.deletionQueue <- pendingDeletion{ctx: deletionCtx, dir: dir}:
+		cs.deletionsQueued[dir.volumeID] = struct{}{}
+	default:
+		LogDebug(ctx, "Deletion queue is full; deferring deletion", "path", dir.volDirPathBeegfsRoot,
+			"sysMgmtdHost", dir.sysMgmtdHost)
+	}
+}
+
+// runDeletionWorker removes queued directories one at a time. A directory that fails to be removed stays in the
+// pendingDeletionDirBasePath and is retried on the next background task pass. runDeletionWorker never returns.
+func (cs *controllerServer) runDeletionWorker() {
+	for d := range cs.deletionQueue {
+		if err := cs.removePendingDeletion(d.ctx, d.dir); err != nil {
+			LogError(d.ctx, err, "Failed to remove directory pending deletion", "path", d.dir.volDirPathBeegfsRoot,
+				"sysMgmtdHost", d.dir.sysMgmtdHost)
+		}
+		cs.deletionsQueuedMutex.Lock()
+		delete(cs.deletionsQueued, d.dir.volumeID)
+		cs.deletionsQueuedMutex.Unlock()
+	}
+}
+
+// removePendingDeletion mounts the BeeGFS file system referenced by dir under dir's own mountDirPath and removes dir,
+// logging progress every deletionProgressInterval.
+func (cs *controllerServer) removePendingDeletion(ctx context.Context, dir beegfsVolume) error {
+	if !cs.volumeIDsInFlight.obtainLockOnString(dir.volumeID) {
+		return errors.Errorf("volumeID %s is in use by another request", dir.volumeID)
+	}
+	defer cs.volumeIDsInFlight.releaseLockOnString(dir.volumeID)
+
+	// Write configuration files and mount BeeGFS.
+	defer func() {
+		if err := unmountAndCleanUpIfNecessary(ctx, dir, true, cs.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up path for directory pending deletion", "path", dir.mountDirPath,
+				"volumeID", dir.volumeID)
+		}
+	}()
+	if err := fs.MkdirAll(dir.mountDirPath, 0750); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := writeClientFiles(ctx, dir, cs.clientConfTemplatePath); err != nil {
+		return err
+	}
+	if err := mountIfNecessary(ctx, dir, cs.mounter); err != nil {
+		return err
+	}
+
+	LogDebug(ctx, "Removing directory pending deletion", "path", dir.volDirPathBeegfsRoot,
+		"sysMgmtdHost", dir.sysMgmtdHost)
+	start := time.Now()
+	lastLog := start
+	removed, err := removeTree(ctx, dir.volDirPath, func(removed int64) {
+		if time.Since(lastLog) >= deletionProgressInterval {
+			lastLog = time.Now()
+			LogDebug(ctx, "Still removing directory pending deletion", "path", dir.volDirPathBeegfsRoot,
+				"sysMgmtdHost", dir.sysMgmtdHost, "entriesRemoved", removed, "elapsed", time.Since(start).String())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	LogDebug(ctx, "Removed directory pending deletion", "path", dir.volDirPathBeegfsRoot,
+		"sysMgmtdHost", dir.sysMgmtdHost, "entriesRemoved", removed, "elapsed", time.Since(start).String())
+	return nil
+}
+
+// queuePendingDeletions queues every directory in the pendingDeletionDirBasePath of every BeeGFS file system the
+// controller service knows about (see getSysMgmtdHosts) for a deletion worker. Failures are logged and retried on the
+// next pass.
+func (cs *controllerServer) queuePendingDeletions(ctx context.Context) {
+	for _, sysMgmtdHost := range cs.getSysMgmtdHosts(ctx) {
+		pendingDir := cs.newBeegfsVolume(sysMgmtdHost, path.Dir(pendingDeletionDirBasePath),
+			path.Base(pendingDeletionDirBasePath))
+		if err := cs.queuePendingDeletionsForDir(ctx, pendingDir); err != nil {
+			LogError(ctx, err, "Failed to queue directories pending deletion", "pendingDeletionDirBasePath",
+				pendingDir.volumeID)
+		}
+	}
+}
+
+// queuePendingDeletionsForDir mounts the BeeGFS file system referenced by pendingDir and queues every directory in
+// it for a deletion worker.
+func (cs *controllerServer) queuePendingDeletionsForDir(ctx context.Context, pendingDir beegfsVolume) error {
+	if !cs.volumeIDsInFlight.obtainLockOnString(pendingDir.volumeID) {
+		return errors.Errorf("volumeID %s is in use by another request", pendingDir.volumeID)
+	}
+	defer cs.volumeIDsInFlight.releaseLockOnString(pendingDir.volumeID)
+
+	// Write configuration files and mount BeeGFS.
+	defer func() {
+		if err := unmountAndCleanUpIfNecessary(ctx, pendingDir, true, cs.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up path for pendingDeletionDirBasePath", "path", pendingDir.mountDirPath,
+				"pendingDeletionDirBasePath", pendingDir.volumeID)
+		}
+	}()
+	if err := fs.MkdirAll(pendingDir.mountDirPath, 0750); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := writeClientFiles(ctx, pendingDir, cs.clientConfTemplatePath); err != nil {
+		return err
+	}
+	if err := mountIfNecessary(ctx, pendingDir, cs.mounter); err != nil {
+		return err
+	}
+
+	dirEntries, err := fsutil.ReadDir(pendingDir.volDirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // No volume was ever deleted.
+		}
+		return errors.WithStack(err)
+	}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			cs.queueDeletion(ctx, cs.newBeegfsVolume(pendingDir.sysMgmtdHost, pendingDeletionDirBasePath,
+				dirEntry.Name()))
+		}
+	}
+	return nil
+}
+
+// getSysMgmtdHosts returns the sorted sysMgmtdHosts of all FileSystemSpecificConfigs and all sysMgmtdHosts recorded by
+// addSysMgmtdHost or addVolDirBasePath (even before the controller service last restarted).
+func (cs *controllerServer) getSysMgmtdHosts(ctx context.Context) []string {
+	cs.knownFileSystemsMutex.Lock()
+	defer cs.knownFileSystemsMutex.Unlock()
+	cs.loadKnownFileSystems(ctx)
+	hostSet := make(map[string]struct{})
+	for _, fsConfig := range cs.pluginConfig.FileSystemSpecificConfigs {
+		hostSet[fsConfig.SysMgmtdHost] = struct{}{}
+	}
+	for sysMgmtdHost := range cs.knownVolDirBasePaths {
+		hostSet[sysMgmtdHost] = struct{}{}
+	}
+	hosts := make([]string, 0, len(hostSet))
+	for sysMgmtdHost := range hostSet {
+		hosts = append(hosts, sysMgmtdHost)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// getVolDirBasePaths returns the sorted volDirBasePaths configured for sysMgmtdHost and all volDirBasePaths recorded by
+// addVolDirBasePath for sysMgmtdHost (even before the controller service last restarted).
+func (cs *controllerServer) getVolDirBasePaths(ctx context.Context, sysMgmtdHost string) []string {
+	cs.knownFileSystemsMutex.Lock()
+	defer cs.knownFileSystemsMutex.Unlock()
+	cs.loadKnownFileSystems(ctx)
+	pathSet := make(map[string]struct{})
+	for _, volDirBasePath := range squashConfigForSysMgmtdHost(sysMgmtdHost, cs.pluginConfig).volDirBasePathsBeegfsRoot() {
+		pathSet[volDirBasePath] = struct{}{}
+	}
+	for volDirBasePath := range cs.knownVolDirBasePaths[sysMgmtdHost] {
+		pathSet[volDirBasePath] = struct{}{}
+	}
+	volDirBasePaths := make([]string, 0, len(pathSet))
+	for volDirBasePath := range pathSet {
+		volDirBasePaths = append(volDirBasePaths, volDirBasePath)
+	}
+	sort.Strings(volDirBasePaths)
+	return volDirBasePaths
 }
 
 // (*controllerServer) newBeegfsVolume is a wrapper around newBeegfsVolume that makes it easier to call in the context
@@ -399,6 +3019,13 @@ func (cs *controllerServer) newBeegfsVolume(sysMgmtdHost, volDirBasePathBeegfsRo
 	return newBeegfsVolume(mountDirPath, sysMgmtdHost, volDirPathBeegfsRoot, cs.pluginConfig)
 }
 
+// (*controllerServer) newBeegfsVolumeForFileSystem is a wrapper around newBeegfsVolume that represents the root of an
+// entire BeeGFS file system. It is useful for RPCs (e.g. GetCapacity) that must run beegfs-ctl commands against a file
+// system without referencing a particular volume.
+func (cs *controllerServer) newBeegfsVolumeForFileSystem(sysMgmtdHost string) beegfsVolume {
+	return cs.newBeegfsVolume(sysMgmtdHost, "/", "")
+}
+
 // (*controllerServer) newBeegfsVolumeFromID is a wrapper around newBeegfsVolumeFromID that makes it easier to call in
 // the context of the controller service. (*controllerServer) newBeegfsVolumeFromID selects the mountDirPath and passes
 // the controller service's PluginConfig.
@@ -406,3 +3033,24 @@ func (cs *controllerServer) newBeegfsVolumeFromID(volumeID string) (beegfsVolume
 	mountDirPath := path.Join(cs.csDataDir, sanitizeVolumeID(volumeID)) // e.g. /csDataDir/127.0.0.1_scratch_pvc-12345678
 	return newBeegfsVolumeFromID(mountDirPath, volumeID, cs.pluginConfig)
 }
+
+// (*controllerServer) newBeegfsSnapshot represents a snapshot as a beegfsVolume whose directory is in the
+// snapshotDirBasePath configured for sysMgmtdHost. The snapshot ID is the beegfsVolume's volumeID.
+func (cs *controllerServer) newBeegfsSnapshot(sysMgmtdHost, snapName string) beegfsVolume {
+	snapDirBasePathBeegfsRoot := squashConfigForSysMgmtdHost(sysMgmtdHost, cs.pluginConfig).snapshotDirBasePathBeegfsRoot()
+	return cs.newBeegfsVolume(sysMgmtdHost, snapDirBasePathBeegfsRoot, snapName)
+}
+
+// (*controllerServer) newBeegfsSnapshotFromID is the newBeegfsVolumeFromID equivalent of newBeegfsSnapshot. It returns
+// an error if the snapshotID does not reference a directory directly under the configured snapshotDirBasePath.
+func (cs *controllerServer) newBeegfsSnapshotFromID(snapshotID string) (beegfsVolume, error) {
+	snap, err := cs.newBeegfsVolumeFromID(snapshotID)
+	if err != nil {
+		return snap, err
+	}
+	if snap.volDirBasePathBeegfsRoot != snap.config.snapshotDirBasePathBeegfsRoot() {
+		return snap, errors.Errorf("%s is not in snapshot directory %s", snapshotID,
+			snap.config.snapshotDirBasePathBeegfsRoot())
+	}
+	return snap, nil
+}
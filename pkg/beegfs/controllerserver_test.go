@@ -6,8 +6,21 @@ Licensed under the Apache License, Version 2.0.
 package beegfs
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestGetStripePatternConfigFromParams(t *testing.T) {
@@ -77,6 +90,79 @@ func TestGetStripePatternConfigFromParams(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		"mirroring example": {
+			reqParams: map[string]string{
+				stripePatternTypeKey: "BuddyMirror",
+				metadataMirroringKey: "1",
+			},
+			want: stripePatternConfig{
+				stripePatternType: stripePatternTypeBuddyMirror,
+				metadataMirroring: "true",
+			},
+			wantErr: false,
+		},
+		"storagePoolName example": {
+			reqParams: map[string]string{
+				stripePatternStoragePoolNameKey: "nvme",
+			},
+			want: stripePatternConfig{
+				storagePoolName: "nvme",
+			},
+			wantErr: false,
+		},
+		"storagePoolID and storagePoolName example": {
+			reqParams: map[string]string{
+				stripePatternStoragePoolIDKey:   "2",
+				stripePatternStoragePoolNameKey: "nvme",
+			},
+			want:    stripePatternConfig{},
+			wantErr: true,
+		},
+		"storagePoolCandidates example": {
+			reqParams: map[string]string{
+				stripePatternStoragePoolCandidatesKey: "nvme:2.5, 3",
+			},
+			want: stripePatternConfig{
+				storagePoolCandidates: []storagePoolCandidate{{pool: "nvme", weight: 2.5}, {pool: "3", weight: 1}},
+			},
+			wantErr: false,
+		},
+		"storagePoolID and storagePoolCandidates example": {
+			reqParams: map[string]string{
+				stripePatternStoragePoolIDKey:         "2",
+				stripePatternStoragePoolCandidatesKey: "nvme,hdd",
+			},
+			want:    stripePatternConfig{},
+			wantErr: true,
+		},
+		"invalid storagePoolCandidates weight example": {
+			reqParams: map[string]string{
+				stripePatternStoragePoolCandidatesKey: "nvme:0",
+			},
+			want:    stripePatternConfig{},
+			wantErr: true,
+		},
+		"empty storagePoolCandidates entry example": {
+			reqParams: map[string]string{
+				stripePatternStoragePoolCandidatesKey: "nvme,,hdd",
+			},
+			want:    stripePatternConfig{},
+			wantErr: true,
+		},
+		"invalid stripePatternTypeKey example": {
+			reqParams: map[string]string{
+				stripePatternTypeKey: "raid10",
+			},
+			want:    stripePatternConfig{},
+			wantErr: true,
+		},
+		"invalid metadataMirroringKey example": {
+			reqParams: map[string]string{
+				metadataMirroringKey: "sometimes",
+			},
+			want:    stripePatternConfig{},
+			wantErr: true,
+		},
 		"wrong example": {
 			reqParams: map[string]string{
 				"stripePattern/storagepoolid": "2",
@@ -96,7 +182,7 @@ func TestGetStripePatternConfigFromParams(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			got, err := getStripePatternConfigFromParams(tc.reqParams)
 			if !reflect.DeepEqual(tc.want, got) {
-				t.Fatalf("expected: %s, got: %s", tc.want, got)
+				t.Fatalf("expected: %v, got: %v", tc.want, got)
 			}
 			if !tc.wantErr && err != nil {
 				t.Fatalf("unexpected error: %s", err)
@@ -205,3 +291,1766 @@ func TestGetPermissionsConfigFromParams(t *testing.T) {
 		})
 	}
 }
+
+func TestGetQuotaConfigFromParams(t *testing.T) {
+	tests := map[string]struct {
+		reqParams         map[string]string
+		permissionsConfig permissionsConfig
+		want              quotaConfig
+		wantErr           bool
+	}{
+		"no quota/ parameters": {
+			reqParams: map[string]string{},
+			want:      quotaConfig{idType: defaultQuotaIDType},
+		},
+		"enforce capacity with default ID type": {
+			reqParams: map[string]string{quotaEnforceCapacityKey: "true", quotaIDRangeKey: "5000-5999"},
+			want:      quotaConfig{enforceCapacity: true, idType: quotaIDTypeGID, idRangeStart: 5000, idRangeEnd: 5999},
+		},
+		"enforce capacity with uid": {
+			reqParams: map[string]string{quotaEnforceCapacityKey: "true", quotaIDTypeKey: "uid",
+				quotaIDRangeKey: "5000-5000"},
+			want: quotaConfig{enforceCapacity: true, idType: quotaIDTypeUID, idRangeStart: 5000, idRangeEnd: 5000},
+		},
+		"enforce capacity disabled": {
+			reqParams: map[string]string{quotaEnforceCapacityKey: "false"},
+			want:      quotaConfig{idType: defaultQuotaIDType},
+		},
+		"enforce capacity without ID range": {
+			reqParams: map[string]string{quotaEnforceCapacityKey: "true"},
+			wantErr:   true,
+		},
+		"unparseable enforce capacity": {
+			reqParams: map[string]string{quotaEnforceCapacityKey: "strange_value"},
+			wantErr:   true,
+		},
+		"invalid ID type": {
+			reqParams: map[string]string{quotaIDTypeKey: "project"},
+			wantErr:   true,
+		},
+		"unparseable ID range": {
+			reqParams: map[string]string{quotaIDRangeKey: "5000"},
+			wantErr:   true,
+		},
+		"reversed ID range": {
+			reqParams: map[string]string{quotaIDRangeKey: "5999-5000"},
+			wantErr:   true,
+		},
+		"ID range including root": {
+			reqParams: map[string]string{quotaIDRangeKey: "0-5000"},
+			wantErr:   true,
+		},
+		"too large ID range": {
+			reqParams: map[string]string{quotaIDRangeKey: "5000-4294967296"},
+			wantErr:   true,
+		},
+		"conflicting permissions gid": {
+			reqParams:         map[string]string{quotaEnforceCapacityKey: "true", quotaIDRangeKey: "5000-5999"},
+			permissionsConfig: permissionsConfig{gid: 1000},
+			wantErr:           true,
+		},
+		"non-conflicting permissions uid": {
+			reqParams:         map[string]string{quotaEnforceCapacityKey: "true", quotaIDRangeKey: "5000-5999"},
+			permissionsConfig: permissionsConfig{uid: 1000},
+			want:              quotaConfig{enforceCapacity: true, idType: quotaIDTypeGID, idRangeStart: 5000, idRangeEnd: 5999},
+		},
+		"unknown quota/ parameter": {
+			reqParams: map[string]string{"quota/sizeLimit": "1G"},
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := getQuotaConfigFromParams(tc.reqParams, tc.permissionsConfig)
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error occured: %s", err)
+			}
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected error did not occur")
+			}
+			if !tc.wantErr && !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("expected: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGetDeletePolicyFromParams(t *testing.T) {
+	tests := map[string]struct {
+		reqParams map[string]string
+		want      deletePolicy
+		wantErr   bool
+	}{
+		"no deletePolicy": {
+			reqParams: map[string]string{},
+			want:      deletePolicyDelete,
+		},
+		"retain-in-place": {
+			reqParams: map[string]string{deletePolicyKey: "retain-in-place"},
+			want:      deletePolicyRetainInPlace,
+		},
+		"move-to-trash": {
+			reqParams: map[string]string{deletePolicyKey: "move-to-trash"},
+			want:      deletePolicyMoveToTrash,
+		},
+		"invalid deletePolicy": {
+			reqParams: map[string]string{deletePolicyKey: "retain"},
+			wantErr:   true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := getDeletePolicyFromParams(tc.reqParams)
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error occured: %s", err)
+			}
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected error did not occur")
+			}
+			if !tc.wantErr && tc.want != got {
+				t.Fatalf("expected: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGetVolDirFromParams(t *testing.T) {
+	pvcParams := map[string]string{pvcNameKey: "data", pvcNamespaceKey: "team-a"}
+	tests := map[string]struct {
+		volDirBasePath string
+		volDirName     string // not passed if empty
+		pvcParams      map[string]string
+		wantBasePath   string
+		wantName       string
+		wantTemplated  bool
+		wantErr        bool
+	}{
+		"no template": {
+			volDirBasePath: "vols/",
+			wantBasePath:   "/vols",
+			wantName:       "pvc-1234",
+		},
+		"namespace in volDirBasePath": {
+			volDirBasePath: "k8s/${pvc.metadata.namespace}",
+			pvcParams:      pvcParams,
+			wantBasePath:   "/k8s/team-a",
+			wantName:       "pvc-1234",
+			wantTemplated:  true,
+		},
+		"PVC name as volDirName": {
+			volDirBasePath: "k8s/${pvc.metadata.namespace}",
+			volDirName:     "${pvc.metadata.name}",
+			pvcParams:      pvcParams,
+			wantBasePath:   "/k8s/team-a",
+			wantName:       "data",
+			wantTemplated:  true,
+		},
+		"combined volDirName": {
+			volDirBasePath: "k8s",
+			volDirName:     "${pvc.metadata.namespace}_${pvc.metadata.name}_${pv.metadata.name}",
+			pvcParams:      pvcParams,
+			wantBasePath:   "/k8s",
+			wantName:       "team-a_data_pvc-1234",
+			wantTemplated:  true,
+		},
+		"sanitized values": {
+			volDirBasePath: "k8s/${pvc.metadata.namespace}",
+			volDirName:     "${pvc.metadata.name}",
+			pvcParams:      map[string]string{pvcNameKey: "../a/b", pvcNamespaceKey: ".."},
+			wantBasePath:   "/k8s/__",
+			wantName:       ".._a_b",
+			wantTemplated:  true,
+		},
+		"long volDirName": {
+			volDirBasePath: "k8s",
+			volDirName:     "${pvc.metadata.name}",
+			pvcParams:      map[string]string{pvcNameKey: strings.Repeat("a", 300)},
+			wantBasePath:   "/k8s",
+			wantName:       strings.Repeat("a", maxDirNameLength),
+			wantTemplated:  true,
+		},
+		"missing PVC parameters": {
+			volDirBasePath: "k8s/${pvc.metadata.namespace}",
+			wantErr:        true,
+		},
+		"unknown variable": {
+			volDirBasePath: "k8s/${pvc.metadata.uid}",
+			pvcParams:      pvcParams,
+			wantErr:        true,
+		},
+		"volDirName with slash": {
+			volDirBasePath: "k8s",
+			volDirName:     "${pvc.metadata.namespace}/${pvc.metadata.name}",
+			pvcParams:      pvcParams,
+			wantErr:        true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			reqParams := map[string]string{volDirBasePathKey: tc.volDirBasePath}
+			if tc.volDirName != "" {
+				reqParams[volDirNameKey] = tc.volDirName
+			}
+			for key, value := range tc.pvcParams {
+				reqParams[key] = value
+			}
+			basePath, name, templated, err := getVolDirFromParams(reqParams, "pvc-1234")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error did not occur")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error occured: %s", err)
+			}
+			if basePath != tc.wantBasePath || name != tc.wantName || templated != tc.wantTemplated {
+				t.Fatalf("expected: %s, %s, %t, got: %s, %s, %t", tc.wantBasePath, tc.wantName, tc.wantTemplated,
+					basePath, name, templated)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeTemplatedVolDir(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	newRequest := func(volName string) *csi.CreateVolumeRequest {
+		req := newTestCreateVolumeRequest(volName, nil)
+		req.Parameters[volDirBasePathKey] = "k8s/${pvc.metadata.namespace}"
+		req.Parameters[volDirNameKey] = "${pvc.metadata.name}"
+		req.Parameters[pvcNamespaceKey] = "team-a"
+		req.Parameters[pvcNameKey] = "data"
+		return req
+	}
+	createVolume := func(volName string) string {
+		resp, err := cs.CreateVolume(context.Background(), newRequest(volName))
+		if err != nil {
+			t.Fatalf("failed to create volume %s: %v", volName, err)
+		}
+		return resp.GetVolume().GetVolumeId()
+	}
+
+	// The first volume gets the templated directory, even when CreateVolume is retried.
+	const wantFirstID = "beegfs://localhost/k8s/team-a/data"
+	for i := 0; i < 2; i++ {
+		if volumeID := createVolume("pvc-1"); volumeID != wantFirstID {
+			t.Fatalf("expected volume ID %s, got %s", wantFirstID, volumeID)
+		}
+	}
+
+	// A recreated PVC with the same name gets a different directory while the first one exists.
+	secondID := createVolume("pvc-2")
+	if !strings.HasPrefix(secondID, wantFirstID+"-") {
+		t.Fatalf("expected volume ID with prefix %s-, got %s", wantFirstID, secondID)
+	}
+	if volumeID := createVolume("pvc-2"); volumeID != secondID {
+		t.Fatalf("expected volume ID %s, got %s", secondID, volumeID)
+	}
+	if volumeID := createVolume("pvc-1"); volumeID != wantFirstID {
+		t.Fatalf("expected volume ID %s, got %s", wantFirstID, volumeID)
+	}
+	if _, err := os.Stat(path.Join(beegfsRootPath, "k8s", "team-a", path.Base(secondID))); err != nil {
+		t.Fatalf("expected directory of second volume: %v", err)
+	}
+
+	// Once the first volume is deleted, its directory can be reused.
+	if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: wantFirstID}); err != nil {
+		t.Fatal(err)
+	}
+	waitForDeletions(t, cs)
+	if volumeID := createVolume("pvc-3"); volumeID != wantFirstID {
+		t.Fatalf("expected volume ID %s, got %s", wantFirstID, volumeID)
+	}
+
+	req := newRequest("pvc-4")
+	delete(req.Parameters, pvcNamespaceKey)
+	if _, err := cs.CreateVolume(context.Background(), req); grpcCode(err) != codes.InvalidArgument {
+		t.Fatalf("expected code %v, got %v", codes.InvalidArgument, err)
+	}
+}
+
+func TestRecordVolumeCreation(t *testing.T) {
+	cs, _, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	req := newTestCreateVolumeRequest("vol1", nil)
+	req.Parameters[pvcNameKey] = "data"
+	req.Parameters[pvcNamespaceKey] = "team-a"
+	req.Parameters[deletePolicyKey] = string(deletePolicyRetainInPlace)
+	vol := cs.newBeegfsVolume("localhost", "/vols", "vol1")
+	if err := fs.MkdirAll(vol.volDirBasePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recordVolumeCreation(vol, "vol1", req.Parameters, deletePolicyRetainInPlace); err != nil {
+		t.Fatal(err)
+	}
+	first, exists, err := readVolumeMetadata(vol)
+	if err != nil || !exists {
+		t.Fatalf("expected metadata, got exists: %t, err: %v", exists, err)
+	}
+	if first.Version != volumeMetadataVersion || first.VolumeName != "vol1" || first.PVCName != "data" ||
+		first.PVCNamespace != "team-a" || first.DeletePolicy != deletePolicyRetainInPlace ||
+		!reflect.DeepEqual(first.Parameters, req.Parameters) || first.CreationTime == nil ||
+		first.DriverVersion != vendorVersion {
+		t.Fatalf("unexpected metadata: %+v", first)
+	}
+
+	// A retried CreateVolume keeps the original creation time.
+	time.Sleep(10 * time.Millisecond)
+	if err := recordVolumeCreation(vol, "vol1", req.Parameters, deletePolicyRetainInPlace); err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := readVolumeMetadata(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.CreationTime.Equal(*first.CreationTime) {
+		t.Fatalf("expected creation time %v, got %v", first.CreationTime, second.CreationTime)
+	}
+}
+
+func TestValidateVolumeCapabilitiesParameters(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	req := newTestCreateVolumeRequest("vol1", nil)
+	req.Parameters[stripePatternChunkSizeKey] = "1m"
+	req.Parameters[deletePolicyKey] = string(deletePolicyRetainInPlace)
+	req.Parameters[pvcNameKey] = "data"
+	resp, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+	// A directory without a metadata file (e.g. a statically provisioned one).
+	ctlExec := newSimBeegfsCtlExecutor(beegfsRootPath)
+	if err := ctlExec.createDirectoryForVolume(ctx, cs.newBeegfsVolume("localhost", "vols", "static"),
+		permissionsConfig{uid: 1000, gid: 2000, mode: 0750}, stripePatternConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	fs = ctlExec.ownershipFs(fs)
+	fsutil = afero.Afero{Fs: fs}
+	const staticID = "beegfs://localhost/vols/static"
+	cs.ctlExec = &healthFakeBeegfsCtlExecutor{
+		simBeegfsCtlExecutor: ctlExec,
+		entryInfo: `Entry type: directory
+EntryID: 0-5F8D7E1B-1
+Metadata node: meta01 [ID: 1]
+Stripe pattern details:
++ Type: RAID0
++ Chunksize: 1M
++ Number of storage targets: desired: 4
++ Storage Pool: 2 (nvme)
+`,
+	}
+
+	tests := map[string]struct {
+		volumeID      string
+		params        map[string]string
+		wantConfirmed bool
+		wantParams    bool
+	}{
+		"no parameters": {
+			volumeID:      volumeID,
+			wantConfirmed: true,
+		},
+		"matching parameters": {
+			volumeID: volumeID,
+			params: map[string]string{sysMgmtdHostKey: "localhost", volDirBasePathKey: "vols",
+				stripePatternChunkSizeKey: "1024k", deletePolicyKey: "retain-in-place", pvcNameKey: "other"},
+			wantConfirmed: true,
+			wantParams:    true,
+		},
+		"different chunk size": {
+			volumeID: volumeID,
+			params:   map[string]string{stripePatternChunkSizeKey: "2m"},
+		},
+		"different volDirBasePath": {
+			volumeID: volumeID,
+			params:   map[string]string{volDirBasePathKey: "other"},
+		},
+		"parameter not recorded": {
+			volumeID: volumeID,
+			params:   map[string]string{quotaEnforceCapacityKey: "false"},
+		},
+		"static volume with matching parameters": {
+			volumeID: staticID,
+			params: map[string]string{stripePatternChunkSizeKey: "1m", stripePatternNumTargetsKey: "4",
+				stripePatternStoragePoolNameKey: "nvme", stripePatternTypeKey: "raid0",
+				permissionsModeKey: "0750", permissionsUIDKey: "1000"},
+			wantConfirmed: true,
+			wantParams:    true,
+		},
+		"static volume in candidate storage pool": {
+			volumeID:      staticID,
+			params:        map[string]string{stripePatternStoragePoolCandidatesKey: "hdd,nvme"},
+			wantConfirmed: true,
+			wantParams:    true,
+		},
+		"static volume in other storage pool": {
+			volumeID: staticID,
+			params:   map[string]string{stripePatternStoragePoolIDKey: "1"},
+		},
+		"static volume with different number of targets": {
+			volumeID: staticID,
+			params:   map[string]string{stripePatternNumTargetsKey: "8"},
+		},
+		"static volume with different mode": {
+			volumeID: staticID,
+			params:   map[string]string{permissionsModeKey: "0777"},
+		},
+		"static volume with unverifiable parameter": {
+			volumeID:      staticID,
+			params:        map[string]string{stripePatternChunkSizeKey: "1m", deletePolicyKey: "retain-in-place"},
+			wantConfirmed: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, err := cs.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           tc.volumeID,
+				VolumeCapabilities: req.GetVolumeCapabilities(),
+				Parameters:         tc.params,
+			})
+			if err != nil {
+				t.Fatalf("failed to validate volume capabilities: %v", err)
+			}
+			if (resp.GetConfirmed() != nil) != tc.wantConfirmed {
+				t.Fatalf("expected confirmed %t, got response %v", tc.wantConfirmed, resp)
+			}
+			gotParams := resp.GetConfirmed().GetParameters()
+			if tc.wantParams && !reflect.DeepEqual(gotParams, tc.params) {
+				t.Fatalf("expected parameters %v, got response %v", tc.params, resp)
+			}
+			if !tc.wantParams && len(gotParams) != 0 {
+				t.Fatalf("expected no parameters, got response %v", resp)
+			}
+		})
+	}
+}
+
+func TestParseChunkSize(t *testing.T) {
+	tests := map[string]struct {
+		chunkSize string
+		want      uint64
+		wantErr   bool
+	}{
+		"bytes":     {chunkSize: "65536", want: 65536},
+		"kibibytes": {chunkSize: "512k", want: 512 << 10},
+		"entryinfo": {chunkSize: "512K", want: 512 << 10},
+		"mebibytes": {chunkSize: "1m", want: 1 << 20},
+		"empty":     {chunkSize: "", wantErr: true},
+		"invalid":   {chunkSize: "1g", wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseChunkSize(tc.chunkSize)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %t, got %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Fatalf("expected %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestClaimQuotaID(t *testing.T) {
+	tests := map[string]struct {
+		usedIDs    []uint32
+		usedPoolID string // the storage pool usedIDs are used in ("1" if empty)
+		cfg        quotaConfig
+		wantID     uint32
+		wantErr    bool
+	}{
+		"first ID unused": {
+			cfg:    quotaConfig{idType: quotaIDTypeGID, idRangeStart: 5000, idRangeEnd: 5999},
+			wantID: 5000,
+		},
+		"first IDs used": {
+			usedIDs: []uint32{5000, 5001},
+			cfg:     quotaConfig{idType: quotaIDTypeGID, idRangeStart: 5000, idRangeEnd: 5999},
+			wantID:  5002,
+		},
+		"first batch used": {
+			usedIDs: func() (ids []uint32) {
+				for id := uint32(5000); id < 5000+quotaIDBatchSize; id++ {
+					ids = append(ids, id)
+				}
+				return ids
+			}(),
+			cfg:    quotaConfig{idType: quotaIDTypeGID, idRangeStart: 5000, idRangeEnd: 5999},
+			wantID: 5000 + quotaIDBatchSize,
+		},
+		"first IDs used in other storage pool": {
+			usedIDs:    []uint32{5000, 5001},
+			usedPoolID: "2",
+			cfg:        quotaConfig{idType: quotaIDTypeGID, idRangeStart: 5000, idRangeEnd: 5999},
+			wantID:     5002,
+		},
+		"all IDs used": {
+			usedIDs: []uint32{5000, 5001},
+			cfg:     quotaConfig{idType: quotaIDTypeGID, idRangeStart: 5000, idRangeEnd: 5001},
+			wantErr: true,
+		},
+		"range ends at largest ID": {
+			cfg:    quotaConfig{idType: quotaIDTypeUID, idRangeStart: 4294967295, idRangeEnd: 4294967295},
+			wantID: 4294967295,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctlExec := newSimBeegfsCtlExecutor("")
+			ctlExec.pools = append(ctlExec.pools, storagePool{id: "2", description: "Fast"})
+			if tc.usedPoolID == "" {
+				tc.usedPoolID = "1"
+			}
+			for _, id := range tc.usedIDs {
+				ctlExec.setQuotaUsage("localhost", tc.usedPoolID, tc.cfg.idType, id, 0, 1)
+			}
+			cs := &controllerServer{ctlExec: ctlExec}
+			vol := beegfsVolume{sysMgmtdHost: "localhost"}
+			got, err := cs.claimQuotaID(context.Background(), vol, "1", tc.cfg, 1024)
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error occured: %s", err)
+			}
+			if tc.wantErr {
+				if !errors.Is(err, errNoFreeQuotaID) {
+					t.Fatalf("expected errNoFreeQuotaID, got: %v", err)
+				}
+				return
+			}
+			if got != tc.wantID {
+				t.Fatalf("expected: %d, got: %d", tc.wantID, got)
+			}
+			if limit := ctlExec.quota("localhost", "1", tc.cfg.idType, got).sizeLimit; limit != 1024 {
+				t.Fatalf("expected limit of 1024 for ID %d, got: %d", got, limit)
+			}
+		})
+	}
+}
+
+func TestGetReservedQuota(t *testing.T) {
+	ctlExec := newSimBeegfsCtlExecutor("")
+	ctlExec.pools = append(ctlExec.pools, storagePool{id: "2", description: "Fast"})
+	for _, quota := range []quotaInfo{
+		{id: 5000, sizeLimit: 1000, sizeUsed: 400},
+		{id: 5001, sizeLimit: 1000, sizeUsed: 1500}, // over quota
+		{id: 5150, sizeLimit: 2000},
+		{id: 5200, sizeLimit: 5000},                     // outside of range
+		{id: 5002, sizeUsed: 100},                       // no limit
+		{id: 5003, sizeLimit: 7000, storagePoolID: "2"}, // other storage pool
+	} {
+		if quota.storagePoolID == "" {
+			quota.storagePoolID = "1"
+		}
+		quota.idType = quotaIDTypeGID
+		ctlExec.setQuota("localhost", quota)
+	}
+	// The same IDs on another file system do not count.
+	ctlExec.setQuota("otherhost", quotaInfo{idType: quotaIDTypeGID, id: 5004, storagePoolID: "1", sizeLimit: 9000})
+	cfg := quotaConfig{idType: quotaIDTypeGID, idRangeStart: 5000, idRangeEnd: 5199}
+	vol := beegfsVolume{sysMgmtdHost: "localhost"}
+	got, err := getReservedQuota(context.Background(), ctlExec, vol, "1", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error occured: %s", err)
+	}
+	if want := uint64(600 + 2000); got != want {
+		t.Fatalf("expected: %d, got: %d", want, got)
+	}
+}
+
+func TestGetCachedReservedQuota(t *testing.T) {
+	ctlExec := newSimBeegfsCtlExecutor("")
+	cs := &controllerServer{ctlExec: ctlExec}
+	vol := beegfsVolume{sysMgmtdHost: "localhost"}
+	cfg := quotaConfig{enforceCapacity: true, idType: quotaIDTypeGID, idRangeStart: 5000, idRangeEnd: 5999}
+	ctlExec.setQuotaUsage("localhost", "1", quotaIDTypeGID, 5000, 400, 1)
+	if err := ctlExec.setQuotaLimitForVolume(context.Background(), vol, "1", quotaIDTypeGID, 5000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	wantReserved := func(want uint64) {
+		t.Helper()
+		got, err := cs.getCachedReservedQuota(context.Background(), vol, "1", cfg)
+		if err != nil {
+			t.Fatalf("unexpected error occured: %s", err)
+		}
+		if got != want {
+			t.Fatalf("expected: %d, got: %d", want, got)
+		}
+	}
+	wantReserved(600)
+
+	// Usage changes are only picked up once the cache expires, and the cache is used instead of beegfs-ctl.
+	ctlExec.setQuotaUsage("localhost", "1", quotaIDTypeGID, 5000, 900, 1)
+	ctlExec.injectFailure(simOpGetQuota, simErrUnreachable)
+	wantReserved(600)
+	ctlExec.failures = make(map[simOp][]error)
+
+	// Claiming an ID changes the reserved capacity, so the cache is refreshed.
+	if _, err := cs.claimQuotaID(context.Background(), vol, "1", cfg, 2000); err != nil {
+		t.Fatal(err)
+	}
+	wantReserved(100 + 2000)
+}
+
+func TestGetCapacity(t *testing.T) {
+	cs, _, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctlExec := cs.ctlExec.(*simBeegfsCtlExecutor)
+	ctlExec.pools = []storagePool{{id: "1", description: "Default", targets: []string{"101", "102", "201"}},
+		{id: "2", description: "Fast", targets: []string{"202"}}}
+	ctlExec.setQuota("localhost", quotaInfo{idType: quotaIDTypeUID, id: 1000, storagePoolID: "1",
+		sizeLimit: 3 << 30, sizeUsed: 1 << 30})
+	ctlExec.setQuota("localhost", quotaInfo{idType: quotaIDTypeGID, id: 5000, storagePoolID: "1",
+		sizeLimit: 1 << 40, sizeUsed: 1 << 38})
+
+	tests := map[string]struct {
+		params   map[string]string
+		ctlErr   error
+		wantCode codes.Code
+		want     int64
+	}{
+		"no sysMgmtdHost": {
+			params: map[string]string{},
+		},
+		"file system": {
+			params: map[string]string{sysMgmtdHostKey: "localhost"},
+			want:   4 << 40,
+		},
+		"storage pool": {
+			params: map[string]string{sysMgmtdHostKey: "localhost", stripePatternStoragePoolIDKey: "2"},
+			want:   1 << 40,
+		},
+		"missing storage pool": {
+			params:   map[string]string{sysMgmtdHostKey: "localhost", stripePatternStoragePoolIDKey: "3"},
+			wantCode: codes.Internal,
+		},
+		"uid quota": {
+			params: map[string]string{sysMgmtdHostKey: "localhost", permissionsUIDKey: "1000"},
+			want:   2 << 30,
+		},
+		"uid quota in other storage pool": {
+			params: map[string]string{sysMgmtdHostKey: "localhost", stripePatternStoragePoolIDKey: "2",
+				permissionsUIDKey: "1000"},
+			want: 1 << 40,
+		},
+		"uid without quota": {
+			params: map[string]string{sysMgmtdHostKey: "localhost", permissionsUIDKey: "1001"},
+			want:   4 << 40,
+		},
+		"quota unavailable": {
+			params:   map[string]string{sysMgmtdHostKey: "localhost", permissionsUIDKey: "1000"},
+			ctlErr:   simErrUnreachable,
+			wantCode: codes.Unavailable,
+		},
+		"enforced capacity": {
+			params: map[string]string{sysMgmtdHostKey: "localhost", quotaEnforceCapacityKey: "true",
+				quotaIDRangeKey: "5000-5099"},
+			want: 4<<40 - (1<<40 - 1<<38),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if tc.ctlErr != nil {
+				ctlExec.injectFailure(simOpGetQuota, tc.ctlErr)
+			}
+			resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: tc.params})
+			if grpcCode(err) != tc.wantCode {
+				t.Fatalf("expected code %v, got %v", tc.wantCode, err)
+			}
+			if err == nil && resp.GetAvailableCapacity() != tc.want {
+				t.Fatalf("expected capacity %d, got %d", tc.want, resp.GetAvailableCapacity())
+			}
+		})
+	}
+
+	// The CO calls GetCapacity concurrently (e.g. for every StorageClass). No call is aborted, and every call cleans
+	// up after itself.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+				Parameters: map[string]string{sysMgmtdHostKey: "localhost"}})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("expected concurrent calls to succeed, got %v", err)
+		}
+	}
+	if entries, err := ioutil.ReadDir(cs.csDataDir); err != nil || len(entries) != 0 {
+		t.Fatalf("expected empty csDataDir, got %v (%v)", entries, err)
+	}
+}
+
+func TestSnapshotLifecycle(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+
+	volumeID := createTestVolume(t, cs, "vol1", nil)
+	otherVolumeID := createTestVolume(t, cs, "vol2", nil)
+	if err := fsutil.WriteFile(path.Join(beegfsRootPath, "vols", "vol1", "data"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A snapshot of a small volume is ready as soon as CreateSnapshot returns.
+	createResp, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap1", SourceVolumeId: volumeID})
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	snap := createResp.GetSnapshot()
+	if snap.GetSnapshotId() != "beegfs://localhost/.beegfs-csi-snapshots/snap1" || !snap.GetReadyToUse() ||
+		snap.GetSizeBytes() != 10 || snap.GetSourceVolumeId() != volumeID {
+		t.Fatalf("unexpected snapshot %v", snap)
+	}
+	data, err := fsutil.ReadFile(path.Join(beegfsRootPath, ".beegfs-csi-snapshots", "snap1", "data"))
+	if err != nil || string(data) != "0123456789" {
+		t.Fatalf("expected copied data, got %q (%v)", data, err)
+	}
+
+	// CreateSnapshot is idempotent but a name can only be used for one source volume.
+	repeatResp, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap1", SourceVolumeId: volumeID})
+	if err != nil || !reflect.DeepEqual(repeatResp.GetSnapshot().GetCreationTime(), snap.GetCreationTime()) {
+		t.Fatalf("expected the same snapshot, got %v (%v)", repeatResp.GetSnapshot(), err)
+	}
+	_, err = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap1", SourceVolumeId: otherVolumeID})
+	if grpcCode(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists, got %v", err)
+	}
+	if _, err = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap2", SourceVolumeId: volumeID}); err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+
+	listTests := map[string]struct {
+		req           *csi.ListSnapshotsRequest
+		wantIDs       []string
+		wantNextToken string
+		wantCode      codes.Code
+	}{
+		"all": {
+			req: &csi.ListSnapshotsRequest{},
+			wantIDs: []string{"beegfs://localhost/.beegfs-csi-snapshots/snap1",
+				"beegfs://localhost/.beegfs-csi-snapshots/snap2"},
+		},
+		"first page": {
+			req:           &csi.ListSnapshotsRequest{MaxEntries: 1},
+			wantIDs:       []string{"beegfs://localhost/.beegfs-csi-snapshots/snap1"},
+			wantNextToken: "beegfs://localhost/.beegfs-csi-snapshots/snap1",
+		},
+		"last page": {
+			req: &csi.ListSnapshotsRequest{MaxEntries: 1,
+				StartingToken: "beegfs://localhost/.beegfs-csi-snapshots/snap1"},
+			wantIDs: []string{"beegfs://localhost/.beegfs-csi-snapshots/snap2"},
+		},
+		"by snapshot ID": {
+			req:     &csi.ListSnapshotsRequest{SnapshotId: "beegfs://localhost/.beegfs-csi-snapshots/snap2"},
+			wantIDs: []string{"beegfs://localhost/.beegfs-csi-snapshots/snap2"},
+		},
+		"by volume ID": {
+			req:     &csi.ListSnapshotsRequest{SnapshotId: volumeID},
+			wantIDs: []string{},
+		},
+		"by source volume ID": {
+			req:     &csi.ListSnapshotsRequest{SourceVolumeId: otherVolumeID},
+			wantIDs: []string{},
+		},
+		"invalid token": {
+			req:      &csi.ListSnapshotsRequest{StartingToken: "invalid"},
+			wantCode: codes.Aborted,
+		},
+	}
+	for name, tc := range listTests {
+		t.Run(name, func(t *testing.T) {
+			resp, err := cs.ListSnapshots(ctx, tc.req)
+			if grpcCode(err) != tc.wantCode {
+				t.Fatalf("expected code %v, got %v", tc.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			gotIDs := []string{}
+			for _, entry := range resp.GetEntries() {
+				gotIDs = append(gotIDs, entry.GetSnapshot().GetSnapshotId())
+			}
+			if !reflect.DeepEqual(gotIDs, tc.wantIDs) || resp.GetNextToken() != tc.wantNextToken {
+				t.Fatalf("expected %v (next token %q), got %v (next token %q)", tc.wantIDs, tc.wantNextToken, gotIDs,
+					resp.GetNextToken())
+			}
+		})
+	}
+
+	// A restarted controller service still knows the file system (which is not in its configuration).
+	restarted := NewControllerServer("testID", PluginConfig{}, cs.clientConfTemplatePath, cs.csDataDir)
+	restarted.mounter, restarted.ctlExec = cs.mounter, cs.ctlExec
+	restartedResp, err := restarted.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+	if err != nil || len(restartedResp.GetEntries()) != 2 {
+		t.Fatalf("expected two snapshots after restart, got %v (%v)", restartedResp.GetEntries(), err)
+	}
+
+	// DeleteSnapshot removes snapshots but refuses to touch anything outside of the snapshot directory.
+	if _, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snap.GetSnapshotId()}); err != nil {
+		t.Fatalf("failed to delete snapshot: %v", err)
+	}
+	if _, err = os.Stat(path.Join(beegfsRootPath, ".beegfs-csi-snapshots", "snap1")); !os.IsNotExist(err) {
+		t.Fatalf("expected snapshot directory to be deleted, got %v", err)
+	}
+	if _, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: volumeID}); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if _, err = os.Stat(path.Join(beegfsRootPath, "vols", "vol1", "data")); err != nil {
+		t.Fatalf("expected volume to be untouched, got %v", err)
+	}
+	listResp, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+	if err != nil || len(listResp.GetEntries()) != 1 {
+		t.Fatalf("expected one remaining snapshot, got %v (%v)", listResp.GetEntries(), err)
+	}
+}
+
+// writeOnOpenFs is an afero.Fs that appends to writePath whenever a file whose path ends with openSuffix is opened
+// (e.g. to simulate a workload that writes to a volume while it is being copied).
+type writeOnOpenFs struct {
+	afero.Fs
+	openSuffix, writePath string
+}
+
+func (f writeOnOpenFs) Open(name string) (afero.File, error) {
+	if strings.HasSuffix(name, f.openSuffix) {
+		file, err := f.Fs.OpenFile(f.writePath, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return nil, err
+		}
+		_, err = file.WriteString("changed")
+		_ = file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f.Fs.Open(name)
+}
+
+func TestCreateSnapshotOfChangingVolume(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	volumeID := createTestVolume(t, cs, "vol1", nil)
+	for _, name := range []string{"a", "b"} {
+		if err := fsutil.WriteFile(path.Join(beegfsRootPath, "vols", "vol1", name), []byte("0123456789"),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The source volume changes while CreateSnapshot copies it.
+	osFs := fs
+	fs = writeOnOpenFs{Fs: osFs, openSuffix: "/vols/vol1/a", writePath: path.Join(beegfsRootPath, "vols", "vol1", "b")}
+	fsutil = afero.Afero{Fs: fs}
+	_, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap1", SourceVolumeId: volumeID})
+	fs, fsutil = osFs, afero.Afero{Fs: osFs}
+	if grpcCode(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(beegfsRootPath, ".beegfs-csi-snapshots", "snap1")); !os.IsNotExist(err) {
+		t.Fatalf("expected inconsistent copy to be discarded, got %v", err)
+	}
+
+	// The CO retries once the source volume is no longer changing.
+	resp, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap1", SourceVolumeId: volumeID})
+	wantSize := int64(10 + 10 + len("changed"))
+	if err != nil || !resp.GetSnapshot().GetReadyToUse() || resp.GetSnapshot().GetSizeBytes() != wantSize {
+		t.Fatalf("expected consistent snapshot, got %v (%v)", resp.GetSnapshot(), err)
+	}
+}
+
+func TestCreateVolumeFromContentSource(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+
+	volumeID := createTestVolume(t, cs, "vol1", nil)
+	if err := os.MkdirAll(path.Join(beegfsRootPath, "vols", "vol1", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsutil.WriteFile(path.Join(beegfsRootPath, "vols", "vol1", "dir", "data"), []byte("0123456789"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	snapResp, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap1", SourceVolumeId: volumeID})
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	snapshotID := snapResp.GetSnapshot().GetSnapshotId()
+	if err := fsutil.WriteFile(path.Join(beegfsRootPath, "vols", "vol1", "dir", "data"), []byte("changed"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	// A volume with the same path on another file system.
+	otherDirPath := path.Join(simRootPath(beegfsRootPath, "otherhost"), "vols", "vol1", "dir")
+	if err := os.MkdirAll(otherDirPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsutil.WriteFile(path.Join(otherDirPath, "data"), []byte("remote"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	volumeSource := func(id string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: id}}}
+	}
+	snapshotSource := func(id string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: id}}}
+	}
+	tests := map[string]struct {
+		name     string
+		source   *csi.VolumeContentSource
+		wantData string
+		wantCode codes.Code
+	}{
+		"clone": {
+			name:     "clone",
+			source:   volumeSource(volumeID),
+			wantData: "changed",
+		},
+		"clone again": {
+			name:     "clone",
+			source:   volumeSource(volumeID),
+			wantData: "changed",
+		},
+		"clone from different file system": {
+			name:     "remote-clone",
+			source:   volumeSource("beegfs://otherhost/vols/vol1"),
+			wantData: "remote",
+		},
+		"restore": {
+			name:     "restored",
+			source:   snapshotSource(snapshotID),
+			wantData: "0123456789",
+		},
+		"different source": {
+			name:     "restored",
+			source:   volumeSource(volumeID),
+			wantCode: codes.AlreadyExists,
+		},
+		"nonexistent volume": {
+			name:     "missing-volume",
+			source:   volumeSource("beegfs://localhost/vols/nonexistent"),
+			wantCode: codes.NotFound,
+		},
+		"volume as snapshot": {
+			name:     "missing-snapshot",
+			source:   snapshotSource(volumeID),
+			wantCode: codes.NotFound,
+		},
+	}
+	for _, name := range []string{"clone", "clone again", "clone from different file system", "restore",
+		"different source", "nonexistent volume", "volume as snapshot"} { // in order
+		tc := tests[name]
+		t.Run(name, func(t *testing.T) {
+			resp, err := cs.CreateVolume(ctx, newTestCreateVolumeRequest(tc.name, tc.source))
+			if grpcCode(err) != tc.wantCode {
+				t.Fatalf("expected code %v, got %v", tc.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(resp.GetVolume().GetContentSource(), tc.source) {
+				t.Fatalf("expected content source %v, got %v", tc.source, resp.GetVolume().GetContentSource())
+			}
+			data, err := fsutil.ReadFile(path.Join(beegfsRootPath, "vols", tc.name, "dir", "data"))
+			if err != nil || string(data) != tc.wantData {
+				t.Fatalf("expected %q, got %q (%v)", tc.wantData, data, err)
+			}
+		})
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	cs.pluginConfig.FileSystemSpecificConfigs = []FileSystemSpecificConfig{
+		{SysMgmtdHost: "otherhost", Config: beegfsConfig{VolDirBasePaths: []string{"static", "empty"}}},
+		{SysMgmtdHost: "downhost", Config: beegfsConfig{VolDirBasePaths: []string{"vols"}}},
+	}
+	// The file system of downhost cannot be mounted, so none of its volumes are listed, but the others still are.
+	if err := fsutil.WriteFile(simRootPath(beegfsRootPath, "downhost"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	volumeID := createTestVolume(t, cs, "vol-a", nil)
+	cloneSource := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+		Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volumeID}}}
+	createTestVolume(t, cs, "vol-b", cloneSource)
+	createTestVolume(t, cs, "vol-c", nil)
+	otherRootPath := simRootPath(beegfsRootPath, "otherhost")
+	if err := os.MkdirAll(path.Join(otherRootPath, "static", "static-vol"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Only directories with a metadata file are volumes.
+	if err := writeMetadataFile(path.Join(otherRootPath, "static", ".static-vol"+metadataFileSuffix),
+		volumeMetadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(otherRootPath, "static", "not-a-volume"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(beegfsRootPath, "vols", ".hidden"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsutil.WriteFile(path.Join(beegfsRootPath, "vols", "file"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wantVolumes := []*csi.Volume{
+		{VolumeId: "beegfs://localhost/vols/vol-a"},
+		{VolumeId: "beegfs://localhost/vols/vol-b", ContentSource: cloneSource},
+		{VolumeId: "beegfs://localhost/vols/vol-c"},
+		{VolumeId: "beegfs://otherhost/static/static-vol"},
+	}
+	var gotVolumes []*csi.Volume
+	var startingToken string
+	for {
+		resp, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 3, StartingToken: startingToken})
+		if err != nil {
+			t.Fatalf("failed to list volumes: %v", err)
+		}
+		for _, entry := range resp.GetEntries() {
+			gotVolumes = append(gotVolumes, entry.GetVolume())
+		}
+		if startingToken = resp.GetNextToken(); startingToken == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(gotVolumes, wantVolumes) {
+		t.Fatalf("expected volumes %v, got %v", wantVolumes, gotVolumes)
+	}
+
+	// Deleting the last volume of a page before the next page is requested does not skip any volumes.
+	resp, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2})
+	if err != nil || resp.GetNextToken() != "beegfs://localhost/vols/vol-b" {
+		t.Fatalf("expected next token for vol-b, got %q (%v)", resp.GetNextToken(), err)
+	}
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "beegfs://localhost/vols/vol-b"}); err != nil {
+		t.Fatalf("failed to delete volume: %v", err)
+	}
+	resp, err = cs.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: resp.GetNextToken()})
+	if err != nil || len(resp.GetEntries()) != 2 ||
+		resp.GetEntries()[0].GetVolume().GetVolumeId() != "beegfs://localhost/vols/vol-c" {
+		t.Fatalf("expected vol-c and static-vol, got %v (%v)", resp.GetEntries(), err)
+	}
+
+	// A restarted controller service still lists the volumes in the volDirBasePaths it learned before.
+	restarted := NewControllerServer("testID", cs.pluginConfig, cs.clientConfTemplatePath, cs.csDataDir)
+	restarted.mounter, restarted.ctlExec = cs.mounter, cs.ctlExec
+	resp, err = restarted.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil || len(resp.GetEntries()) != 3 {
+		t.Fatalf("expected three volumes after restart, got %v (%v)", resp.GetEntries(), err)
+	}
+
+	if _, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "5"}); grpcCode(err) != codes.Aborted {
+		t.Fatalf("expected code %v, got %v", codes.Aborted, err)
+	}
+	if _, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "invalid"}); grpcCode(err) != codes.Aborted {
+		t.Fatalf("expected code %v, got %v", codes.Aborted, err)
+	}
+	if _, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: -1}); grpcCode(err) != codes.InvalidArgument {
+		t.Fatalf("expected code %v, got %v", codes.InvalidArgument, err)
+	}
+}
+
+// TestListVolumesNestedVolDirBasePaths verifies that a volDirBasePath inside another one (e.g. because only one Storage
+// Class templates it with the PVC namespace) is not listed as a volume of the outer one.
+func TestListVolumesNestedVolDirBasePaths(t *testing.T) {
+	cs, _, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+
+	createTestVolume(t, cs, "vol-a", nil)
+	req := newTestCreateVolumeRequest("vol-b", nil)
+	req.Parameters[volDirBasePathKey] = "vols/${pvc.metadata.namespace}"
+	req.Parameters[pvcNamespaceKey] = "ns1"
+	req.Parameters[pvcNameKey] = "pvc-b"
+	if _, err := cs.CreateVolume(ctx, req); err != nil {
+		t.Fatalf("failed to create volume: %v", err)
+	}
+
+	resp, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("failed to list volumes: %v", err)
+	}
+	var gotIDs []string
+	for _, entry := range resp.GetEntries() {
+		gotIDs = append(gotIDs, entry.GetVolume().GetVolumeId())
+	}
+	wantIDs := []string{"beegfs://localhost/vols/ns1/vol-b", "beegfs://localhost/vols/vol-a"}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Fatalf("expected volumes %v, got %v", wantIDs, gotIDs)
+	}
+}
+
+func TestDeleteVolumeDeletePolicy(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	trashPath := path.Join(beegfsRootPath, defaultTrashDirBasePath)
+
+	for _, policy := range []deletePolicy{deletePolicyDelete, deletePolicyRetainInPlace, deletePolicyMoveToTrash} {
+		req := newTestCreateVolumeRequest("vol-"+string(policy), nil)
+		req.Parameters[deletePolicyKey] = string(policy)
+		resp, err := cs.CreateVolume(ctx, req)
+		if err != nil {
+			t.Fatalf("failed to create volume: %v", err)
+		}
+		volDirPath := path.Join(beegfsRootPath, "vols", req.GetName())
+		if err := fsutil.WriteFile(path.Join(volDirPath, "file"), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Delete twice to verify that DeleteVolume is idempotent.
+		for i := 0; i < 2; i++ {
+			if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()}); err != nil {
+				t.Fatalf("failed to delete volume with deletePolicy %s: %v", policy, err)
+			}
+		}
+		if _, err := os.Stat(volDirPath); (policy == deletePolicyRetainInPlace) != (err == nil) {
+			t.Fatalf("unexpected state of volume with deletePolicy %s: %v", policy, err)
+		}
+	}
+
+	trashEntries, err := fsutil.ReadDir(trashPath)
+	if err != nil {
+		t.Fatalf("failed to read trash: %v", err)
+	}
+	if len(trashEntries) != 2 { // directory and metadata file
+		t.Fatalf("expected 2 entries in trash, got %d", len(trashEntries))
+	}
+	var trashedDirName string
+	for _, entry := range trashEntries {
+		if entry.IsDir() {
+			trashedDirName = entry.Name()
+		}
+	}
+	if !strings.HasSuffix(trashedDirName, "_vols_vol-move-to-trash") {
+		t.Fatalf("unexpected trashed directory name %s", trashedDirName)
+	}
+	if _, err := os.Stat(path.Join(trashPath, trashedDirName, "file")); err != nil {
+		t.Fatalf("expected trashed directory to keep its contents: %v", err)
+	}
+
+	// An unexpired volume survives reaping. An expired one does not.
+	cs.reapTrash(ctx)
+	if _, err := os.Stat(path.Join(trashPath, trashedDirName)); err != nil {
+		t.Fatalf("expected unexpired volume to remain in trash: %v", err)
+	}
+	// A restarted controller service still reaps the trash of the file system it learned about before (which is not
+	// in its configuration).
+	pluginConfig := PluginConfig{}
+	pluginConfig.DefaultConfig.TrashRetentionPeriod = time.Nanosecond
+	restarted := NewControllerServer("testID", pluginConfig, cs.clientConfTemplatePath, cs.csDataDir)
+	restarted.mounter, restarted.ctlExec = cs.mounter, cs.ctlExec
+	restarted.reapTrash(ctx)
+	waitForDeletions(t, restarted)
+	if trashEntries, err = fsutil.ReadDir(trashPath); err != nil || len(trashEntries) != 0 {
+		t.Fatalf("expected empty trash, got %d entries: %v", len(trashEntries), err)
+	}
+}
+
+func TestDeleteVolumeInBackground(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	pendingPath := path.Join(beegfsRootPath, pendingDeletionDirBasePath)
+
+	volumeID := createTestVolume(t, cs, "vol-a", nil)
+	volDirPath := path.Join(beegfsRootPath, "vols", "vol-a")
+	if err := os.Mkdir(path.Join(volDirPath, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsutil.WriteFile(path.Join(volDirPath, "dir", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatalf("failed to delete volume: %v", err)
+	}
+	if _, err := os.Stat(volDirPath); !os.IsNotExist(err) {
+		t.Fatalf("expected volume directory to be gone, got %v", err)
+	}
+	waitForDeletions(t, cs)
+	if entries, err := fsutil.ReadDir(pendingPath); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no directories pending deletion, got %d (%v)", len(entries), err)
+	}
+
+	// A directory left behind by a previous controller service is removed on the next background task pass, even if
+	// the file system is not in the configuration of the restarted controller service.
+	if err := os.Mkdir(path.Join(pendingPath, "leftover"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsutil.WriteFile(path.Join(pendingPath, "leftover", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewControllerServer("testID", PluginConfig{}, cs.clientConfTemplatePath, cs.csDataDir)
+	restarted.mounter, restarted.ctlExec = cs.mounter, cs.ctlExec
+	restarted.queuePendingDeletions(ctx)
+	waitForDeletions(t, restarted)
+	if entries, err := fsutil.ReadDir(pendingPath); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no directories pending deletion, got %d (%v)", len(entries), err)
+	}
+}
+
+// healthFakeBeegfsCtlExecutor is a simBeegfsCtlExecutor that returns configurable getentryinfo output.
+type healthFakeBeegfsCtlExecutor struct {
+	*simBeegfsCtlExecutor
+	entryInfo    string
+	entryInfoErr error
+}
+
+func (e *healthFakeBeegfsCtlExecutor) statDirectoryForVolume(ctx context.Context, vol beegfsVolume) (entryInfo, error) {
+	info, err := e.simBeegfsCtlExecutor.statDirectoryForVolume(ctx, vol)
+	if err != nil || e.entryInfo == "" && e.entryInfoErr == nil {
+		return info, err
+	}
+	if e.entryInfoErr != nil {
+		return entryInfo{}, e.entryInfoErr
+	}
+	return parseEntryInfo(e.entryInfo)
+}
+
+func TestCreateVolumeMirroring(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	groups := []mirrorGroup{{id: "1", primary: "101", secondary: "201"}, {id: "2", primary: "102", secondary: "202"}}
+	pools := []storagePool{
+		{id: "1", targets: []string{"101", "102", "201", "202"}, buddyGroups: []string{"1", "2"}},
+		{id: "2", targets: []string{"3", "4"}},
+	}
+	const mirroredEntryInfo = "Entry type: directory\nEntryID: 0-5F8D7E1B-1\nMetadata buddy group: 1\n"
+	const unmirroredEntryInfo = "Entry type: directory\nEntryID: 0-5F8D7E1B-1\nMetadata node: meta01 [ID: 1]\n"
+
+	tests := map[string]struct {
+		params     map[string]string
+		metaGroups []mirrorGroup
+		entryInfo  string
+		wantCode   codes.Code
+	}{
+		"buddy mirror": {
+			params: map[string]string{stripePatternTypeKey: "buddymirror", stripePatternNumTargetsKey: "2"},
+		},
+		"buddy mirror in pool with groups": {
+			params: map[string]string{stripePatternTypeKey: "buddymirror", stripePatternStoragePoolIDKey: "1"},
+		},
+		"buddy mirror in pool without groups": {
+			params:   map[string]string{stripePatternTypeKey: "buddymirror", stripePatternStoragePoolIDKey: "2"},
+			wantCode: codes.InvalidArgument,
+		},
+		"buddy mirror with too many targets": {
+			params:   map[string]string{stripePatternTypeKey: "buddymirror", stripePatternNumTargetsKey: "3"},
+			wantCode: codes.InvalidArgument,
+		},
+		"metadata mirroring": {
+			params:     map[string]string{metadataMirroringKey: "true"},
+			metaGroups: groups,
+			entryInfo:  mirroredEntryInfo,
+		},
+		"metadata mirroring without groups": {
+			params:   map[string]string{metadataMirroringKey: "true"},
+			wantCode: codes.InvalidArgument,
+		},
+		"metadata mirroring not inherited": {
+			params:     map[string]string{metadataMirroringKey: "true"},
+			metaGroups: groups,
+			entryInfo:  unmirroredEntryInfo,
+			wantCode:   codes.InvalidArgument,
+		},
+		"metadata mirroring disabled": {
+			params: map[string]string{metadataMirroringKey: "false"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctlExec := newSimBeegfsCtlExecutor(beegfsRootPath)
+			ctlExec.pools, ctlExec.storageGroups, ctlExec.metaGroups = pools, groups, tc.metaGroups
+			cs.ctlExec = &healthFakeBeegfsCtlExecutor{simBeegfsCtlExecutor: ctlExec, entryInfo: tc.entryInfo}
+			req := newTestCreateVolumeRequest(strings.ReplaceAll(name, " ", "-"), nil)
+			for key, value := range tc.params {
+				req.Parameters[key] = value
+			}
+			if _, err := cs.CreateVolume(context.Background(), req); grpcCode(err) != tc.wantCode {
+				t.Fatalf("expected code %v, got %v", tc.wantCode, err)
+			}
+			// A CreateVolume that fails validation leaves no directory behind.
+			volDirPath := path.Join(beegfsRootPath, "vols", req.GetName())
+			if _, err := os.Stat(volDirPath); tc.wantCode != codes.OK && !os.IsNotExist(err) {
+				t.Fatalf("expected no volume directory, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeSimulatedFileSystem(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	ctlExec := newSimBeegfsCtlExecutor(beegfsRootPath)
+	ctlExec.pools = append(ctlExec.pools, storagePool{id: "2", description: "nvme"})
+	cs.ctlExec = ctlExec
+
+	req := newTestCreateVolumeRequest("simulated", nil)
+	req.Parameters[stripePatternChunkSizeKey] = "1m"
+	req.Parameters[stripePatternNumTargetsKey] = "2"
+	req.Parameters[stripePatternStoragePoolIDKey] = "2"
+	req.Parameters[permissionsUIDKey] = "1000"
+	req.Parameters[permissionsGIDKey] = "2000"
+	req.Parameters[permissionsModeKey] = "0750"
+	resp, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, ok := ctlExec.entryState("localhost", "/vols/simulated")
+	if !ok {
+		t.Fatal("expected volume directory to exist")
+	}
+	if state.uid != 1000 || state.gid != 2000 || state.mode != 0750 {
+		t.Fatalf("expected uid 1000, gid 2000, and mode 0750, got %d, %d, and %04o", state.uid, state.gid, state.mode)
+	}
+	wantInfo := entryInfo{entryType: "directory", entryID: state.info.entryID, metadataNode: "meta01",
+		metadataNodeID: "1", stripePatternType: stripePatternTypeRAID0, chunkSize: "1M", numTargets: 2,
+		storagePoolID: "2", storagePoolName: "nvme"}
+	if state.info != wantInfo {
+		t.Fatalf("expected entry info %+v, got %+v", wantInfo, state.info)
+	}
+	// The parent directory keeps the default pattern of the file system.
+	parent, _ := ctlExec.entryState("localhost", "/vols")
+	if parent.info.chunkSize != "512K" || parent.info.storagePoolID != "1" {
+		t.Fatalf("expected parent directory to keep the default pattern, got %+v", parent.info)
+	}
+	getResp, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getResp.GetStatus().GetVolumeCondition().GetAbnormal() {
+		t.Fatalf("expected normal volume condition, got %v", getResp.GetStatus().GetVolumeCondition())
+	}
+	for key, want := range map[string]string{stripePatternChunkSizeKey: "1M", stripePatternNumTargetsKey: "2",
+		stripePatternStoragePoolIDKey: "2", stripePatternStoragePoolNameKey: "nvme"} {
+		if got := getResp.GetVolume().GetVolumeContext()[key]; got != want {
+			t.Fatalf("expected %s %s, got %s", key, want, got)
+		}
+	}
+
+	// The directory is gone once the volume is deleted.
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()}); err != nil {
+		t.Fatal(err)
+	}
+	waitForDeletions(t, cs)
+	if _, ok := ctlExec.entryState("localhost", "/vols/simulated"); ok {
+		t.Fatal("expected volume directory to be removed")
+	}
+}
+
+func TestCreateVolumeInjectedFailures(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+
+	tests := map[string]struct {
+		op       simOp
+		err      error
+		params   map[string]string
+		wantCode codes.Code
+	}{
+		"unreachable": {
+			op:       simOpCreateDir,
+			err:      simErrUnreachable,
+			wantCode: codes.Unavailable,
+		},
+		"timeout": {
+			op:       simOpCreateDir,
+			err:      simErrTimeout,
+			wantCode: codes.Unavailable,
+		},
+		"directory removed before setting pattern": {
+			op:       simOpSetPattern,
+			err:      simErrNotExist,
+			params:   map[string]string{stripePatternChunkSizeKey: "1m"},
+			wantCode: codes.Internal,
+		},
+		"unknown storage pool": {
+			params:   map[string]string{stripePatternStoragePoolIDKey: "7"},
+			wantCode: codes.Internal,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctlExec := newSimBeegfsCtlExecutor(beegfsRootPath)
+			if tc.err != nil {
+				ctlExec.injectFailure(tc.op, tc.err)
+			}
+			cs.ctlExec = ctlExec
+			req := newTestCreateVolumeRequest(strings.ReplaceAll(name, " ", "-"), nil)
+			for key, value := range tc.params {
+				req.Parameters[key] = value
+			}
+			if _, err := cs.CreateVolume(context.Background(), req); grpcCode(err) != tc.wantCode {
+				t.Fatalf("expected code %v, got %v", tc.wantCode, err)
+			}
+		})
+	}
+}
+
+// poolFakeBeegfsCtlExecutor is a simBeegfsCtlExecutor that counts how often storage pools are listed.
+type poolFakeBeegfsCtlExecutor struct {
+	*simBeegfsCtlExecutor
+	poolLists int
+}
+
+func (e *poolFakeBeegfsCtlExecutor) listStoragePools(ctx context.Context, vol beegfsVolume) ([]storagePool, error) {
+	e.poolLists++
+	return e.simBeegfsCtlExecutor.listStoragePools(ctx, vol)
+}
+
+func TestResolveStoragePoolName(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	ctlExec := &poolFakeBeegfsCtlExecutor{simBeegfsCtlExecutor: newSimBeegfsCtlExecutor(beegfsRootPath)}
+	ctlExec.pools = []storagePool{{id: "1", description: "Default"}, {id: "2", description: "nvme"}}
+	cs.ctlExec = ctlExec
+	vol := cs.newBeegfsVolume("localhost", "vols", "vol1")
+	otherVol := cs.newBeegfsVolume("otherhost", "vols", "vol1")
+
+	tests := []struct {
+		name          string
+		vol           beegfsVolume
+		poolName      string
+		wantID        string
+		wantCode      codes.Code
+		wantPoolLists int // total so far
+	}{
+		{name: "first lookup", vol: vol, poolName: "nvme", wantID: "2", wantPoolLists: 1},
+		{name: "cached lookup", vol: vol, poolName: "Default", wantID: "1", wantPoolLists: 1},
+		{name: "other file system", vol: otherVol, poolName: "nvme", wantID: "2", wantPoolLists: 2},
+		{name: "unknown name refreshes cache", vol: vol, poolName: "hdd", wantCode: codes.InvalidArgument,
+			wantPoolLists: 3},
+		{name: "no name", vol: vol, wantPoolLists: 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := cs.resolveStoragePoolName(ctx, tc.vol, stripePatternConfig{storagePoolName: tc.poolName})
+			if grpcCode(err) != tc.wantCode {
+				t.Fatalf("expected code %v, got %v", tc.wantCode, err)
+			}
+			if err == nil && cfg.storagePoolID != tc.wantID {
+				t.Fatalf("expected storage pool ID %q, got %q", tc.wantID, cfg.storagePoolID)
+			}
+			if ctlExec.poolLists != tc.wantPoolLists {
+				t.Fatalf("expected %d storage pool lists, got %d", tc.wantPoolLists, ctlExec.poolLists)
+			}
+		})
+	}
+
+	// A storage pool created after the cache was filled is found without waiting for the cache to expire.
+	ctlExec.pools = append(ctlExec.pools, storagePool{id: "3", description: "hdd"})
+	if cfg, err := cs.resolveStoragePoolName(ctx, vol, stripePatternConfig{storagePoolName: "hdd"}); err != nil ||
+		cfg.storagePoolID != "3" {
+		t.Fatalf("expected storage pool ID 3, got %q (%v)", cfg.storagePoolID, err)
+	}
+}
+
+func TestCreateVolumeSelectStoragePool(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	pools := []storagePool{
+		{id: "1", description: "Default", targets: []string{"101"}},
+		{id: "2", description: "nvme", targets: []string{"201", "202"}},
+		{id: "3", description: "hdd", targets: []string{"301"}},
+	}
+	targets := []storageTarget{
+		{id: "101", reachability: "Online", freeBytes: 100},
+		{id: "201", reachability: "Online", freeBytes: 40},
+		{id: "202", reachability: "Offline", freeBytes: 40},
+		{id: "301", reachability: "Online", freeBytes: 50},
+	}
+
+	tests := map[string]struct {
+		candidates string
+		entryInfo  string // returned when the directory already exists
+		existing   bool
+		wantPoolID string
+		wantCode   codes.Code
+	}{
+		"most free space": {
+			candidates: "nvme,hdd",
+			wantPoolID: "3",
+		},
+		"by ID": {
+			candidates: "2,1",
+			wantPoolID: "1",
+		},
+		"weighted": {
+			candidates: "nvme:2,hdd",
+			wantPoolID: "2",
+		},
+		"tie goes to first candidate": {
+			candidates: "nvme:2.5,Default",
+			wantPoolID: "2",
+		},
+		"unknown candidate": {
+			candidates: "nvme,ssd",
+			wantCode:   codes.InvalidArgument,
+		},
+		"small weight": {
+			candidates: "nvme:0.001",
+			wantPoolID: "2",
+		},
+		"existing directory": {
+			candidates: "nvme,hdd",
+			entryInfo:  "Entry type: directory\nEntryID: 0-5F8D7E1B-1\nStorage Pool: 2 (nvme)\n",
+			existing:   true,
+			wantPoolID: "2",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctlExec := newSimBeegfsCtlExecutor(beegfsRootPath)
+			ctlExec.targets, ctlExec.pools = targets, pools
+			cs.ctlExec = &healthFakeBeegfsCtlExecutor{simBeegfsCtlExecutor: ctlExec, entryInfo: tc.entryInfo}
+			req := newTestCreateVolumeRequest(strings.ReplaceAll(name, " ", "-"), nil)
+			if tc.existing {
+				if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+					t.Fatal(err)
+				}
+			}
+			req.Parameters[stripePatternStoragePoolCandidatesKey] = tc.candidates
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if grpcCode(err) != tc.wantCode {
+				t.Fatalf("expected code %v, got %v", tc.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if got := resp.GetVolume().GetVolumeContext()[stripePatternStoragePoolIDKey]; got != tc.wantPoolID {
+				t.Fatalf("expected storage pool ID %q, got %q", tc.wantPoolID, got)
+			}
+		})
+	}
+
+	// A file system without free space in any candidate storage pool can not provision a volume.
+	ctlExec := newSimBeegfsCtlExecutor(beegfsRootPath)
+	ctlExec.targets = []storageTarget{{id: "201", reachability: "Offline", freeBytes: 40}}
+	ctlExec.pools = pools
+	cs.ctlExec = ctlExec
+	req := newTestCreateVolumeRequest("full", nil)
+	req.Parameters[stripePatternStoragePoolCandidatesKey] = "nvme,hdd"
+	if _, err := cs.CreateVolume(context.Background(), req); grpcCode(err) != codes.ResourceExhausted {
+		t.Fatalf("expected code %v, got %v", codes.ResourceExhausted, err)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	cs, beegfsRootPath, cleanUp := newTestControllerServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	ctlExec := newSimBeegfsCtlExecutor(beegfsRootPath)
+	cs.ctlExec = ctlExec
+	fs = ctlExec.ownershipFs(fs)
+	fsutil = afero.Afero{Fs: fs}
+	req := newTestCreateVolumeRequest("vol1", nil)
+	req.Parameters[pvcNameKey] = "data"
+	req.Parameters[pvcNamespaceKey] = "team-a"
+	req.Parameters[permissionsUIDKey] = "1000"
+	req.Parameters[permissionsGIDKey] = "2000"
+	req.Parameters[permissionsModeKey] = "0750"
+	resp, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+
+	const entryInfo = `Entry type: directory
+EntryID: 0-5F8D7E1B-1
+Metadata node: meta01 [ID: 1]
+Stripe pattern details:
++ Type: RAID0
++ Chunksize: 512K
++ Number of storage targets: desired: 4
++ Storage Pool: 2 (nvme)
+`
+	pools := []storagePool{
+		{id: "1", targets: []string{"1", "2"}},
+		{id: "2", targets: []string{"3", "4"}},
+	}
+	tests := map[string]struct {
+		volumeID     string
+		entryInfoErr error
+		targets      []storageTarget
+		wantCode     codes.Code
+		wantAbnormal bool
+		wantContext  map[string]string
+	}{
+		"healthy": {
+			volumeID: volumeID,
+			targets: []storageTarget{
+				{id: "1", reachability: "Offline", consistency: "Good"}, // not in storage pool 2
+				{id: "3", reachability: "Online", consistency: "Good"},
+				{id: "4", reachability: "Online", consistency: "Good"},
+			},
+			wantContext: map[string]string{
+				stripePatternChunkSizeKey:       "512K",
+				stripePatternNumTargetsKey:      "4",
+				stripePatternStoragePoolIDKey:   "2",
+				stripePatternStoragePoolNameKey: "nvme",
+				stripePatternTypeKey:            stripePatternTypeRAID0,
+				metadataMirroringKey:            "false",
+				permissionsUIDKey:               "1000",
+				permissionsGIDKey:               "2000",
+				permissionsModeKey:              "0750",
+				pvcNameKey:                      "data",
+				pvcNamespaceKey:                 "team-a",
+				driverVersionKey:                vendorVersion,
+			},
+		},
+		"target offline": {
+			volumeID: volumeID,
+			targets: []storageTarget{
+				{id: "3", reachability: "Offline", consistency: "Good"},
+				{id: "4", reachability: "Online", consistency: "Good"},
+			},
+			wantAbnormal: true,
+		},
+		"target needs resync": {
+			volumeID: volumeID,
+			targets: []storageTarget{
+				{id: "3", reachability: "Online", consistency: "Good"},
+				{id: "4", reachability: "Online", consistency: "Needs-resync"},
+			},
+			wantAbnormal: true,
+		},
+		"directory missing": {
+			volumeID: "beegfs://localhost/vols/missing",
+			wantCode: codes.NotFound,
+		},
+		"getentryinfo fails": {
+			volumeID:     volumeID,
+			entryInfoErr: errors.New("communication error"),
+			wantAbnormal: true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctlExec.targets, ctlExec.pools = tc.targets, pools
+			cs.ctlExec = &healthFakeBeegfsCtlExecutor{
+				simBeegfsCtlExecutor: ctlExec,
+				entryInfo:            entryInfo,
+				entryInfoErr:         tc.entryInfoErr,
+			}
+			resp, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: tc.volumeID})
+			if tc.wantCode != codes.OK {
+				if grpcCode(err) != tc.wantCode {
+					t.Fatalf("expected code %v, got %v", tc.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get volume: %v", err)
+			}
+			condition := resp.GetStatus().GetVolumeCondition()
+			if condition.GetAbnormal() != tc.wantAbnormal {
+				t.Fatalf("expected abnormal %t, got condition %v", tc.wantAbnormal, condition)
+			}
+			if tc.wantContext == nil {
+				return
+			}
+			volContext := resp.GetVolume().GetVolumeContext()
+			if _, err := time.Parse(time.RFC3339, volContext[creationTimeKey]); err != nil {
+				t.Fatalf("expected creation time, got volume context %v", volContext)
+			}
+			delete(volContext, creationTimeKey)
+			if !reflect.DeepEqual(volContext, tc.wantContext) {
+				t.Fatalf("expected volume context %v, got %v", tc.wantContext, volContext)
+			}
+		})
+	}
+}
+
+// newTestControllerServer returns a controllerServer that uses a sanityMounter and a simBeegfsCtlExecutor to
+// emulate BeeGFS file systems in a temporary directory. It also returns the directory that stands in for the root of
+// every BeeGFS file system and a function that removes the temporary directory.
+func newTestControllerServer(t *testing.T) (*controllerServer, string, func()) {
+	fs = afero.NewOsFs()
+	fsutil = afero.Afero{Fs: fs}
+	testDir, err := ioutil.TempDir("", "controller-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanUp := func() { _ = os.RemoveAll(testDir) }
+	beegfsRootPath := path.Join(testDir, "beegfs-root")
+	clientConfTemplatePath := path.Join(testDir, "beegfs-client.conf")
+	if err := os.Mkdir(beegfsRootPath, 0755); err != nil {
+		cleanUp()
+		t.Fatal(err)
+	}
+	if err := fsutil.WriteFile(clientConfTemplatePath, []byte(TestWriteClientFilesTemplate), 0644); err != nil {
+		cleanUp()
+		t.Fatal(err)
+	}
+	cs := NewControllerServer("testID", PluginConfig{}, clientConfTemplatePath, path.Join(testDir, "csi-data-dir"))
+	cs.mounter = newSanityMounter(beegfsRootPath)
+	cs.ctlExec = newSimBeegfsCtlExecutor(beegfsRootPath)
+	return cs, beegfsRootPath, cleanUp
+}
+
+// newTestCreateVolumeRequest returns a CreateVolumeRequest for a volume in the vols directory of the localhost file
+// system.
+func newTestCreateVolumeRequest(name string, source *csi.VolumeContentSource) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name: name,
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}},
+		Parameters:          map[string]string{sysMgmtdHostKey: "localhost", volDirBasePathKey: "vols"},
+		VolumeContentSource: source,
+	}
+}
+
+// createTestVolume creates a volume with newTestCreateVolumeRequest and returns its volume ID.
+func createTestVolume(t *testing.T, cs *controllerServer, name string, source *csi.VolumeContentSource) string {
+	resp, err := cs.CreateVolume(context.Background(), newTestCreateVolumeRequest(name, source))
+	if err != nil {
+		t.Fatalf("failed to create volume %s: %v", name, err)
+	}
+	return resp.GetVolume().GetVolumeId()
+}
+
+// waitForDeletions waits for the deletion workers of cs to remove every queued directory.
+func waitForDeletions(t *testing.T, cs *controllerServer) {
+	for i := 0; i < 500; i++ {
+		cs.deletionsQueuedMutex.Lock()
+		numQueued := len(cs.deletionsQueued)
+		cs.deletionsQueuedMutex.Unlock()
+		if numQueued == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for deletions")
+}
+
+// grpcCode returns the gRPC status code of an error returned by an RPC, including a grpcError.
+func grpcCode(err error) codes.Code {
+	if grpcErr, ok := err.(grpcError); ok {
+		return status.Code(grpcErr.statusErr)
+	}
+	return status.Code(err)
+}
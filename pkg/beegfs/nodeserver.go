@@ -22,11 +22,19 @@ Licensed under the Apache License, Version 2.0.
 package beegfs
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/utils/mount"
@@ -35,15 +43,46 @@ import (
 var (
 	nodeCaps = []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 	}
+
+	// mountProbeTimeout is the maximum amount of time NodeGetVolumeStats waits for a BeeGFS mount to respond before it
+	// reports an abnormal volume condition. It is a variable so that tests can shorten it.
+	mountProbeTimeout = 10 * time.Second
+
+	// errMountUnresponsive indicates that a BeeGFS mount did not respond within mountProbeTimeout.
+	errMountUnresponsive = errors.New("BeeGFS mount unresponsive")
+
+	// reconcileMountsWaitTimeout is the maximum amount of time Run waits for reconcileMounts before it starts serving
+	// requests (see reconcileMountsInBackground). It must stay well below the delay after which the liveness probe
+	// restarts a node service that does not serve requests. It is a variable so that tests can change it.
+	reconcileMountsWaitTimeout = 5 * time.Second
 )
 
+// defaultKubeletCSIPluginDir is the directory below which kubelet creates the staging target paths of CSI volumes (e.g.
+// .../pv/<pv name>/globalmount) if it runs with the default --root-dir. reconcileMounts only recovers staged volumes
+// below the directory it is passed (see --node-kubelet-csi-plugin-dir).
+const defaultKubeletCSIPluginDir = "/var/lib/kubelet/plugins/kubernetes.io/csi"
+
+// staleClientConfSearchDepth is the number of directories below the kubelet directory reconcileMounts searches for the
+// beegfs-client.conf file of a staging target path (e.g. pv/<pv name>/globalmount/beegfs-client.conf).
+const staleClientConfSearchDepth = 4
+
+// sharedMountRefsDirName is the directory inside the shared mountDirPath of a file system (see newSharedBeegfsVolume)
+// that holds one file for each staging target path the file system is staged at.
+const sharedMountRefsDirName = "staged"
+
 type nodeServer struct {
 	ctlExec                beegfsCtlExecutorInterface
 	nodeID                 string
 	pluginConfig           PluginConfig
 	clientConfTemplatePath string
 	mounter                mount.Interface
+	mountProbesInFlight    *threadSafeStringLock // volume paths with a probe that has not returned (e.g. a hung mount)
+	sharedMountDir         string                // if set, each file system is mounted once (see newSharedBeegfsVolume)
+	sharedMountsInFlight   *threadSafeStringLock // shared mountDirPaths in use by a stage or unstage request
+	mountsReconciling      int32                 // non-zero while reconcileMounts runs in the background
 }
 
 func NewNodeServer(nodeId string, pluginConfig PluginConfig, clientConfTemplatePath string) *nodeServer {
@@ -53,6 +92,8 @@ func NewNodeServer(nodeId string, pluginConfig PluginConfig, clientConfTemplateP
 		pluginConfig:           pluginConfig,
 		clientConfTemplatePath: clientConfTemplatePath,
 		mounter:                nil,
+		mountProbesInFlight:    newThreadSafeStringLock(),
+		sharedMountsInFlight:   newThreadSafeStringLock(),
 	}
 }
 
@@ -79,7 +120,11 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 	readOnly := req.GetReadonly()
 
-	vol, err := newBeegfsVolumeFromID(stagingTargetPath, volumeID, ns.pluginConfig)
+	if err := ns.checkMountsReconciled(); err != nil {
+		return nil, err
+	}
+
+	vol, _, err := ns.getStagedVolume(stagingTargetPath, volumeID)
 	if err != nil {
 		return nil, newGrpcErrorFromCause(codes.Internal, err)
 	}
@@ -174,17 +219,27 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Errorf(codes.InvalidArgument, "Volume capability not supported: %s", reason)
 	}
 
-	vol, err := newBeegfsVolumeFromID(stagingTargetPath, volumeID, ns.pluginConfig)
+	if err := ns.checkMountsReconciled(); err != nil {
+		return nil, err
+	}
+
+	vol, shared, err := ns.getStagedVolume(stagingTargetPath, volumeID)
 	if err != nil {
 		return nil, newGrpcErrorFromCause(codes.Internal, err)
 	}
 
-	// Ensure mountDirPath already exists (CO should have created req.StagingTargetPath).
-	_, err = fs.Stat(vol.mountDirPath)
+	// Ensure the staging target path already exists (CO should have created req.StagingTargetPath).
+	_, err = fs.Stat(stagingTargetPath)
 	if err != nil {
 		err = errors.WithStack(err)
 		return nil, newGrpcErrorFromCause(codes.Internal, err)
 	}
+	if shared {
+		if err := ns.stageSharedVolume(ctx, vol, stagingTargetPath); err != nil {
+			return nil, err
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
 
 	// Write configuration files.
 	if err := writeClientFiles(ctx, vol, ns.clientConfTemplatePath); err != nil {
@@ -216,10 +271,20 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		return nil, status.Error(codes.InvalidArgument, "Staging target path not provided")
 	}
 
-	vol, err := newBeegfsVolumeFromID(stagingTargetPath, volumeID, ns.pluginConfig)
+	if err := ns.checkMountsReconciled(); err != nil {
+		return nil, err
+	}
+
+	vol, shared, err := ns.getStagedVolume(stagingTargetPath, volumeID)
 	if err != nil {
 		return nil, newGrpcErrorFromCause(codes.Internal, err)
 	}
+	if shared {
+		if err := ns.unstageSharedVolume(ctx, vol, stagingTargetPath); err != nil {
+			return nil, err
+		}
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
 
 	err = unmountAndCleanUpIfNecessary(ctx, vol, false, ns.mounter) // The CO will clean up mountDirPath.
 	if err != nil {
@@ -250,10 +315,492 @@ func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
 }
 
-func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, in *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// NodeGetVolumeStats reports the capacity and inode usage of a published volume. A BeeGFS directory has no capacity of
+// its own, so NodeGetVolumeStats reports the usage of the entire BeeGFS file system by default. If the volumeStatsSource
+// configuration option selects a quota, NodeGetVolumeStats reports the quota usage of the user or group that owns the
+// volume instead. NodeGetVolumeStats reports an abnormal volume condition if the BeeGFS mount does not respond (see
+// probeVolumePath).
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	// Check arguments.
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume ID not provided")
+	}
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path not provided")
+	}
+
+	fileInfo, statfs, err := ns.probeVolumePath(volumePath)
+	if errors.Is(err, errMountUnresponsive) {
+		LogError(ctx, err, "Volume condition is abnormal", "volumeID", volumeID, "volumePath", volumePath)
+		return &csi.NodeGetVolumeStatsResponse{
+			// kubelet discards a response without usage (and its volume condition), so report zero usage.
+			Usage: []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES}, {Unit: csi.VolumeUsage_INODES}},
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  errMountUnresponsive.Error(),
+			},
+		}, nil
+	} else if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, newGrpcErrorFromCause(codes.NotFound, err)
+		}
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	usage := newVolumeUsageFromStatfs(statfs)
+	condition := &csi.VolumeCondition{Abnormal: false, Message: "BeeGFS mount responsive"}
+
+	sysMgmtdHost, _, err := parseBeegfsUrl(volumeID)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	volumeStatsSource := squashConfigForSysMgmtdHost(sysMgmtdHost, ns.pluginConfig).VolumeStatsSource
+	if volumeStatsSource != volumeStatsSourceUIDQuota && volumeStatsSource != volumeStatsSourceGIDQuota {
+		return &csi.NodeGetVolumeStatsResponse{Usage: usage, VolumeCondition: condition}, nil
+	}
+
+	// Quota information is retrieved with beegfs-ctl, which requires the client files written during NodeStageVolume.
+	stagingTargetPath := req.GetStagingTargetPath()
+	if len(stagingTargetPath) == 0 {
+		LogDebug(ctx, "Staging target path not provided; reporting file system usage instead of quota usage",
+			"volumeID", volumeID, "volumeStatsSource", volumeStatsSource)
+		return &csi.NodeGetVolumeStatsResponse{Usage: usage, VolumeCondition: condition}, nil
+	}
+	vol, _, err := ns.getStagedVolume(stagingTargetPath, volumeID)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		err = errors.Errorf("failed to determine owner of %s", volumePath)
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	idType, id := quotaIDTypeUID, stat.Uid
+	if volumeStatsSource == volumeStatsSourceGIDQuota {
+		idType, id = quotaIDTypeGID, stat.Gid
+	}
+	// BeeGFS tracks quota usage separately in each storage pool. Report the usage in the storage pool of the volume.
+	info, err := ns.ctlExec.statDirectoryForVolume(ctx, vol)
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+	quotas, err := ns.ctlExec.getQuotasForVolume(ctx, vol, info.storagePoolID, idType, []uint32{id})
+	if err != nil {
+		return nil, newGrpcErrorFromCause(codes.Internal, err)
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           newVolumeUsageFromQuota(quotas[0], statfs),
+		VolumeCondition: condition,
+	}, nil
+}
+
+// newSharedBeegfsVolume returns a beegfsVolume for volumeID whose file system is mounted in a subdirectory of
+// ns.sharedMountDir that every volume on the same file system shares. Sharing one mount (and one beegfs-client.conf and
+// UDP port) per file system avoids the memory each additional BeeGFS client mount costs on RDMA connections.
+func (ns *nodeServer) newSharedBeegfsVolume(volumeID string) (beegfsVolume, error) {
+	sysMgmtdHost, volDirPathBeegfsRoot, err := parseBeegfsUrl(volumeID)
+	if err != nil {
+		return beegfsVolume{}, err
+	}
+	mountDirPath := path.Join(ns.sharedMountDir, sanitizeVolumeID(sysMgmtdHost))
+	return newBeegfsVolume(mountDirPath, sysMgmtdHost, volDirPathBeegfsRoot, ns.pluginConfig), nil
+}
+
+// getStagedVolume returns the beegfsVolume NodeStageVolume mounts (or mounted) for volumeID at stagingTargetPath and
+// whether its file system is mounted in ns.sharedMountDir. A volume that was staged with its own mount (e.g. before
+// ns.sharedMountDir was set) keeps that mount until it is unstaged.
+func (ns *nodeServer) getStagedVolume(stagingTargetPath, volumeID string) (vol beegfsVolume, shared bool, err error) {
+	vol, err = newBeegfsVolumeFromID(stagingTargetPath, volumeID, ns.pluginConfig)
+	if err != nil || ns.sharedMountDir == "" {
+		return vol, false, err
+	}
+	if notMnt, err := ns.mounter.IsLikelyNotMountPoint(vol.mountPath); err == nil && !notMnt {
+		return vol, false, nil
+	}
+	vol, err = ns.newSharedBeegfsVolume(volumeID)
+	return vol, true, err
+}
+
+// sharedMountRefPath returns the file that records that the file system of vol (a volume returned by
+// newSharedBeegfsVolume) is staged at stagingTargetPath.
+func sharedMountRefPath(vol beegfsVolume, stagingTargetPath string) string {
+	return path.Join(vol.mountDirPath, sharedMountRefsDirName,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(stagingTargetPath))))
+}
+
+// stageSharedVolume mounts the file system of vol (a volume returned by newSharedBeegfsVolume) if it is not already
+// mounted and records that it is staged at stagingTargetPath. The references are files (instead of a counter in memory)
+// so that they survive a restart of the node service.
+func (ns *nodeServer) stageSharedVolume(ctx context.Context, vol beegfsVolume, stagingTargetPath string) error {
+	if !ns.sharedMountsInFlight.obtainLockOnString(vol.mountDirPath) {
+		return status.Errorf(codes.Aborted, "file system %s is in use by another request", vol.sysMgmtdHost)
+	}
+	defer ns.sharedMountsInFlight.releaseLockOnString(vol.mountDirPath)
+
+	refPath := sharedMountRefPath(vol, stagingTargetPath)
+	if err := fs.MkdirAll(path.Dir(refPath), 0750); err != nil {
+		return newGrpcErrorFromCause(codes.Internal, errors.WithStack(err))
+	}
+	// Only write configuration files for a file system that is not mounted yet. The files of a mounted file system
+	// must keep matching its mount (e.g. its connClientPortUDP).
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(vol.mountPath)
+	if err != nil && !os.IsNotExist(err) {
+		return newGrpcErrorFromCause(codes.Internal, errors.WithStack(err))
+	}
+	if notMnt {
+		if err := writeClientFiles(ctx, vol, ns.clientConfTemplatePath); err != nil {
+			return newGrpcErrorFromCause(codes.Internal, err)
+		}
+	}
+
+	// Only mount BeeGFS if beegfs-ctl reports our target directory exists.
+	if _, err := ns.ctlExec.statDirectoryForVolume(ctx, vol); err != nil {
+		if errors.As(err, &ctlNotExistError{}) {
+			return newGrpcErrorFromCause(codes.NotFound, err)
+		}
+		return newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := mountIfNecessary(ctx, vol, ns.mounter); err != nil {
+		return newGrpcErrorFromCause(codes.Internal, err)
+	}
+	if err := fsutil.WriteFile(refPath, []byte(stagingTargetPath+"\n"), 0640); err != nil {
+		return newGrpcErrorFromCause(codes.Internal, errors.WithStack(err))
+	}
+	return nil
+}
+
+// unstageSharedVolume forgets that the file system of vol (a volume returned by newSharedBeegfsVolume) is staged at
+// stagingTargetPath and unmounts it if it is no longer staged anywhere else.
+func (ns *nodeServer) unstageSharedVolume(ctx context.Context, vol beegfsVolume, stagingTargetPath string) error {
+	if !ns.sharedMountsInFlight.obtainLockOnString(vol.mountDirPath) {
+		return status.Errorf(codes.Aborted, "file system %s is in use by another request", vol.sysMgmtdHost)
+	}
+	defer ns.sharedMountsInFlight.releaseLockOnString(vol.mountDirPath)
+
+	if _, err := fs.Stat(vol.mountDirPath); os.IsNotExist(err) {
+		return nil // The file system is not staged anywhere.
+	}
+	refPath := sharedMountRefPath(vol, stagingTargetPath)
+	if err := fs.Remove(refPath); err != nil && !os.IsNotExist(err) {
+		return newGrpcErrorFromCause(codes.Internal, errors.WithStack(err))
+	}
+	refs, err := fsutil.ReadDir(path.Dir(refPath))
+	if err != nil && !os.IsNotExist(err) {
+		return newGrpcErrorFromCause(codes.Internal, errors.WithStack(err))
+	}
+	if len(refs) != 0 {
+		LogDebug(ctx, "File system is still staged for other volumes", "path", vol.mountPath, "volumeID", vol.volumeID,
+			"references", len(refs))
+		return nil
+	}
+	if err := unmountAndCleanUpIfNecessary(ctx, vol, true, ns.mounter); err != nil {
+		// Restore the reference so that a retry checks again.
+		if writeErr := fsutil.WriteFile(refPath, []byte(stagingTargetPath+"\n"), 0640); writeErr != nil {
+			LogError(ctx, writeErr, "Failed to restore shared mount reference", "path", refPath)
+		}
+		return newGrpcErrorFromCause(codes.Internal, err)
+	}
+	return nil
+}
+
+// probeVolumePath stats and statfs's volumePath in a separate Goroutine so that a hung BeeGFS mount (e.g. after a
+// BeeGFS server reboots) cannot block NodeGetVolumeStats indefinitely. probeVolumePath returns an error wrapping
+// errMountUnresponsive if the probe does not complete within mountProbeTimeout or if an earlier probe of volumePath
+// has still not completed. The Goroutine of a probe that times out remains blocked until the mount responds, so at most
+// one such Goroutine exists per volumePath.
+func (ns *nodeServer) probeVolumePath(volumePath string) (os.FileInfo, unix.Statfs_t, error) {
+	type probeResult struct {
+		fileInfo os.FileInfo
+		statfs   unix.Statfs_t
+		err      error
+	}
+	if !ns.mountProbesInFlight.obtainLockOnString(volumePath) {
+		return nil, unix.Statfs_t{}, errors.Wrapf(errMountUnresponsive, "earlier probe of %s has not completed",
+			volumePath)
+	}
+	results := make(chan probeResult, 1) // buffered so that a probe that times out can still send and exit
+	go func() {
+		defer ns.mountProbesInFlight.releaseLockOnString(volumePath)
+		var result probeResult
+		if result.fileInfo, result.err = fs.Stat(volumePath); result.err != nil {
+			result.err = errors.WithStack(result.err)
+		} else if err := unix.Statfs(volumePath, &result.statfs); err != nil {
+			result.err = errors.Wrapf(err, "failed to statfs %s", volumePath)
+		}
+		results <- result
+	}()
+
+	select {
+	case result := <-results:
+		return result.fileInfo, result.statfs, result.err
+	case <-time.After(mountProbeTimeout):
+		return nil, unix.Statfs_t{}, errors.Wrapf(errMountUnresponsive, "probe of %s did not complete within %s",
+			volumePath, mountProbeTimeout)
+	}
 }
 
 func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
+
+// reconcileMountsInBackground runs reconcileMounts in a separate Goroutine and waits up to timeout for it to finish.
+// kubelet only registers the driver once it serves requests, and an unresponsive BeeGFS mount can delay
+// reconcileMounts, so the caller may start serving requests before reconcileMounts finishes. Until then,
+// checkMountsReconciled makes stage, unstage, and publish requests fail so that the CO retries them later.
+func (ns *nodeServer) reconcileMountsInBackground(ctx context.Context, kubeletDir string, timeout time.Duration) {
+	atomic.StoreInt32(&ns.mountsReconciling, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ns.reconcileMounts(ctx, kubeletDir)
+		atomic.StoreInt32(&ns.mountsReconciling, 0)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		LogDebug(ctx, "Serving requests before staged volume mounts are reconciled", "timeout", timeout)
+	}
+}
+
+// checkMountsReconciled returns an Unavailable error while reconcileMounts runs in the background (see
+// reconcileMountsInBackground). A request that changes a staged volume mount at the same time could confuse
+// reconcileMounts (e.g. it could remove the client configuration files of a mount that is not made yet).
+func (ns *nodeServer) checkMountsReconciled() error {
+	if atomic.LoadInt32(&ns.mountsReconciling) != 0 {
+		return status.Error(codes.Unavailable, "node service is still reconciling staged volume mounts")
+	}
+	return nil
+}
+
+// reconcileMounts recovers the BeeGFS mounts the node service made before it last stopped (e.g. because its container
+// restarted). It considers every BeeGFS file system mounted at a staging target path below kubeletDir or in
+// ns.sharedMountDir (see reconcileMount) and then removes any client configuration files a stage or unstage request
+// left behind without a mount. reconcileMounts logs what it cannot fix instead of failing, and the node service must
+// not handle stage, unstage, or publish requests while it runs.
+func (ns *nodeServer) reconcileMounts(ctx context.Context, kubeletDir string) {
+	LogDebug(ctx, "Reconciling staged volume mounts", "kubeletCSIPluginDir", kubeletDir,
+		"sharedMountDir", ns.sharedMountDir)
+	if _, err := fs.Stat(kubeletDir); err != nil {
+		// kubelet creates the directory when it stages the first CSI volume, so it may not exist yet. If it never
+		// does, kubelet probably runs with a different --root-dir.
+		LogError(ctx, errors.WithStack(err), "Failed to find kubelet CSI plugin directory; only volumes staged below it "+
+			"are reconciled", "kubeletCSIPluginDir", kubeletDir)
+	}
+	mountPoints, err := ns.mounter.List()
+	if err != nil {
+		LogError(ctx, err, "Failed to list mounts to reconcile")
+		return
+	}
+	for _, mountPoint := range mountPoints {
+		if mountDirPath, shared, ok := ns.getReconcilableMountDirPath(mountPoint, kubeletDir); ok {
+			ns.reconcileMount(ctx, mountDirPath, shared)
+		}
+	}
+
+	if err := ns.removeStaleClientFiles(ctx, kubeletDir, staleClientConfSearchDepth, false); err != nil {
+		LogError(ctx, err, "Failed to remove stale client files", "path", kubeletDir)
+	}
+	if ns.sharedMountDir != "" {
+		if err := ns.removeStaleClientFiles(ctx, ns.sharedMountDir, 2, true); err != nil {
+			LogError(ctx, err, "Failed to remove stale client files", "path", ns.sharedMountDir)
+		}
+	}
+}
+
+// getReconcilableMountDirPath returns the mountDirPath of the beegfsVolume mountPoint was mounted for and whether it is
+// a shared mount (see newSharedBeegfsVolume) if reconcileMounts is responsible for mountPoint (i.e. it was mounted for
+// a staging target path below kubeletDir or in ns.sharedMountDir). Bind mounts and mounts the node service did not
+// make (e.g. by the controller service or an administrator) are left alone.
+func (ns *nodeServer) getReconcilableMountDirPath(mountPoint mount.MountPoint,
+	kubeletDir string) (mountDirPath string, shared, ok bool) {
+	if mountPoint.Device != "beegfs_nodev" {
+		return "", false, false
+	}
+	for _, opt := range mountPoint.Opts {
+		if !strings.HasPrefix(opt, "cfgFile=") {
+			continue
+		}
+		mountDirPath = path.Dir(strings.TrimPrefix(opt, "cfgFile="))
+		if mountPoint.Path != path.Join(mountDirPath, "mount") {
+			return "", false, false // a bind mount or a duplicate under /host
+		}
+		if ns.sharedMountDir != "" && path.Dir(mountDirPath) == ns.sharedMountDir {
+			return mountDirPath, true, true
+		}
+		return mountDirPath, false, strings.HasPrefix(mountDirPath, kubeletDir+"/")
+	}
+	return "", false, false
+}
+
+// reconcileMount recovers the BeeGFS file system mounted for the beegfsVolume at mountDirPath:
+//   * If its client configuration files are missing or incomplete (so it can never be mounted again) or, for a shared
+//     mount, if it is no longer staged anywhere, it is an orphan. reconcileMount unmounts it and cleans up
+//     mountDirPath.
+//   * If it does not respond to a probe (see probeVolumePath), reconcileMount unmounts it and mounts it again.
+// reconcileMount never unmounts a file system that is still bind mounted into a container. Those containers keep using
+// the old mount, so a new one would not help them.
+func (ns *nodeServer) reconcileMount(ctx context.Context, mountDirPath string, shared bool) {
+	vol := newBeegfsVolume(mountDirPath, "", "", ns.pluginConfig)
+	sysMgmtdHost, confErr := readClientConf(vol.clientConfPath)
+	if confErr == nil {
+		vol = newBeegfsVolume(mountDirPath, sysMgmtdHost, "", ns.pluginConfig)
+	}
+	orphaned := confErr != nil || (shared && !ns.pruneSharedMountRefs(ctx, vol))
+	_, _, probeErr := ns.probeVolumePath(vol.mountPath)
+	if !orphaned && probeErr == nil {
+		LogDebug(ctx, "Staged volume mount is healthy", "path", vol.mountPath, "sysMgmtdHost", vol.sysMgmtdHost)
+		return
+	}
+
+	if bindMountPath, err := getBindMountPath(vol, ns.mounter); err != nil || bindMountPath != "" {
+		if err == nil {
+			err = errors.Errorf("file system at %s is bind mounted at %s", vol.mountPath, bindMountPath)
+		}
+		LogError(ctx, err, "Failed to reconcile staged volume mount", "path", vol.mountPath, "sysMgmtdHost", vol.sysMgmtdHost,
+			"clientConfError", confErr, "probeError", probeErr)
+		return
+	}
+	if orphaned {
+		LogDebug(ctx, "Unmounting orphaned staged volume mount", "path", vol.mountPath, "clientConfError", confErr)
+		if probeErr == nil {
+			err := unmountAndCleanUpIfNecessary(ctx, vol, shared, ns.mounter)
+			if err != nil {
+				LogError(ctx, err, "Failed to unmount orphaned staged volume mount", "path", vol.mountPath)
+			}
+			return
+		}
+	} else {
+		LogError(ctx, probeErr, "Mounting unresponsive staged volume mount again", "path", vol.mountPath,
+			"sysMgmtdHost", vol.sysMgmtdHost)
+	}
+
+	if err := ns.unmountUnresponsive(vol.mountPath); err != nil {
+		LogError(ctx, err, "Failed to unmount unresponsive staged volume mount", "path", vol.mountPath)
+		return
+	}
+	if orphaned {
+		if err := removeClientFiles(ctx, vol, shared, ns.mounter); err != nil {
+			LogError(ctx, err, "Failed to clean up orphaned staged volume mount", "path", vol.mountDirPath)
+		}
+		return
+	}
+	if err := mountIfNecessary(ctx, vol, ns.mounter); err != nil {
+		LogError(ctx, err, "Failed to mount staged volume again", "path", vol.mountPath, "sysMgmtdHost", vol.sysMgmtdHost)
+	}
+}
+
+// pruneSharedMountRefs removes each reference (see sharedMountRefPath) to a staging target path that no longer exists
+// from the shared mount of vol and returns whether any references remain. The CO removes a staging target path after
+// NodeUnstageVolume succeeds, so such a reference was left behind by an interrupted request.
+func (ns *nodeServer) pruneSharedMountRefs(ctx context.Context, vol beegfsVolume) bool {
+	refsDirPath := path.Join(vol.mountDirPath, sharedMountRefsDirName)
+	refs, err := fsutil.ReadDir(refsDirPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LogError(ctx, errors.WithStack(err), "Failed to read shared mount references", "path", refsDirPath)
+			return true // Assume the file system is still staged.
+		}
+		return false
+	}
+	remaining := 0
+	for _, ref := range refs {
+		refPath := path.Join(refsDirPath, ref.Name())
+		stagingTargetPath, err := fsutil.ReadFile(refPath)
+		if err == nil {
+			_, err = fs.Stat(strings.TrimSpace(string(stagingTargetPath)))
+		}
+		if !os.IsNotExist(err) {
+			remaining++
+			continue
+		}
+		LogDebug(ctx, "Removing shared mount reference to missing staging target path", "path", refPath,
+			"stagingTargetPath", strings.TrimSpace(string(stagingTargetPath)))
+		if err := fs.Remove(refPath); err != nil {
+			LogError(ctx, errors.WithStack(err), "Failed to remove shared mount reference", "path", refPath)
+			remaining++
+		}
+	}
+	return remaining != 0
+}
+
+// unmountUnresponsive unmounts the file system at mountPath in a separate Goroutine and gives up after
+// mountProbeTimeout. Unlike unmountAndCleanUpIfNecessary, it does not stat mountPath, which would block on an
+// unresponsive mount.
+func (ns *nodeServer) unmountUnresponsive(mountPath string) error {
+	results := make(chan error, 1) // buffered so that an unmount that times out can still send and exit
+	go func() {
+		results <- ns.mounter.Unmount(mountPath)
+	}()
+
+	select {
+	case err := <-results:
+		return errors.WithStack(err)
+	case <-time.After(mountProbeTimeout):
+		return errors.Errorf("unmount of %s did not complete within %s", mountPath, mountProbeTimeout)
+	}
+}
+
+// removeStaleClientFiles searches up to depth directories below dirPath for beegfs-client.conf files whose BeeGFS file
+// system is not mounted and removes the client files next to them (see removeClientFiles). A stage request that
+// failed before mounting or an unstage request that was interrupted after unmounting leaves such files behind. It
+// removes the directories themselves if rmDir is true and they are empty. It never enters a mount point, which might
+// not respond, and it never deletes anything in a mount point directory, which might hold volume data.
+func (ns *nodeServer) removeStaleClientFiles(ctx context.Context, dirPath string, depth int, rmDir bool) error {
+	mountPoints, err := ns.mounter.List()
+	if err != nil {
+		return errors.Wrap(err, "error listing mounted filesystems")
+	}
+	mountPaths := make(map[string]bool)
+	for _, mountPoint := range mountPoints {
+		mountPaths[mountPoint.Path] = true
+	}
+	skipPaths := map[string]bool{ns.sharedMountDir: true} // handled separately
+	var search func(dirPath string, depth int) error
+	search = func(dirPath string, depth int) error {
+		dir, err := fs.Open(dirPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		names, err := dir.Readdirnames(-1) // Readdir would stat every entry, including mount points.
+		_ = dir.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, name := range names {
+			if name != "beegfs-client.conf" {
+				continue
+			}
+			// dirPath is the mountDirPath of a beegfsVolume.
+			vol := newBeegfsVolume(dirPath, "", "", ns.pluginConfig)
+			if mountPaths[vol.mountPath] {
+				return nil
+			}
+			LogDebug(ctx, "Removing stale client files", "path", dirPath)
+			if err := removeClientFiles(ctx, vol, rmDir, ns.mounter); err != nil {
+				LogError(ctx, err, "Failed to remove stale client files", "path", dirPath)
+			}
+			return nil
+		}
+		for _, name := range names {
+			entryPath := path.Join(dirPath, name)
+			if mountPaths[entryPath] || skipPaths[entryPath] {
+				continue
+			}
+			if depth > 1 {
+				if fileInfo, err := fs.Stat(entryPath); err == nil && fileInfo.IsDir() {
+					if err := search(entryPath, depth-1); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+	return search(dirPath, depth)
+}
@@ -0,0 +1,768 @@
+/*
+Copyright 2021 NetApp, Inc. All Rights Reserved.
+Licensed under the Apache License, Version 2.0.
+*/
+
+package beegfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/spf13/afero"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"k8s.io/utils/mount"
+)
+
+// hungFs is an afero.Fs whose Stat of hungPath blocks until unblock is closed. It emulates a BeeGFS
+// mount that does not respond.
+type hungFs struct {
+	afero.Fs
+	hungPath string
+	unblock  chan struct{}
+}
+
+func (h *hungFs) Stat(name string) (os.FileInfo, error) {
+	if name == h.hungPath {
+		<-h.unblock
+	}
+	return h.Fs.Stat(name)
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	ns, ctlExec, testDir, cleanUp := newTestNodeServer(t)
+	defer cleanUp()
+	volumePath := path.Join(testDir, "target")
+	stagingTargetPath := path.Join(testDir, "staging")
+	if err := os.Mkdir(stagingTargetPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The volume directory is in a storage pool other than the default one, so only quotas in that pool count.
+	ctlExec.pools = append(ctlExec.pools, storagePool{id: "2", description: "Fast"})
+	vol, _ := newBeegfsVolumeFromID(stagingTargetPath, "beegfs://localhost/vols/vol1", ns.pluginConfig)
+	const uid, gid = 1000, 2000
+	if err := ctlExec.createDirectoryForVolume(context.Background(), vol,
+		permissionsConfig{uid: uid, gid: gid, mode: 0755}, stripePatternConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctlExec.setPatternForVolume(context.Background(), vol,
+		stripePatternConfig{storagePoolID: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	// Stand in for the bind mount of the volume directory and report its simulated owner and group.
+	if err := os.Symlink(path.Join(ctlExec.beegfsRootPath, "vols", "vol1"), volumePath); err != nil {
+		t.Fatal(err)
+	}
+	fs = ctlExec.ownershipFs(fs)
+	fsutil = afero.Afero{Fs: fs}
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(volumePath, &statfs); err != nil {
+		t.Fatal(err)
+	}
+	fsTotalBytes := int64(statfs.Blocks) * int64(statfs.Bsize)
+	ctlExec.setQuotaUsage("localhost", "1", quotaIDTypeUID, uid, 5000, 50)
+	ctlExec.setQuotaUsage("localhost", "2", quotaIDTypeUID, uid, 1000, 10)
+	ctlExec.setQuotaUsage("localhost", "2", quotaIDTypeGID, gid, 2000, 20)
+	// Usage on another file system does not count.
+	ctlExec.setQuotaUsage("otherhost", "2", quotaIDTypeUID, uid, 9000, 90)
+	if err := ctlExec.setQuotaLimitForVolume(context.Background(), vol, "2", quotaIDTypeGID, gid, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		volumeStatsSource string
+		stagingTargetPath string
+		volumePath        string
+		ctlErr            error
+		wantCode          codes.Code
+		wantBytes         *csi.VolumeUsage // nil if the usage comes from statfs
+		wantInodesUsed    int64
+	}{
+		"statfs": {
+			volumeStatsSource: volumeStatsSourceStatfs,
+			stagingTargetPath: stagingTargetPath,
+		},
+		"uid quota without limit": {
+			volumeStatsSource: volumeStatsSourceUIDQuota,
+			stagingTargetPath: stagingTargetPath,
+			wantBytes:         &csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Used: 1000, Total: fsTotalBytes},
+			wantInodesUsed:    10,
+		},
+		"gid quota with limit": {
+			volumeStatsSource: volumeStatsSourceGIDQuota,
+			stagingTargetPath: stagingTargetPath,
+			wantBytes:         &csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Used: 2000, Available: 2096, Total: 4096},
+			wantInodesUsed:    20,
+		},
+		"quota without staging target path": { // falls back to statfs
+			volumeStatsSource: volumeStatsSourceUIDQuota,
+		},
+		"quota unavailable": {
+			volumeStatsSource: volumeStatsSourceUIDQuota,
+			stagingTargetPath: stagingTargetPath,
+			ctlErr:            simErrUnreachable,
+			wantCode:          codes.Unavailable,
+		},
+		"missing volume path": {
+			volumeStatsSource: volumeStatsSourceStatfs,
+			volumePath:        path.Join(testDir, "missing"),
+			wantCode:          codes.NotFound,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ns.pluginConfig = PluginConfig{DefaultConfig: beegfsConfig{VolumeStatsSource: tc.volumeStatsSource}}
+			if tc.ctlErr != nil {
+				ctlExec.injectFailure(simOpGetQuota, tc.ctlErr)
+			}
+			if tc.volumePath == "" {
+				tc.volumePath = volumePath
+			}
+			resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+				VolumeId:          "beegfs://localhost/vols/vol1",
+				VolumePath:        tc.volumePath,
+				StagingTargetPath: tc.stagingTargetPath,
+			})
+			if grpcCode(err) != tc.wantCode {
+				t.Fatalf("expected code %v, got %v", tc.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			usage := resp.GetUsage()
+			if len(usage) != 2 || usage[0].Unit != csi.VolumeUsage_BYTES || usage[1].Unit != csi.VolumeUsage_INODES {
+				t.Fatalf("expected byte and inode usage, got %v", usage)
+			}
+			if tc.wantBytes == nil {
+				// The file system may change between statfs calls, so only compare its size.
+				if usage[0].Total != fsTotalBytes || usage[1].Total != int64(statfs.Files) {
+					t.Fatalf("expected file system usage, got %v", usage)
+				}
+				return
+			}
+			if usage[0].Used != tc.wantBytes.Used || usage[0].Total != tc.wantBytes.Total ||
+				(tc.wantBytes.Available != 0 && usage[0].Available != tc.wantBytes.Available) {
+				t.Fatalf("expected byte usage %v, got %v", tc.wantBytes, usage[0])
+			}
+			if usage[1].Used != tc.wantInodesUsed {
+				t.Fatalf("expected %d inodes used, got %v", tc.wantInodesUsed, usage[1])
+			}
+		})
+	}
+}
+
+func TestNodeGetVolumeStatsVolumeCondition(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "node-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(testDir) }()
+	healthyPath := path.Join(testDir, "healthy")
+	hungPath := path.Join(testDir, "hung")
+	for _, dir := range []string{healthyPath, hungPath} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defaultMountProbeTimeout := mountProbeTimeout
+	mountProbeTimeout = 100 * time.Millisecond
+	defer func() { mountProbeTimeout = defaultMountProbeTimeout }()
+	ns := NewNodeServer("testID", PluginConfig{}, "")
+	unblock := make(chan struct{})
+	fs = &hungFs{Fs: afero.NewOsFs(), hungPath: hungPath, unblock: unblock}
+	fsutil = afero.Afero{Fs: fs}
+	defer func() {
+		// Wait for the hung probe to return before restoring fs.
+		close(unblock)
+		for !ns.mountProbesInFlight.obtainLockOnString(hungPath) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		fs = afero.NewOsFs()
+		fsutil = afero.Afero{Fs: fs}
+	}()
+
+	tests := map[string]struct {
+		volumePath   string
+		wantCode     codes.Code
+		wantAbnormal bool
+	}{
+		"healthy": {
+			volumePath: healthyPath,
+		},
+		"hung": {
+			volumePath:   hungPath,
+			wantAbnormal: true,
+		},
+		"still hung": { // The probe from the previous request has not returned.
+			volumePath:   hungPath,
+			wantAbnormal: true,
+		},
+		"missing": {
+			volumePath: path.Join(testDir, "missing"),
+			wantCode:   codes.NotFound,
+		},
+	}
+	for _, name := range []string{"healthy", "hung", "still hung", "missing"} { // in order
+		tc := tests[name]
+		t.Run(name, func(t *testing.T) {
+			resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+				VolumeId:   "beegfs://localhost/vols/vol1",
+				VolumePath: tc.volumePath,
+			})
+			if grpcCode(err) != tc.wantCode {
+				t.Fatalf("expected code %v, got %v", tc.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if resp.GetVolumeCondition().GetAbnormal() != tc.wantAbnormal {
+				t.Fatalf("expected abnormal %t, got condition %v", tc.wantAbnormal, resp.GetVolumeCondition())
+			}
+			if len(resp.GetUsage()) == 0 {
+				t.Fatalf("expected usage, got none")
+			}
+		})
+	}
+}
+
+// nodeTestMounter is a mount.FakeMounter that lists mounts the way Linux does in /proc/mounts. A bind mount of a
+// directory inside a mounted file system is listed with the device and options of that file system (e.g. beegfs_nodev
+// and cfgFile=...), which is how unmountAndCleanUpIfNecessary detects that a staged volume is still published. Unlike
+// mount.FakeMounter, it also keeps the options of the remaining mount points when one is unmounted.
+type nodeTestMounter struct {
+	*mount.FakeMounter
+	mutex sync.Mutex
+}
+
+func newNodeTestMounter() *nodeTestMounter {
+	return &nodeTestMounter{FakeMounter: mount.NewFakeMounter(nil)}
+}
+
+func (m *nodeTestMounter) Mount(source string, target string, fstype string, options []string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, option := range options {
+		if option != "bind" {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(source); err == nil {
+			source = resolved
+		}
+		mountPoints, _ := m.FakeMounter.List()
+		for _, mountPoint := range mountPoints {
+			if source == mountPoint.Path || strings.HasPrefix(source, mountPoint.Path+"/") {
+				return m.FakeMounter.Mount(mountPoint.Device, target, mountPoint.Type,
+					append(append([]string{}, options...), mountPoint.Opts...))
+			}
+		}
+	}
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
+
+func (m *nodeTestMounter) MountSensitive(source string, target string, fstype string, options []string,
+	sensitiveOptions []string) error {
+	return m.Mount(source, target, fstype, append(options, sensitiveOptions...))
+}
+
+func (m *nodeTestMounter) Unmount(target string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mountPoints, _ := m.FakeMounter.List()
+	opts := make(map[string][]string)
+	for _, mountPoint := range mountPoints {
+		opts[mountPoint.Path] = mountPoint.Opts
+	}
+	if err := m.FakeMounter.Unmount(target); err != nil {
+		return err
+	}
+	for i := range m.FakeMounter.MountPoints {
+		m.FakeMounter.MountPoints[i].Opts = opts[m.FakeMounter.MountPoints[i].Path]
+	}
+	return nil
+}
+
+// isMounted returns the mount point at path and true, or false if nothing is mounted at path.
+func (m *nodeTestMounter) isMounted(path string) (mount.MountPoint, bool) {
+	mountPoints, _ := m.List()
+	for _, mountPoint := range mountPoints {
+		if mountPoint.Path == path {
+			return mountPoint, true
+		}
+	}
+	return mount.MountPoint{}, false
+}
+
+// newTestNodeServer returns a nodeServer that uses a nodeTestMounter and a simBeegfsCtlExecutor to emulate BeeGFS file
+// systems in a temporary directory. It also returns the simBeegfsCtlExecutor, the temporary directory, and a function
+// that removes the temporary directory. The mount helpers in k8s.io/utils/mount use the os package directly, so the
+// node service uses an afero.OsFs in the temporary directory instead of an in-memory file system.
+func newTestNodeServer(t *testing.T) (*nodeServer, *simBeegfsCtlExecutor, string, func()) {
+	fs = afero.NewOsFs()
+	fsutil = afero.Afero{Fs: fs}
+	testDir, err := ioutil.TempDir("", "node-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanUp := func() { _ = os.RemoveAll(testDir) }
+	beegfsRootPath := path.Join(testDir, "beegfs-root")
+	clientConfTemplatePath := path.Join(testDir, "beegfs-client.conf")
+	if err := os.Mkdir(beegfsRootPath, 0755); err != nil {
+		cleanUp()
+		t.Fatal(err)
+	}
+	if err := fsutil.WriteFile(clientConfTemplatePath, []byte(TestWriteClientFilesTemplate), 0644); err != nil {
+		cleanUp()
+		t.Fatal(err)
+	}
+	ns := NewNodeServer("testID", PluginConfig{}, clientConfTemplatePath)
+	ns.mounter = newNodeTestMounter()
+	ctlExec := newSimBeegfsCtlExecutor(beegfsRootPath)
+	ns.ctlExec = ctlExec
+	return ns, ctlExec, testDir, cleanUp
+}
+
+func TestNodeVolumeLifecycle(t *testing.T) {
+	ns, ctlExec, testDir, cleanUp := newTestNodeServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	mounter := ns.mounter.(*nodeTestMounter)
+	const volumeID = "beegfs://localhost/vols/vol1"
+	vol, _ := newBeegfsVolumeFromID(path.Join(testDir, "staging"), volumeID, ns.pluginConfig)
+	permCfg := permissionsConfig{mode: 0755}
+	if err := ctlExec.createDirectoryForVolume(ctx, vol, permCfg, stripePatternConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(vol.mountDirPath, 0750); err != nil { // The CO creates the staging target path.
+		t.Fatal(err)
+	}
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	targetPaths := []string{path.Join(testDir, "target1"), path.Join(testDir, "target2")}
+	stageReq := &csi.NodeStageVolumeRequest{VolumeId: volumeID, StagingTargetPath: vol.mountDirPath,
+		VolumeCapability: volCap}
+	unstageReq := &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: vol.mountDirPath}
+
+	// A missing volume directory is not mounted.
+	missingReq := *stageReq
+	missingReq.VolumeId = "beegfs://localhost/vols/missing"
+	if _, err := ns.NodeStageVolume(ctx, &missingReq); grpcCode(err) != codes.NotFound {
+		t.Fatalf("expected code %v, got %v", codes.NotFound, err)
+	}
+	// A volume can be staged repeatedly, but its file system is only mounted once.
+	for i := 0; i < 2; i++ {
+		if _, err := ns.NodeStageVolume(ctx, stageReq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mountPoint, ok := mounter.isMounted(vol.mountPath); !ok || mountPoint.Device != "beegfs_nodev" {
+		t.Fatalf("expected BeeGFS to be mounted at %s, got %v", vol.mountPath, mountPoint)
+	}
+	if len(mounter.GetLog()) != 1 {
+		t.Fatalf("expected one mount, got %v", mounter.GetLog())
+	}
+	if _, err := fs.Stat(vol.clientConfPath); err != nil {
+		t.Fatalf("expected client configuration file: %v", err)
+	}
+
+	for i, targetPath := range targetPaths {
+		if _, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: volumeID,
+			StagingTargetPath: vol.mountDirPath, TargetPath: targetPath, VolumeCapability: volCap,
+			Readonly: i == 1}); err != nil {
+			t.Fatal(err)
+		}
+		mountPoint, ok := mounter.isMounted(targetPath)
+		if !ok || mountPoint.Device != "beegfs_nodev" {
+			t.Fatalf("expected BeeGFS to be bind mounted at %s, got %v", targetPath, mountPoint)
+		}
+		if readOnly := i == 1; readOnly != (mountPoint.Opts[1] == "ro") {
+			t.Fatalf("expected read-only %t, got options %v", readOnly, mountPoint.Opts)
+		}
+	}
+
+	// The file system is not unmounted while the volume is still published.
+	for _, targetPath := range targetPaths {
+		if _, err := ns.NodeUnstageVolume(ctx, unstageReq); grpcCode(err) != codes.Internal ||
+			!strings.Contains(err.Error(), "refused to unmount") {
+			t.Fatalf("expected refusal to unmount, got %v", err)
+		}
+		if _, ok := mounter.isMounted(vol.mountPath); !ok {
+			t.Fatalf("expected BeeGFS to remain mounted at %s", vol.mountPath)
+		}
+		if _, err := ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID,
+			TargetPath: targetPath}); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := mounter.isMounted(targetPath); ok {
+			t.Fatalf("expected %s to be unmounted", targetPath)
+		}
+		if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", targetPath, err)
+		}
+	}
+
+	// Once the volume is no longer published, its file system is unmounted and its staging target path is emptied
+	// (but not removed).
+	if _, err := ns.NodeUnstageVolume(ctx, unstageReq); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mounter.isMounted(vol.mountPath); ok {
+		t.Fatalf("expected %s to be unmounted", vol.mountPath)
+	}
+	if entries, err := ioutil.ReadDir(vol.mountDirPath); err != nil || len(entries) != 0 {
+		t.Fatalf("expected empty staging target path, got %v (%v)", entries, err)
+	}
+	if _, err := ns.NodeUnstageVolume(ctx, unstageReq); err != nil {
+		t.Fatalf("expected repeated unstage to succeed, got %v", err)
+	}
+}
+
+func TestNodeSharedMountLifecycle(t *testing.T) {
+	ns, ctlExec, testDir, cleanUp := newTestNodeServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	mounter := ns.mounter.(*nodeTestMounter)
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	volumeIDs := []string{"beegfs://localhost/vols/vol1", "beegfs://localhost/vols/vol2", "beegfs://localhost/vols/vol3"}
+	stagingPaths := make([]string, len(volumeIDs))
+	for i, volumeID := range volumeIDs {
+		stagingPaths[i] = path.Join(testDir, "staging", strconv.Itoa(i))
+		vol, _ := newBeegfsVolumeFromID(stagingPaths[i], volumeID, ns.pluginConfig)
+		permCfg := permissionsConfig{mode: 0755}
+		if err := ctlExec.createDirectoryForVolume(ctx, vol, permCfg, stripePatternConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(stagingPaths[i], 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stage := func(ns *nodeServer, i int) error {
+		_, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: volumeIDs[i],
+			StagingTargetPath: stagingPaths[i], VolumeCapability: volCap})
+		return err
+	}
+	unstage := func(ns *nodeServer, i int) error {
+		_, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeIDs[i],
+			StagingTargetPath: stagingPaths[i]})
+		return err
+	}
+
+	// vol3 was staged with its own mount before shared mounts were enabled.
+	if err := stage(ns, 2); err != nil {
+		t.Fatal(err)
+	}
+	ns.sharedMountDir = path.Join(testDir, "shared")
+	sharedVol, _ := ns.newSharedBeegfsVolume(volumeIDs[0])
+
+	// vol1 and vol2 share one mount.
+	for i := 0; i < 2; i++ {
+		if err := stage(ns, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mountPoint, ok := mounter.isMounted(sharedVol.mountPath); !ok || mountPoint.Device != "beegfs_nodev" {
+		t.Fatalf("expected BeeGFS to be mounted at %s, got %v", sharedVol.mountPath, mountPoint)
+	}
+	if len(mounter.GetLog()) != 2 {
+		t.Fatalf("expected two mounts, got %v", mounter.GetLog())
+	}
+
+	// Each volume is bind mounted from the mount it was staged with.
+	targetPaths := []string{path.Join(testDir, "target1"), "", path.Join(testDir, "target3")}
+	for _, i := range []int{0, 2} {
+		if _, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: volumeIDs[i],
+			StagingTargetPath: stagingPaths[i], TargetPath: targetPaths[i], VolumeCapability: volCap}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log := mounter.GetLog()
+	if source := log[len(log)-2].Source; source != "beegfs_nodev" {
+		t.Fatalf("expected bind mount of the shared mount, got %v", log[len(log)-2])
+	}
+	wantCfgFile := "cfgFile=" + sharedVol.clientConfPath
+	if mountPoint, _ := mounter.isMounted(targetPaths[0]); mountPoint.Opts[len(mountPoint.Opts)-1] != wantCfgFile {
+		t.Fatalf("expected bind mount of the shared mount, got options %v", mountPoint.Opts)
+	}
+	vol3, _ := newBeegfsVolumeFromID(stagingPaths[2], volumeIDs[2], ns.pluginConfig)
+	wantCfgFile = "cfgFile=" + vol3.clientConfPath
+	if mountPoint, _ := mounter.isMounted(targetPaths[2]); mountPoint.Opts[len(mountPoint.Opts)-1] != wantCfgFile {
+		t.Fatalf("expected bind mount of the staging mount, got options %v", mountPoint.Opts)
+	}
+
+	// References survive a restart of the node service.
+	restarted := NewNodeServer("testID", PluginConfig{}, ns.clientConfTemplatePath)
+	restarted.mounter, restarted.ctlExec, restarted.sharedMountDir = ns.mounter, ns.ctlExec, ns.sharedMountDir
+	if err := unstage(restarted, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mounter.isMounted(sharedVol.mountPath); !ok {
+		t.Fatalf("expected BeeGFS to remain mounted at %s while vol1 is staged", sharedVol.mountPath)
+	}
+
+	// The shared mount is not unmounted while a volume is still published from it.
+	err := unstage(restarted, 0)
+	if grpcCode(err) != codes.Internal || !strings.Contains(err.Error(), "refused to unmount") {
+		t.Fatalf("expected refusal to unmount, got %v", err)
+	}
+	for _, i := range []int{0, 2} {
+		if _, err := restarted.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeIDs[i],
+			TargetPath: targetPaths[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range []int{0, 2, 0} { // The second unstage of vol1 has nothing to do.
+		if err := unstage(restarted, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, mountPath := range []string{sharedVol.mountPath, vol3.mountPath} {
+		if _, ok := mounter.isMounted(mountPath); ok {
+			t.Fatalf("expected %s to be unmounted", mountPath)
+		}
+	}
+	if _, err := os.Stat(sharedVol.mountDirPath); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", sharedVol.mountDirPath, err)
+	}
+}
+
+func TestReconcileMounts(t *testing.T) {
+	ns, ctlExec, testDir, cleanUp := newTestNodeServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	mounter := ns.mounter.(*nodeTestMounter)
+	kubeletDir := path.Join(testDir, "kubelet")
+	defaultMountProbeTimeout := mountProbeTimeout
+	mountProbeTimeout = 100 * time.Millisecond
+	defer func() { mountProbeTimeout = defaultMountProbeTimeout }()
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	// stage stages volumeID at a staging target path like the ones kubelet creates and returns the volume that is
+	// mounted for it and the staging target path.
+	stage := func(name, volumeID string) (beegfsVolume, string) {
+		stagingTargetPath := path.Join(kubeletDir, "pv", name, "globalmount")
+		vol, _ := newBeegfsVolumeFromID(stagingTargetPath, volumeID, ns.pluginConfig)
+		permCfg := permissionsConfig{mode: 0755}
+		if err := ctlExec.createDirectoryForVolume(ctx, vol, permCfg, stripePatternConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(stagingTargetPath, 0750); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{VolumeId: volumeID,
+			StagingTargetPath: stagingTargetPath, VolumeCapability: volCap}); err != nil {
+			t.Fatal(err)
+		}
+		vol, _, _ = ns.getStagedVolume(stagingTargetPath, volumeID)
+		return vol, stagingTargetPath
+	}
+
+	healthyVol, _ := stage("healthy", "beegfs://localhost/vols/healthy")
+	hungVol, _ := stage("hung", "beegfs://localhost/vols/hung")
+	// The client configuration files of an orphan are gone, so it cannot be mounted again.
+	orphanVol, _ := stage("orphan", "beegfs://localhost/vols/orphan")
+	if err := os.Remove(orphanVol.clientConfPath); err != nil {
+		t.Fatal(err)
+	}
+	// An orphan that is still published is not unmounted.
+	publishedVol, publishedStagingPath := stage("published", "beegfs://localhost/vols/published")
+	if _, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: "beegfs://localhost/vols/published",
+		StagingTargetPath: publishedStagingPath, TargetPath: path.Join(testDir, "target"),
+		VolumeCapability: volCap}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(publishedVol.clientConfPath); err != nil {
+		t.Fatal(err)
+	}
+	// A stage request failed after writing client configuration files.
+	staleVol, _ := newBeegfsVolumeFromID(path.Join(kubeletDir, "pv", "stale", "globalmount"),
+		"beegfs://localhost/vols/stale", ns.pluginConfig)
+	if err := os.MkdirAll(staleVol.mountDirPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeClientFiles(ctx, staleVol, ns.clientConfTemplatePath); err != nil {
+		t.Fatal(err)
+	}
+	// Like staleVol, but its mount point holds data (e.g. because a mount was not listed). The data must survive.
+	dataVol, _ := newBeegfsVolumeFromID(path.Join(kubeletDir, "pv", "data", "globalmount"),
+		"beegfs://localhost/vols/data", ns.pluginConfig)
+	dataPath := path.Join(dataVol.mountPath, "vols", "data", "file")
+	if err := os.MkdirAll(path.Dir(dataPath), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dataPath, []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeClientFiles(ctx, dataVol, ns.clientConfTemplatePath); err != nil {
+		t.Fatal(err)
+	}
+
+	ns.sharedMountDir = path.Join(testDir, "shared")
+	// One of two volumes sharing a mount was unstaged by the CO without removing its reference.
+	sharedVol, unstagedPath := stage("shared1", "beegfs://host1/vols/vol1")
+	stage("shared2", "beegfs://host1/vols/vol2")
+	// The only volume using a shared mount was unstaged by the CO without removing its reference.
+	unstagedSharedVol, unstagedSharedPath := stage("unstaged", "beegfs://host2/vols/vol1")
+	for _, stagingTargetPath := range []string{unstagedPath, unstagedSharedPath} {
+		if err := os.RemoveAll(stagingTargetPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The node rebooted, so a shared mount is gone but its files and references are not.
+	rebootedSharedVol, _ := stage("rebooted", "beegfs://host3/vols/vol1")
+	if err := mounter.Unmount(rebootedSharedVol.mountPath); err != nil {
+		t.Fatal(err)
+	}
+	// Like rebootedSharedVol, but its mount point holds data. The data must survive.
+	sharedDataVol, _ := stage("shareddata", "beegfs://host4/vols/vol1")
+	if err := mounter.Unmount(sharedDataVol.mountPath); err != nil {
+		t.Fatal(err)
+	}
+	sharedDataPath := path.Join(sharedDataVol.mountPath, "file")
+	if err := ioutil.WriteFile(sharedDataPath, []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// The node service did not mount this file system.
+	otherMountPath := path.Join(testDir, "other", "mount")
+	if err := os.MkdirAll(otherMountPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := mounter.Mount("beegfs_nodev", otherMountPath, "beegfs",
+		[]string{"cfgFile=" + path.Join(testDir, "other", "beegfs-client.conf")}); err != nil {
+		t.Fatal(err)
+	}
+
+	unblock := make(chan struct{})
+	fs = &hungFs{Fs: afero.NewOsFs(), hungPath: hungVol.mountPath, unblock: unblock}
+	fsutil = afero.Afero{Fs: fs}
+	defer func() {
+		// Wait for the hung probe to return before restoring fs.
+		close(unblock)
+		for !ns.mountProbesInFlight.obtainLockOnString(hungVol.mountPath) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		fs = afero.NewOsFs()
+		fsutil = afero.Afero{Fs: fs}
+	}()
+
+	mounter.ResetLog()
+	restarted := NewNodeServer("testID", PluginConfig{}, ns.clientConfTemplatePath)
+	restarted.mounter, restarted.ctlExec, restarted.sharedMountDir = ns.mounter, ns.ctlExec, ns.sharedMountDir
+	restarted.mountProbesInFlight = ns.mountProbesInFlight // so that the deferred function can wait for the probe
+	restarted.reconcileMounts(ctx, kubeletDir)
+
+	wantLog := []mount.FakeAction{
+		{Action: mount.FakeActionUnmount, Target: hungVol.mountPath},
+		{Action: mount.FakeActionMount, Target: hungVol.mountPath, Source: "beegfs_nodev", FSType: "beegfs"},
+		{Action: mount.FakeActionUnmount, Target: orphanVol.mountPath},
+		{Action: mount.FakeActionUnmount, Target: unstagedSharedVol.mountPath},
+	}
+	if log := mounter.GetLog(); !reflect.DeepEqual(log, wantLog) {
+		t.Fatalf("expected mount actions %v, got %v", wantLog, log)
+	}
+	for _, mountPath := range []string{healthyVol.mountPath, hungVol.mountPath, publishedVol.mountPath,
+		sharedVol.mountPath, otherMountPath} {
+		if _, ok := mounter.isMounted(mountPath); !ok {
+			t.Fatalf("expected %s to remain mounted", mountPath)
+		}
+	}
+	if refs, err := ioutil.ReadDir(path.Join(sharedVol.mountDirPath, sharedMountRefsDirName)); err != nil ||
+		len(refs) != 1 {
+		t.Fatalf("expected one remaining reference, got %v (%v)", refs, err)
+	}
+	// Staging target paths are emptied (but not removed). Shared mount directories are removed.
+	for _, mountDirPath := range []string{orphanVol.mountDirPath, staleVol.mountDirPath} {
+		if entries, err := ioutil.ReadDir(mountDirPath); err != nil || len(entries) != 0 {
+			t.Fatalf("expected empty staging target path %s, got %v (%v)", mountDirPath, entries, err)
+		}
+	}
+	for _, mountDirPath := range []string{unstagedSharedVol.mountDirPath, rebootedSharedVol.mountDirPath} {
+		if _, err := os.Stat(mountDirPath); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", mountDirPath, err)
+		}
+	}
+	if _, err := os.Stat(healthyVol.clientConfPath); err != nil {
+		t.Fatalf("expected client configuration file: %v", err)
+	}
+	// Only the client files next to the data are removed.
+	if entries, err := ioutil.ReadDir(dataVol.mountDirPath); err != nil || len(entries) != 1 ||
+		entries[0].Name() != "mount" {
+		t.Fatalf("expected only %s in %s, got %v (%v)", dataVol.mountPath, dataVol.mountDirPath, entries, err)
+	}
+	for _, filePath := range []string{dataPath, sharedDataPath} {
+		if data, err := ioutil.ReadFile(filePath); err != nil || string(data) != "data" {
+			t.Fatalf("expected data in %s to survive, got %q (%v)", filePath, data, err)
+		}
+	}
+	if _, err := os.Stat(sharedDataVol.clientConfPath); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", sharedDataVol.clientConfPath, err)
+	}
+}
+
+// blockingListMounter is a nodeTestMounter whose List does not return until unblock is closed (e.g. like a mount table
+// that is slow to read).
+type blockingListMounter struct {
+	*nodeTestMounter
+	unblock chan struct{}
+}
+
+func (m *blockingListMounter) List() ([]mount.MountPoint, error) {
+	<-m.unblock
+	return m.nodeTestMounter.List()
+}
+
+func TestReconcileMountsInBackground(t *testing.T) {
+	ns, ctlExec, testDir, cleanUp := newTestNodeServer(t)
+	defer cleanUp()
+	ctx := context.Background()
+	mounter := &blockingListMounter{nodeTestMounter: ns.mounter.(*nodeTestMounter), unblock: make(chan struct{})}
+	ns.mounter = mounter
+	stagingTargetPath := path.Join(testDir, "kubelet", "pv", "vol1", "globalmount")
+	vol, _ := newBeegfsVolumeFromID(stagingTargetPath, "beegfs://localhost/vols/vol1", ns.pluginConfig)
+	permCfg := permissionsConfig{mode: 0755}
+	if err := ctlExec.createDirectoryForVolume(ctx, vol, permCfg, stripePatternConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(stagingTargetPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	req := &csi.NodeStageVolumeRequest{VolumeId: "beegfs://localhost/vols/vol1", StagingTargetPath: stagingTargetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}}
+
+	// reconcileMountsInBackground gives up waiting, and requests fail until reconcileMounts finishes.
+	ns.reconcileMountsInBackground(ctx, path.Join(testDir, "kubelet"), 10*time.Millisecond)
+	if _, err := ns.NodeStageVolume(ctx, req); grpcCode(err) != codes.Unavailable {
+		t.Fatalf("expected code %v, got %v", codes.Unavailable, err)
+	}
+	close(mounter.unblock)
+	for deadline := time.Now().Add(10 * time.Second); ns.checkMountsReconciled() != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected reconcileMounts to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := ns.NodeStageVolume(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -9,20 +9,30 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/kubernetes-csi/csi-test/v4/pkg/sanity"
 	"github.com/onsi/ginkgo/config"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
 	"k8s.io/utils/mount"
 )
 
 func TestSanity(t *testing.T) {
+	fs = afero.NewOsFs() // the controller service must see data written by previous requests
+	fsutil = afero.Afero{Fs: fs}
 	config.DefaultReporterConfig.NoColor = true
 	sanityDir, err := ioutil.TempDir("", "driver-sanity")
 	if err != nil {
 		t.Fatal(err)
 	}
 	csDataDirPath := path.Join(sanityDir, "csi-data-dir")
+	beegfsRootPath := path.Join(sanityDir, "beegfs-root")
+	if err := os.Mkdir(beegfsRootPath, 0755); err != nil {
+		t.Fatal(err)
+	}
 	endpoint := "unix://" + sanityDir + "/beegfscsi.sock"
 	clientConfTemplatePath := path.Join(sanityDir, "beegfs-client.conf")
 
@@ -31,15 +41,17 @@ func TestSanity(t *testing.T) {
 	}
 
 	// Create and run the driver
-	driver, err := NewBeegfsDriver("", "", csDataDirPath, "testDriver", endpoint, "testID", clientConfTemplatePath, "v0.1")
+	driver, err := NewBeegfsDriver("", "", csDataDirPath, "testDriver", endpoint, "testID", clientConfTemplatePath, "v0.1",
+		false, 0, "", true, path.Join(sanityDir, "kubelet"), false) // never reconcile the mounts of the host
 	if err != nil {
 		t.Fatal(err)
 	}
-	var mps []mount.MountPoint
-	driver.cs.mounter = mount.NewFakeMounter(mps)
-	driver.ns.mounter = mount.NewFakeMounter(mps)
-	driver.cs.ctlExec = &fakeBeegfsCtlExecutor{}
-	driver.ns.ctlExec = &fakeBeegfsCtlExecutor{}
+	driver.cs.mounter = newSanityMounter(beegfsRootPath)
+	driver.ns.mounter = newNodeTestMounter()
+	// Both services see the same simulated file system.
+	ctlExec := newSimBeegfsCtlExecutor(beegfsRootPath)
+	driver.cs.ctlExec = ctlExec
+	driver.ns.ctlExec = ctlExec
 	go driver.Run()
 
 	// Setup configuration parameters
@@ -58,3 +70,90 @@ func TestSanity(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// sanityMounter is a mount.Interface that emulates mounting a BeeGFS file system by replacing the (empty) mount point
+// with a symbolic link to the local directory that stands in for the root of the file system of the sysMgmtdHost in
+// the mounted beegfs-client.conf (see simRootPath). Unlike mount.FakeMounter, it allows the controller service to see
+// directories created by previous requests (e.g. the source volume of a snapshot).
+type sanityMounter struct {
+	mutex          sync.Mutex
+	beegfsRootPath string
+	mountPoints    map[string]mount.MountPoint
+}
+
+func newSanityMounter(beegfsRootPath string) *sanityMounter {
+	return &sanityMounter{beegfsRootPath: beegfsRootPath, mountPoints: make(map[string]mount.MountPoint)}
+}
+
+func (m *sanityMounter) Mount(source string, target string, fstype string, options []string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.mountPoints[target]; ok {
+		return errors.Errorf("%s is already mounted", target)
+	}
+	rootPath := m.beegfsRootPath
+	for _, option := range options {
+		if strings.HasPrefix(option, "cfgFile=") {
+			sysMgmtdHost, err := readClientConf(strings.TrimPrefix(option, "cfgFile="))
+			if err != nil {
+				return err
+			}
+			rootPath = simRootPath(m.beegfsRootPath, sysMgmtdHost)
+		}
+	}
+	if err := os.MkdirAll(rootPath, 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil {
+		return err
+	}
+	if err := os.Symlink(rootPath, target); err != nil {
+		return err
+	}
+	m.mountPoints[target] = mount.MountPoint{Device: source, Path: target, Type: fstype, Opts: options}
+	return nil
+}
+
+func (m *sanityMounter) MountSensitive(source string, target string, fstype string, options []string,
+	sensitiveOptions []string) error {
+	return m.Mount(source, target, fstype, append(options, sensitiveOptions...))
+}
+
+func (m *sanityMounter) Unmount(target string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.mountPoints[target]; !ok {
+		return errors.Errorf("%s is not mounted", target)
+	}
+	if err := os.Remove(target); err != nil {
+		return err
+	}
+	delete(m.mountPoints, target)
+	return os.Mkdir(target, 0750)
+}
+
+func (m *sanityMounter) List() ([]mount.MountPoint, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var mountPoints []mount.MountPoint
+	for _, mountPoint := range m.mountPoints {
+		mountPoints = append(mountPoints, mountPoint)
+	}
+	return mountPoints, nil
+}
+
+func (m *sanityMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.mountPoints[file]; ok {
+		return false, nil
+	}
+	if _, err := os.Stat(file); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+func (m *sanityMounter) GetMountRefs(pathname string) ([]string, error) {
+	return nil, nil
+}
@@ -55,10 +55,22 @@ type grpcError struct {
 	cause     error // error of type created by github.com/pkg/errors
 }
 
+// grpcCoder is implemented by errors that determine the gRPC code of any RPC they cause to fail (e.g. a
+// ctlTimeoutError or a ctlFailureError).
+type grpcCoder interface {
+	grpcCode() codes.Code
+}
+
+// newGrpcErrorFromCause returns a grpcError with the given code and cause. If a grpcCoder is somewhere in the chain of
+// causes (e.g. because beegfs-ctl timed out), its code is used instead so that the CO retries appropriately.
 func newGrpcErrorFromCause(code codes.Code, cause error) grpcError {
 	if cause == nil {
 		cause = errors.New("")
 	}
+	var coder grpcCoder
+	if errors.As(cause, &coder) {
+		code = coder.grpcCode()
+	}
 	statusErr := status.Error(code, cause.Error())
 	return grpcError{statusErr: statusErr, cause: cause}
 }
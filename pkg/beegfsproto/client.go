@@ -0,0 +1,354 @@
+/*
+Copyright 2021 NetApp, Inc. All Rights Reserved.
+Licensed under the Apache License, Version 2.0.
+*/
+
+package beegfsproto
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// OpsErr is the result of an operation as a BeeGFS service reports it.
+type OpsErr uint32
+
+const (
+	OpsErrSuccess       OpsErr = 0
+	OpsErrInternal      OpsErr = 1
+	OpsErrCommunication OpsErr = 3
+	OpsErrExists        OpsErr = 7
+	OpsErrPathNotExists OpsErr = 8
+	OpsErrNotADir       OpsErr = 12
+	OpsErrUnknownTarget OpsErr = 15 // a target needed for the operation is offline or unknown
+	OpsErrInval         OpsErr = 20
+	OpsErrPerm          OpsErr = 24
+)
+
+func (err OpsErr) Error() string {
+	switch err {
+	case OpsErrSuccess:
+		return "success"
+	case OpsErrInternal:
+		return "internal error"
+	case OpsErrCommunication:
+		return "communication error"
+	case OpsErrExists:
+		return "entry exists already"
+	case OpsErrPathNotExists:
+		return "path does not exist"
+	case OpsErrNotADir:
+		return "not a directory"
+	case OpsErrUnknownTarget:
+		return "unknown or offline target"
+	case OpsErrInval:
+		return "invalid argument"
+	case OpsErrPerm:
+		return "permission denied"
+	}
+	return fmt.Sprintf("BeeGFS error %d", uint32(err))
+}
+
+// CommError indicates that a request could not be sent to a BeeGFS service or that the service did not respond. The
+// service might be down or unreachable. A service that requires authentication may also close the connection without
+// responding to a request that does not authenticate, so a CommError can also indicate a connAuthFile mismatch.
+type CommError struct {
+	Addr string
+	Err  error
+}
+
+func (err *CommError) Error() string {
+	return fmt.Sprintf("communication with %s failed: %v", err.Addr, err.Err)
+}
+
+func (err *CommError) Unwrap() error { return err.Err }
+
+// ConnAuthHash returns the hash a client sends in an AuthenticateChannelMsg for the contents of a connAuthFile. It is
+// the 32-bit Hsieh hash of the first half of the contents in the upper 32 bits and of the second half in the lower 32
+// bits.
+func ConnAuthHash(connAuth []byte) uint64 {
+	half := len(connAuth) / 2
+	return uint64(hsiehHash32(connAuth[:half]))<<32 | uint64(hsiehHash32(connAuth[half:]))
+}
+
+// hsiehHash32 is Paul Hsieh's SuperFastHash.
+func hsiehHash32(data []byte) uint32 {
+	if len(data) == 0 {
+		return 0
+	}
+	get16 := func(b []byte) uint32 { return uint32(b[0]) | uint32(b[1])<<8 }
+	signed := func(b byte) uint32 { return uint32(int32(int8(b))) }
+
+	hash := uint32(len(data))
+	for ; len(data) >= 4; data = data[4:] {
+		hash += get16(data)
+		tmp := get16(data[2:])<<11 ^ hash
+		hash = hash<<16 ^ tmp
+		hash += hash >> 11
+	}
+	switch len(data) {
+	case 3:
+		hash += get16(data)
+		hash ^= hash << 16
+		hash ^= signed(data[2]) << 18
+		hash += hash >> 11
+	case 2:
+		hash += get16(data)
+		hash ^= hash << 11
+		hash += hash >> 17
+	case 1:
+		hash += signed(data[0])
+		hash ^= hash << 10
+		hash += hash >> 1
+	}
+	hash ^= hash << 3
+	hash += hash >> 5
+	hash ^= hash << 4
+	hash += hash >> 17
+	hash ^= hash << 25
+	hash += hash >> 6
+	return hash
+}
+
+// Client sends requests to the management service of a BeeGFS file system and to the metadata services it reports.
+// Each request uses a new connection, which is closed when the response arrives or ctx ends.
+type Client struct {
+	mgmtdAddr string
+	connAuth  []byte // the contents of the connAuthFile or nil if the file system does not use one
+	seq       uint64
+}
+
+// NewClient returns a Client for the file system whose management service listens on mgmtdHost:mgmtdPort. connAuth
+// is the contents of the file system's connAuthFile or nil if it does not use one.
+func NewClient(mgmtdHost string, mgmtdPort uint16, connAuth []byte) *Client {
+	return &Client{mgmtdAddr: net.JoinHostPort(mgmtdHost, strconv.Itoa(int(mgmtdPort))), connAuth: connAuth}
+}
+
+// request sends req to addr and returns the response, which must be of respType. It returns a CommError if the
+// request cannot be sent or no response arrives, or the error of ctx if ctx ends first.
+func (c *Client) request(ctx context.Context, addr string, req Message, respType uint16) (Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "cannot connect to %s", addr)
+		}
+		return nil, errors.WithStack(&CommError{Addr: addr, Err: err})
+	}
+	defer conn.Close()
+	// Unblock the reads and writes below when ctx ends.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	seq := atomic.AddUint64(&c.seq, 1)
+	if c.connAuth != nil {
+		if err = writeMessage(conn, &AuthenticateChannelMsg{AuthHash: ConnAuthHash(c.connAuth)}, seq); err != nil {
+			return nil, c.commError(ctx, addr, err)
+		}
+	}
+	if err = writeMessage(conn, req, seq); err != nil {
+		return nil, c.commError(ctx, addr, err)
+	}
+	resp, respSeq, err := readMessage(conn)
+	if err != nil {
+		return nil, c.commError(ctx, addr, err)
+	}
+	if resp.MsgType() != respType || respSeq != seq {
+		return nil, errors.Errorf("unexpected response of type %d (sequence number %d) from %s to request of type "+
+			"%d (sequence number %d)", resp.MsgType(), respSeq, addr, req.MsgType(), seq)
+	}
+	return resp, nil
+}
+
+// commError returns the error of ctx if it ended (which closes the connection) or a CommError for err otherwise.
+func (c *Client) commError(ctx context.Context, addr string, err error) error {
+	if ctx.Err() != nil {
+		return errors.Wrapf(ctx.Err(), "request to %s interrupted", addr)
+	}
+	return errors.WithStack(&CommError{Addr: addr, Err: err})
+}
+
+// resultError returns nil if result is OpsErrSuccess or result as an error otherwise.
+func resultError(result OpsErr) error {
+	if result == OpsErrSuccess {
+		return nil
+	}
+	return errors.WithStack(result)
+}
+
+// GetNodes returns all nodes of nodeType. For NodeTypeMeta, it also returns the ID of the metadata node (or metadata
+// buddy mirror group) that owns the root directory.
+func (c *Client) GetNodes(ctx context.Context, nodeType NodeType) (*GetNodesRespMsg, error) {
+	resp, err := c.request(ctx, c.mgmtdAddr, &GetNodesMsg{NodeType: nodeType}, MsgTypeGetNodesResp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*GetNodesRespMsg), nil
+}
+
+// GetMirrorBuddyGroups returns all buddy mirror groups of nodeType.
+func (c *Client) GetMirrorBuddyGroups(ctx context.Context, nodeType NodeType) ([]BuddyGroup, error) {
+	resp, err := c.request(ctx, c.mgmtdAddr, &GetMirrorBuddyGroupsMsg{NodeType: nodeType},
+		MsgTypeGetMirrorBuddyGroupsResp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*GetMirrorBuddyGroupsRespMsg).Groups, nil
+}
+
+// GetStorageTargetInfo returns the state and free space of all storage targets.
+func (c *Client) GetStorageTargetInfo(ctx context.Context) ([]TargetInfo, error) {
+	resp, err := c.request(ctx, c.mgmtdAddr, &GetStorageTargetInfoMsg{}, MsgTypeGetStorageTargetInfoResp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*GetStorageTargetInfoRespMsg).Targets, nil
+}
+
+// GetStoragePools returns all storage pools.
+func (c *Client) GetStoragePools(ctx context.Context) ([]StoragePool, error) {
+	resp, err := c.request(ctx, c.mgmtdAddr, &GetStoragePoolsMsg{}, MsgTypeGetStoragePoolsResp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*GetStoragePoolsRespMsg).Pools, nil
+}
+
+// GetQuotaInfo returns the quota usage and limits of each of ids in a storage pool.
+func (c *Client) GetQuotaInfo(ctx context.Context, idType QuotaIDType, ids []uint32,
+	storagePoolID uint16) ([]QuotaInfo, error) {
+	req := &GetQuotaInfoMsg{IDType: idType, IDs: ids, StoragePoolID: storagePoolID}
+	resp, err := c.request(ctx, c.mgmtdAddr, req, MsgTypeGetQuotaInfoResp)
+	if err != nil {
+		return nil, err
+	}
+	if err = resultError(resp.(*GetQuotaInfoRespMsg).Result); err != nil {
+		return nil, err
+	}
+	return resp.(*GetQuotaInfoRespMsg).Quotas, nil
+}
+
+// SetQuota sets the quota limits of a user or group in a storage pool.
+func (c *Client) SetQuota(ctx context.Context, req *SetQuotaMsg) error {
+	resp, err := c.request(ctx, c.mgmtdAddr, req, MsgTypeSetQuotaResp)
+	if err != nil {
+		return err
+	}
+	return resultError(resp.(*SetQuotaRespMsg).Result)
+}
+
+// MetaNode returns the metadata node that owns info (the current primary of its metadata buddy mirror group if its
+// metadata is buddy mirrored).
+func (c *Client) MetaNode(ctx context.Context, info EntryInfo) (Node, error) {
+	return c.metaNode(ctx, info.OwnerID, info.BuddyMirrored)
+}
+
+// metaNode returns the metadata node with ownerID or, if buddyMirrored, the current primary of the metadata buddy
+// mirror group with ownerID.
+func (c *Client) metaNode(ctx context.Context, ownerID uint32, buddyMirrored bool) (Node, error) {
+	nodeID := ownerID
+	if buddyMirrored {
+		groups, err := c.GetMirrorBuddyGroups(ctx, NodeTypeMeta)
+		if err != nil {
+			return Node{}, err
+		}
+		found := false
+		for _, group := range groups {
+			if uint32(group.ID) == ownerID {
+				nodeID, found = uint32(group.PrimaryID), true
+				break
+			}
+		}
+		if !found {
+			return Node{}, errors.Errorf("unknown metadata buddy mirror group %d", ownerID)
+		}
+	}
+	resp, err := c.GetNodes(ctx, NodeTypeMeta)
+	if err != nil {
+		return Node{}, err
+	}
+	for _, node := range resp.Nodes {
+		if node.NumID == nodeID {
+			if len(node.Addresses) == 0 {
+				return Node{}, errors.Errorf("metadata node %s [ID: %d] has no addresses", node.ID, node.NumID)
+			}
+			return node, nil
+		}
+	}
+	return Node{}, errors.Errorf("unknown metadata node %d", nodeID)
+}
+
+// metaRequest sends req to the metadata node returned by metaNode.
+func (c *Client) metaRequest(ctx context.Context, ownerID uint32, buddyMirrored bool, req Message,
+	respType uint16) (Message, error) {
+	node, err := c.metaNode(ctx, ownerID, buddyMirrored)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(node.Addresses[0], strconv.Itoa(int(node.PortTCP)))
+	return c.request(ctx, addr, req, respType)
+}
+
+// FindOwner returns the entry info of the entry at path (an absolute path from the root of the file system).
+func (c *Client) FindOwner(ctx context.Context, path string) (EntryInfo, error) {
+	nodes, err := c.GetNodes(ctx, NodeTypeMeta)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	resp, err := c.metaRequest(ctx, nodes.RootNumID, nodes.RootIsBuddyMirrored, &FindOwnerMsg{Path: path},
+		MsgTypeFindOwnerResp)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	if err = resultError(resp.(*FindOwnerRespMsg).Result); err != nil {
+		return EntryInfo{}, errors.WithMessagef(err, "cannot find %s", path)
+	}
+	return resp.(*FindOwnerRespMsg).Info, nil
+}
+
+// GetEntryInfo returns the stripe pattern of info.
+func (c *Client) GetEntryInfo(ctx context.Context, info EntryInfo) (StripePattern, error) {
+	resp, err := c.metaRequest(ctx, info.OwnerID, info.BuddyMirrored, &GetEntryInfoMsg{Info: info},
+		MsgTypeGetEntryInfoResp)
+	if err != nil {
+		return StripePattern{}, err
+	}
+	if err = resultError(resp.(*GetEntryInfoRespMsg).Result); err != nil {
+		return StripePattern{}, err
+	}
+	return resp.(*GetEntryInfoRespMsg).Pattern, nil
+}
+
+// MkDir creates the directory req describes and returns its entry info.
+func (c *Client) MkDir(ctx context.Context, req *MkDirMsg) (EntryInfo, error) {
+	resp, err := c.metaRequest(ctx, req.Parent.OwnerID, req.Parent.BuddyMirrored, req, MsgTypeMkDirResp)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	if err = resultError(resp.(*MkDirRespMsg).Result); err != nil {
+		return EntryInfo{}, err
+	}
+	return resp.(*MkDirRespMsg).Info, nil
+}
+
+// SetDirPattern replaces the stripe pattern of the directory info identifies.
+func (c *Client) SetDirPattern(ctx context.Context, info EntryInfo, pattern StripePattern) error {
+	resp, err := c.metaRequest(ctx, info.OwnerID, info.BuddyMirrored, &SetDirPatternMsg{Info: info, Pattern: pattern},
+		MsgTypeSetDirPatternResp)
+	if err != nil {
+		return err
+	}
+	return resultError(resp.(*SetDirPatternRespMsg).Result)
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2021 NetApp, Inc. All Rights Reserved.
+Licensed under the Apache License, Version 2.0.
+*/
+
+package beegfsproto
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// newTestServer starts a FakeServer for a test and returns it with a Client for it.
+func newTestServer(t *testing.T, serverConnAuth, clientConnAuth []byte) (*FakeServer, *Client) {
+	server, err := NewFakeServer(serverConnAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	return server, NewClient(server.Host(), server.Port(), clientConnAuth)
+}
+
+func TestClientDirectories(t *testing.T) {
+	server, client := newTestServer(t, nil, nil)
+	ctx := context.Background()
+
+	root, err := client.FindOwner(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := client.MkDir(ctx, &MkDirMsg{Parent: root, Name: "k8s", UserID: 1000, GroupID: 2000, Mode: 0o750})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.MkDir(ctx, &MkDirMsg{Parent: root, Name: "k8s"}); !errors.Is(err, OpsErrExists) {
+		t.Fatalf("expected %v, got %v", OpsErrExists, err)
+	}
+	found, err := client.FindOwner(ctx, "/k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, info) {
+		t.Fatalf("expected %+v, got %+v", info, found)
+	}
+	entry, _ := server.Entry("/k8s")
+	if entry.UserID != 1000 || entry.GroupID != 2000 || entry.Mode != 0o750 {
+		t.Fatalf("expected owner 1000:2000 and mode 750, got %d:%d and %o", entry.UserID, entry.GroupID, entry.Mode)
+	}
+	if _, err = client.FindOwner(ctx, "/k8s/pvc-1"); !errors.Is(err, OpsErrPathNotExists) {
+		t.Fatalf("expected %v, got %v", OpsErrPathNotExists, err)
+	}
+
+	pattern, err := client.GetEntryInfo(ctx, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPattern := StripePattern{Type: PatternTypeRAID0, ChunkSize: 512 << 10, StoragePoolID: 1, DefaultNumTargets: 4}
+	if !reflect.DeepEqual(pattern, wantPattern) {
+		t.Fatalf("expected inherited pattern %+v, got %+v", wantPattern, pattern)
+	}
+	pattern.ChunkSize, pattern.DefaultNumTargets = 1<<20, 2
+	if err = client.SetDirPattern(ctx, info, pattern); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.GetEntryInfo(ctx, info); err != nil || !reflect.DeepEqual(got, pattern) {
+		t.Fatalf("expected pattern %+v, got %+v (error %v)", pattern, got, err)
+	}
+	pattern.ChunkSize = 1000
+	if err = client.SetDirPattern(ctx, info, pattern); !errors.Is(err, OpsErrInval) {
+		t.Fatalf("expected %v, got %v", OpsErrInval, err)
+	}
+
+	server.FailRequests(MsgTypeMkDir, OpsErrUnknownTarget)
+	if _, err = client.MkDir(ctx, &MkDirMsg{Parent: info, Name: "pvc-1"}); !errors.Is(err, OpsErrUnknownTarget) {
+		t.Fatalf("expected %v, got %v", OpsErrUnknownTarget, err)
+	}
+}
+
+func TestClientMetadataMirroring(t *testing.T) {
+	server, client := newTestServer(t, nil, nil)
+	ctx := context.Background()
+	server.SetMirrorBuddyGroups(NodeTypeMeta, []BuddyGroup{{ID: 7, PrimaryID: 1, SecondaryID: 1}})
+	server.SetRootMetadataMirrored(7)
+
+	root, err := client.FindOwner(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.BuddyMirrored || root.OwnerID != 7 {
+		t.Fatalf("expected root owned by buddy group 7, got %+v", root)
+	}
+	mirrored, err := client.MkDir(ctx, &MkDirMsg{Parent: root, Name: "mirrored"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mirrored.BuddyMirrored || mirrored.OwnerID != 7 {
+		t.Fatalf("expected directory owned by buddy group 7, got %+v", mirrored)
+	}
+	unmirrored, err := client.MkDir(ctx, &MkDirMsg{Parent: root, Name: "unmirrored", NoMirror: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unmirrored.BuddyMirrored || unmirrored.OwnerID != fakeMetaNodeID {
+		t.Fatalf("expected directory owned by node %d, got %+v", fakeMetaNodeID, unmirrored)
+	}
+	node, err := client.MetaNode(ctx, mirrored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.ID != "meta01" || node.NumID != fakeMetaNodeID {
+		t.Fatalf("expected primary meta01 [ID: %d], got %s [ID: %d]", fakeMetaNodeID, node.ID, node.NumID)
+	}
+
+	server.SetMirrorBuddyGroups(NodeTypeMeta, nil)
+	if _, err = client.GetEntryInfo(ctx, mirrored); err == nil {
+		t.Fatal("expected error for unknown metadata buddy mirror group")
+	}
+}
+
+func TestClientManagement(t *testing.T) {
+	server, client := newTestServer(t, nil, nil)
+	ctx := context.Background()
+	targets := []TargetInfo{
+		{TargetID: 101, NodeID: 1, Path: "/data/storage", TotalBytes: 1 << 40, FreeBytes: 1 << 39},
+		{TargetID: 102, NodeID: 2, Reachability: ReachabilityOffline, Consistency: ConsistencyBad},
+	}
+	pools := []StoragePool{
+		{ID: 1, Description: "Default", TargetIDs: []uint16{101}},
+		{ID: 2, Description: "mirrored", TargetIDs: []uint16{102}, BuddyGroups: []uint16{1}},
+	}
+	groups := []BuddyGroup{{ID: 1, PrimaryID: 101, SecondaryID: 102}}
+	server.SetStorageTargets(targets)
+	server.SetStoragePools(pools)
+	server.SetMirrorBuddyGroups(NodeTypeStorage, groups)
+
+	if got, err := client.GetStorageTargetInfo(ctx); err != nil || !reflect.DeepEqual(got, targets) {
+		t.Fatalf("expected targets %+v, got %+v (error %v)", targets, got, err)
+	}
+	if got, err := client.GetStoragePools(ctx); err != nil || !reflect.DeepEqual(got, pools) {
+		t.Fatalf("expected pools %+v, got %+v (error %v)", pools, got, err)
+	}
+	if got, err := client.GetMirrorBuddyGroups(ctx, NodeTypeStorage); err != nil || !reflect.DeepEqual(got, groups) {
+		t.Fatalf("expected buddy groups %+v, got %+v (error %v)", groups, got, err)
+	}
+
+	server.SetQuota(QuotaIDTypeGroup, 2, QuotaInfo{ID: 1000, SizeUsed: 4096, InodesUsed: 1})
+	err := client.SetQuota(ctx, &SetQuotaMsg{IDType: QuotaIDTypeGroup, ID: 1000, StoragePoolID: 2, SizeLimit: 1 << 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas, err := client.GetQuotaInfo(ctx, QuotaIDTypeGroup, []uint32{1000, 1001}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantQuotas := []QuotaInfo{{ID: 1000, SizeUsed: 4096, SizeLimit: 1 << 30, InodesUsed: 1}, {ID: 1001}}
+	if !reflect.DeepEqual(quotas, wantQuotas) {
+		t.Fatalf("expected quotas %+v, got %+v", wantQuotas, quotas)
+	}
+	if quota := server.Quota(QuotaIDTypeGroup, 1, 1000); quota.SizeLimit != 0 {
+		t.Fatalf("expected no limit in storage pool 1, got %d", quota.SizeLimit)
+	}
+}
+
+func TestClientAuthentication(t *testing.T) {
+	tests := map[string]struct {
+		serverConnAuth []byte
+		clientConnAuth []byte
+		wantCommError  bool
+	}{
+		"no authentication": {},
+		"matching connAuthFile": {
+			serverConnAuth: []byte("secret\n"),
+			clientConnAuth: []byte("secret\n"),
+		},
+		"mismatched connAuthFile": {
+			serverConnAuth: []byte("secret\n"),
+			clientConnAuth: []byte("not the secret\n"),
+			wantCommError:  true,
+		},
+		"missing connAuthFile": {
+			serverConnAuth: []byte("secret\n"),
+			wantCommError:  true,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, client := newTestServer(t, tc.serverConnAuth, tc.clientConnAuth)
+			_, err := client.GetStoragePools(context.Background())
+			var commErr *CommError
+			if tc.wantCommError {
+				if !errors.As(err, &commErr) {
+					t.Fatalf("expected CommError, got %v", err)
+				}
+				if server.UnauthorizedCount() != 1 {
+					t.Fatalf("expected 1 unauthorized connection, got %d", server.UnauthorizedCount())
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestClientUnreachable(t *testing.T) {
+	server, client := newTestServer(t, nil, nil)
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.GetStoragePools(context.Background())
+	var commErr *CommError
+	if !errors.As(err, &commErr) {
+		t.Fatalf("expected CommError, got %v", err)
+	}
+}
+
+func TestClientContextEnds(t *testing.T) {
+	// This listener accepts connections but never responds.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	client := NewClient("127.0.0.1", uint16(listener.Addr().(*net.TCPAddr).Port), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.GetStoragePools(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
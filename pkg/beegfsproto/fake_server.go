@@ -0,0 +1,399 @@
+/*
+Copyright 2021 NetApp, Inc. All Rights Reserved.
+Licensed under the Apache License, Version 2.0.
+*/
+
+package beegfsproto
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// fakeMetaNodeID is the ID of the only metadata node a FakeServer reports. The FakeServer serves its requests itself.
+const fakeMetaNodeID = 1
+
+// FakeEntry is a directory on a FakeServer.
+type FakeEntry struct {
+	Info    EntryInfo
+	Pattern StripePattern
+	UserID  uint32
+	GroupID uint32
+	Mode    uint32
+}
+
+// fakeQuotaKey identifies the quota of a user or group in a storage pool on a FakeServer.
+type fakeQuotaKey struct {
+	idType        QuotaIDType
+	id            uint32
+	storagePoolID uint16
+}
+
+// FakeServer is a local stand-in for the management service and the metadata service of a BeeGFS file system for
+// tests. It keeps the directories, storage targets, storage pools, buddy mirror groups, and quotas of the file system
+// in memory. Its root directory has a RAID0 stripe pattern with a 512K chunk size and 4 targets in storage pool 1.
+type FakeServer struct {
+	listener net.Listener
+	authHash *uint64 // nil if the file system does not use a connAuthFile
+
+	mutex             sync.Mutex
+	entries           map[string]*FakeEntry // by path
+	paths             map[string]string     // by entry ID
+	nextEntryID       int
+	targets           []TargetInfo
+	pools             []StoragePool
+	buddyGroups       map[NodeType][]BuddyGroup
+	quotas            map[fakeQuotaKey]QuotaInfo
+	failures          map[uint16]OpsErr // requests of a type fail with the OpsErr
+	requestCounts     map[uint16]int
+	unauthorizedCount int
+	conns             map[net.Conn]struct{} // open connections, which Close closes
+	wg                sync.WaitGroup
+}
+
+// NewFakeServer starts a FakeServer on an ephemeral local port. connAuth is the contents of the connAuthFile the
+// FakeServer requires clients to authenticate with or nil if it does not require authentication.
+func NewFakeServer(connAuth []byte) (*FakeServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot listen for BeeGFS requests")
+	}
+	s := &FakeServer{
+		listener:      listener,
+		entries:       make(map[string]*FakeEntry),
+		paths:         make(map[string]string),
+		buddyGroups:   make(map[NodeType][]BuddyGroup),
+		quotas:        make(map[fakeQuotaKey]QuotaInfo),
+		failures:      make(map[uint16]OpsErr),
+		requestCounts: make(map[uint16]int),
+		conns:         make(map[net.Conn]struct{}),
+		pools:         []StoragePool{{ID: 1, Description: "Default"}},
+	}
+	if connAuth != nil {
+		hash := ConnAuthHash(connAuth)
+		s.authHash = &hash
+	}
+	root := &FakeEntry{
+		Info:    EntryInfo{OwnerID: fakeMetaNodeID, EntryID: "root", Type: EntryTypeDirectory},
+		Pattern: StripePattern{Type: PatternTypeRAID0, ChunkSize: 512 << 10, StoragePoolID: 1, DefaultNumTargets: 4},
+		Mode:    0o755,
+	}
+	s.entries["/"], s.paths["root"] = root, "/"
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Host returns the host a Client uses to reach the FakeServer.
+func (s *FakeServer) Host() string { return s.listener.Addr().(*net.TCPAddr).IP.String() }
+
+// Port returns the port a Client uses to reach the FakeServer.
+func (s *FakeServer) Port() uint16 { return uint16(s.listener.Addr().(*net.TCPAddr).Port) }
+
+// Close stops the FakeServer. Requests sent to it afterwards fail with a CommError.
+func (s *FakeServer) Close() error {
+	err := s.listener.Close()
+	s.mutex.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// SetStorageTargets replaces the storage targets of the file system.
+func (s *FakeServer) SetStorageTargets(targets []TargetInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.targets = targets
+}
+
+// SetStoragePools replaces the storage pools of the file system.
+func (s *FakeServer) SetStoragePools(pools []StoragePool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pools = pools
+}
+
+// SetMirrorBuddyGroups replaces the buddy mirror groups of nodeType. The primary (and secondary) of a metadata buddy
+// mirror group must be node 1, the FakeServer's only metadata node.
+func (s *FakeServer) SetMirrorBuddyGroups(nodeType NodeType, groups []BuddyGroup) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.buddyGroups[nodeType] = groups
+}
+
+// SetRootMetadataMirrored mirrors the metadata of the root directory (and of any directory created below it
+// afterwards without NoMirror) in the metadata buddy mirror group with groupID, which must have been set with
+// SetMirrorBuddyGroups.
+func (s *FakeServer) SetRootMetadataMirrored(groupID uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	root := s.entries["/"]
+	root.Info.OwnerID, root.Info.BuddyMirrored = uint32(groupID), true
+}
+
+// SetQuota sets the quota usage and limits of a user or group in a storage pool.
+func (s *FakeServer) SetQuota(idType QuotaIDType, storagePoolID uint16, quota QuotaInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.quotas[fakeQuotaKey{idType: idType, id: quota.ID, storagePoolID: storagePoolID}] = quota
+}
+
+// Quota returns the quota usage and limits of a user or group in a storage pool.
+func (s *FakeServer) Quota(idType QuotaIDType, storagePoolID uint16, id uint32) QuotaInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	quota, ok := s.quotas[fakeQuotaKey{idType: idType, id: id, storagePoolID: storagePoolID}]
+	if !ok {
+		quota.ID = id
+	}
+	return quota
+}
+
+// Entry returns the directory at path and true or false if there is no such directory.
+func (s *FakeServer) Entry(path string) (FakeEntry, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[path]
+	if !ok {
+		return FakeEntry{}, false
+	}
+	return *entry, true
+}
+
+// FailRequests makes every subsequent request of msgType fail with result. OpsErrSuccess makes them succeed again.
+// Requests of a type that does not report a result are not affected.
+func (s *FakeServer) FailRequests(msgType uint16, result OpsErr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if result == OpsErrSuccess {
+		delete(s.failures, msgType)
+	} else {
+		s.failures[msgType] = result
+	}
+}
+
+// RequestCount returns the number of requests of msgType the FakeServer has handled.
+func (s *FakeServer) RequestCount(msgType uint16) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requestCounts[msgType]
+}
+
+// UnauthorizedCount returns the number of connections the FakeServer closed because they did not authenticate.
+func (s *FakeServer) UnauthorizedCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.unauthorizedCount
+}
+
+// serve accepts connections until the FakeServer is closed.
+func (s *FakeServer) serve() {
+	defer s.wg.Done()
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			s.serveConn(conn)
+			_ = conn.Close()
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// serveConn handles the requests sent on conn until it is closed. It closes a connection without responding if the
+// FakeServer requires authentication and the first message is not an AuthenticateChannelMsg with the right hash.
+func (s *FakeServer) serveConn(conn net.Conn) {
+	authenticated := s.authHash == nil
+	for {
+		req, seq, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		if auth, ok := req.(*AuthenticateChannelMsg); ok {
+			authenticated = s.authHash != nil && auth.AuthHash == *s.authHash
+			continue
+		}
+		if !authenticated {
+			s.mutex.Lock()
+			s.unauthorizedCount++
+			s.mutex.Unlock()
+			return
+		}
+		resp := s.handle(req)
+		if resp == nil {
+			return
+		}
+		if err = writeMessage(conn, resp, seq); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response to req or nil if req is not a request the FakeServer handles.
+func (s *FakeServer) handle(req Message) Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requestCounts[req.MsgType()]++
+	failure := s.failures[req.MsgType()]
+
+	switch req := req.(type) {
+	case *GetNodesMsg:
+		resp := &GetNodesRespMsg{}
+		if req.NodeType == NodeTypeMeta {
+			resp.Nodes = []Node{{ID: "meta01", NumID: fakeMetaNodeID, Type: NodeTypeMeta, PortTCP: s.Port(),
+				Addresses: []string{s.Host()}}}
+			resp.RootNumID, resp.RootIsBuddyMirrored = s.entries["/"].Info.OwnerID, s.entries["/"].Info.BuddyMirrored
+		}
+		return resp
+	case *GetMirrorBuddyGroupsMsg:
+		return &GetMirrorBuddyGroupsRespMsg{Groups: s.buddyGroups[req.NodeType]}
+	case *GetStorageTargetInfoMsg:
+		return &GetStorageTargetInfoRespMsg{Targets: s.targets}
+	case *GetStoragePoolsMsg:
+		return &GetStoragePoolsRespMsg{Pools: s.pools}
+	case *FindOwnerMsg:
+		if failure != OpsErrSuccess {
+			return &FindOwnerRespMsg{Result: failure}
+		}
+		entry, ok := s.entries[path.Clean(req.Path)]
+		if !ok {
+			return &FindOwnerRespMsg{Result: OpsErrPathNotExists}
+		}
+		return &FindOwnerRespMsg{Info: entry.Info}
+	case *GetEntryInfoMsg:
+		if failure != OpsErrSuccess {
+			return &GetEntryInfoRespMsg{Result: failure}
+		}
+		entry, result := s.entryByInfo(req.Info)
+		if result != OpsErrSuccess {
+			return &GetEntryInfoRespMsg{Result: result}
+		}
+		return &GetEntryInfoRespMsg{Pattern: entry.Pattern}
+	case *MkDirMsg:
+		if failure != OpsErrSuccess {
+			return &MkDirRespMsg{Result: failure}
+		}
+		info, result := s.mkDir(req)
+		return &MkDirRespMsg{Result: result, Info: info}
+	case *SetDirPatternMsg:
+		if failure != OpsErrSuccess {
+			return &SetDirPatternRespMsg{Result: failure}
+		}
+		return &SetDirPatternRespMsg{Result: s.setDirPattern(req)}
+	case *GetQuotaInfoMsg:
+		if failure != OpsErrSuccess {
+			return &GetQuotaInfoRespMsg{Result: failure}
+		}
+		resp := &GetQuotaInfoRespMsg{}
+		for _, id := range req.IDs {
+			quota, ok := s.quotas[fakeQuotaKey{idType: req.IDType, id: id, storagePoolID: req.StoragePoolID}]
+			if !ok {
+				quota.ID = id
+			}
+			resp.Quotas = append(resp.Quotas, quota)
+		}
+		return resp
+	case *SetQuotaMsg:
+		if failure != OpsErrSuccess {
+			return &SetQuotaRespMsg{Result: failure}
+		}
+		key := fakeQuotaKey{idType: req.IDType, id: req.ID, storagePoolID: req.StoragePoolID}
+		quota := s.quotas[key]
+		quota.ID, quota.SizeLimit, quota.InodesLimit = req.ID, req.SizeLimit, req.InodesLimit
+		s.quotas[key] = quota
+		return &SetQuotaRespMsg{}
+	}
+	return nil
+}
+
+// entryByInfo returns the directory info identifies. The caller must hold s.mutex.
+func (s *FakeServer) entryByInfo(info EntryInfo) (*FakeEntry, OpsErr) {
+	entryPath, ok := s.paths[info.EntryID]
+	if !ok {
+		return nil, OpsErrPathNotExists
+	}
+	entry := s.entries[entryPath]
+	if entry.Info.OwnerID != info.OwnerID || entry.Info.BuddyMirrored != info.BuddyMirrored {
+		return nil, OpsErrInval // A metadata service only handles requests for the entries it owns.
+	}
+	return entry, OpsErrSuccess
+}
+
+// mkDir creates the directory req describes. The caller must hold s.mutex.
+func (s *FakeServer) mkDir(req *MkDirMsg) (EntryInfo, OpsErr) {
+	parent, result := s.entryByInfo(req.Parent)
+	if result != OpsErrSuccess {
+		return EntryInfo{}, result
+	}
+	if req.Name == "" || req.Name == "." || req.Name == ".." || strings.Contains(req.Name, "/") {
+		return EntryInfo{}, OpsErrInval
+	}
+	parentPath := s.paths[parent.Info.EntryID]
+	entryPath := path.Join(parentPath, req.Name)
+	if _, ok := s.entries[entryPath]; ok {
+		return EntryInfo{}, OpsErrExists
+	}
+	s.nextEntryID++
+	entry := &FakeEntry{
+		Info: EntryInfo{
+			OwnerID:       parent.Info.OwnerID,
+			ParentEntryID: parent.Info.EntryID,
+			EntryID:       fmt.Sprintf("%X-5F8D7E1B-1", s.nextEntryID),
+			FileName:      req.Name,
+			Type:          EntryTypeDirectory,
+			BuddyMirrored: parent.Info.BuddyMirrored,
+		},
+		Pattern: parent.Pattern,
+		UserID:  req.UserID,
+		GroupID: req.GroupID,
+		Mode:    req.Mode,
+	}
+	entry.Pattern.TargetIDs = nil
+	if entry.Info.BuddyMirrored && req.NoMirror {
+		entry.Info.OwnerID, entry.Info.BuddyMirrored = fakeMetaNodeID, false
+	}
+	s.entries[entryPath], s.paths[entry.Info.EntryID] = entry, entryPath
+	return entry.Info, OpsErrSuccess
+}
+
+// setDirPattern replaces the stripe pattern of the directory req identifies. The caller must hold s.mutex.
+func (s *FakeServer) setDirPattern(req *SetDirPatternMsg) OpsErr {
+	entry, result := s.entryByInfo(req.Info)
+	if result != OpsErrSuccess {
+		return result
+	}
+	if req.Pattern.Type != PatternTypeRAID0 && req.Pattern.Type != PatternTypeBuddyMirror {
+		return OpsErrInval
+	}
+	if req.Pattern.ChunkSize < 64<<10 || req.Pattern.ChunkSize&(req.Pattern.ChunkSize-1) != 0 {
+		return OpsErrInval // BeeGFS requires a power of two chunk size of at least 64K.
+	}
+	poolFound := false
+	for _, pool := range s.pools {
+		poolFound = poolFound || pool.ID == req.Pattern.StoragePoolID
+	}
+	if !poolFound {
+		return OpsErrInval
+	}
+	entry.Pattern = req.Pattern
+	return OpsErrSuccess
+}
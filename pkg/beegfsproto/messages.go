@@ -0,0 +1,771 @@
+/*
+Copyright 2021 NetApp, Inc. All Rights Reserved.
+Licensed under the Apache License, Version 2.0.
+*/
+
+// Package beegfsproto implements the subset of the BeeGFS management (mgmtd) and metadata (meta) network protocol the
+// driver needs to create directories, get their entry info, set their stripe patterns, list storage targets, storage
+// pools, and buddy mirror groups, and get and set quotas without running beegfs-ctl.
+//
+// The message type numbers and layouts, the result codes (OpsErr), and the connAuthFile hash (ConnAuthHash) are
+// modelled on BeeGFS 7, but they have only been tested against FakeServer, not against BeeGFS services. Check them
+// against the sources of the BeeGFS release in use before talking to a real file system with Client.
+package beegfsproto
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Message types.
+const (
+	MsgTypeGetNodes                 uint16 = 1017
+	MsgTypeGetNodesResp             uint16 = 1018
+	MsgTypeGetMirrorBuddyGroups     uint16 = 1047
+	MsgTypeGetMirrorBuddyGroupsResp uint16 = 1048
+	MsgTypeGetStorageTargetInfo     uint16 = 1055
+	MsgTypeGetStorageTargetInfoResp uint16 = 1056
+	MsgTypeGetStoragePools          uint16 = 1065
+	MsgTypeGetStoragePoolsResp      uint16 = 1066
+	MsgTypeMkDir                    uint16 = 2007
+	MsgTypeMkDirResp                uint16 = 2008
+	MsgTypeFindOwner                uint16 = 2031
+	MsgTypeFindOwnerResp            uint16 = 2032
+	MsgTypeGetEntryInfo             uint16 = 2039
+	MsgTypeGetEntryInfoResp         uint16 = 2040
+	MsgTypeSetDirPattern            uint16 = 2041
+	MsgTypeSetDirPatternResp        uint16 = 2042
+	MsgTypeGetQuotaInfo             uint16 = 2097
+	MsgTypeGetQuotaInfoResp         uint16 = 2098
+	MsgTypeSetQuota                 uint16 = 2099
+	MsgTypeSetQuotaResp             uint16 = 2100
+	MsgTypeAuthenticateChannel      uint16 = 4007
+)
+
+// headerLength is the length of the header that precedes every message.
+const headerLength = 40
+
+// maxMessageLength limits the length of a message (including its header) a peer can make us read.
+const maxMessageLength = 64 << 20
+
+// msgPrefix identifies a BeeGFS message.
+var msgPrefix = [8]byte{'B', 'G', 'F', 'S', 0, 0, 0, 0}
+
+// header precedes every message. It is serialized as the uint32 length of the message (including the header), uint16
+// feature flags, uint8 compatibility feature flags, uint8 flags, msgPrefix, and the remaining fields in order.
+type header struct {
+	length       uint32
+	msgType      uint16
+	targetID     uint16 // 0 for a message to a node rather than one of its targets
+	userID       uint32
+	seq          uint64
+	seqDone      uint64
+	featureFlags uint16
+}
+
+func (h header) serialize() []byte {
+	b := make([]byte, headerLength)
+	binary.LittleEndian.PutUint32(b[0:], h.length)
+	binary.LittleEndian.PutUint16(b[4:], h.featureFlags)
+	// b[6] (compatibility feature flags) and b[7] (flags) are always 0.
+	copy(b[8:16], msgPrefix[:])
+	binary.LittleEndian.PutUint16(b[16:], h.msgType)
+	binary.LittleEndian.PutUint16(b[18:], h.targetID)
+	binary.LittleEndian.PutUint32(b[20:], h.userID)
+	binary.LittleEndian.PutUint64(b[24:], h.seq)
+	binary.LittleEndian.PutUint64(b[32:], h.seqDone)
+	return b
+}
+
+func deserializeHeader(b []byte) (header, error) {
+	var h header
+	if len(b) != headerLength {
+		return h, errors.Errorf("message header of %d bytes", len(b))
+	}
+	var prefix [8]byte
+	copy(prefix[:], b[8:16])
+	if prefix != msgPrefix {
+		return h, errors.Errorf("unexpected message prefix %q", prefix[:])
+	}
+	h.length = binary.LittleEndian.Uint32(b[0:])
+	h.featureFlags = binary.LittleEndian.Uint16(b[4:])
+	h.msgType = binary.LittleEndian.Uint16(b[16:])
+	h.targetID = binary.LittleEndian.Uint16(b[18:])
+	h.userID = binary.LittleEndian.Uint32(b[20:])
+	h.seq = binary.LittleEndian.Uint64(b[24:])
+	h.seqDone = binary.LittleEndian.Uint64(b[32:])
+	if h.length < headerLength || h.length > maxMessageLength {
+		return h, errors.Errorf("unexpected message length %d", h.length)
+	}
+	return h, nil
+}
+
+// Message is a BeeGFS network message.
+type Message interface {
+	MsgType() uint16
+	serialize(e *encoder)
+	deserialize(d *decoder)
+}
+
+// newMessage returns an empty Message of msgType or nil if msgType is not implemented.
+func newMessage(msgType uint16) Message {
+	switch msgType {
+	case MsgTypeAuthenticateChannel:
+		return &AuthenticateChannelMsg{}
+	case MsgTypeGetNodes:
+		return &GetNodesMsg{}
+	case MsgTypeGetNodesResp:
+		return &GetNodesRespMsg{}
+	case MsgTypeGetMirrorBuddyGroups:
+		return &GetMirrorBuddyGroupsMsg{}
+	case MsgTypeGetMirrorBuddyGroupsResp:
+		return &GetMirrorBuddyGroupsRespMsg{}
+	case MsgTypeGetStorageTargetInfo:
+		return &GetStorageTargetInfoMsg{}
+	case MsgTypeGetStorageTargetInfoResp:
+		return &GetStorageTargetInfoRespMsg{}
+	case MsgTypeGetStoragePools:
+		return &GetStoragePoolsMsg{}
+	case MsgTypeGetStoragePoolsResp:
+		return &GetStoragePoolsRespMsg{}
+	case MsgTypeMkDir:
+		return &MkDirMsg{}
+	case MsgTypeMkDirResp:
+		return &MkDirRespMsg{}
+	case MsgTypeFindOwner:
+		return &FindOwnerMsg{}
+	case MsgTypeFindOwnerResp:
+		return &FindOwnerRespMsg{}
+	case MsgTypeGetEntryInfo:
+		return &GetEntryInfoMsg{}
+	case MsgTypeGetEntryInfoResp:
+		return &GetEntryInfoRespMsg{}
+	case MsgTypeSetDirPattern:
+		return &SetDirPatternMsg{}
+	case MsgTypeSetDirPatternResp:
+		return &SetDirPatternRespMsg{}
+	case MsgTypeGetQuotaInfo:
+		return &GetQuotaInfoMsg{}
+	case MsgTypeGetQuotaInfoResp:
+		return &GetQuotaInfoRespMsg{}
+	case MsgTypeSetQuota:
+		return &SetQuotaMsg{}
+	case MsgTypeSetQuotaResp:
+		return &SetQuotaRespMsg{}
+	}
+	return nil
+}
+
+// writeMessage serializes msg with seq as its sequence number and writes it to w.
+func writeMessage(w io.Writer, msg Message, seq uint64) error {
+	var body encoder
+	msg.serialize(&body)
+	h := header{length: uint32(headerLength + body.buf.Len()), msgType: msg.MsgType(), seq: seq}
+	_, err := w.Write(append(h.serialize(), body.buf.Bytes()...))
+	return err
+}
+
+// readMessage reads a message from r and returns it with its sequence number.
+func readMessage(r io.Reader) (Message, uint64, error) {
+	b := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, err
+	}
+	h, err := deserializeHeader(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	b = make([]byte, h.length-headerLength)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, errors.Wrapf(err, "cannot read message of type %d", h.msgType)
+	}
+	msg := newMessage(h.msgType)
+	if msg == nil {
+		return nil, 0, errors.Errorf("unsupported message type %d", h.msgType)
+	}
+	d := decoder{buf: b}
+	msg.deserialize(&d)
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = errors.Errorf("%d unexpected bytes", len(d.buf))
+	}
+	if d.err != nil {
+		return nil, 0, errors.WithMessagef(d.err, "cannot deserialize message of type %d", h.msgType)
+	}
+	return msg, h.seq, nil
+}
+
+// NodeType is the type of a BeeGFS node.
+type NodeType uint8
+
+const (
+	NodeTypeMeta    NodeType = 1
+	NodeTypeStorage NodeType = 2
+)
+
+// Node is a BeeGFS node as the management service reports it.
+type Node struct {
+	ID        string // the node's alias, e.g. meta01
+	NumID     uint32
+	Type      NodeType
+	PortTCP   uint16
+	Addresses []string // IP addresses
+}
+
+func (n *Node) serialize(e *encoder) {
+	e.str(n.ID)
+	e.u32(n.NumID)
+	e.u8(uint8(n.Type))
+	e.u16(n.PortTCP)
+	e.list(len(n.Addresses), func(i int) { e.str(n.Addresses[i]) })
+}
+
+func (n *Node) deserialize(d *decoder) {
+	n.ID = d.str()
+	n.NumID = d.u32()
+	n.Type = NodeType(d.u8())
+	n.PortTCP = d.u16()
+	d.list(func() { n.Addresses = append(n.Addresses, d.str()) })
+}
+
+// EntryType is the type of a file system entry.
+type EntryType uint32
+
+const (
+	EntryTypeDirectory   EntryType = 1
+	EntryTypeRegularFile EntryType = 2
+)
+
+// entryInfoFlagBuddyMirrored is set in the serialized feature flags of an EntryInfo with buddy mirrored metadata.
+const entryInfoFlagBuddyMirrored = 1 << 2
+
+// EntryInfo identifies a file system entry and the metadata node (or metadata buddy mirror group) that owns it.
+type EntryInfo struct {
+	OwnerID       uint32 // a metadata node ID or, if BuddyMirrored, a metadata buddy mirror group ID
+	ParentEntryID string
+	EntryID       string
+	FileName      string
+	Type          EntryType
+	BuddyMirrored bool
+}
+
+func (info *EntryInfo) serialize(e *encoder) {
+	var flags uint32
+	if info.BuddyMirrored {
+		flags |= entryInfoFlagBuddyMirrored
+	}
+	e.u32(info.OwnerID)
+	e.str(info.ParentEntryID)
+	e.str(info.EntryID)
+	e.str(info.FileName)
+	e.u32(uint32(info.Type))
+	e.u32(flags)
+}
+
+func (info *EntryInfo) deserialize(d *decoder) {
+	info.OwnerID = d.u32()
+	info.ParentEntryID = d.str()
+	info.EntryID = d.str()
+	info.FileName = d.str()
+	info.Type = EntryType(d.u32())
+	info.BuddyMirrored = d.u32()&entryInfoFlagBuddyMirrored != 0
+}
+
+// PatternType is the type of a stripe pattern.
+type PatternType uint32
+
+const (
+	PatternTypeRAID0       PatternType = 1
+	PatternTypeBuddyMirror PatternType = 3
+)
+
+// StripePattern describes how the files in a directory are striped across storage targets.
+type StripePattern struct {
+	Type              PatternType
+	ChunkSize         uint32 // bytes
+	StoragePoolID     uint16
+	DefaultNumTargets uint32   // the desired number of storage targets (or buddy mirror groups) per file
+	TargetIDs         []uint16 // storage target (or buddy mirror group) IDs; empty for a directory
+}
+
+func (p *StripePattern) serialize(e *encoder) {
+	e.u32(uint32(p.Type))
+	e.u32(p.ChunkSize)
+	e.u16(p.StoragePoolID)
+	e.u32(p.DefaultNumTargets)
+	e.u16List(p.TargetIDs)
+}
+
+func (p *StripePattern) deserialize(d *decoder) {
+	p.Type = PatternType(d.u32())
+	p.ChunkSize = d.u32()
+	p.StoragePoolID = d.u16()
+	p.DefaultNumTargets = d.u32()
+	p.TargetIDs = d.u16List()
+}
+
+// Reachability is the reachability state of a target.
+type Reachability uint8
+
+const (
+	ReachabilityOnline          Reachability = 0
+	ReachabilityProbablyOffline Reachability = 1
+	ReachabilityOffline         Reachability = 2
+)
+
+// Consistency is the consistency state of a target.
+type Consistency uint8
+
+const (
+	ConsistencyGood        Consistency = 0
+	ConsistencyNeedsResync Consistency = 1
+	ConsistencyBad         Consistency = 2
+)
+
+// TargetInfo is the state and free space of a storage target.
+type TargetInfo struct {
+	TargetID     uint16
+	NodeID       uint32
+	Path         string
+	TotalBytes   int64
+	FreeBytes    int64
+	TotalInodes  int64
+	FreeInodes   int64
+	Reachability Reachability
+	Consistency  Consistency
+}
+
+func (t *TargetInfo) serialize(e *encoder) {
+	e.u16(t.TargetID)
+	e.u32(t.NodeID)
+	e.str(t.Path)
+	e.i64(t.TotalBytes)
+	e.i64(t.FreeBytes)
+	e.i64(t.TotalInodes)
+	e.i64(t.FreeInodes)
+	e.u8(uint8(t.Reachability))
+	e.u8(uint8(t.Consistency))
+}
+
+func (t *TargetInfo) deserialize(d *decoder) {
+	t.TargetID = d.u16()
+	t.NodeID = d.u32()
+	t.Path = d.str()
+	t.TotalBytes = d.i64()
+	t.FreeBytes = d.i64()
+	t.TotalInodes = d.i64()
+	t.FreeInodes = d.i64()
+	t.Reachability = Reachability(d.u8())
+	t.Consistency = Consistency(d.u8())
+}
+
+// StoragePool is a storage pool and its members.
+type StoragePool struct {
+	ID          uint16
+	Description string
+	TargetIDs   []uint16
+	BuddyGroups []uint16
+}
+
+func (p *StoragePool) serialize(e *encoder) {
+	e.u16(p.ID)
+	e.str(p.Description)
+	e.u16List(p.TargetIDs)
+	e.u16List(p.BuddyGroups)
+}
+
+func (p *StoragePool) deserialize(d *decoder) {
+	p.ID = d.u16()
+	p.Description = d.str()
+	p.TargetIDs = d.u16List()
+	p.BuddyGroups = d.u16List()
+}
+
+// BuddyGroup is a buddy mirror group. PrimaryID and SecondaryID are storage target IDs for a storage buddy mirror group
+// and node IDs for a metadata buddy mirror group.
+type BuddyGroup struct {
+	ID          uint16
+	PrimaryID   uint16
+	SecondaryID uint16
+}
+
+// QuotaIDType is the type of ID (user or group) a quota applies to.
+type QuotaIDType uint32
+
+const (
+	QuotaIDTypeUser  QuotaIDType = 1
+	QuotaIDTypeGroup QuotaIDType = 2
+)
+
+// QuotaInfo is the quota usage and limits of a single user or group in a single storage pool. A limit of 0 indicates
+// that no limit is set.
+type QuotaInfo struct {
+	ID          uint32
+	SizeUsed    uint64 // bytes
+	SizeLimit   uint64 // bytes
+	InodesUsed  uint64
+	InodesLimit uint64
+}
+
+func (q *QuotaInfo) serialize(e *encoder) {
+	e.u32(q.ID)
+	e.u64(q.SizeUsed)
+	e.u64(q.SizeLimit)
+	e.u64(q.InodesUsed)
+	e.u64(q.InodesLimit)
+}
+
+func (q *QuotaInfo) deserialize(d *decoder) {
+	q.ID = d.u32()
+	q.SizeUsed = d.u64()
+	q.SizeLimit = d.u64()
+	q.InodesUsed = d.u64()
+	q.InodesLimit = d.u64()
+}
+
+// AuthenticateChannelMsg is the first message a client sends on a connection to a file system that uses a connAuthFile.
+// It has no response.
+type AuthenticateChannelMsg struct {
+	AuthHash uint64 // see ConnAuthHash
+}
+
+func (m *AuthenticateChannelMsg) MsgType() uint16        { return MsgTypeAuthenticateChannel }
+func (m *AuthenticateChannelMsg) serialize(e *encoder)   { e.u64(m.AuthHash) }
+func (m *AuthenticateChannelMsg) deserialize(d *decoder) { m.AuthHash = d.u64() }
+
+// GetNodesMsg asks the management service for all nodes of a type.
+type GetNodesMsg struct {
+	NodeType NodeType
+}
+
+func (m *GetNodesMsg) MsgType() uint16        { return MsgTypeGetNodes }
+func (m *GetNodesMsg) serialize(e *encoder)   { e.u8(uint8(m.NodeType)) }
+func (m *GetNodesMsg) deserialize(d *decoder) { m.NodeType = NodeType(d.u8()) }
+
+// GetNodesRespMsg responds to a GetNodesMsg. RootNumID and RootIsBuddyMirrored identify the owner of the root
+// directory in a response for NodeTypeMeta.
+type GetNodesRespMsg struct {
+	Nodes               []Node
+	RootNumID           uint32
+	RootIsBuddyMirrored bool
+}
+
+func (m *GetNodesRespMsg) MsgType() uint16 { return MsgTypeGetNodesResp }
+
+func (m *GetNodesRespMsg) serialize(e *encoder) {
+	e.list(len(m.Nodes), func(i int) { m.Nodes[i].serialize(e) })
+	e.u32(m.RootNumID)
+	e.bool(m.RootIsBuddyMirrored)
+}
+
+func (m *GetNodesRespMsg) deserialize(d *decoder) {
+	d.list(func() {
+		var n Node
+		n.deserialize(d)
+		m.Nodes = append(m.Nodes, n)
+	})
+	m.RootNumID = d.u32()
+	m.RootIsBuddyMirrored = d.bool()
+}
+
+// GetMirrorBuddyGroupsMsg asks the management service for all buddy mirror groups of a type.
+type GetMirrorBuddyGroupsMsg struct {
+	NodeType NodeType
+}
+
+func (m *GetMirrorBuddyGroupsMsg) MsgType() uint16        { return MsgTypeGetMirrorBuddyGroups }
+func (m *GetMirrorBuddyGroupsMsg) serialize(e *encoder)   { e.u8(uint8(m.NodeType)) }
+func (m *GetMirrorBuddyGroupsMsg) deserialize(d *decoder) { m.NodeType = NodeType(d.u8()) }
+
+// GetMirrorBuddyGroupsRespMsg responds to a GetMirrorBuddyGroupsMsg. It is serialized as parallel lists of group,
+// primary, and secondary IDs.
+type GetMirrorBuddyGroupsRespMsg struct {
+	Groups []BuddyGroup
+}
+
+func (m *GetMirrorBuddyGroupsRespMsg) MsgType() uint16 { return MsgTypeGetMirrorBuddyGroupsResp }
+
+func (m *GetMirrorBuddyGroupsRespMsg) serialize(e *encoder) {
+	var ids, primaries, secondaries []uint16
+	for _, g := range m.Groups {
+		ids, primaries, secondaries = append(ids, g.ID), append(primaries, g.PrimaryID), append(secondaries, g.SecondaryID)
+	}
+	e.u16List(ids)
+	e.u16List(primaries)
+	e.u16List(secondaries)
+}
+
+func (m *GetMirrorBuddyGroupsRespMsg) deserialize(d *decoder) {
+	ids, primaries, secondaries := d.u16List(), d.u16List(), d.u16List()
+	if d.err == nil && (len(primaries) != len(ids) || len(secondaries) != len(ids)) {
+		d.err = errors.Errorf("%d buddy groups with %d primaries and %d secondaries", len(ids), len(primaries),
+			len(secondaries))
+		return
+	}
+	for i := range ids {
+		m.Groups = append(m.Groups, BuddyGroup{ID: ids[i], PrimaryID: primaries[i], SecondaryID: secondaries[i]})
+	}
+}
+
+// GetStorageTargetInfoMsg asks the management service for the state and free space of all storage targets.
+type GetStorageTargetInfoMsg struct{}
+
+func (m *GetStorageTargetInfoMsg) MsgType() uint16        { return MsgTypeGetStorageTargetInfo }
+func (m *GetStorageTargetInfoMsg) serialize(e *encoder)   {}
+func (m *GetStorageTargetInfoMsg) deserialize(d *decoder) {}
+
+// GetStorageTargetInfoRespMsg responds to a GetStorageTargetInfoMsg.
+type GetStorageTargetInfoRespMsg struct {
+	Targets []TargetInfo
+}
+
+func (m *GetStorageTargetInfoRespMsg) MsgType() uint16 { return MsgTypeGetStorageTargetInfoResp }
+
+func (m *GetStorageTargetInfoRespMsg) serialize(e *encoder) {
+	e.list(len(m.Targets), func(i int) { m.Targets[i].serialize(e) })
+}
+
+func (m *GetStorageTargetInfoRespMsg) deserialize(d *decoder) {
+	d.list(func() {
+		var t TargetInfo
+		t.deserialize(d)
+		m.Targets = append(m.Targets, t)
+	})
+}
+
+// GetStoragePoolsMsg asks the management service for all storage pools.
+type GetStoragePoolsMsg struct{}
+
+func (m *GetStoragePoolsMsg) MsgType() uint16        { return MsgTypeGetStoragePools }
+func (m *GetStoragePoolsMsg) serialize(e *encoder)   {}
+func (m *GetStoragePoolsMsg) deserialize(d *decoder) {}
+
+// GetStoragePoolsRespMsg responds to a GetStoragePoolsMsg.
+type GetStoragePoolsRespMsg struct {
+	Pools []StoragePool
+}
+
+func (m *GetStoragePoolsRespMsg) MsgType() uint16 { return MsgTypeGetStoragePoolsResp }
+
+func (m *GetStoragePoolsRespMsg) serialize(e *encoder) {
+	e.list(len(m.Pools), func(i int) { m.Pools[i].serialize(e) })
+}
+
+func (m *GetStoragePoolsRespMsg) deserialize(d *decoder) {
+	d.list(func() {
+		var p StoragePool
+		p.deserialize(d)
+		m.Pools = append(m.Pools, p)
+	})
+}
+
+// FindOwnerMsg asks the metadata service that owns the root directory for the entry info of a path.
+type FindOwnerMsg struct {
+	Path string // absolute path from the root of the file system
+}
+
+func (m *FindOwnerMsg) MsgType() uint16        { return MsgTypeFindOwner }
+func (m *FindOwnerMsg) serialize(e *encoder)   { e.str(m.Path) }
+func (m *FindOwnerMsg) deserialize(d *decoder) { m.Path = d.str() }
+
+// FindOwnerRespMsg responds to a FindOwnerMsg.
+type FindOwnerRespMsg struct {
+	Result OpsErr
+	Info   EntryInfo
+}
+
+func (m *FindOwnerRespMsg) MsgType() uint16 { return MsgTypeFindOwnerResp }
+
+func (m *FindOwnerRespMsg) serialize(e *encoder) {
+	e.u32(uint32(m.Result))
+	m.Info.serialize(e)
+}
+
+func (m *FindOwnerRespMsg) deserialize(d *decoder) {
+	m.Result = OpsErr(d.u32())
+	m.Info.deserialize(d)
+}
+
+// GetEntryInfoMsg asks the owner of an entry for its stripe pattern.
+type GetEntryInfoMsg struct {
+	Info EntryInfo
+}
+
+func (m *GetEntryInfoMsg) MsgType() uint16        { return MsgTypeGetEntryInfo }
+func (m *GetEntryInfoMsg) serialize(e *encoder)   { m.Info.serialize(e) }
+func (m *GetEntryInfoMsg) deserialize(d *decoder) { m.Info.deserialize(d) }
+
+// GetEntryInfoRespMsg responds to a GetEntryInfoMsg.
+type GetEntryInfoRespMsg struct {
+	Result  OpsErr
+	Pattern StripePattern
+}
+
+func (m *GetEntryInfoRespMsg) MsgType() uint16 { return MsgTypeGetEntryInfoResp }
+
+func (m *GetEntryInfoRespMsg) serialize(e *encoder) {
+	e.u32(uint32(m.Result))
+	m.Pattern.serialize(e)
+}
+
+func (m *GetEntryInfoRespMsg) deserialize(d *decoder) {
+	m.Result = OpsErr(d.u32())
+	m.Pattern.deserialize(d)
+}
+
+// MkDirMsg asks the owner of a directory to create a subdirectory. The subdirectory inherits the stripe pattern of its
+// parent and, unless NoMirror is set, its metadata mirroring.
+type MkDirMsg struct {
+	Parent   EntryInfo
+	Name     string
+	UserID   uint32
+	GroupID  uint32
+	Mode     uint32
+	NoMirror bool
+}
+
+func (m *MkDirMsg) MsgType() uint16 { return MsgTypeMkDir }
+
+func (m *MkDirMsg) serialize(e *encoder) {
+	m.Parent.serialize(e)
+	e.str(m.Name)
+	e.u32(m.UserID)
+	e.u32(m.GroupID)
+	e.u32(m.Mode)
+	e.bool(m.NoMirror)
+}
+
+func (m *MkDirMsg) deserialize(d *decoder) {
+	m.Parent.deserialize(d)
+	m.Name = d.str()
+	m.UserID = d.u32()
+	m.GroupID = d.u32()
+	m.Mode = d.u32()
+	m.NoMirror = d.bool()
+}
+
+// MkDirRespMsg responds to a MkDirMsg.
+type MkDirRespMsg struct {
+	Result OpsErr
+	Info   EntryInfo // the new directory
+}
+
+func (m *MkDirRespMsg) MsgType() uint16 { return MsgTypeMkDirResp }
+
+func (m *MkDirRespMsg) serialize(e *encoder) {
+	e.u32(uint32(m.Result))
+	m.Info.serialize(e)
+}
+
+func (m *MkDirRespMsg) deserialize(d *decoder) {
+	m.Result = OpsErr(d.u32())
+	m.Info.deserialize(d)
+}
+
+// SetDirPatternMsg asks the owner of a directory to replace its stripe pattern.
+type SetDirPatternMsg struct {
+	Info    EntryInfo
+	Pattern StripePattern
+}
+
+func (m *SetDirPatternMsg) MsgType() uint16 { return MsgTypeSetDirPattern }
+
+func (m *SetDirPatternMsg) serialize(e *encoder) {
+	m.Info.serialize(e)
+	m.Pattern.serialize(e)
+}
+
+func (m *SetDirPatternMsg) deserialize(d *decoder) {
+	m.Info.deserialize(d)
+	m.Pattern.deserialize(d)
+}
+
+// SetDirPatternRespMsg responds to a SetDirPatternMsg.
+type SetDirPatternRespMsg struct {
+	Result OpsErr
+}
+
+func (m *SetDirPatternRespMsg) MsgType() uint16        { return MsgTypeSetDirPatternResp }
+func (m *SetDirPatternRespMsg) serialize(e *encoder)   { e.u32(uint32(m.Result)) }
+func (m *SetDirPatternRespMsg) deserialize(d *decoder) { m.Result = OpsErr(d.u32()) }
+
+// GetQuotaInfoMsg asks the management service for the quota usage and limits of users or groups in a storage pool.
+type GetQuotaInfoMsg struct {
+	IDType        QuotaIDType
+	IDs           []uint32
+	StoragePoolID uint16
+}
+
+func (m *GetQuotaInfoMsg) MsgType() uint16 { return MsgTypeGetQuotaInfo }
+
+func (m *GetQuotaInfoMsg) serialize(e *encoder) {
+	e.u32(uint32(m.IDType))
+	e.u32List(m.IDs)
+	e.u16(m.StoragePoolID)
+}
+
+func (m *GetQuotaInfoMsg) deserialize(d *decoder) {
+	m.IDType = QuotaIDType(d.u32())
+	m.IDs = d.u32List()
+	m.StoragePoolID = d.u16()
+}
+
+// GetQuotaInfoRespMsg responds to a GetQuotaInfoMsg with one QuotaInfo for each requested ID.
+type GetQuotaInfoRespMsg struct {
+	Result OpsErr
+	Quotas []QuotaInfo
+}
+
+func (m *GetQuotaInfoRespMsg) MsgType() uint16 { return MsgTypeGetQuotaInfoResp }
+
+func (m *GetQuotaInfoRespMsg) serialize(e *encoder) {
+	e.u32(uint32(m.Result))
+	e.list(len(m.Quotas), func(i int) { m.Quotas[i].serialize(e) })
+}
+
+func (m *GetQuotaInfoRespMsg) deserialize(d *decoder) {
+	m.Result = OpsErr(d.u32())
+	d.list(func() {
+		var q QuotaInfo
+		q.deserialize(d)
+		m.Quotas = append(m.Quotas, q)
+	})
+}
+
+// SetQuotaMsg asks the management service to set the quota limits of a user or group in a storage pool. A limit of 0
+// removes any existing limit.
+type SetQuotaMsg struct {
+	IDType        QuotaIDType
+	ID            uint32
+	StoragePoolID uint16
+	SizeLimit     uint64
+	InodesLimit   uint64
+}
+
+func (m *SetQuotaMsg) MsgType() uint16 { return MsgTypeSetQuota }
+
+func (m *SetQuotaMsg) serialize(e *encoder) {
+	e.u32(uint32(m.IDType))
+	e.u32(m.ID)
+	e.u16(m.StoragePoolID)
+	e.u64(m.SizeLimit)
+	e.u64(m.InodesLimit)
+}
+
+func (m *SetQuotaMsg) deserialize(d *decoder) {
+	m.IDType = QuotaIDType(d.u32())
+	m.ID = d.u32()
+	m.StoragePoolID = d.u16()
+	m.SizeLimit = d.u64()
+	m.InodesLimit = d.u64()
+}
+
+// SetQuotaRespMsg responds to a SetQuotaMsg.
+type SetQuotaRespMsg struct {
+	Result OpsErr
+}
+
+func (m *SetQuotaRespMsg) MsgType() uint16        { return MsgTypeSetQuotaResp }
+func (m *SetQuotaRespMsg) serialize(e *encoder)   { e.u32(uint32(m.Result)) }
+func (m *SetQuotaRespMsg) deserialize(d *decoder) { m.Result = OpsErr(d.u32()) }
@@ -0,0 +1,166 @@
+/*
+Copyright 2021 NetApp, Inc. All Rights Reserved.
+Licensed under the Apache License, Version 2.0.
+*/
+
+package beegfsproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	dirInfo := EntryInfo{OwnerID: 2, ParentEntryID: "root", EntryID: "1-5F8D7E1B-1", FileName: "pvc-1",
+		Type: EntryTypeDirectory, BuddyMirrored: true}
+	tests := map[string]Message{
+		"AuthenticateChannel": &AuthenticateChannelMsg{AuthHash: 0x0123456789abcdef},
+		"GetNodes":            &GetNodesMsg{NodeType: NodeTypeMeta},
+		"GetNodesResp": &GetNodesRespMsg{
+			Nodes: []Node{
+				{ID: "meta01", NumID: 1, Type: NodeTypeMeta, PortTCP: 8005, Addresses: []string{"10.0.0.1", "10.0.1.1"}},
+				{ID: "meta02", NumID: 2, Type: NodeTypeMeta, PortTCP: 8005, Addresses: []string{"10.0.0.2"}},
+			},
+			RootNumID:           1,
+			RootIsBuddyMirrored: true,
+		},
+		"GetMirrorBuddyGroups": &GetMirrorBuddyGroupsMsg{NodeType: NodeTypeStorage},
+		"GetMirrorBuddyGroupsResp": &GetMirrorBuddyGroupsRespMsg{Groups: []BuddyGroup{
+			{ID: 1, PrimaryID: 101, SecondaryID: 201},
+			{ID: 2, PrimaryID: 202, SecondaryID: 102},
+		}},
+		"GetStorageTargetInfo": &GetStorageTargetInfoMsg{},
+		"GetStorageTargetInfoResp": &GetStorageTargetInfoRespMsg{Targets: []TargetInfo{
+			{TargetID: 101, NodeID: 1, Path: "/data/storage", TotalBytes: 1 << 40, FreeBytes: 1 << 39,
+				TotalInodes: 1e8, FreeInodes: 9e7, Reachability: ReachabilityOffline, Consistency: ConsistencyNeedsResync},
+		}},
+		"GetStoragePools": &GetStoragePoolsMsg{},
+		"GetStoragePoolsResp": &GetStoragePoolsRespMsg{Pools: []StoragePool{
+			{ID: 1, Description: "Default", TargetIDs: []uint16{101, 102}},
+			{ID: 2, Description: "fast nvme", TargetIDs: []uint16{201, 202}, BuddyGroups: []uint16{1}},
+		}},
+		"FindOwner":     &FindOwnerMsg{Path: "/k8s/pvc-1"},
+		"FindOwnerResp": &FindOwnerRespMsg{Result: OpsErrSuccess, Info: dirInfo},
+		"GetEntryInfo":  &GetEntryInfoMsg{Info: dirInfo},
+		"GetEntryInfoResp": &GetEntryInfoRespMsg{Pattern: StripePattern{Type: PatternTypeBuddyMirror,
+			ChunkSize: 1 << 20, StoragePoolID: 2, DefaultNumTargets: 2, TargetIDs: []uint16{1, 2}}},
+		"MkDir": &MkDirMsg{Parent: dirInfo, Name: "pvc-2", UserID: 1000, GroupID: 2000, Mode: 0o755,
+			NoMirror: true},
+		"MkDirResp":         &MkDirRespMsg{Result: OpsErrExists},
+		"SetDirPattern":     &SetDirPatternMsg{Info: dirInfo, Pattern: StripePattern{Type: PatternTypeRAID0}},
+		"SetDirPatternResp": &SetDirPatternRespMsg{Result: OpsErrInval},
+		"GetQuotaInfo": &GetQuotaInfoMsg{IDType: QuotaIDTypeGroup, IDs: []uint32{1000, 1001},
+			StoragePoolID: 2},
+		"GetQuotaInfoResp": &GetQuotaInfoRespMsg{Quotas: []QuotaInfo{
+			{ID: 1000, SizeUsed: 4096, SizeLimit: 1 << 30, InodesUsed: 1},
+			{ID: 1001},
+		}},
+		"SetQuota":     &SetQuotaMsg{IDType: QuotaIDTypeUser, ID: 1000, StoragePoolID: 1, SizeLimit: 1 << 30},
+		"SetQuotaResp": &SetQuotaRespMsg{Result: OpsErrPerm},
+	}
+	for name, msg := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeMessage(&buf, msg, 42); err != nil {
+				t.Fatal(err)
+			}
+			if length := binary.LittleEndian.Uint32(buf.Bytes()); int(length) != buf.Len() {
+				t.Fatalf("expected header length %d, got %d", buf.Len(), length)
+			}
+			got, seq, err := readMessage(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seq != 42 {
+				t.Fatalf("expected sequence number 42, got %d", seq)
+			}
+			if !reflect.DeepEqual(got, msg) {
+				t.Fatalf("expected %+v, got %+v", msg, got)
+			}
+		})
+	}
+}
+
+func TestReadMessageMalformed(t *testing.T) {
+	// serialized returns a serialized FindOwnerMsg after passing it to modify.
+	serialized := func(modify func(b []byte) []byte) []byte {
+		var buf bytes.Buffer
+		if err := writeMessage(&buf, &FindOwnerMsg{Path: "/k8s"}, 1); err != nil {
+			t.Fatal(err)
+		}
+		return modify(buf.Bytes())
+	}
+	// setLength sets the length in the header of b.
+	setLength := func(b []byte, length int) []byte {
+		binary.LittleEndian.PutUint32(b, uint32(length))
+		return b
+	}
+
+	tests := map[string]struct {
+		msg     []byte
+		wantErr string
+	}{
+		"truncated header": {
+			msg:     serialized(func(b []byte) []byte { return b[:headerLength-1] }),
+			wantErr: "unexpected EOF",
+		},
+		"truncated body": {
+			msg:     serialized(func(b []byte) []byte { return b[:len(b)-1] }),
+			wantErr: "cannot read message",
+		},
+		"wrong prefix": {
+			msg:     serialized(func(b []byte) []byte { b[8] = 'X'; return b }),
+			wantErr: "unexpected message prefix",
+		},
+		"length shorter than header": {
+			msg:     serialized(func(b []byte) []byte { return setLength(b, headerLength-1) }),
+			wantErr: "unexpected message length",
+		},
+		"length too long": {
+			msg:     serialized(func(b []byte) []byte { return setLength(b, maxMessageLength+1) }),
+			wantErr: "unexpected message length",
+		},
+		"unsupported type": {
+			msg:     serialized(func(b []byte) []byte { binary.LittleEndian.PutUint16(b[16:], 1); return b }),
+			wantErr: "unsupported message type 1",
+		},
+		"string longer than message": {
+			msg: serialized(func(b []byte) []byte {
+				binary.LittleEndian.PutUint32(b[headerLength:], 100)
+				return b
+			}),
+			wantErr: "message truncated",
+		},
+		"string not terminated": {
+			msg:     serialized(func(b []byte) []byte { b[len(b)-1] = 'x'; return b }),
+			wantErr: "string not terminated",
+		},
+		"trailing bytes": {
+			msg:     serialized(func(b []byte) []byte { return setLength(append(b, 0), len(b)+1) }),
+			wantErr: "1 unexpected bytes",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := readMessage(bytes.NewReader(tc.msg))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDecodeListLengthMismatch(t *testing.T) {
+	var e encoder
+	e.u16List([]uint16{1, 2})
+	b := e.buf.Bytes()
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-2)) // The list claims to be shorter than its elements.
+	d := decoder{buf: b}
+	d.u16List()
+	if d.err == nil || !strings.Contains(d.err.Error(), "does not match") {
+		t.Fatalf("expected list length mismatch, got %v", d.err)
+	}
+}
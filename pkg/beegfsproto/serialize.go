@@ -0,0 +1,168 @@
+/*
+Copyright 2021 NetApp, Inc. All Rights Reserved.
+Licensed under the Apache License, Version 2.0.
+*/
+
+package beegfsproto
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// All integers are serialized little endian. A string is serialized as its uint32 length, its bytes, and a terminating
+// NUL. A list is serialized as its uint32 serialized length (including the length itself), its uint32 element count,
+// and its elements.
+
+// encoder serializes values into a buffer.
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) u8(v uint8) { e.buf.WriteByte(v) }
+
+func (e *encoder) u16(v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) u32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) u64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) i64(v int64) { e.u64(uint64(v)) }
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.u8(1)
+	} else {
+		e.u8(0)
+	}
+}
+
+func (e *encoder) str(v string) {
+	e.u32(uint32(len(v)))
+	e.buf.WriteString(v)
+	e.buf.WriteByte(0)
+}
+
+// list serializes count elements with elem, which is called with the index of each element.
+func (e *encoder) list(count int, elem func(i int)) {
+	start := e.buf.Len()
+	e.u32(0) // The serialized length is filled in below.
+	e.u32(uint32(count))
+	for i := 0; i < count; i++ {
+		elem(i)
+	}
+	binary.LittleEndian.PutUint32(e.buf.Bytes()[start:], uint32(e.buf.Len()-start))
+}
+
+func (e *encoder) u16List(v []uint16) { e.list(len(v), func(i int) { e.u16(v[i]) }) }
+
+func (e *encoder) u32List(v []uint32) { e.list(len(v), func(i int) { e.u32(v[i]) }) }
+
+// decoder deserializes values from a buffer. The first error is sticky: once a value cannot be deserialized, every
+// subsequent value is zero and err returns the error.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+// next returns the next n bytes of the buffer or nil if there are fewer than n.
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errors.Errorf("message truncated: need %d bytes but have %d", n, len(d.buf))
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) u32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) i64() int64 { return int64(d.u64()) }
+
+func (d *decoder) bool() bool { return d.u8() != 0 }
+
+func (d *decoder) str() string {
+	length := d.u32()
+	if d.err == nil && uint64(length) >= uint64(len(d.buf)) {
+		d.err = errors.Errorf("message truncated: string of %d bytes", length)
+	}
+	b := d.next(int(length) + 1)
+	if b == nil {
+		return ""
+	}
+	if b[length] != 0 {
+		d.err = errors.New("string not terminated")
+		return ""
+	}
+	return string(b[:length])
+}
+
+// list deserializes a list by calling elem once for each of its elements. It checks that the elements are exactly as
+// long as the serialized length of the list says.
+func (d *decoder) list(elem func()) {
+	remaining := len(d.buf)
+	length, count := d.u32(), d.u32()
+	if d.err == nil && uint64(length) > uint64(remaining) {
+		d.err = errors.Errorf("message truncated: list of %d bytes", length)
+	}
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		elem()
+	}
+	if d.err == nil && remaining-len(d.buf) != int(length) {
+		d.err = errors.Errorf("list length %d does not match its %d elements", length, count)
+	}
+}
+
+func (d *decoder) u16List() (v []uint16) {
+	d.list(func() { v = append(v, d.u16()) })
+	return v
+}
+
+func (d *decoder) u32List() (v []uint32) {
+	d.list(func() { v = append(v, d.u32()) })
+	return v
+}
@@ -11,10 +11,12 @@ import (
 	"github.com/netapp/beegfs-csi-driver/pkg/beegfs"
 	corev1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/util/sets"
 	e2eframework "k8s.io/kubernetes/test/e2e/framework"
 	e2eskipper "k8s.io/kubernetes/test/e2e/framework/skipper"
 	storageframework "k8s.io/kubernetes/test/e2e/storage/framework"
+	storageutils "k8s.io/kubernetes/test/e2e/storage/utils"
 )
 
 // Verify expected interfaces are properly implemented at compile time.
@@ -23,6 +25,8 @@ var _ storageframework.TestDriver = &BeegfsDynamicDriver{}
 var _ storageframework.DynamicPVTestDriver = &BeegfsDriver{}
 var _ storageframework.DynamicPVTestDriver = &BeegfsDynamicDriver{}
 var _ storageframework.PreprovisionedVolumeTestDriver = &BeegfsDriver{}
+var _ storageframework.SnapshottableTestDriver = &BeegfsDriver{}
+var _ storageframework.SnapshottableTestDriver = &BeegfsDynamicDriver{}
 
 // baseBeegfsDriver is unexported and cannot be directly accessed or instantiated. All exported drivers use it as
 // their underlying data structure and can call its internal methods.
@@ -38,18 +42,18 @@ type baseBeegfsDriver struct {
 }
 
 // BeegfsDriver is an exported driver that implements the storageframework.TestDriver,
-// storageframework.DynamicPVTestDriver, storageframework.PreprovisionedVolumeTestDriver, and
-// storageframework.PreprovisionedPVTestDriver interfaces. It is intended to be used in all beegfs-csi-driver specific
-//tests.
+// storageframework.DynamicPVTestDriver, storageframework.SnapshottableTestDriver,
+// storageframework.PreprovisionedVolumeTestDriver, and storageframework.PreprovisionedPVTestDriver interfaces. It is
+// intended to be used in all beegfs-csi-driver specific tests.
 type BeegfsDriver struct {
 	*baseBeegfsDriver
 }
 
-// BeegfsDynamicDriver is an exported driver that implements the storageframework.TestDriver and
-// storageframework.DynamicPVTestDriver interfaces. It intentionally does not implement the
-// storageframework.PreprovisionedVolumeTestDriver and storageframework.PreprovisionedPVTestDriver interfaces. It is
-// intended to be used for K8s built-in tests, which may use the pre-provisioned interface in unanticipated ways if
-// allowed.
+// BeegfsDynamicDriver is an exported driver that implements the storageframework.TestDriver,
+// storageframework.DynamicPVTestDriver, and storageframework.SnapshottableTestDriver interfaces. It intentionally does
+// not implement the storageframework.PreprovisionedVolumeTestDriver and storageframework.PreprovisionedPVTestDriver
+// interfaces. It is intended to be used for K8s built-in tests, which may use the pre-provisioned interface in
+// unanticipated ways if allowed.
 type BeegfsDynamicDriver struct {
 	*baseBeegfsDriver
 }
@@ -96,8 +100,8 @@ func initBaseBeegfsDriver() *baseBeegfsDriver {
 				storageframework.CapBlock:               false,
 				storageframework.CapFsGroup:             false,
 				storageframework.CapExec:                true,
-				storageframework.CapSnapshotDataSource:  false,
-				storageframework.CapPVCDataSource:       false,
+				storageframework.CapSnapshotDataSource:  true,
+				storageframework.CapPVCDataSource:       true,
 				storageframework.CapMultiPODs:           true,
 				storageframework.CapRWX:                 true,
 				storageframework.CapControllerExpansion: false,
@@ -151,6 +155,13 @@ func (d *baseBeegfsDriver) GetDynamicProvisionStorageClass(config *storageframew
 		config.Framework.Namespace.Name)
 }
 
+// baseBeegfsDriver directly implements the storageframework.SnapshottableTestDriver interface.
+func (d *baseBeegfsDriver) GetSnapshotClass(config *storageframework.PerTestConfig,
+	parameters map[string]string) *unstructured.Unstructured {
+	return storageutils.GenerateSnapshotClassSpec("beegfs.csi.netapp.com", parameters, config.Framework.Namespace.Name,
+		"beegfs-vsc")
+}
+
 // BeegfsDriver implements the storageframework.PreprovisionedVolumeTestDriver interface.
 // CreateVolume returns a storageframework.TestVolume that appropriately references a pre-created directory on a
 // BeeGFS file system known to the driver. Tests can use SetFSIndex and SetStaticDirName to modify its behavior.
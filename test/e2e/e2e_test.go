@@ -81,7 +81,7 @@ var k8sSuitesToRun = []func() storageframework.TestSuite{
 	// TODO(webere, A202): Look for reasons no specs from the provisioning test suite run. Pay special attention to
 	// "should provision storage with mount options".
 	storagesuites.InitProvisioningTestSuite,  // No specs run.
-	storagesuites.InitSnapshottableTestSuite, // No specs run.
+	storagesuites.InitSnapshottableTestSuite, // Requires the VolumeSnapshot CRDs and snapshot controller.
 	// One subpath test (should be able to unmount after the subpath directory is deleted [LinuxOnly]) fails
 	// consistently and must be skipped in the "go test" or "ginkgo" command.
 	// TODO(webere, A200): Fix broken subpath functionality.
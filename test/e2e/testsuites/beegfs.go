@@ -34,6 +34,7 @@ package testsuites
 import (
 	"fmt"
 	"path"
+	"strings"
 
 	"github.com/netapp/beegfs-csi-driver/test/e2e/driver"
 	"github.com/netapp/beegfs-csi-driver/test/e2e/utils"
@@ -173,6 +174,63 @@ func (b *beegfsTestSuite) DefineTests(tDriver storageframework.TestDriver, patte
 		gomega.Expect(string(result)).To(gomega.ContainSubstring("Number of storage targets: desired: 2"))
 	})
 
+	ginkgo.It("should correctly interpret a storage class buddy mirror stripe pattern", func() {
+		if pattern.VolType != storageframework.DynamicPV {
+			e2eskipper.Skipf("This test only works with dynamic volumes -- skipping")
+		}
+
+		// Don't do expensive test setup until we know we'll run the test.
+		init()
+		defer cleanup()
+		cfg, _ := d.PrepareTest(f)
+		testVolumeSizeRange := b.GetTestSuiteInfo().SupportedSizeRange
+
+		// Use a default volume to determine whether the file system has storage and metadata buddy mirror groups.
+		fsExec := utils.NewFSExec(cfg, d, testVolumeSizeRange)
+		storageGroups, err := fsExec.IssueCommandWithBeegfsPaths(
+			"beegfs-ctl --mount=%s --listmirrorgroups --nodetype=storage", "")
+		e2eframework.ExpectNoError(err)
+		metaGroups, err := fsExec.IssueCommandWithBeegfsPaths(
+			"beegfs-ctl --mount=%s --listmirrorgroups --nodetype=meta", "")
+		e2eframework.ExpectNoError(err)
+		e2eframework.ExpectNoError(fsExec.Cleanup())
+		// Output looks like the following (with no rows if there are no groups):
+		//      BuddyGroupID   PrimaryTargetID SecondaryTargetID
+		//      ============   =============== =================
+		//                 1               101               201
+		hasGroups := func(output string) bool {
+			return len(strings.Split(strings.TrimSpace(output), "\n")) > 2
+		}
+		if !hasGroups(storageGroups) {
+			e2eskipper.Skipf("This test requires storage buddy mirror groups -- skipping")
+		}
+
+		// Create an FSExec with a storage resource including a StorageClass with buddy mirroring params.
+		params := map[string]string{
+			"stripePattern/patternType": "buddymirror",
+			"stripePattern/numTargets":  "1",
+		}
+		if hasGroups(metaGroups) {
+			params["stripePattern/metadataMirroring"] = "false"
+		}
+		d.SetStorageClassParams(params)
+		defer d.UnsetStorageClassParams()
+		fsExec = utils.NewFSExec(cfg, d, testVolumeSizeRange)
+		defer func() {
+			e2eframework.ExpectNoError(fsExec.Cleanup())
+		}()
+
+		// Execute beegfs-ctl getentryinfo command.
+		volDirPathBeegfsRoot := path.Join(fsExec.Resource.Sc.Parameters["volDirBasePath"], fsExec.Resource.Pv.Name)
+		result, err := fsExec.IssueCommandWithBeegfsPaths("beegfs-ctl --mount=%s --getentryinfo %s",
+			"", volDirPathBeegfsRoot)
+
+		e2eframework.ExpectNoError(err)
+		gomega.Expect(string(result)).To(gomega.ContainSubstring("Type: Buddy Mirror"))
+		gomega.Expect(string(result)).To(gomega.ContainSubstring("Number of storage targets: desired: 1"))
+		gomega.Expect(string(result)).NotTo(gomega.ContainSubstring("Metadata buddy group"))
+	})
+
 	ginkgo.It("should use RDMA to connect", func() {
 		init()
 		defer cleanup()